@@ -33,7 +33,13 @@ import (
 )
 
 func HandlerFactory(hf sgin.HandlerFactory, logger log.Logger, rejecterF jose.RejecterFactory) sgin.HandlerFactory {
-	return TokenSignatureValidator(TokenSigner(hf, logger), logger, rejecterF)
+	return HandlerFactoryWithContext(context.Background(), hf, logger, rejecterF)
+}
+
+// HandlerFactoryWithContext returns a handler factory whose validators are released when the
+// context is done
+func HandlerFactoryWithContext(ctx context.Context, hf sgin.HandlerFactory, logger log.Logger, rejecterF jose.RejecterFactory) sgin.HandlerFactory {
+	return TokenSignatureValidatorWithContext(ctx, TokenSigner(hf, logger), logger, rejecterF)
 }
 
 func TokenSigner(hf sgin.HandlerFactory, logger log.Logger) sgin.HandlerFactory {
@@ -84,6 +90,12 @@ func TokenSigner(hf sgin.HandlerFactory, logger log.Logger) sgin.HandlerFactory
 }
 
 func TokenSignatureValidator(hf sgin.HandlerFactory, logger log.Logger, rejecterF jose.RejecterFactory) sgin.HandlerFactory {
+	return TokenSignatureValidatorWithContext(context.Background(), hf, logger, rejecterF)
+}
+
+// TokenSignatureValidatorWithContext returns a handler factory validating the tokens with the
+// validators shared by the endpoints of the context. They are released when the context is done
+func TokenSignatureValidatorWithContext(ctx context.Context, hf sgin.HandlerFactory, logger log.Logger, rejecterF jose.RejecterFactory) sgin.HandlerFactory {
 	return func(cfg *config.EndpointConfig, prxy proxy.Proxy) gin.HandlerFunc {
 		logPrefix := "[ENDPOINT: " + cfg.Endpoint + "][JWTValidator]"
 		if rejecterF == nil {
@@ -92,7 +104,7 @@ func TokenSignatureValidator(hf sgin.HandlerFactory, logger log.Logger, rejecter
 		rejecter := rejecterF.New(logger, cfg)
 
 		handler := hf(cfg, prxy)
-		scfg, err := jose.GetSignatureConfig(cfg)
+		scfg, icfg, err := jose.GetValidatorConfig(cfg)
 		if err == jose.ErrNoValidatorCfg {
 			logger.Info(logPrefix, "Validator disabled for this endpoint")
 			return handler
@@ -102,36 +114,35 @@ func TokenSignatureValidator(hf sgin.HandlerFactory, logger log.Logger, rejecter
 			return handler
 		}
 
-		validator, err := jose.NewValidator(scfg, FromCookie)
+		validator, err := validators.Get(ctx, scfg, icfg)
 		if err != nil {
 			logger.Fatal(logPrefix, "Unable to create the validator:", err.Error())
 		}
 
-		var aclCheck func(string, map[string]interface{}, []string) bool
-
 		if scfg.RolesKeyIsNested && strings.Contains(scfg.RolesKey, ".") && scfg.RolesKey[:4] != "http" {
 			logger.Debug(logPrefix, fmt.Sprintf("Roles will be matched against the nested key: '%s'", scfg.RolesKey))
-			aclCheck = jose.CanAccessNested
 		} else {
 			logger.Debug(logPrefix, fmt.Sprintf("Roles will be matched against the key: '%s'", scfg.RolesKey))
-			aclCheck = jose.CanAccess
 		}
 
-		var scopesMatcher func(string, map[string]interface{}, []string) bool
-
 		if len(scfg.Scopes) > 0 && scfg.ScopesKey != "" {
 			if scfg.ScopesMatcher == "all" {
 				logger.Debug(logPrefix, fmt.Sprintf("Constraint added: tokens must contain a claim '%s' with all these scopes: %v", scfg.ScopesKey, scfg.Scopes))
-				scopesMatcher = jose.ScopesAllMatcher
 			} else {
 				logger.Debug(logPrefix, fmt.Sprintf("Constraint added: tokens must contain a claim '%s' with any of these scopes: %v", scfg.ScopesKey, scfg.Scopes))
-				scopesMatcher = jose.ScopesAnyMatcher
 			}
 		} else {
 			logger.Debug(logPrefix, "No scope validation required")
-			scopesMatcher = jose.ScopesDefaultMatcher
 		}
 
+		for _, i := range scfg.Issuers {
+			logger.Debug(logPrefix, fmt.Sprintf("Trusted issuer: '%s'", i.Issuer))
+		}
+		if scfg.OIDCIssuer != "" {
+			logger.Debug(logPrefix, fmt.Sprintf("Options discovered from the OIDC issuer: '%s'", scfg.OIDCIssuer))
+		}
+		accessChecker := jose.NewAccessChecker(scfg)
+
 		if scfg.OperationDebug {
 			logger.Debug(logPrefix, "Validator enabled for this endpoint. Operation debug is enabled")
 		} else {
@@ -141,7 +152,7 @@ func TokenSignatureValidator(hf sgin.HandlerFactory, logger log.Logger, rejecter
 		paramExtractor := extractRequiredJWTClaims(cfg)
 
 		return func(c *gin.Context) {
-			token, err := validator.ValidateRequest(c.Request)
+			claims, err := validateClaims(c, validator)
 			if err != nil {
 				if scfg.OperationDebug {
 					logger.Error(logPrefix, "Unable to validate the token:", err.Error())
@@ -150,16 +161,6 @@ func TokenSignatureValidator(hf sgin.HandlerFactory, logger log.Logger, rejecter
 				return
 			}
 
-			claims := map[string]interface{}{}
-			err = validator.Claims(c.Request, token, &claims)
-			if err != nil {
-				if scfg.OperationDebug {
-					logger.Error(logPrefix, "Token sent by client is invalid:", err.Error())
-				}
-				c.AbortWithStatus(http.StatusUnauthorized)
-				return
-			}
-
 			if rejecter.Reject(claims) {
 				if scfg.OperationDebug {
 					logger.Error(logPrefix, "Token sent by client rejected")
@@ -168,7 +169,7 @@ func TokenSignatureValidator(hf sgin.HandlerFactory, logger log.Logger, rejecter
 				return
 			}
 
-			if !aclCheck(scfg.RolesKey, claims, scfg.Roles) {
+			if !accessChecker.HasRoles(claims) {
 				if scfg.OperationDebug {
 					logger.Error(logPrefix, "Token sent by client does not have sufficient roles")
 				}
@@ -176,7 +177,7 @@ func TokenSignatureValidator(hf sgin.HandlerFactory, logger log.Logger, rejecter
 				return
 			}
 
-			if !scopesMatcher(scfg.ScopesKey, claims, scfg.Scopes) {
+			if !accessChecker.HasScopes(claims) {
 				if scfg.OperationDebug {
 					logger.Error(logPrefix, "Token sent by client does not have the required scopes")
 				}
@@ -193,6 +194,79 @@ func TokenSignatureValidator(hf sgin.HandlerFactory, logger log.Logger, rejecter
 	}
 }
 
+// ClaimsKey is the key of the gin context storing the claims of the validated token
+const ClaimsKey = "sonic_jose_claims"
+
+// ClaimsFromContext returns the claims of the token validated for the current request, if any
+func ClaimsFromContext(c *gin.Context) (map[string]interface{}, bool) {
+	v, ok := c.Get(ClaimsKey)
+	if !ok {
+		return nil, false
+	}
+	claims, ok := v.(map[string]interface{})
+	return claims, ok
+}
+
+// NewClaimsExtractor returns a function providing the validated claims of the request to other
+// middlewares, wherever they are placed in the handler chain. If the token has not been validated
+// yet, it is validated with the validator config of the endpoint and its claims are stored in the
+// context, so the validator middleware reuses them. The requests with an invalid token are aborted
+// with a 401 status
+func NewClaimsExtractor(cfg *config.EndpointConfig) func(*gin.Context) (map[string]interface{}, bool) {
+	return NewClaimsExtractorWithContext(context.Background(), cfg)
+}
+
+// NewClaimsExtractorWithContext returns a claims extractor like NewClaimsExtractor, sharing the
+// validators of the endpoints of the context
+func NewClaimsExtractorWithContext(ctx context.Context, cfg *config.EndpointConfig) func(*gin.Context) (map[string]interface{}, bool) {
+	scfg, icfg, err := jose.GetValidatorConfig(cfg)
+	if err != nil {
+		return ClaimsFromContext
+	}
+	validator, err := validators.Get(ctx, scfg, icfg)
+	if err != nil {
+		return ClaimsFromContext
+	}
+	return func(c *gin.Context) (map[string]interface{}, bool) {
+		claims, err := validateClaims(c, validator)
+		if err != nil {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return nil, false
+		}
+		return claims, true
+	}
+}
+
+// validatedClaims are the claims stored in the context along with the validator producing them
+type validatedClaims struct {
+	validator jose.ClaimsValidator
+	claims    map[string]interface{}
+}
+
+const validatedClaimsKey = "sonic_jose_validated_claims"
+
+// validateClaims returns the claims of the request, reusing the ones stored in the context only if
+// they were validated by the same validator
+func validateClaims(c *gin.Context, validator jose.ClaimsValidator) (map[string]interface{}, error) {
+	if v, ok := c.Get(validatedClaimsKey); ok {
+		if vc, ok := v.(validatedClaims); ok && vc.validator == validator {
+			return vc.claims, nil
+		}
+	}
+
+	claims, err := validator.ValidateClaims(c.Request)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Set(validatedClaimsKey, validatedClaims{validator: validator, claims: claims})
+	c.Set(ClaimsKey, claims)
+	return claims, nil
+}
+
+// validators keeps the validators shared by the endpoints with the same validator config
+var validators = jose.NewValidatorRegistry(FromCookie)
+
 func propagateHeaders(cfg *config.EndpointConfig, propagationCfg [][]string, claims map[string]interface{}, c *gin.Context, logger log.Logger) {
 	logPrefix := "[ENDPOINT: " + cfg.Endpoint + "][PropagateHeaders]"
 	if len(propagationCfg) > 0 {
@@ -19,7 +19,10 @@ package gin
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"github.com/gin-gonic/gin"
+	"github.com/starvn/sonic/auth/jose"
+	"github.com/starvn/turbo/config"
 	"github.com/starvn/turbo/log"
 	"github.com/starvn/turbo/proxy"
 	sgin "github.com/starvn/turbo/route/gin"
@@ -28,6 +31,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestTokenSignatureValidator(t *testing.T) {
@@ -193,6 +197,146 @@ func TestTokenSignatureValidator(t *testing.T) {
 	}
 }
 
+func TestTokenSignatureValidator_introspection(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp := map[string]interface{}{"active": false}
+		switch r.PostFormValue("token") {
+		case "admin":
+			resp = map[string]interface{}{"active": true, "sub": "alice", "roles": []string{"admin"}, "scope": "read"}
+		case "user":
+			resp = map[string]interface{}{"active": true, "sub": "bob", "roles": []string{"user"}, "scope": "read"}
+		case "banned":
+			resp = map[string]interface{}{"active": true, "sub": "mallory", "roles": []string{"admin"}, "scope": "read"}
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	cfg := &config.EndpointConfig{
+		Timeout:  time.Second,
+		Endpoint: "/introspected",
+		Backend:  []*config.Backend{{URLPattern: "/", Host: []string{"http://example.com/"}}},
+		ExtraConfig: config.ExtraConfig{
+			jose.IntrospectionNamespace: map[string]interface{}{
+				"introspection_url":              server.URL,
+				"disable_introspection_security": true,
+				"roles":                          []string{"admin"},
+				"scopes":                         []string{"read"},
+				"scopes_key":                     "scope",
+				"propagate_claims":               [][]string{{"sub", "x-user"}},
+			},
+		},
+	}
+
+	var propagated string
+	prxy := func(_ context.Context, r *proxy.Request) (*proxy.Response, error) {
+		propagated = r.Headers["X-User"][0]
+		return &proxy.Response{Data: map[string]interface{}{}, IsComplete: true}, nil
+	}
+	rejecter := jose.RejecterFactoryFunc(func(_ log.Logger, _ *config.EndpointConfig) jose.Rejecter {
+		return jose.RejecterFunc(func(claims map[string]interface{}) bool { return claims["sub"] == "mallory" })
+	})
+	cfg.HeadersToPass = []string{"X-User"}
+
+	logger, _ := log.NewLogger("ERROR", ioutil.Discard, "")
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.GET(cfg.Endpoint, TokenSignatureValidator(sgin.EndpointHandler, logger, rejecter)(cfg, prxy))
+
+	for token, status := range map[string]int{
+		"admin":   http.StatusOK,
+		"user":    http.StatusForbidden,
+		"banned":  http.StatusUnauthorized,
+		"expired": http.StatusUnauthorized,
+	} {
+		req := httptest.NewRequest("GET", cfg.Endpoint, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		if w.Code != status {
+			t.Errorf("%s: unexpected status code: %d", token, w.Code)
+		}
+	}
+	if propagated != "alice" {
+		t.Errorf("the claim should be propagated: %s", propagated)
+	}
+}
+
+func TestNewClaimsExtractor(t *testing.T) {
+	server := httptest.NewServer(jwkEndpoint("symmetric"))
+	defer server.Close()
+
+	_, signer, err := jose.NewSigner(newSignerEndpointCfg("HS256", "sim2", server.URL), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	token, err := signer(map[string]interface{}{
+		"aud": "http://api.example.com",
+		"iss": "http://example.com",
+		"sub": "1234567890qwertyuio",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	extractor := NewClaimsExtractor(newVerifierEndpointCfg("HS256", server.URL, []string{}))
+
+	gin.SetMode(gin.TestMode)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/private", nil)
+	if _, ok := extractor(c); ok {
+		t.Error("claims extracted from a request without token")
+	}
+	if !c.IsAborted() || w.Code != http.StatusUnauthorized {
+		t.Errorf("the request without token should be aborted with a 401 status: %d", w.Code)
+	}
+
+	c, _ = gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/private", nil)
+	c.Request.Header.Set("Authorization", "BEARER "+token)
+	claims, ok := extractor(c)
+	if !ok {
+		t.Error("unable to extract the claims")
+		return
+	}
+	if claims["sub"] != "1234567890qwertyuio" {
+		t.Errorf("unexpected claims: %v", claims)
+	}
+	if stored, ok := ClaimsFromContext(c); !ok || stored["sub"] != claims["sub"] {
+		t.Errorf("the claims should be stored in the context: %v", stored)
+	}
+
+	c.Request.Header.Del("Authorization")
+	claims, ok = extractor(c)
+	if !ok || claims["sub"] != "1234567890qwertyuio" {
+		t.Errorf("the claims validated by the same validator should be reused: %v", claims)
+	}
+
+	c, _ = gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/private", nil)
+	c.Set(ClaimsKey, map[string]interface{}{"sub": "already-validated"})
+	if claims, ok = extractor(c); ok {
+		t.Errorf("the claims stored by other middlewares should not be reused: %v", claims)
+	}
+
+	other := newVerifierEndpointCfg("HS256", server.URL, []string{})
+	other.ExtraConfig[jose.ValidatorNamespace].(map[string]interface{})["audience"] = []string{"http://other.example.com"}
+	c, _ = gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/private", nil)
+	c.Request.Header.Set("Authorization", "BEARER "+token)
+	if _, ok := extractor(c); !ok {
+		t.Error("unable to extract the claims")
+	}
+	if claims, ok = NewClaimsExtractor(other)(c); ok {
+		t.Errorf("the claims validated by another validator should not be reused: %v", claims)
+	}
+}
+
 func jwkEndpoint(name string) http.HandlerFunc {
 	data, err := ioutil.ReadFile("../fixture/" + name + ".json")
 	return func(rw http.ResponseWriter, _ *http.Request) {
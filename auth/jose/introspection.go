@@ -0,0 +1,353 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jose
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/auth0-community/go-auth0"
+	"github.com/starvn/turbo/config"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	IntrospectionNamespace = "github.com/starvn/sonic/auth/jose/introspection"
+	// DefaultIntrospectionTimeout is the max duration of the calls to the introspection endpoint
+	DefaultIntrospectionTimeout = 5 * time.Second
+	// DefaultIntrospectionCacheSize is the max number of tokens kept in the cache
+	DefaultIntrospectionCacheSize = 10000
+	// DefaultIntrospectionNegativeTTL is the time the inactive and the invalid tokens are cached,
+	// so replaying them does not flood the introspection endpoint
+	DefaultIntrospectionNegativeTTL = 10 * time.Second
+	defaultTokenCookie              = "access_token"
+)
+
+// IntrospectionConfig defines a validator of opaque tokens calling an RFC 7662 introspection
+// endpoint. The embedded signature config provides the roles, scopes, issuer, audience, cookie and
+// claim propagation options, so both validators share the same checks. Its cipher_suites,
+// jwk_local_ca and jwk_fingerprints options apply to the connections to the introspection endpoint
+type IntrospectionConfig struct {
+	SignatureConfig
+	URL                          string `json:"introspection_url"`
+	ClientID                     string `json:"client_id,omitempty"`
+	ClientSecret                 string `json:"client_secret,omitempty"`
+	TokenTypeHint                string `json:"token_type_hint,omitempty"`
+	DisableIntrospectionSecurity bool   `json:"disable_introspection_security,omitempty"`
+}
+
+var (
+	ErrNoIntrospectionCfg          = errors.New("no introspection config")
+	ErrInsecureIntrospectionSource = errors.New("introspection client is using an insecure connection to the introspection endpoint")
+	ErrInactiveToken               = errors.New("inactive token")
+)
+
+// GetIntrospectionConfig returns the introspection validator config of the endpoint
+func GetIntrospectionConfig(cfg *config.EndpointConfig) (*IntrospectionConfig, error) {
+	tmp, ok := cfg.ExtraConfig[IntrospectionNamespace]
+	if !ok {
+		return nil, ErrNoIntrospectionCfg
+	}
+	data, _ := json.Marshal(tmp)
+	res := new(IntrospectionConfig)
+	if err := json.Unmarshal(data, res); err != nil {
+		return nil, err
+	}
+
+	if res.RolesKey == "" {
+		res.RolesKey = defaultRolesKey
+	}
+	if !strings.HasPrefix(res.URL, "https://") && !res.DisableIntrospectionSecurity {
+		return res, ErrInsecureIntrospectionSource
+	}
+	return res, nil
+}
+
+// ClaimsValidator validates the token of a request, returning its claims
+type ClaimsValidator interface {
+	ValidateClaims(r *http.Request) (map[string]interface{}, error)
+}
+
+// GetValidatorConfig returns the config of the validator of the endpoint. The introspection config
+// is returned along with its embedded signature config if the endpoint defines one, so its checks
+// can be applied the same way
+func GetValidatorConfig(cfg *config.EndpointConfig) (*SignatureConfig, *IntrospectionConfig, error) {
+	icfg, err := GetIntrospectionConfig(cfg)
+	if err == ErrNoIntrospectionCfg {
+		scfg, err := GetSignatureConfig(cfg)
+		return scfg, nil, err
+	}
+	if icfg == nil {
+		return nil, nil, err
+	}
+	return &icfg.SignatureConfig, icfg, err
+}
+
+// NewClaimsValidator returns the introspector for the given introspection config or, if it is nil,
+// the JWT validator for the signature config, picking the trusted issuer of every token if the
+// config lists several ones, or discovering its options if it defines an oidc issuer
+func NewClaimsValidator(scfg *SignatureConfig, icfg *IntrospectionConfig, ef ExtractorFactory) (ClaimsValidator, error) {
+	if icfg != nil {
+		return NewIntrospector(icfg)
+	}
+	if scfg.OIDCIssuer != "" {
+		return newOIDCValidator(scfg, ef)
+	}
+	if len(scfg.Issuers) > 0 {
+		return newMultiIssuerValidator(scfg, ef)
+	}
+	v, sp, err := newValidator(scfg, ef)
+	if err != nil {
+		return nil, err
+	}
+	return jwtClaimsValidator{JWTValidator: v, provider: sp}, nil
+}
+
+type jwtClaimsValidator struct {
+	*auth0.JWTValidator
+	provider *JWKClient
+}
+
+func (v jwtClaimsValidator) close() {
+	closeSecretProvider(v.provider)
+}
+
+func (v jwtClaimsValidator) ValidateClaims(r *http.Request) (map[string]interface{}, error) {
+	token, err := v.ValidateRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	claims := map[string]interface{}{}
+	if err := v.Claims(r, token, &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// Introspector validates opaque tokens against an RFC 7662 introspection endpoint, authenticating
+// with the client credentials. The claims of the active tokens are cached until their expiration,
+// capped by the cache duration of the config, and the rejections for a short time. The least
+// recently used tokens are evicted once the cache is full
+type Introspector struct {
+	cfg         IntrospectionConfig
+	client      *http.Client
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	mu          *sync.Mutex
+	cache       map[string]*list.Element
+	lru         *list.List
+	maxItems    int
+}
+
+type introspectionEntry struct {
+	key        string
+	claims     map[string]interface{}
+	err        error
+	expiration time.Time
+}
+
+// NewIntrospector returns an introspector for the given config
+func NewIntrospector(cfg *IntrospectionConfig) (*Introspector, error) {
+	decodedFs, err := DecodeFingerprints(cfg.Fingerprints)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := newJWKClientOptions(SecretProviderConfig{
+		URI:           cfg.URL,
+		Fingerprints:  decodedFs,
+		Cs:            cfg.CipherSuites,
+		LocalCA:       cfg.LocalCA,
+		AllowInsecure: cfg.DisableIntrospectionSecurity,
+	})
+	if err != nil {
+		return nil, err
+	}
+	client := opts.Client
+	client.Timeout = DefaultIntrospectionTimeout
+
+	return &Introspector{
+		cfg:         *cfg,
+		client:      client,
+		maxTTL:      time.Duration(cfg.CacheDuration) * time.Second,
+		negativeTTL: DefaultIntrospectionNegativeTTL,
+		mu:          new(sync.Mutex),
+		cache:       map[string]*list.Element{},
+		lru:         list.New(),
+		maxItems:    DefaultIntrospectionCacheSize,
+	}, nil
+}
+
+// ValidateClaims introspects the token sent in the Authorization header or in the cookie of the
+// config, returning the claims of the active tokens
+func (i *Introspector) ValidateClaims(r *http.Request) (map[string]interface{}, error) {
+	token := tokenFromRequest(r, i.cfg.CookieKey)
+	if token == "" {
+		return nil, auth0.ErrTokenNotFound
+	}
+
+	h := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(h[:])
+	if e, ok := i.get(key); ok {
+		return e.claims, e.err
+	}
+
+	claims, err := i.introspect(r, token)
+	if err != nil {
+		return nil, err
+	}
+	if err := i.validate(claims); err != nil {
+		i.add(introspectionEntry{key: key, err: err, expiration: now().Add(i.negativeTTL)})
+		return nil, err
+	}
+	i.set(key, claims)
+	return claims, nil
+}
+
+func (i *Introspector) introspect(r *http.Request, token string) (map[string]interface{}, error) {
+	form := url.Values{"token": []string{token}}
+	if i.cfg.TokenTypeHint != "" {
+		form.Set("token_type_hint", i.cfg.TokenTypeHint)
+	}
+	req, err := http.NewRequestWithContext(r.Context(), "POST", i.cfg.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if i.cfg.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(i.cfg.ClientID), url.QueryEscape(i.cfg.ClientSecret))
+	}
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JOSE: introspection endpoint returned status %d", resp.StatusCode)
+	}
+
+	claims := map[string]interface{}{}
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (i *Introspector) validate(claims map[string]interface{}) error {
+	if active, _ := claims["active"].(bool); !active {
+		return ErrInactiveToken
+	}
+	if exp, ok := claims["exp"].(float64); ok && !now().Before(time.Unix(int64(exp), 0)) {
+		return ErrInactiveToken
+	}
+	if i.cfg.Issuer != "" && claims["iss"] != i.cfg.Issuer {
+		return fmt.Errorf("JOSE: unexpected issuer %v", claims["iss"])
+	}
+	if len(i.cfg.Audience) > 0 {
+		audience := map[string]bool{}
+		switch aud := claims["aud"].(type) {
+		case string:
+			audience[aud] = true
+		case []interface{}:
+			for _, a := range aud {
+				if s, ok := a.(string); ok {
+					audience[s] = true
+				}
+			}
+		}
+		for _, a := range i.cfg.Audience {
+			if !audience[a] {
+				return fmt.Errorf("JOSE: the token is not intended for the audience %s", a)
+			}
+		}
+	}
+	return nil
+}
+
+func (i *Introspector) get(key string) (introspectionEntry, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	el, ok := i.cache[key]
+	if !ok {
+		return introspectionEntry{}, false
+	}
+	e := el.Value.(introspectionEntry)
+	if !now().Before(e.expiration) {
+		i.lru.Remove(el)
+		delete(i.cache, key)
+		return introspectionEntry{}, false
+	}
+	i.lru.MoveToFront(el)
+	return e, true
+}
+
+// set caches the claims until the expiration of the token, capped by the cache duration. Tokens
+// without expiration are only cached if the cache duration is defined
+func (i *Introspector) set(key string, claims map[string]interface{}) {
+	t := now()
+	var expiration time.Time
+	if exp, ok := claims["exp"].(float64); ok {
+		expiration = time.Unix(int64(exp), 0)
+	}
+	if i.maxTTL > 0 && (expiration.IsZero() || expiration.After(t.Add(i.maxTTL))) {
+		expiration = t.Add(i.maxTTL)
+	}
+	if !expiration.After(t) {
+		return
+	}
+	i.add(introspectionEntry{key: key, claims: claims, expiration: expiration})
+}
+
+// add caches the entry, evicting the least recently used ones if the cache is full
+func (i *Introspector) add(e introspectionEntry) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if el, ok := i.cache[e.key]; ok {
+		el.Value = e
+		i.lru.MoveToFront(el)
+		return
+	}
+	i.cache[e.key] = i.lru.PushFront(e)
+	for i.lru.Len() > i.maxItems {
+		el := i.lru.Back()
+		i.lru.Remove(el)
+		delete(i.cache, el.Value.(introspectionEntry).key)
+	}
+}
+
+func tokenFromRequest(r *http.Request, cookieKey string) string {
+	if parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2); len(parts) == 2 && strings.EqualFold(parts[0], "bearer") {
+		return strings.TrimSpace(parts[1])
+	}
+	if cookieKey == "" {
+		cookieKey = defaultTokenCookie
+	}
+	if cookie, err := r.Cookie(cookieKey); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+var now = time.Now
@@ -0,0 +1,250 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jose
+
+import (
+	"encoding/json"
+	"github.com/starvn/turbo/config"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetIntrospectionConfig(t *testing.T) {
+	cfg := &config.EndpointConfig{
+		ExtraConfig: config.ExtraConfig{
+			IntrospectionNamespace: map[string]interface{}{
+				"introspection_url": "https://idp.example.com/introspect",
+				"client_id":         "sonic",
+				"client_secret":     "secret",
+				"token_type_hint":   "access_token",
+				"roles":             []string{"admin"},
+				"propagate_claims":  [][]string{{"sub", "x-user"}},
+			},
+		},
+	}
+	scfg, icfg, err := GetValidatorConfig(cfg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if scfg != &icfg.SignatureConfig {
+		t.Error("the signature config should be the embedded one")
+	}
+	if icfg.URL != "https://idp.example.com/introspect" || icfg.ClientID != "sonic" || icfg.ClientSecret != "secret" || icfg.TokenTypeHint != "access_token" {
+		t.Errorf("unexpected config: %+v", icfg)
+	}
+	if scfg.RolesKey != "roles" || !reflect.DeepEqual(scfg.Roles, []string{"admin"}) || !reflect.DeepEqual(scfg.PropagateClaimsToHeader, [][]string{{"sub", "x-user"}}) {
+		t.Errorf("unexpected signature config: %+v", scfg)
+	}
+
+	cfg.ExtraConfig[IntrospectionNamespace].(map[string]interface{})["introspection_url"] = "http://idp.example.com/introspect"
+	if _, _, err := GetValidatorConfig(cfg); err != ErrInsecureIntrospectionSource {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, _, err := GetValidatorConfig(&config.EndpointConfig{}); err != ErrNoValidatorCfg {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestIntrospector(t *testing.T) {
+	calls := uint64(0)
+	exp := time.Now().Add(time.Hour).Unix()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&calls, 1)
+		if id, secret, ok := r.BasicAuth(); !ok || id != "sonic" || secret != "s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "POST" || r.PostFormValue("token_type_hint") != "access_token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var resp map[string]interface{}
+		switch r.PostFormValue("token") {
+		case "active":
+			resp = map[string]interface{}{"active": true, "sub": "alice", "scope": "read write", "iss": "https://idp.example.com", "aud": []string{"api"}, "exp": exp}
+		case "expired":
+			resp = map[string]interface{}{"active": true, "sub": "bob", "iss": "https://idp.example.com", "aud": "api", "exp": time.Now().Add(-time.Minute).Unix()}
+		case "other_audience":
+			resp = map[string]interface{}{"active": true, "sub": "carol", "iss": "https://idp.example.com", "aud": "other", "exp": exp}
+		default:
+			resp = map[string]interface{}{"active": false}
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	cfg := &IntrospectionConfig{
+		SignatureConfig: SignatureConfig{
+			Issuer:   "https://idp.example.com",
+			Audience: []string{"api"},
+		},
+		URL:                          server.URL,
+		ClientID:                     "sonic",
+		ClientSecret:                 "s3cr3t",
+		TokenTypeHint:                "access_token",
+		DisableIntrospectionSecurity: true,
+	}
+	v, err := NewClaimsValidator(&cfg.SignatureConfig, cfg, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	newRequest := func(token string) *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return req
+	}
+
+	for i := 0; i < 3; i++ {
+		claims, err := v.ValidateClaims(newRequest("active"))
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		if claims["sub"] != "alice" || !ScopesAllMatcher("scope", claims, []string{"read", "write"}) {
+			t.Errorf("unexpected claims: %v", claims)
+		}
+	}
+	if c := atomic.LoadUint64(&calls); c != 1 {
+		t.Errorf("the active token should be cached: %d calls", c)
+	}
+
+	req := newRequest("")
+	req.AddCookie(&http.Cookie{Name: "access_token", Value: "active"})
+	if _, err := v.ValidateClaims(req); err != nil {
+		t.Errorf("the token should be read from the cookie: %v", err)
+	}
+
+	for _, token := range []string{"inactive", "expired", "other_audience", ""} {
+		if _, err := v.ValidateClaims(newRequest(token)); err == nil {
+			t.Errorf("%s: error expected", token)
+		}
+	}
+	if _, err := v.ValidateClaims(newRequest("inactive")); err != ErrInactiveToken {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if c := atomic.LoadUint64(&calls); c != 4 {
+		t.Errorf("the rejected tokens should be cached: %d calls", c)
+	}
+
+	cfg.ClientSecret = "wrong"
+	v, _ = NewClaimsValidator(&cfg.SignatureConfig, cfg, nil)
+	if _, err := v.ValidateClaims(newRequest("active")); err == nil {
+		t.Error("the introspection should fail with the wrong credentials")
+	}
+}
+
+func TestIntrospector_cacheDuration(t *testing.T) {
+	defer func() { now = time.Now }()
+	current := time.Now()
+	now = func() time.Time { return current }
+
+	calls := uint64(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddUint64(&calls, 1)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"active": true, "exp": current.Add(time.Hour).Unix()})
+	}))
+	defer server.Close()
+
+	v, err := NewIntrospector(&IntrospectionConfig{
+		SignatureConfig:              SignatureConfig{CacheDuration: 60},
+		URL:                          server.URL,
+		DisableIntrospectionSecurity: true,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer token")
+
+	for _, step := range []struct {
+		advance time.Duration
+		calls   uint64
+	}{
+		{0, 1},
+		{30 * time.Second, 1},
+		{31 * time.Second, 2},
+		{30 * time.Second, 2},
+	} {
+		current = current.Add(step.advance)
+		if _, err := v.ValidateClaims(req); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if c := atomic.LoadUint64(&calls); c != step.calls {
+			t.Errorf("unexpected calls at %v: %d", current, c)
+		}
+	}
+}
+
+func TestIntrospector_cache(t *testing.T) {
+	defer func() { now = time.Now }()
+	current := time.Now()
+	now = func() time.Time { return current }
+
+	calls := map[string]int{}
+	mu := new(sync.Mutex)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.PostFormValue("token")
+		mu.Lock()
+		calls[token]++
+		mu.Unlock()
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"active": token != "inactive", "exp": current.Add(time.Hour).Unix()})
+	}))
+	defer server.Close()
+
+	v, err := NewIntrospector(&IntrospectionConfig{URL: server.URL, DisableIntrospectionSecurity: true})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	v.maxItems = 2
+	validate := func(token string) error {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		_, err := v.ValidateClaims(req)
+		return err
+	}
+
+	for _, token := range []string{"a", "b", "a", "c", "a", "b"} {
+		validate(token)
+	}
+	if calls["a"] != 1 || calls["b"] != 2 || calls["c"] != 1 {
+		t.Errorf("the least recently used token should be evicted: %v", calls)
+	}
+
+	for j := 0; j < 3; j++ {
+		if err := validate("inactive"); err != ErrInactiveToken {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	current = current.Add(DefaultIntrospectionNegativeTTL)
+	validate("inactive")
+	if calls["inactive"] != 2 {
+		t.Errorf("the inactive token should be cached for a short time: %d calls", calls["inactive"])
+	}
+}
@@ -0,0 +1,223 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jose
+
+import (
+	"errors"
+	"fmt"
+	"github.com/auth0-community/go-auth0"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"net/http"
+	"strings"
+)
+
+var ErrUnknownIssuer = errors.New("JOSE: the token issuer is not trusted")
+
+// ForIssuer returns the signature config of the trusted issuer with the given name, merged with the
+// options of the endpoint. It returns nil if the issuer is not trusted
+func (s *SignatureConfig) ForIssuer(issuer string) *SignatureConfig {
+	for _, i := range s.Issuers {
+		if i.Issuer != issuer {
+			continue
+		}
+		res := *s
+		res.Issuers = nil
+		res.Issuer = i.Issuer
+		res.URI = i.URI
+		res.CacheEnabled = i.CacheEnabled
+		res.CacheDuration = i.CacheDuration
+		res.CipherSuites = i.CipherSuites
+		res.DisableJWKSecurity = i.DisableJWKSecurity
+		res.Fingerprints = i.Fingerprints
+		res.LocalCA = i.LocalCA
+		res.LocalPath = ""
+		res.KeyIdentifyStrategy = i.KeyIdentifyStrategy
+		if len(i.Audience) > 0 {
+			res.Audience = i.Audience
+		}
+		if i.RolesKey != "" {
+			res.RolesKey = i.RolesKey
+			res.RolesKeyIsNested = i.RolesKeyIsNested
+		}
+		if i.ScopesKey != "" {
+			res.ScopesKey = i.ScopesKey
+		}
+		return &res
+	}
+	return nil
+}
+
+// issuerAlgorithms returns the algorithms accepted for the tokens of the given issuer
+func (s *SignatureConfig) issuerAlgorithms(i IssuerConfig) []string {
+	if len(i.Algorithms) > 0 {
+		return i.Algorithms
+	}
+	return []string{s.Alg}
+}
+
+// AccessChecker verifies the roles and the scopes of the validated claims with the keys of their
+// issuer
+type AccessChecker struct {
+	rule    accessRule
+	issuers map[string]accessRule
+}
+
+type accessRule struct {
+	rolesKey      string
+	roles         []string
+	aclCheck      func(string, map[string]interface{}, []string) bool
+	scopesKey     string
+	scopes        []string
+	scopesMatcher func(string, map[string]interface{}, []string) bool
+}
+
+// NewAccessChecker returns the access checker for the given config
+func NewAccessChecker(scfg *SignatureConfig) *AccessChecker {
+	a := &AccessChecker{
+		rule:    newAccessRule(scfg),
+		issuers: map[string]accessRule{},
+	}
+	for _, i := range scfg.Issuers {
+		a.issuers[i.Issuer] = newAccessRule(scfg.ForIssuer(i.Issuer))
+	}
+	return a
+}
+
+func newAccessRule(scfg *SignatureConfig) accessRule {
+	r := accessRule{
+		rolesKey:      scfg.RolesKey,
+		roles:         scfg.Roles,
+		aclCheck:      CanAccess,
+		scopesKey:     scfg.ScopesKey,
+		scopes:        scfg.Scopes,
+		scopesMatcher: ScopesDefaultMatcher,
+	}
+	if scfg.RolesKeyIsNested && strings.Contains(scfg.RolesKey, ".") && scfg.RolesKey[:4] != "http" {
+		r.aclCheck = CanAccessNested
+	}
+	if len(scfg.Scopes) > 0 && scfg.ScopesKey != "" {
+		if scfg.ScopesMatcher == "all" {
+			r.scopesMatcher = ScopesAllMatcher
+		} else {
+			r.scopesMatcher = ScopesAnyMatcher
+		}
+	}
+	return r
+}
+
+func (a *AccessChecker) ruleFor(claims map[string]interface{}) accessRule {
+	if iss, ok := claims["iss"].(string); ok {
+		if r, ok := a.issuers[iss]; ok {
+			return r
+		}
+	}
+	return a.rule
+}
+
+// HasRoles reports whether the claims contain any of the required roles
+func (a *AccessChecker) HasRoles(claims map[string]interface{}) bool {
+	r := a.ruleFor(claims)
+	return r.aclCheck(r.rolesKey, claims, r.roles)
+}
+
+// HasScopes reports whether the claims contain the required scopes
+func (a *AccessChecker) HasScopes(claims map[string]interface{}) bool {
+	r := a.ruleFor(claims)
+	return r.scopesMatcher(r.scopesKey, claims, r.scopes)
+}
+
+// multiIssuerValidator picks the validator of the token from its unverified issuer and algorithm,
+// rejecting the tokens of unknown issuers before verifying their signature
+type multiIssuerValidator struct {
+	extractor  auth0.RequestTokenExtractor
+	validators map[string]map[string]*auth0.JWTValidator
+	providers  []*JWKClient
+}
+
+func newMultiIssuerValidator(scfg *SignatureConfig, ef ExtractorFactory) (*multiIssuerValidator, error) {
+	var created []*JWKClient
+	v, err := newMultiIssuerValidatorWithProviders(scfg, ef, func(icfg *SignatureConfig, te auth0.RequestTokenExtractor) (*JWKClient, error) {
+		sp, err := newSecretProvider(icfg, te)
+		if sp != nil {
+			created = append(created, sp)
+		}
+		return sp, err
+	})
+	if err != nil {
+		for _, sp := range created {
+			closeSecretProvider(sp)
+		}
+		return nil, err
+	}
+	return v, nil
+}
+
+// newMultiIssuerValidatorWithProviders builds the validator with the secret providers returned by the
+// given function, so the callers can reuse the ones of a previous validator
+func newMultiIssuerValidatorWithProviders(scfg *SignatureConfig, ef ExtractorFactory, secretProvider func(*SignatureConfig, auth0.RequestTokenExtractor) (*JWKClient, error)) (*multiIssuerValidator, error) {
+	v := &multiIssuerValidator{
+		extractor:  newTokenExtractor(scfg, ef),
+		validators: map[string]map[string]*auth0.JWTValidator{},
+	}
+	for _, i := range scfg.Issuers {
+		icfg := scfg.ForIssuer(i.Issuer)
+		sp, err := secretProvider(icfg, v.extractor)
+		if err != nil {
+			return nil, fmt.Errorf("JOSE: issuer %s: %s", i.Issuer, err.Error())
+		}
+		v.providers = append(v.providers, sp)
+		algs := map[string]*auth0.JWTValidator{}
+		for _, alg := range scfg.issuerAlgorithms(i) {
+			sa, ok := supportedAlgorithms[alg]
+			if !ok {
+				return nil, fmt.Errorf("JOSE: unknown algorithm %s for the issuer %s", alg, i.Issuer)
+			}
+			algs[string(sa)] = auth0.NewValidator(auth0.NewConfiguration(sp, icfg.Audience, icfg.Issuer, sa), v.extractor)
+		}
+		v.validators[i.Issuer] = algs
+	}
+	return v, nil
+}
+
+func (v *multiIssuerValidator) close() {
+	for _, sp := range v.providers {
+		closeSecretProvider(sp)
+	}
+}
+
+func (v *multiIssuerValidator) ValidateClaims(r *http.Request) (map[string]interface{}, error) {
+	token, err := v.extractor.Extract(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(token.Headers) < 1 {
+		return nil, auth0.ErrNoJWTHeaders
+	}
+	unverified := jwt.Claims{}
+	if err := token.UnsafeClaimsWithoutVerification(&unverified); err != nil {
+		return nil, err
+	}
+	algs, ok := v.validators[unverified.Issuer]
+	if !ok {
+		return nil, ErrUnknownIssuer
+	}
+	validator, ok := algs[token.Headers[0].Algorithm]
+	if !ok {
+		return nil, auth0.ErrInvalidAlgorithm
+	}
+	return jwtClaimsValidator{JWTValidator: validator}.ValidateClaims(r)
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jose
+
+import (
+	"encoding/json"
+	"github.com/starvn/turbo/config"
+	"gopkg.in/square/go-jose.v2"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetSignatureConfig_issuers(t *testing.T) {
+	var extra config.ExtraConfig
+	if err := json.Unmarshal([]byte(`{
+		"github.com/starvn/sonic/auth/jose/validator": {
+			"roles": ["admin"],
+			"roles_key": "roles",
+			"audience": ["api"],
+			"issuers": [
+				{"issuer": "https://a.example.com", "jwk_url": "https://a.example.com/jwks", "algorithms": ["RS256", "ES256"], "roles_key": "realm.roles", "roles_key_is_nested": true},
+				{"issuer": "https://b.example.com", "jwk_url": "https://b.example.com/jwks", "algorithms": ["RS256"], "audience": ["b-api"], "scopes_key": "scp"}
+			]
+		}
+	}`), &extra); err != nil {
+		t.Error(err)
+		return
+	}
+	scfg, err := GetSignatureConfig(&config.EndpointConfig{ExtraConfig: extra})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	a := scfg.ForIssuer("https://a.example.com")
+	if a == nil || a.URI != "https://a.example.com/jwks" || a.RolesKey != "realm.roles" || !a.RolesKeyIsNested || a.Audience[0] != "api" || len(a.Roles) != 1 {
+		t.Errorf("unexpected config: %+v", a)
+	}
+	b := scfg.ForIssuer("https://b.example.com")
+	if b == nil || b.RolesKey != "roles" || b.ScopesKey != "scp" || b.Audience[0] != "b-api" {
+		t.Errorf("unexpected config: %+v", b)
+	}
+	if scfg.ForIssuer("https://c.example.com") != nil {
+		t.Error("unknown issuers should not have a config")
+	}
+
+	scfg.Issuers[1].URI = "http://b.example.com/jwks"
+	data, _ := json.Marshal(scfg)
+	var tmp map[string]interface{}
+	_ = json.Unmarshal(data, &tmp)
+	if _, err := GetSignatureConfig(&config.EndpointConfig{ExtraConfig: config.ExtraConfig{ValidatorNamespace: tmp}}); err != ErrInsecureJWKSource {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNewClaimsValidator_issuers(t *testing.T) {
+	rsaServer := httptest.NewServer(jwkEndpoint("public"))
+	defer rsaServer.Close()
+	rsaSigner := httptest.NewServer(jwkEndpoint("private"))
+	defer rsaSigner.Close()
+	hmacServer := httptest.NewServer(jwkEndpoint("symmetric"))
+	defer hmacServer.Close()
+
+	scfg := &SignatureConfig{
+		RolesKey: "roles",
+		Roles:    []string{"admin"},
+		Audience: []string{"api"},
+		Issuers: []IssuerConfig{
+			{Issuer: "https://rsa.example.com", URI: rsaServer.URL, Algorithms: []string{"RS256"}, DisableJWKSecurity: true},
+			{Issuer: "https://hmac.example.com", URI: hmacServer.URL, Algorithms: []string{"HS256"}, RolesKey: "groups", DisableJWKSecurity: true},
+		},
+	}
+	v, err := NewClaimsValidator(scfg, nil, nopExtractor)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	checker := NewAccessChecker(scfg)
+
+	rsaToken := signToken(t, rsaSigner.URL, "2011-04-29", map[string]interface{}{"iss": "https://rsa.example.com", "roles": []string{"admin"}})
+	hmacToken := signToken(t, hmacServer.URL, "sim2", map[string]interface{}{"iss": "https://hmac.example.com", "groups": []string{"admin"}})
+	forgedToken := signToken(t, hmacServer.URL, "sim2", map[string]interface{}{"iss": "https://rsa.example.com", "roles": []string{"admin"}})
+	unknownToken := signToken(t, hmacServer.URL, "sim2", map[string]interface{}{"iss": "https://unknown.example.com"})
+
+	newRequest := func(token string) *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return req
+	}
+
+	for name, token := range map[string]string{"rsa": rsaToken, "hmac": hmacToken} {
+		claims, err := v.ValidateClaims(newRequest(token))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+			continue
+		}
+		if !checker.HasRoles(claims) {
+			t.Errorf("%s: the roles should be read from the key of the issuer: %v", name, claims)
+		}
+	}
+	if _, err := v.ValidateClaims(newRequest(forgedToken)); err == nil {
+		t.Error("the token signed with the algorithm of another issuer should be rejected")
+	}
+	if _, err := v.ValidateClaims(newRequest(unknownToken)); err != ErrUnknownIssuer {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if checker.HasRoles(map[string]interface{}{"iss": "https://hmac.example.com", "roles": []string{"admin"}}) {
+		t.Error("the roles key of the issuer should be used")
+	}
+}
+
+func signToken(t *testing.T, jwkURL, kid string, claims map[string]interface{}) string {
+	sp, err := SecretProvider(SecretProviderConfig{URI: jwkURL, AllowInsecure: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := sp.GetKey(kid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := jose.NewSigner(
+		jose.SigningKey{Key: key.Key, Algorithm: jose.SignatureAlgorithm(key.Algorithm)},
+		(&jose.SignerOptions{}).WithHeader("kid", kid),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims["aud"] = "api"
+	claims["exp"] = time.Now().Add(time.Hour).Unix()
+	payload, _ := json.Marshal(claims)
+	obj, err := s.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := obj.CompactSerialize()
+	return token
+}
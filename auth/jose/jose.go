@@ -31,15 +31,43 @@ import (
 type ExtractorFactory func(string) func(r *http.Request) (*jwt.JSONWebToken, error)
 
 func NewValidator(signatureConfig *SignatureConfig, ef ExtractorFactory) (*auth0.JWTValidator, error) {
+	v, _, err := newValidator(signatureConfig, ef)
+	return v, err
+}
+
+// newValidator returns the validator along with its secret provider, so the callers can release
+// the key cacher of the provider
+func newValidator(signatureConfig *SignatureConfig, ef ExtractorFactory) (*auth0.JWTValidator, *JWKClient, error) {
 	sa, ok := supportedAlgorithms[signatureConfig.Alg]
 	if !ok {
-		return nil, fmt.Errorf("JOSE: unknown algorithm %s", signatureConfig.Alg)
+		return nil, nil, fmt.Errorf("JOSE: unknown algorithm %s", signatureConfig.Alg)
+	}
+	te := newTokenExtractor(signatureConfig, ef)
+
+	sp, err := newSecretProvider(signatureConfig, te)
+	if err != nil {
+		return nil, nil, err
 	}
-	te := auth0.FromMultiple(
+
+	return auth0.NewValidator(
+		auth0.NewConfiguration(
+			sp,
+			signatureConfig.Audience,
+			signatureConfig.Issuer,
+			sa,
+		),
+		te,
+	), sp, nil
+}
+
+func newTokenExtractor(signatureConfig *SignatureConfig, ef ExtractorFactory) auth0.RequestTokenExtractor {
+	return auth0.FromMultiple(
 		auth0.RequestTokenExtractorFunc(auth0.FromHeader),
 		auth0.RequestTokenExtractorFunc(ef(signatureConfig.CookieKey)),
 	)
+}
 
+func newSecretProvider(signatureConfig *SignatureConfig, te auth0.RequestTokenExtractor) (*JWKClient, error) {
 	decodedFs, err := DecodeFingerprints(signatureConfig.Fingerprints)
 	if err != nil {
 		return nil, err
@@ -48,6 +76,7 @@ func NewValidator(signatureConfig *SignatureConfig, ef ExtractorFactory) (*auth0
 	cfg := SecretProviderConfig{
 		URI:                 signatureConfig.URI,
 		CacheEnabled:        signatureConfig.CacheEnabled,
+		CacheDuration:       signatureConfig.CacheDuration,
 		Fingerprints:        decodedFs,
 		Cs:                  signatureConfig.CipherSuites,
 		LocalCA:             signatureConfig.LocalCA,
@@ -58,20 +87,7 @@ func NewValidator(signatureConfig *SignatureConfig, ef ExtractorFactory) (*auth0
 		KeyIdentifyStrategy: signatureConfig.KeyIdentifyStrategy,
 	}
 
-	sp, err := SecretProvider(cfg, te)
-	if err != nil {
-		return nil, err
-	}
-
-	return auth0.NewValidator(
-		auth0.NewConfiguration(
-			sp,
-			signatureConfig.Audience,
-			signatureConfig.Issuer,
-			sa,
-		),
-		te,
-	), nil
+	return SecretProvider(cfg, te)
 }
 
 func CanAccessNested(roleKey string, claims map[string]interface{}, required []string) bool {
@@ -281,6 +297,19 @@ func (c Claims) Get(name string) (string, bool) {
 	return normalized, ok
 }
 
+// GetNested returns the normalized value of the claim at the given path. Nested claims are
+// separated by dots, unless the path is a URI
+func (c Claims) GetNested(path string) (string, bool) {
+	if !strings.Contains(path, ".") || strings.HasPrefix(path, "http") {
+		return c.Get(path)
+	}
+	key, tmp := getNestedClaim(path, c)
+	if tmp == nil {
+		return "", false
+	}
+	return Claims(tmp).Get(key)
+}
+
 func CalculateHeadersToPropagate(propagationCfg [][]string, claims map[string]interface{}) (map[string]string, error) {
 	if len(propagationCfg) == 0 {
 		return nil, fmt.Errorf("JOSE: no headers to propagate. Config size: %d", len(propagationCfg))
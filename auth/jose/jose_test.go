@@ -351,3 +351,34 @@ func TestCalculateHeadersToPropagate(t *testing.T) {
 		}
 	}
 }
+
+func TestClaims_GetNested(t *testing.T) {
+	c := Claims{
+		"sub": "foo",
+		"app": map[string]interface{}{
+			"client_id": "bar",
+			"tier":      map[string]interface{}{"name": "pro"},
+		},
+		"http://example.com/client": "baz",
+	}
+	for path, expected := range map[string]string{
+		"sub":                       "foo",
+		"app.client_id":             "bar",
+		"app.tier.name":             "pro",
+		"http://example.com/client": "baz",
+	} {
+		v, ok := c.GetNested(path)
+		if !ok {
+			t.Errorf("%s: claim not found", path)
+			continue
+		}
+		if v != expected {
+			t.Errorf("%s: unexpected value %s", path, v)
+		}
+	}
+	for _, path := range []string{"unknown", "app.unknown", "sub.unknown", "app.tier.name.unknown"} {
+		if v, ok := c.GetNested(path); ok {
+			t.Errorf("%s: unexpected value %s", path, v)
+		}
+	}
+}
@@ -77,7 +77,7 @@ func SecretProvider(cfg SecretProviderConfig, te auth0.RequestTokenExtractor) (*
 	client := NewJWKClientWithCache(
 		opts,
 		te,
-		NewMemoryKeyCacher(cacheDuration, auth0.MaxCacheSizeNoCheck, opts.KeyIdentifyStrategy),
+		NewRefreshingKeyCacher(cfg.URI, NewJWKSFetcher(opts.JWKClientOptions), cacheDuration, opts.KeyIdentifyStrategy),
 	)
 
 	_, _ = client.GetKey("unknown")
@@ -0,0 +1,361 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jose
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/auth0-community/go-auth0"
+	"github.com/rcrowley/go-metrics"
+	"gopkg.in/square/go-jose.v2"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultUnknownKeyTTL is the time an unknown key id is rejected without fetching the key set
+	DefaultUnknownKeyTTL = time.Minute
+	// DefaultMinRefreshInterval is the min time between two fetches triggered by unknown key ids
+	DefaultMinRefreshInterval = 5 * time.Second
+	// DefaultJWKFetchTimeout is the max duration of the fetches of the key set
+	DefaultJWKFetchTimeout = 10 * time.Second
+	maxUnknownKeys         = 1000
+)
+
+// KeyFetcher returns the current key set of the identity provider
+type KeyFetcher func() ([]jose.JSONWebKey, error)
+
+// NewJWKSFetcher returns a fetcher downloading the key set from the JWK endpoint of the options. The
+// fetches are cancelled after the DefaultJWKFetchTimeout
+func NewJWKSFetcher(opts auth0.JWKClientOptions) KeyFetcher {
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return func() ([]jose.JSONWebKey, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultJWKFetchTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, "GET", opts.URI, new(bytes.Buffer))
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if contentH := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentH, "application/json") {
+			return nil, auth0.ErrInvalidContentType
+		}
+		jwks := auth0.JWKS{}
+		if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+			return nil, err
+		}
+		if len(jwks.Keys) < 1 {
+			return nil, ErrNoKeyFound
+		}
+		return jwks.Keys, nil
+	}
+}
+
+// RefreshingKeyCacher is a concurrency-safe key cacher fetching the whole key set by itself. The key
+// set is refreshed in the background once it reaches 3/4 of its max age, so the known keys are
+// never blocked by the JWK endpoint and the last known ones are served while it is failing. Unknown key ids
+// trigger a single fetch shared by all the concurrent requests, at most once every min refresh
+// interval, and they are rejected without fetching the key set again during the unknown key TTL
+type RefreshingKeyCacher struct {
+	fetch              KeyFetcher
+	keyIDGetter        KeyIDGetter
+	maxKeyAge          time.Duration
+	refreshAfter       time.Duration
+	minRefreshInterval time.Duration
+	unknownKeyTTL      time.Duration
+
+	mu          *sync.RWMutex
+	keys        map[string]jose.JSONWebKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	unknown     map[string]time.Time
+	inflight    *keyFetch
+
+	stats *keyCacherStats
+	name  string
+}
+
+type keyFetch struct {
+	done chan struct{}
+	err  error
+}
+
+type keyCacherStats struct {
+	refreshes     metrics.Counter
+	refreshErrors metrics.Counter
+	rejected      metrics.Counter
+	refreshedAt   int64
+}
+
+// KeyCacherStats is the state of a refreshing key cacher
+type KeyCacherStats struct {
+	Keys          int
+	Refreshes     int64
+	RefreshErrors int64
+	RejectedKeys  int64
+	LastRefresh   time.Time
+}
+
+// NewRefreshingKeyCacher returns a refreshing key cacher using the given fetcher. The name
+// identifies the metrics of the cacher
+func NewRefreshingKeyCacher(name string, fetch KeyFetcher, maxKeyAge time.Duration, keyIdentifyStrategy string) *RefreshingKeyCacher {
+	c := &RefreshingKeyCacher{
+		fetch:              fetch,
+		keyIDGetter:        KeyIDGetterFactory(keyIdentifyStrategy),
+		maxKeyAge:          maxKeyAge,
+		refreshAfter:       maxKeyAge * 3 / 4,
+		minRefreshInterval: DefaultMinRefreshInterval,
+		unknownKeyTTL:      DefaultUnknownKeyTTL,
+		mu:                 new(sync.RWMutex),
+		keys:               map[string]jose.JSONWebKey{},
+		unknown:            map[string]time.Time{},
+		stats: &keyCacherStats{
+			refreshes:     metrics.NewCounter(),
+			refreshErrors: metrics.NewCounter(),
+			rejected:      metrics.NewCounter(),
+		},
+	}
+	registerKeyCacherMetrics(name, c)
+	return c
+}
+
+func (c *RefreshingKeyCacher) Get(keyID string) (*jose.JSONWebKey, error) {
+	c.mu.RLock()
+	key, ok := c.keys[keyID]
+	age := now().Sub(c.fetchedAt)
+	c.mu.RUnlock()
+
+	if ok {
+		if c.maxKeyAge > 0 && age >= c.refreshAfter {
+			// the key is served, even if it is stale, while the key set is refreshed
+			_ = c.refresh(false)
+		}
+		return &key, nil
+	}
+
+	if c.isUnknown(keyID) {
+		c.stats.rejected.Inc(1)
+		return nil, ErrNoKeyFound
+	}
+	if err := c.refresh(true); err != nil {
+		if err == errRefreshThrottled {
+			c.stats.rejected.Inc(1)
+			return nil, ErrNoKeyFound
+		}
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.keys[keyID]; ok {
+		return &key, nil
+	}
+	if len(c.unknown) >= maxUnknownKeys {
+		c.unknown = map[string]time.Time{}
+	}
+	c.unknown[keyID] = now().Add(c.unknownKeyTTL)
+	return nil, ErrNoKeyFound
+}
+
+// Add replaces the cached key set with the given one, returning the key with the given id
+func (c *RefreshingKeyCacher) Add(keyID string, downloadedKeys []jose.JSONWebKey) (*jose.JSONWebKey, error) {
+	c.store(downloadedKeys)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if key, ok := c.keys[keyID]; ok {
+		return &key, nil
+	}
+	return nil, ErrNoKeyFound
+}
+
+// Stats returns the current state of the cacher
+func (c *RefreshingKeyCacher) Stats() KeyCacherStats {
+	c.mu.RLock()
+	keys := len(c.keys)
+	c.mu.RUnlock()
+	s := KeyCacherStats{
+		Keys:          keys,
+		Refreshes:     c.stats.refreshes.Count(),
+		RefreshErrors: c.stats.refreshErrors.Count(),
+		RejectedKeys:  c.stats.rejected.Count(),
+	}
+	if t := atomic.LoadInt64(&c.stats.refreshedAt); t > 0 {
+		s.LastRefresh = time.Unix(0, t)
+	}
+	return s
+}
+
+func (c *RefreshingKeyCacher) isUnknown(keyID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	exp, ok := c.unknown[keyID]
+	if !ok {
+		return false
+	}
+	if now().Before(exp) {
+		return true
+	}
+	delete(c.unknown, keyID)
+	return false
+}
+
+var errRefreshThrottled = errors.New("the key set has been fetched recently")
+
+// refresh fetches the key set, sharing the fetch in progress if any. A new fetch is not started if
+// the previous one began less than the min refresh interval ago. If wait is false, the fetch runs
+// in the background
+func (c *RefreshingKeyCacher) refresh(wait bool) error {
+	c.mu.Lock()
+	f := c.inflight
+	if f == nil {
+		if !c.attemptedAt.IsZero() && now().Sub(c.attemptedAt) < c.minRefreshInterval {
+			c.mu.Unlock()
+			return errRefreshThrottled
+		}
+		f = &keyFetch{done: make(chan struct{})}
+		c.inflight = f
+		c.attemptedAt = now()
+		go c.doFetch(f)
+	}
+	c.mu.Unlock()
+
+	if !wait {
+		return nil
+	}
+	<-f.done
+	return f.err
+}
+
+func (c *RefreshingKeyCacher) doFetch(f *keyFetch) {
+	keys, err := c.fetch()
+	if err == nil {
+		c.store(keys)
+		c.stats.refreshes.Inc(1)
+	} else {
+		c.stats.refreshErrors.Inc(1)
+	}
+
+	c.mu.Lock()
+	c.inflight = nil
+	c.mu.Unlock()
+
+	f.err = err
+	close(f.done)
+}
+
+func (c *RefreshingKeyCacher) store(downloadedKeys []jose.JSONWebKey) {
+	keys := make(map[string]jose.JSONWebKey, len(downloadedKeys))
+	for _, key := range downloadedKeys {
+		k := key
+		keys[c.keyIDGetter.Get(&k)] = k
+	}
+	t := now()
+
+	c.mu.Lock()
+	c.keys = keys
+	c.fetchedAt = t
+	for k := range keys {
+		delete(c.unknown, k)
+	}
+	c.mu.Unlock()
+	atomic.StoreInt64(&c.stats.refreshedAt, t.UnixNano())
+}
+
+var (
+	keyCacherMetricsMu = new(sync.Mutex)
+	keyCacherRegistry  metrics.Registry
+	keyCachers         = map[string]*RefreshingKeyCacher{}
+)
+
+// RegisterKeyCacherMetrics makes the refreshing key cachers report their metrics to the given
+// registry, including the cachers created before the call. A nil registry disables the reports
+func RegisterKeyCacherMetrics(r metrics.Registry) {
+	keyCacherMetricsMu.Lock()
+	defer keyCacherMetricsMu.Unlock()
+	keyCacherRegistry = r
+	if r == nil {
+		return
+	}
+	for name, c := range keyCachers {
+		c.register(r, name)
+	}
+}
+
+func registerKeyCacherMetrics(name string, c *RefreshingKeyCacher) {
+	keyCacherMetricsMu.Lock()
+	defer keyCacherMetricsMu.Unlock()
+	for i, base := 2, name; keyCachers[name] != nil; i++ {
+		name = fmt.Sprintf("%s#%d", base, i)
+	}
+	keyCachers[name] = c
+	c.name = name
+	if keyCacherRegistry != nil {
+		c.register(keyCacherRegistry, name)
+	}
+}
+
+// unregisterKeyCacherMetrics removes the cacher and its metrics once it is not used anymore
+func unregisterKeyCacherMetrics(c *RefreshingKeyCacher) {
+	keyCacherMetricsMu.Lock()
+	defer keyCacherMetricsMu.Unlock()
+	if keyCachers[c.name] != c {
+		return
+	}
+	delete(keyCachers, c.name)
+	if keyCacherRegistry != nil {
+		for metric := range c.metrics(c.name) {
+			keyCacherRegistry.Unregister(metric)
+		}
+	}
+}
+
+func (c *RefreshingKeyCacher) register(r metrics.Registry, name string) {
+	for metric, v := range c.metrics(name) {
+		r.Unregister(metric)
+		_ = r.Register(metric, v)
+	}
+}
+
+func (c *RefreshingKeyCacher) metrics(name string) map[string]interface{} {
+	labels := ".uri." + name
+	return map[string]interface{}{
+		"jwk.refresh" + labels:        c.stats.refreshes,
+		"jwk.refresh.errors" + labels: c.stats.refreshErrors,
+		"jwk.rejected" + labels:       c.stats.rejected,
+		"jwk.keys" + labels:           metrics.NewFunctionalGauge(func() int64 { return int64(c.Stats().Keys) }),
+		"jwk.age" + labels: metrics.NewFunctionalGauge(func() int64 {
+			if t := atomic.LoadInt64(&c.stats.refreshedAt); t > 0 {
+				return int64(now().Sub(time.Unix(0, t)) / time.Second)
+			}
+			return 0
+		}),
+	}
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jose
+
+import (
+	"errors"
+	"github.com/rcrowley/go-metrics"
+	"gopkg.in/square/go-jose.v2"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRefreshingKeyCacher_unknownKeys(t *testing.T) {
+	calls := uint64(0)
+	release := make(chan struct{})
+	c := NewRefreshingKeyCacher("test_unknown", func() ([]jose.JSONWebKey, error) {
+		atomic.AddUint64(&calls, 1)
+		<-release
+		return []jose.JSONWebKey{{KeyID: "a", Key: []byte("secret")}}, nil
+	}, time.Minute, "kid")
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if k, err := c.Get("a"); err != nil || k.KeyID != "a" {
+				t.Errorf("unexpected result: %v %v", k, err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadUint64(&calls); n != 1 {
+		t.Errorf("the concurrent requests should share the fetch: %d calls", n)
+	}
+
+	c.minRefreshInterval = 0
+	for i := 0; i < 5; i++ {
+		if _, err := c.Get("unknown"); err != ErrNoKeyFound {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if n := atomic.LoadUint64(&calls); n != 2 {
+		t.Errorf("the unknown key should be fetched once: %d calls", n)
+	}
+	if s := c.Stats(); s.Keys != 1 || s.Refreshes != 2 || s.RejectedKeys != 4 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+
+	c.minRefreshInterval = time.Hour
+	if _, err := c.Get("other"); err != ErrNoKeyFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if n := atomic.LoadUint64(&calls); n != 2 {
+		t.Errorf("the fetches should be throttled: %d calls", n)
+	}
+}
+
+func TestRefreshingKeyCacher_refresh(t *testing.T) {
+	defer func() { now = time.Now }()
+	current := time.Now()
+	mu := new(sync.Mutex)
+	now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return current
+	}
+	advance := func(d time.Duration) {
+		mu.Lock()
+		current = current.Add(d)
+		mu.Unlock()
+	}
+
+	calls := uint64(0)
+	var failing atomic.Value
+	failing.Store(false)
+	c := NewRefreshingKeyCacher("test_refresh", func() ([]jose.JSONWebKey, error) {
+		n := atomic.AddUint64(&calls, 1)
+		if failing.Load().(bool) {
+			return nil, errors.New("jwk endpoint down")
+		}
+		if n == 1 {
+			return []jose.JSONWebKey{{KeyID: "old", Key: []byte("secret")}}, nil
+		}
+		return []jose.JSONWebKey{{KeyID: "new", Key: []byte("secret")}}, nil
+	}, 4*time.Minute, "kid")
+	c.minRefreshInterval = time.Second
+
+	if _, err := c.Get("old"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	advance(3*time.Minute + time.Second)
+	if _, err := c.Get("old"); err != nil {
+		t.Errorf("the key should be served while refreshing in the background: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for c.Stats().Refreshes < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := c.Get("new"); err != nil {
+		t.Errorf("the rotated key should be available: %v", err)
+	}
+	if _, err := c.Get("old"); err != ErrNoKeyFound {
+		t.Errorf("the removed key should not be served: %v", err)
+	}
+
+	failing.Store(true)
+	advance(10 * time.Minute)
+	for i := 0; i < 3; i++ {
+		if _, err := c.Get("new"); err != nil {
+			t.Errorf("the stale key should be served while the jwk endpoint is down: %v", err)
+		}
+	}
+	deadline = time.Now().Add(time.Second)
+	for c.Stats().RefreshErrors < 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if s := c.Stats(); s.RefreshErrors != 1 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+}
+
+func TestRefreshingKeyCacher_staleNotBlocking(t *testing.T) {
+	defer func() { now = time.Now }()
+	current := time.Now()
+	mu := new(sync.Mutex)
+	now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return current
+	}
+
+	release := make(chan struct{})
+	calls := uint64(0)
+	c := NewRefreshingKeyCacher("test_stale", func() ([]jose.JSONWebKey, error) {
+		if atomic.AddUint64(&calls, 1) > 1 {
+			<-release
+		}
+		return []jose.JSONWebKey{{KeyID: "kid", Key: []byte("secret")}}, nil
+	}, time.Minute, "kid")
+
+	if _, err := c.Get("kid"); err != nil {
+		t.Error(err)
+		return
+	}
+	mu.Lock()
+	current = current.Add(time.Hour)
+	mu.Unlock()
+
+	done := make(chan error)
+	go func() {
+		_, err := c.Get("kid")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("the stale key should be served: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("the stale key should not wait for the refresh")
+	}
+
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for c.Stats().Refreshes < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRegisterKeyCacherMetrics(t *testing.T) {
+	r := metrics.NewRegistry()
+	RegisterKeyCacherMetrics(r)
+	defer RegisterKeyCacherMetrics(nil)
+
+	c := NewRefreshingKeyCacher("test_metrics", func() ([]jose.JSONWebKey, error) {
+		return []jose.JSONWebKey{{KeyID: "a", Key: []byte("secret")}}, nil
+	}, time.Minute, "kid")
+	_, _ = c.Get("a")
+
+	if v, ok := r.Get("jwk.refresh.uri.test_metrics").(metrics.Counter); !ok || v.Count() != 1 {
+		t.Errorf("unexpected refresh counter: %v", r.Get("jwk.refresh.uri.test_metrics"))
+	}
+	if v, ok := r.Get("jwk.keys.uri.test_metrics").(metrics.Gauge); !ok || v.Value() != 1 {
+		t.Errorf("unexpected keys gauge: %v", r.Get("jwk.keys.uri.test_metrics"))
+	}
+}
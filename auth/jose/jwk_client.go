@@ -18,6 +18,7 @@ package jose
 
 import (
 	"github.com/auth0-community/go-auth0"
+	"gopkg.in/square/go-jose.v2"
 	"gopkg.in/square/go-jose.v2/jwt"
 	"net/http"
 )
@@ -71,16 +72,32 @@ type JWKClient struct {
 	*auth0.JWKClient
 	extractor     auth0.RequestTokenExtractor
 	tokenIDGetter TokenIDGetter
+	refresher     *RefreshingKeyCacher
 }
 
 func NewJWKClientWithCache(options JWKClientOptions, extractor auth0.RequestTokenExtractor, keyCacher auth0.KeyCacher) *JWKClient {
+	refresher, _ := keyCacher.(*RefreshingKeyCacher)
 	return &JWKClient{
 		JWKClient:     auth0.NewJWKClientWithCache(options.JWKClientOptions, extractor, keyCacher),
 		extractor:     extractor,
 		tokenIDGetter: TokenIDGetterFactory(options.KeyIdentifyStrategy),
+		refresher:     refresher,
 	}
 }
 
+// GetKey returns the key with the given id. The refreshing key cachers fetch the key set by
+// themselves, so they are queried without the lock of the auth0 client serializing the requests
+func (j *JWKClient) GetKey(ID string) (jose.JSONWebKey, error) {
+	if j.refresher == nil {
+		return j.JWKClient.GetKey(ID)
+	}
+	key, err := j.refresher.Get(ID)
+	if err != nil {
+		return jose.JSONWebKey{}, err
+	}
+	return *key, nil
+}
+
 func (j *JWKClient) GetSecret(r *http.Request) (interface{}, error) {
 	token, err := j.extractor.Extract(r)
 	if err != nil {
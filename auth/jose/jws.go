@@ -56,8 +56,38 @@ type SignatureConfig struct {
 	ScopesMatcher           string     `json:"scopes_matcher,omitempty"`
 	KeyIdentifyStrategy     string     `json:"key_identify_strategy"`
 	OperationDebug          bool       `json:"operation_debug,omitempty"`
+	// OIDCIssuer is the OpenID Connect issuer providing the jwk_url, the issuer and the algorithms
+	// of the validator through its discovery document, fetched again every refresh interval. The
+	// signer does not support it
+	OIDCIssuer          string `json:"oidc_issuer,omitempty"`
+	OIDCRefreshInterval uint32 `json:"oidc_refresh_interval,omitempty"`
+	// Issuers lists the trusted identity providers of the endpoint. If defined, the token is
+	// verified with the entry matching its issuer claim and the tokens of other issuers are rejected
+	Issuers []IssuerConfig `json:"issuers,omitempty"`
 }
 
+// IssuerConfig defines a trusted identity provider. The empty algorithms, audience, roles key and
+// scopes key fall back to the ones of the endpoint
+type IssuerConfig struct {
+	Issuer              string   `json:"issuer"`
+	URI                 string   `json:"jwk_url"`
+	Algorithms          []string `json:"algorithms,omitempty"`
+	Audience            []string `json:"audience,omitempty"`
+	RolesKey            string   `json:"roles_key,omitempty"`
+	RolesKeyIsNested    bool     `json:"roles_key_is_nested,omitempty"`
+	ScopesKey           string   `json:"scopes_key,omitempty"`
+	CacheEnabled        bool     `json:"cache,omitempty"`
+	CacheDuration       uint32   `json:"cache_duration,omitempty"`
+	CipherSuites        []uint16 `json:"cipher_suites,omitempty"`
+	DisableJWKSecurity  bool     `json:"disable_jwk_security"`
+	Fingerprints        []string `json:"jwk_fingerprints,omitempty"`
+	LocalCA             string   `json:"jwk_local_ca,omitempty"`
+	KeyIdentifyStrategy string   `json:"key_identify_strategy"`
+}
+
+// SignerConfig defines the keys signing the responses. Unlike the validator, the signer does not
+// support the oidc_issuer option: the discovery documents only publish the public keys of the
+// issuer, so the jwk_url of the signer must point to its private keys
 type SignerConfig struct {
 	Alg                string   `json:"alg"`
 	KeyID              string   `json:"kid"`
@@ -76,6 +106,8 @@ type SignerConfig struct {
 var (
 	ErrNoValidatorCfg = errors.New("no validator config")
 	ErrNoSignerCfg    = errors.New("no signer config")
+	ErrNoIssuer       = errors.New("trusted issuer without issuer or algorithms")
+	ErrOIDCSigner     = errors.New("the signer does not support the oidc discovery")
 )
 
 func GetSignatureConfig(cfg *config.EndpointConfig) (*SignatureConfig, error) {
@@ -92,6 +124,23 @@ func GetSignatureConfig(cfg *config.EndpointConfig) (*SignatureConfig, error) {
 	if res.RolesKey == "" {
 		res.RolesKey = defaultRolesKey
 	}
+	if len(res.Issuers) > 0 {
+		for _, i := range res.Issuers {
+			if i.Issuer == "" || (len(i.Algorithms) == 0 && res.Alg == "") {
+				return res, ErrNoIssuer
+			}
+			if !strings.HasPrefix(i.URI, "https://") && !i.DisableJWKSecurity {
+				return res, ErrInsecureJWKSource
+			}
+		}
+		return res, nil
+	}
+	if res.OIDCIssuer != "" {
+		if !strings.HasPrefix(res.OIDCIssuer, "https://") && !res.DisableJWKSecurity {
+			return res, ErrInsecureJWKSource
+		}
+		return res, nil
+	}
 	if !strings.HasPrefix(res.URI, "https://") && !res.DisableJWKSecurity {
 		return res, ErrInsecureJWKSource
 	}
@@ -103,6 +152,9 @@ func getSignerConfig(cfg *config.EndpointConfig) (*SignerConfig, error) {
 	if !ok {
 		return nil, ErrNoSignerCfg
 	}
+	if m, ok := tmp.(map[string]interface{}); ok && m["oidc_issuer"] != nil {
+		return nil, ErrOIDCSigner
+	}
 	data, _ := json.Marshal(tmp)
 	res := new(SignerConfig)
 	if err := json.Unmarshal(data, res); err != nil {
@@ -148,6 +148,23 @@ func Test_newSigner_unsecure(t *testing.T) {
 	}
 }
 
+func Test_newSigner_oidc(t *testing.T) {
+	cfg := &config.EndpointConfig{
+		Endpoint: "/token",
+		ExtraConfig: config.ExtraConfig{
+			SignerNamespace: map[string]interface{}{
+				"kid":          "2011-04-29",
+				"oidc_issuer":  "https://idp.example.com",
+				"keys_to_sign": []string{"access_token"},
+			},
+		},
+	}
+	_, _, err := NewSigner(cfg, nil)
+	if err != ErrOIDCSigner {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
 func Test_newSigner_wrongStruct(t *testing.T) {
 	cfg := &config.EndpointConfig{
 		Timeout:  time.Second,
@@ -20,6 +20,7 @@ import (
 	b64 "encoding/base64"
 	"errors"
 	"gopkg.in/square/go-jose.v2"
+	"sync"
 	"time"
 )
 
@@ -71,6 +72,7 @@ type KeyCacher interface {
 }
 
 type MemoryKeyCacher struct {
+	mu           *sync.Mutex
 	entries      map[string]keyCacherEntry
 	maxKeyAge    time.Duration
 	maxCacheSize int
@@ -84,6 +86,7 @@ type keyCacherEntry struct {
 
 func NewMemoryKeyCacher(maxKeyAge time.Duration, maxCacheSize int, keyIdentifyStrategy string) KeyCacher {
 	return &MemoryKeyCacher{
+		mu:           new(sync.Mutex),
 		entries:      map[string]keyCacherEntry{},
 		maxKeyAge:    maxKeyAge,
 		maxCacheSize: maxCacheSize,
@@ -92,6 +95,8 @@ func NewMemoryKeyCacher(maxKeyAge time.Duration, maxCacheSize int, keyIdentifySt
 }
 
 func (mkc *MemoryKeyCacher) Get(keyID string) (*jose.JSONWebKey, error) {
+	mkc.mu.Lock()
+	defer mkc.mu.Unlock()
 	searchKey, ok := mkc.entries[keyID]
 	if ok {
 		if mkc.maxKeyAge == MaxKeyAgeNoCheck || !mkc.keyIsExpired(keyID) {
@@ -103,6 +108,8 @@ func (mkc *MemoryKeyCacher) Get(keyID string) (*jose.JSONWebKey, error) {
 }
 
 func (mkc *MemoryKeyCacher) Add(keyID string, downloadedKeys []jose.JSONWebKey) (*jose.JSONWebKey, error) {
+	mkc.mu.Lock()
+	defer mkc.mu.Unlock()
 
 	var addingKey jose.JSONWebKey
 	var addingKeyID string
@@ -29,11 +29,16 @@ import (
 	"gopkg.in/square/go-jose.v2/jwt"
 	"log"
 	"net/http"
-	"strings"
 )
 
 func HandlerFactory(hf smux.HandlerFactory, paramExtractor smux.ParamExtractor, logger logging.Logger, rejecterF jose.RejecterFactory) smux.HandlerFactory {
-	return TokenSignatureValidator(TokenSigner(hf, paramExtractor, logger), logger, rejecterF)
+	return HandlerFactoryWithContext(context.Background(), hf, paramExtractor, logger, rejecterF)
+}
+
+// HandlerFactoryWithContext returns a handler factory whose validators are released when the
+// context is done
+func HandlerFactoryWithContext(ctx context.Context, hf smux.HandlerFactory, paramExtractor smux.ParamExtractor, logger logging.Logger, rejecterF jose.RejecterFactory) smux.HandlerFactory {
+	return TokenSignatureValidatorWithContext(ctx, TokenSigner(hf, paramExtractor, logger), logger, rejecterF)
 }
 
 func TokenSigner(hf smux.HandlerFactory, paramExtractor smux.ParamExtractor, logger logging.Logger) smux.HandlerFactory {
@@ -107,6 +112,12 @@ func jsonRender(w http.ResponseWriter, response *proxy.Response) error {
 }
 
 func TokenSignatureValidator(hf smux.HandlerFactory, logger logging.Logger, rejecterF jose.RejecterFactory) smux.HandlerFactory {
+	return TokenSignatureValidatorWithContext(context.Background(), hf, logger, rejecterF)
+}
+
+// TokenSignatureValidatorWithContext returns a handler factory validating the tokens with the
+// validators shared by the endpoints of the context. They are released when the context is done
+func TokenSignatureValidatorWithContext(ctx context.Context, hf smux.HandlerFactory, logger logging.Logger, rejecterF jose.RejecterFactory) smux.HandlerFactory {
 	return func(cfg *config.EndpointConfig, prxy proxy.Proxy) http.HandlerFunc {
 		if rejecterF == nil {
 			rejecterF = new(jose.NopRejecterFactory)
@@ -114,7 +125,7 @@ func TokenSignatureValidator(hf smux.HandlerFactory, logger logging.Logger, reje
 		rejecter := rejecterF.New(logger, cfg)
 
 		handler := hf(cfg, prxy)
-		signatureConfig, err := jose.GetSignatureConfig(cfg)
+		signatureConfig, introspectionConfig, err := jose.GetValidatorConfig(cfg)
 		if err == jose.ErrNoValidatorCfg {
 			logger.Info("JOSE: validator disabled for the endpoint", cfg.Endpoint)
 			return handler
@@ -124,42 +135,17 @@ func TokenSignatureValidator(hf smux.HandlerFactory, logger logging.Logger, reje
 			return handler
 		}
 
-		validator, err := jose.NewValidator(signatureConfig, FromCookie)
+		validator, err := validators.Get(ctx, signatureConfig, introspectionConfig)
 		if err != nil {
 			log.Fatalf("%s: %s", cfg.Endpoint, err.Error())
 		}
 
-		var aclCheck func(string, map[string]interface{}, []string) bool
-
-		if signatureConfig.RolesKeyIsNested && strings.Contains(signatureConfig.RolesKey, ".") && signatureConfig.RolesKey[:4] != "http" {
-			aclCheck = jose.CanAccessNested
-		} else {
-			aclCheck = jose.CanAccess
-		}
-
-		var scopesMatcher func(string, map[string]interface{}, []string) bool
-
-		if len(signatureConfig.Scopes) > 0 && signatureConfig.ScopesKey != "" {
-			if signatureConfig.ScopesMatcher == "all" {
-				scopesMatcher = jose.ScopesAllMatcher
-			} else {
-				scopesMatcher = jose.ScopesAnyMatcher
-			}
-		} else {
-			scopesMatcher = jose.ScopesDefaultMatcher
-		}
+		accessChecker := jose.NewAccessChecker(signatureConfig)
 
 		logger.Info("JOSE: validator enabled for the endpoint", cfg.Endpoint)
 
 		return func(w http.ResponseWriter, r *http.Request) {
-			token, err := validator.ValidateRequest(r)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusUnauthorized)
-				return
-			}
-
-			claims := map[string]interface{}{}
-			err = validator.Claims(r, token, &claims)
+			claims, err := validator.ValidateClaims(r)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusUnauthorized)
 				return
@@ -170,12 +156,12 @@ func TokenSignatureValidator(hf smux.HandlerFactory, logger logging.Logger, reje
 				return
 			}
 
-			if !aclCheck(signatureConfig.RolesKey, claims, signatureConfig.Roles) {
+			if !accessChecker.HasRoles(claims) {
 				http.Error(w, "", http.StatusForbidden)
 				return
 			}
 
-			if !scopesMatcher(signatureConfig.ScopesKey, claims, signatureConfig.Scopes) {
+			if !accessChecker.HasScopes(claims) {
 				http.Error(w, "", http.StatusForbidden)
 				return
 			}
@@ -187,6 +173,9 @@ func TokenSignatureValidator(hf smux.HandlerFactory, logger logging.Logger, reje
 	}
 }
 
+// validators keeps the validators shared by the endpoints with the same validator config
+var validators = jose.NewValidatorRegistry(FromCookie)
+
 func FromCookie(key string) func(r *http.Request) (*jwt.JSONWebToken, error) {
 	if key == "" {
 		key = "access_token"
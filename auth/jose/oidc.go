@@ -0,0 +1,309 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jose
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/auth0-community/go-auth0"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultOIDCRefreshInterval is the time between two fetches of the discovery document
+	DefaultOIDCRefreshInterval = time.Hour
+	// DefaultOIDCDiscoveryTimeout is the max duration of the fetches of the discovery document
+	DefaultOIDCDiscoveryTimeout = 10 * time.Second
+	oidcDiscoveryPath           = "/.well-known/openid-configuration"
+)
+
+var (
+	ErrOIDCIssuerMismatch = errors.New("JOSE: the discovered issuer does not match the oidc issuer")
+	ErrNoOIDCAlgorithm    = errors.New("JOSE: the oidc issuer does not support any known algorithm")
+	errOIDCPending        = errors.New("JOSE: the oidc discovery is in progress")
+	errOIDCClosed         = errors.New("JOSE: the oidc validator is closed")
+)
+
+// OIDCConfiguration is the part of the OpenID Connect discovery document used by the validator
+type OIDCConfiguration struct {
+	Issuer     string   `json:"issuer"`
+	JWKSURI    string   `json:"jwks_uri"`
+	Algorithms []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// DiscoverOIDC fetches the discovery document of the given issuer, using the TLS options of the
+// secret provider config
+func DiscoverOIDC(issuer string, cfg SecretProviderConfig) (*OIDCConfiguration, error) {
+	client, err := newOIDCClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return discoverOIDC(client, issuer)
+}
+
+func newOIDCClient(cfg SecretProviderConfig) (*http.Client, error) {
+	opts, err := newJWKClientOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	client := opts.Client
+	client.Timeout = DefaultOIDCDiscoveryTimeout
+	return client, nil
+}
+
+func discoverOIDC(client *http.Client, issuer string) (*OIDCConfiguration, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+	resp, err := client.Get(issuer + oidcDiscoveryPath)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JOSE: oidc discovery endpoint returned status %d", resp.StatusCode)
+	}
+
+	res := new(OIDCConfiguration)
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(res.Issuer, "/") != issuer {
+		return nil, ErrOIDCIssuerMismatch
+	}
+	return res, nil
+}
+
+// oidcValidator validates the tokens with the jwk_url, the issuer and the algorithms published by
+// the oidc issuer. The options defined in the config take precedence over the discovered ones. The
+// discovery document is fetched again in the background every refresh interval, and the validator
+// is only rebuilt if the document changes, so the cached keys survive the refreshes. The key cacher
+// is kept while the jwks_uri does not change, and unregistered once it is replaced. The tokens are
+// rejected until a discovery succeeds
+type oidcValidator struct {
+	scfg     SignatureConfig
+	ef       ExtractorFactory
+	client   *http.Client
+	interval time.Duration
+
+	mu          *sync.RWMutex
+	validator   ClaimsValidator
+	current     *OIDCConfiguration
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	err         error
+	refreshing  int32
+
+	// provider is the secret provider of the validator, for the jwks_uri. It is replaced by the
+	// refreshes and released by close, so both hold providerMu
+	providerMu  *sync.Mutex
+	provider    *JWKClient
+	providerURI string
+	closed      bool
+}
+
+func newOIDCValidator(scfg *SignatureConfig, ef ExtractorFactory) (*oidcValidator, error) {
+	decodedFs, err := DecodeFingerprints(scfg.Fingerprints)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newOIDCClient(SecretProviderConfig{
+		Fingerprints:  decodedFs,
+		Cs:            scfg.CipherSuites,
+		LocalCA:       scfg.LocalCA,
+		AllowInsecure: scfg.DisableJWKSecurity,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	interval := time.Duration(scfg.OIDCRefreshInterval) * time.Second
+	if interval <= 0 {
+		interval = DefaultOIDCRefreshInterval
+	}
+	v := &oidcValidator{
+		scfg:       *scfg,
+		ef:         ef,
+		client:     client,
+		interval:   interval,
+		mu:         new(sync.RWMutex),
+		providerMu: new(sync.Mutex),
+	}
+	// the errors of the first discovery are reported by the validations until one succeeds
+	v.tryRefresh()
+	return v, nil
+}
+
+func (v *oidcValidator) ValidateClaims(r *http.Request) (map[string]interface{}, error) {
+	v.mu.RLock()
+	validator, fetchedAt, attemptedAt := v.validator, v.fetchedAt, v.attemptedAt
+	v.mu.RUnlock()
+
+	t := now()
+	retry := t.Sub(attemptedAt) >= DefaultMinRefreshInterval
+	if validator == nil {
+		if retry {
+			v.tryRefresh()
+		}
+		v.mu.RLock()
+		validator, err := v.validator, v.err
+		v.mu.RUnlock()
+		if validator == nil {
+			return nil, fmt.Errorf("JOSE: oidc discovery: %v", err)
+		}
+		return validator.ValidateClaims(r)
+	}
+
+	if retry && t.Sub(fetchedAt) >= v.interval && atomic.CompareAndSwapInt32(&v.refreshing, 0, 1) {
+		go func() {
+			v.refresh()
+			atomic.StoreInt32(&v.refreshing, 0)
+		}()
+	}
+	return validator.ValidateClaims(r)
+}
+
+// tryRefresh refreshes the validator unless another refresh is in progress
+func (v *oidcValidator) tryRefresh() {
+	if !atomic.CompareAndSwapInt32(&v.refreshing, 0, 1) {
+		v.mu.Lock()
+		if v.err == nil {
+			v.err = errOIDCPending
+		}
+		v.mu.Unlock()
+		return
+	}
+	v.refresh()
+	atomic.StoreInt32(&v.refreshing, 0)
+}
+
+func (v *oidcValidator) refresh() {
+	conf, err := discoverOIDC(v.client, v.scfg.OIDCIssuer)
+
+	v.mu.RLock()
+	changed := !reflect.DeepEqual(conf, v.current)
+	v.mu.RUnlock()
+
+	var validator ClaimsValidator
+	if err == nil && changed {
+		validator, err = v.newValidator(conf)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.attemptedAt = now()
+	if err != nil {
+		v.err = err
+		return
+	}
+	if validator != nil {
+		v.validator = validator
+		v.current = conf
+	}
+	v.fetchedAt = v.attemptedAt
+	v.err = nil
+}
+
+func (v *oidcValidator) newValidator(conf *OIDCConfiguration) (ClaimsValidator, error) {
+	uri := v.scfg.URI
+	if uri == "" {
+		uri = conf.JWKSURI
+	}
+	if !strings.HasPrefix(uri, "https://") && !v.scfg.DisableJWKSecurity {
+		return nil, ErrInsecureJWKSource
+	}
+
+	var algs []string
+	if v.scfg.Alg != "" {
+		algs = []string{v.scfg.Alg}
+	} else {
+		for _, alg := range conf.Algorithms {
+			if _, ok := supportedAlgorithms[alg]; ok {
+				algs = append(algs, alg)
+			}
+		}
+	}
+	if len(algs) == 0 {
+		return nil, ErrNoOIDCAlgorithm
+	}
+
+	issuer := v.scfg.Issuer
+	if issuer == "" {
+		issuer = conf.Issuer
+	}
+	cfg := v.scfg
+	cfg.OIDCIssuer = ""
+	cfg.Issuers = []IssuerConfig{
+		{
+			Issuer:              issuer,
+			URI:                 uri,
+			Algorithms:          algs,
+			CacheEnabled:        v.scfg.CacheEnabled,
+			CacheDuration:       v.scfg.CacheDuration,
+			CipherSuites:        v.scfg.CipherSuites,
+			DisableJWKSecurity:  v.scfg.DisableJWKSecurity,
+			Fingerprints:        v.scfg.Fingerprints,
+			LocalCA:             v.scfg.LocalCA,
+			KeyIdentifyStrategy: v.scfg.KeyIdentifyStrategy,
+		},
+	}
+
+	v.providerMu.Lock()
+	defer v.providerMu.Unlock()
+	if v.closed {
+		return nil, errOIDCClosed
+	}
+
+	var created *JWKClient
+	validator, err := newMultiIssuerValidatorWithProviders(&cfg, v.ef, func(icfg *SignatureConfig, te auth0.RequestTokenExtractor) (*JWKClient, error) {
+		if v.provider != nil && v.providerURI == uri {
+			return v.provider, nil
+		}
+		sp, err := newSecretProvider(icfg, te)
+		created = sp
+		return sp, err
+	})
+	if err != nil {
+		closeSecretProvider(created)
+		return nil, err
+	}
+	if created != nil {
+		closeSecretProvider(v.provider)
+		v.provider, v.providerURI = created, uri
+	}
+	return validator, nil
+}
+
+// close releases the key cacher of the validator. The later refreshes keep the current validator
+func (v *oidcValidator) close() {
+	v.providerMu.Lock()
+	defer v.providerMu.Unlock()
+	v.closed = true
+	closeSecretProvider(v.provider)
+	v.provider, v.providerURI = nil, ""
+}
+
+// closeSecretProvider unregisters the key cacher of the provider, if any
+func closeSecretProvider(sp *JWKClient) {
+	if sp != nil && sp.refresher != nil {
+		unregisterKeyCacherMetrics(sp.refresher)
+	}
+}
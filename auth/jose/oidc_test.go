@@ -0,0 +1,256 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jose
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"github.com/starvn/turbo/config"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetSignatureConfig_oidc(t *testing.T) {
+	cfg := &config.EndpointConfig{
+		ExtraConfig: config.ExtraConfig{
+			ValidatorNamespace: map[string]interface{}{
+				"oidc_issuer":           "https://idp.example.com",
+				"oidc_refresh_interval": 60,
+			},
+		},
+	}
+	scfg, err := GetSignatureConfig(cfg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if scfg.OIDCIssuer != "https://idp.example.com" || scfg.OIDCRefreshInterval != 60 {
+		t.Errorf("unexpected config: %+v", scfg)
+	}
+
+	cfg.ExtraConfig[ValidatorNamespace].(map[string]interface{})["oidc_issuer"] = "http://idp.example.com"
+	if _, err := GetSignatureConfig(cfg); err != ErrInsecureJWKSource {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestDiscoverOIDC(t *testing.T) {
+	var issuer string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != oidcDiscoveryPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(OIDCConfiguration{Issuer: issuer, JWKSURI: issuer + "/jwks", Algorithms: []string{"RS256"}})
+	}))
+	defer server.Close()
+	issuer = server.URL
+
+	if _, err := DiscoverOIDC(server.URL, SecretProviderConfig{}); err == nil {
+		t.Error("the certificate of the issuer should not be trusted")
+	}
+
+	localCA := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(localCA, data, 0600); err != nil {
+		t.Error(err)
+		return
+	}
+	conf, err := DiscoverOIDC(server.URL+"/", SecretProviderConfig{LocalCA: localCA})
+	if err != nil {
+		t.Errorf("the local ca should be used: %v", err)
+		return
+	}
+	if conf.Issuer != server.URL || conf.JWKSURI != server.URL+"/jwks" || len(conf.Algorithms) != 1 {
+		t.Errorf("unexpected configuration: %+v", conf)
+	}
+
+	issuer = "https://other.example.com"
+	if _, err := DiscoverOIDC(server.URL, SecretProviderConfig{LocalCA: localCA}); err != ErrOIDCIssuerMismatch {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNewClaimsValidator_oidc(t *testing.T) {
+	defer func() { now = time.Now }()
+	current := time.Now()
+	mu := new(sync.Mutex)
+	now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return current
+	}
+	advance := func(d time.Duration) {
+		mu.Lock()
+		current = current.Add(d)
+		mu.Unlock()
+	}
+
+	discoveries := uint64(0)
+	available := int32(0)
+	jwks := jwkEndpoint("symmetric")
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case oidcDiscoveryPath:
+			atomic.AddUint64(&discoveries, 1)
+			if atomic.LoadInt32(&available) == 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(OIDCConfiguration{
+				Issuer:     server.URL,
+				JWKSURI:    server.URL + "/jwks",
+				Algorithms: []string{"HS256", "unknown"},
+			})
+		case "/jwks":
+			jwks(w, r)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	v, err := NewClaimsValidator(&SignatureConfig{
+		OIDCIssuer:          server.URL,
+		OIDCRefreshInterval: 60,
+		Audience:            []string{"api"},
+		DisableJWKSecurity:  true,
+	}, nil, nopExtractor)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	newRequest := func(token string) *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return req
+	}
+	token := signToken(t, server.URL+"/jwks", "sim2", map[string]interface{}{"iss": server.URL, "sub": "alice"})
+
+	if _, err := v.ValidateClaims(newRequest(token)); err == nil {
+		t.Error("the tokens should be rejected until the discovery succeeds")
+	}
+	atomic.StoreInt32(&available, 1)
+	if _, err := v.ValidateClaims(newRequest(token)); err == nil {
+		t.Error("the discovery should not be retried before the min refresh interval")
+	}
+
+	advance(DefaultMinRefreshInterval)
+	claims, err := v.ValidateClaims(newRequest(token))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if claims["sub"] != "alice" {
+		t.Errorf("unexpected claims: %v", claims)
+	}
+	other := signToken(t, server.URL+"/jwks", "sim2", map[string]interface{}{"iss": "https://other.example.com"})
+	if _, err := v.ValidateClaims(newRequest(other)); err != ErrUnknownIssuer {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if n := atomic.LoadUint64(&discoveries); n != 2 {
+		t.Errorf("unexpected discoveries: %d", n)
+	}
+
+	validator := v.(*oidcValidator).validator
+	advance(time.Minute)
+	if _, err := v.ValidateClaims(newRequest(token)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadUint64(&discoveries) < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := atomic.LoadUint64(&discoveries); n != 3 {
+		t.Errorf("the discovery document should be fetched again: %d", n)
+	}
+	for atomic.LoadInt32(&v.(*oidcValidator).refreshing) == 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	v.(*oidcValidator).mu.RLock()
+	same := v.(*oidcValidator).validator == validator
+	v.(*oidcValidator).mu.RUnlock()
+	if !same {
+		t.Error("the validator should be kept if the discovery document does not change")
+	}
+}
+
+func TestOIDCValidator_keyCacher(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(jwkEndpoint("symmetric")))
+	defer server.Close()
+
+	v := &oidcValidator{
+		scfg:       SignatureConfig{CacheEnabled: true, DisableJWKSecurity: true},
+		ef:         nopExtractor,
+		mu:         new(sync.RWMutex),
+		providerMu: new(sync.Mutex),
+	}
+	registered := func(sp *JWKClient) bool {
+		keyCacherMetricsMu.Lock()
+		defer keyCacherMetricsMu.Unlock()
+		return keyCachers[sp.refresher.name] == sp.refresher
+	}
+
+	if _, err := v.newValidator(&OIDCConfiguration{Issuer: server.URL, JWKSURI: server.URL + "/jwks", Algorithms: []string{"HS256"}}); err != nil {
+		t.Error(err)
+		return
+	}
+	first := v.provider
+	if first == nil || !registered(first) {
+		t.Error("the key cacher should be registered")
+		return
+	}
+
+	if _, err := v.newValidator(&OIDCConfiguration{Issuer: server.URL, JWKSURI: server.URL + "/jwks", Algorithms: []string{"HS256", "HS512"}}); err != nil {
+		t.Error(err)
+		return
+	}
+	if v.provider != first || !registered(first) {
+		t.Error("the key cacher should be reused while the jwks_uri does not change")
+	}
+
+	if _, err := v.newValidator(&OIDCConfiguration{Issuer: server.URL, JWKSURI: server.URL + "/rotated", Algorithms: []string{"HS256"}}); err != nil {
+		t.Error(err)
+		return
+	}
+	if v.provider == first || !registered(v.provider) {
+		t.Error("a new key cacher should be registered for the new jwks_uri")
+	}
+	if registered(first) {
+		t.Error("the replaced key cacher should be unregistered")
+	}
+
+	last := v.provider
+	v.close()
+	if registered(last) {
+		t.Error("the key cacher should be unregistered once the validator is closed")
+	}
+	if _, err := v.newValidator(&OIDCConfiguration{Issuer: server.URL, JWKSURI: server.URL + "/jwks", Algorithms: []string{"HS256"}}); err != errOIDCClosed {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if v.provider != nil {
+		t.Error("the closed validator should not create key cachers")
+	}
+}
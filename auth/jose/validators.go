@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jose
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// ValidatorRegistry shares the claims validators between the endpoints with the same validator
+// config. The validators are bound to the context of the service creating them, so a new router
+// gets its own validators and the ones of the previous router are released, along with their key
+// cachers, once its context is done
+type ValidatorRegistry struct {
+	ef         ExtractorFactory
+	mu         *sync.Mutex
+	validators map[validatorKey]ClaimsValidator
+}
+
+type validatorKey struct {
+	ctx context.Context
+	cfg string
+}
+
+// NewValidatorRegistry returns a registry creating the validators with the given extractor factory
+func NewValidatorRegistry(ef ExtractorFactory) *ValidatorRegistry {
+	return &ValidatorRegistry{
+		ef:         ef,
+		mu:         new(sync.Mutex),
+		validators: map[validatorKey]ClaimsValidator{},
+	}
+}
+
+// Get returns the validator for the configs within the context, creating it if needed
+func (r *ValidatorRegistry) Get(ctx context.Context, scfg *SignatureConfig, icfg *IntrospectionConfig) (ClaimsValidator, error) {
+	b, err := json.Marshal([]interface{}{scfg, icfg})
+	if err != nil {
+		return nil, err
+	}
+	k := validatorKey{ctx: ctx, cfg: string(b)}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if v, ok := r.validators[k]; ok {
+		return v, nil
+	}
+	v, err := NewClaimsValidator(scfg, icfg, r.ef)
+	if err != nil {
+		return nil, err
+	}
+	r.validators[k] = v
+	if done := ctx.Done(); done != nil {
+		go func() {
+			<-done
+			closeValidator(v)
+			r.mu.Lock()
+			delete(r.validators, k)
+			r.mu.Unlock()
+		}()
+	}
+	return v, nil
+}
+
+// closeValidator releases the key cachers of the validator, if any
+func closeValidator(v ClaimsValidator) {
+	if c, ok := v.(interface{ close() }); ok {
+		c.close()
+	}
+}
+
+// Len returns the number of validators in the registry
+func (r *ValidatorRegistry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.validators)
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jose
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestValidatorRegistry(t *testing.T) {
+	r := NewValidatorRegistry(nopExtractor)
+	scfg := &SignatureConfig{Alg: "HS256", URI: "http://localhost:1/jwk", DisableJWKSecurity: true, CacheEnabled: true}
+	other := &SignatureConfig{Alg: "HS256", URI: "http://localhost:1/other", DisableJWKSecurity: true}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	v1, err := r.Get(ctx, scfg, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if v, _ := r.Get(ctx, &SignatureConfig{Alg: "HS256", URI: "http://localhost:1/jwk", DisableJWKSecurity: true, CacheEnabled: true}, nil); v != v1 {
+		t.Error("the endpoints with the same config should share the validator")
+	}
+	if v, _ := r.Get(ctx, other, nil); v == v1 {
+		t.Error("the endpoints with different configs should not share the validator")
+	}
+	if v, _ := r.Get(context.Background(), scfg, nil); v == v1 {
+		t.Error("the endpoints of different contexts should not share the validator")
+	}
+	if _, err := r.Get(ctx, &SignatureConfig{Alg: "random"}, nil); err == nil {
+		t.Error("expecting an error")
+	}
+	if n := r.Len(); n != 3 {
+		t.Errorf("unexpected validators: %d", n)
+	}
+	refresher := v1.(jwtClaimsValidator).provider.refresher
+	registered := func() bool {
+		keyCacherMetricsMu.Lock()
+		defer keyCacherMetricsMu.Unlock()
+		return keyCachers[refresher.name] == refresher
+	}
+	if !registered() {
+		t.Error("the key cacher should be registered")
+	}
+
+	cancel()
+	for i := 0; i < 100 && r.Len() != 1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := r.Len(); n != 1 {
+		t.Errorf("the validators of the context should be released once it is done: %d", n)
+	}
+	if registered() {
+		t.Error("the key cacher of the released validator should be unregistered")
+	}
+}
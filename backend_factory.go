@@ -25,8 +25,12 @@ import (
 	lua "github.com/starvn/sonic/modifier/interpreter/proxy"
 	"github.com/starvn/sonic/modifier/martian"
 	cb "github.com/starvn/sonic/qos/circuitbreaker/gobreaker/proxy"
+	coalescing "github.com/starvn/sonic/qos/coalescing/proxy"
+	concurrency "github.com/starvn/sonic/qos/concurrency/proxy"
+	hedging "github.com/starvn/sonic/qos/hedging/proxy"
 	"github.com/starvn/sonic/qos/httpcache"
 	juju "github.com/starvn/sonic/qos/ratelimit/juju/proxy"
+	retry "github.com/starvn/sonic/qos/retry/proxy"
 	metrics "github.com/starvn/sonic/telemetry/metrics/gin"
 	"github.com/starvn/sonic/telemetry/opencensus"
 	"github.com/starvn/sonic/validation/explang"
@@ -47,7 +51,7 @@ func NewBackendFactoryWithContext(ctx context.Context, logger log.Logger, metric
 		if _, ok := cfg.ExtraConfig[oauth2client.Namespace]; ok {
 			clientFactory = oauth2client.NewHTTPClient(cfg)
 		} else {
-			clientFactory = httpcache.NewHTTPClient(cfg)
+			clientFactory = httpcache.NewHTTPClientWithContext(ctx, cfg, logger, metricCollector.Metrics)
 		}
 		return opencensus.HTTPRequestExecutorFromConfig(clientFactory, cfg)
 	}
@@ -59,8 +63,12 @@ func NewBackendFactoryWithContext(ctx context.Context, logger log.Logger, metric
 	backendFactory = lambda.BackendFactory(logger, backendFactory)
 	backendFactory = explang.BackendFactory(logger, backendFactory)
 	backendFactory = lua.BackendFactory(logger, backendFactory)
-	backendFactory = juju.BackendFactory(backendFactory)
-	backendFactory = cb.BackendFactory(backendFactory, logger)
+	backendFactory = juju.BackendFactoryWithContext(ctx, backendFactory, logger, metricCollector.Metrics)
+	backendFactory = concurrency.BackendFactory(backendFactory, logger, metricCollector.Metrics)
+	backendFactory = cb.BackendFactoryWithContext(ctx, backendFactory, logger, metricCollector.Metrics)
+	backendFactory = retry.BackendFactory(backendFactory, logger, metricCollector.Metrics)
+	backendFactory = hedging.BackendFactory(backendFactory, logger, metricCollector.Metrics)
+	backendFactory = coalescing.BackendFactory(backendFactory, logger, metricCollector.Metrics)
 	backendFactory = metricCollector.BackendFactory("backend", backendFactory)
 	backendFactory = opencensus.BackendFactory(backendFactory)
 	return backendFactory
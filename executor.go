@@ -26,6 +26,8 @@ import (
 	sonicbf "github.com/starvn/go-bloom-filter/sonic"
 	"github.com/starvn/sonic/auth/jose"
 	"github.com/starvn/sonic/backend/pubsub"
+	"github.com/starvn/sonic/qos/circuitbreaker/gobreaker"
+	"github.com/starvn/sonic/qos/httpcache"
 	cors "github.com/starvn/sonic/security/cors/gin"
 	cmd "github.com/starvn/sonic/support/cobra"
 	"github.com/starvn/sonic/support/usage/client"
@@ -51,6 +53,7 @@ import (
 	router "github.com/starvn/turbo/route/gin"
 	serverhttp "github.com/starvn/turbo/transport/http/server"
 	server "github.com/starvn/turbo/transport/http/server/plugin"
+	"go.opencensus.io/stats/view"
 	"io"
 	"net/http"
 	"os"
@@ -86,6 +89,12 @@ type ProxyFactory interface {
 	NewProxyFactory(log.Logger, proxy.BackendFactory, *metrics.Metrics) proxy.Factory
 }
 
+// ContextProxyFactory is implemented by the proxy factories able to bind their caches to the
+// context of the service
+type ContextProxyFactory interface {
+	NewProxyFactoryWithContext(context.Context, log.Logger, proxy.BackendFactory, *metrics.Metrics) proxy.Factory
+}
+
 type BackendFactory interface {
 	NewBackendFactory(context.Context, log.Logger, *metrics.Metrics) proxy.BackendFactory
 }
@@ -94,6 +103,12 @@ type HandlerFactory interface {
 	NewHandlerFactory(log.Logger, *metrics.Metrics, jose.RejecterFactory) router.HandlerFactory
 }
 
+// ContextHandlerFactory is implemented by the handler factories able to bind their middlewares to
+// the context of the service
+type ContextHandlerFactory interface {
+	NewHandlerFactoryWithContext(context.Context, log.Logger, *metrics.Metrics, jose.RejecterFactory) router.HandlerFactory
+}
+
 type LoggerFactory interface {
 	NewLogger(config.ServiceConfig) (log.Logger, io.Writer, error)
 }
@@ -148,16 +163,27 @@ func (e *ExecutorBuilder) NewCmdExecutor(ctx context.Context) cmd.Executor {
 			logger.Warning("[SERVICE: Bloomfilter]", err.Error())
 		}
 
+		var handlerFactory router.HandlerFactory
+		if hf, ok := e.HandlerFactory.(ContextHandlerFactory); ok {
+			handlerFactory = hf.NewHandlerFactoryWithContext(ctx, logger, metricCollector, tokenRejecterFactory)
+		} else {
+			handlerFactory = e.HandlerFactory.NewHandlerFactory(logger, metricCollector, tokenRejecterFactory)
+		}
+
+		backendFactory := e.BackendFactory.NewBackendFactory(ctx, logger, metricCollector)
+		var proxyFactory proxy.Factory
+		if pf, ok := e.ProxyFactory.(ContextProxyFactory); ok {
+			proxyFactory = pf.NewProxyFactoryWithContext(ctx, logger, backendFactory, metricCollector)
+		} else {
+			proxyFactory = e.ProxyFactory.NewProxyFactory(logger, backendFactory, metricCollector)
+		}
+
 		routerFactory := router.NewFactory(router.Config{
-			Engine: e.EngineFactory.NewEngine(cfg, logger, gelfWriter),
-			ProxyFactory: e.ProxyFactory.NewProxyFactory(
-				logger,
-				e.BackendFactory.NewBackendFactory(ctx, logger, metricCollector),
-				metricCollector,
-			),
+			Engine:         e.EngineFactory.NewEngine(cfg, logger, gelfWriter),
+			ProxyFactory:   proxyFactory,
 			Middlewares:    e.Middlewares,
 			Logger:         logger,
-			HandlerFactory: e.HandlerFactory.NewHandlerFactory(logger, metricCollector, tokenRejecterFactory),
+			HandlerFactory: handlerFactory,
 			RunServer:      router.RunServerFunc(e.RunServerFactory.NewRunServer(logger, serverhttp.RunServer)),
 		})
 
@@ -274,7 +300,7 @@ func (MetricsAndTraces) Register(ctx context.Context, cfg config.ServiceConfig,
 		l.Debug("[SERVICE: InfluxDB] Service correctly registered")
 	}
 
-	if err := opencensus.Register(ctx, cfg, append(opencensus.DefaultViews, pubsub.OpenCensusViews...)...); err != nil {
+	if err := opencensus.Register(ctx, cfg, openCensusViews()...); err != nil {
 		if err != opencensus.ErrNoConfig {
 			l.Warning("[SERVICE: OpenCensus]", err.Error())
 		}
@@ -282,9 +308,27 @@ func (MetricsAndTraces) Register(ctx context.Context, cfg config.ServiceConfig,
 		l.Debug("[SERVICE: OpenCensus] Service correctly registered")
 	}
 
+	if err := gobreaker.RunAdmin(ctx, cfg.ExtraConfig, l); err != nil {
+		if err != gobreaker.ErrNoConfig {
+			l.Warning("[SERVICE: CircuitBreaker]", err.Error())
+		}
+	}
+
+	if err := httpcache.RunAdmin(ctx, cfg.ExtraConfig, l); err != nil {
+		if err != httpcache.ErrNoConfig {
+			l.Warning("[SERVICE: HTTPCache]", err.Error())
+		}
+	}
+
 	return metricCollector
 }
 
+func openCensusViews() []*view.View {
+	views := append([]*view.View{}, opencensus.DefaultViews...)
+	views = append(views, pubsub.OpenCensusViews...)
+	return append(views, gobreaker.OpenCensusViews...)
+}
+
 const (
 	usageDisable = "USAGE_DISABLE"
 	usageDelay   = 5 * time.Second
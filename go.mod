@@ -11,14 +11,17 @@ require (
 	contrib.go.opencensus.io/exporter/zipkin v0.1.2
 	github.com/DataDog/opencensus-go-exporter-datadog v0.0.0-20210527074920-9baf37265e83
 	github.com/Masterminds/sprig v2.22.0+incompatible
-	github.com/alexeyco/binder v0.0.0-20180729220023-2a21303f588a
+	github.com/alecthomas/chroma v0.9.4
+	github.com/alicebob/miniredis/v2 v2.14.1
 	github.com/auth0-community/go-auth0 v1.0.0
 	github.com/aws/aws-sdk-go v1.40.34
 	github.com/catalinc/hashcash v0.0.0-20161205220751-e6bc29ff4de9
 	github.com/clbanning/mxj v1.8.4
 	github.com/eapache/go-resiliency v1.2.0
+	github.com/fatih/color v1.9.0
 	github.com/gin-gonic/gin v1.7.4
 	github.com/go-contrib/uuid v1.2.0
+	github.com/go-redis/redis/v8 v8.11.4
 	github.com/google/cel-go v0.9.0
 	github.com/google/martian v2.1.1-0.20190517191504-25dcb96d9e51+incompatible
 	github.com/gregjones/httpcache v0.0.0-20190611155906-901d90724c79
@@ -40,7 +43,7 @@ require (
 	github.com/streadway/amqp v1.0.0
 	github.com/unrolled/secure v1.0.9
 	github.com/xeipuuv/gojsonschema v1.2.0
-	github.com/yuin/gopher-lua v0.0.0-20190206043414-8bfc7677f583
+	github.com/yuin/gopher-lua v0.0.0-20191220021717-ab39c6098bdb
 	go.opencensus.io v0.23.0
 	gocloud.dev v0.24.0
 	gocloud.dev/pubsub/kafkapubsub v0.24.0
@@ -49,7 +52,7 @@ require (
 	gocloud.dev/secrets/hashivault v0.24.0
 	golang.org/x/net v0.0.0-20210825183410-e898025ed96a
 	golang.org/x/oauth2 v0.0.0-20210819190943-2bc19b11175f
-	golang.org/x/time v0.0.0-20210723032227-1f47c861a9ac
+	golang.org/x/time v0.3.0
 	google.golang.org/grpc v1.40.0
 	gopkg.in/Graylog2/go-gelf.v2 v2.0.0-20191017102106-1550ee647df0
 	gopkg.in/square/go-jose.v2 v2.6.0
@@ -80,7 +83,7 @@ require (
 	github.com/Masterminds/semver v1.5.0 // indirect
 	github.com/PuerkitoBio/goquery v1.5.1 // indirect
 	github.com/Shopify/sarama v1.29.1 // indirect
-	github.com/alecthomas/chroma v0.9.4 // indirect
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
 	github.com/andybalholm/cascadia v1.1.0 // indirect
 	github.com/antlr/antlr4/runtime/Go/antlr v0.0.0-20210826220005-b48c857c3a0e // indirect
 	github.com/aws/aws-sdk-go-v2 v1.9.0 // indirect
@@ -96,14 +99,14 @@ require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cenkalti/backoff/v3 v3.2.2 // indirect
 	github.com/census-instrumentation/opencensus-proto v0.3.0 // indirect
-	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/devigned/tab v0.1.1 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/dimchansky/utfbom v1.1.1 // indirect
 	github.com/dlclark/regexp2 v1.4.0 // indirect
 	github.com/eapache/go-xerial-snappy v0.0.0-20180814174437-776d5712da21 // indirect
 	github.com/eapache/queue v1.1.0 // indirect
-	github.com/fatih/color v1.9.0 // indirect
 	github.com/fsnotify/fsnotify v1.5.1 // indirect
 	github.com/gin-contrib/sse v0.1.0 // indirect
 	github.com/go-kit/log v0.1.0 // indirect
@@ -17,10 +17,13 @@
 package sonic
 
 import (
+	"context"
+	gometrics "github.com/rcrowley/go-metrics"
 	"github.com/starvn/sonic/auth/jose"
 	ginjose "github.com/starvn/sonic/auth/jose/gin"
 	lua "github.com/starvn/sonic/modifier/interpreter/route/gin"
 	juju "github.com/starvn/sonic/qos/ratelimit/juju/router/gin"
+	quota "github.com/starvn/sonic/qos/ratelimit/quota/router/gin"
 	detector "github.com/starvn/sonic/security/detector/gin"
 	metrics "github.com/starvn/sonic/telemetry/metrics/gin"
 	opencensus "github.com/starvn/sonic/telemetry/opencensus/router/gin"
@@ -30,10 +33,16 @@ import (
 )
 
 func NewHandlerFactory(logger log.Logger, metricCollector *metrics.Metrics, rejecter jose.RejecterFactory) router.HandlerFactory {
+	return NewHandlerFactoryWithContext(context.Background(), logger, metricCollector, rejecter)
+}
+
+func NewHandlerFactoryWithContext(ctx context.Context, logger log.Logger, metricCollector *metrics.Metrics, rejecter jose.RejecterFactory) router.HandlerFactory {
 	handlerFactory := router.CustomErrorEndpointHandler(logger, server.DefaultToHTTPError)
-	handlerFactory = juju.NewRateLimiterMw(handlerFactory)
+	handlerFactory = quota.HandlerFactoryWithContext(ctx, logger, handlerFactory)
+	handlerFactory = juju.NewRateLimiterMwWithContext(ctx, logger, handlerFactory, metricCollector.Metrics)
 	handlerFactory = lua.HandlerFactory(logger, handlerFactory)
-	handlerFactory = ginjose.HandlerFactory(handlerFactory, logger, rejecter)
+	jose.RegisterKeyCacherMetrics(gometrics.NewPrefixedChildRegistry(*metricCollector.Registry, "jose."))
+	handlerFactory = ginjose.HandlerFactoryWithContext(ctx, handlerFactory, logger, rejecter)
 	handlerFactory = metricCollector.NewHTTPHandlerFactory(handlerFactory)
 	handlerFactory = opencensus.New(handlerFactory)
 	handlerFactory = detector.New(handlerFactory, logger)
@@ -45,3 +54,7 @@ type handlerFactory struct{}
 func (h handlerFactory) NewHandlerFactory(l log.Logger, m *metrics.Metrics, r jose.RejecterFactory) router.HandlerFactory {
 	return NewHandlerFactory(l, m, r)
 }
+
+func (h handlerFactory) NewHandlerFactoryWithContext(ctx context.Context, l log.Logger, m *metrics.Metrics, r jose.RejecterFactory) router.HandlerFactory {
+	return NewHandlerFactoryWithContext(ctx, l, m, r)
+}
@@ -19,7 +19,7 @@ package interpreter
 import (
 	"errors"
 	"fmt"
-	"github.com/alexeyco/binder"
+	"github.com/starvn/sonic/modifier/interpreter/binder"
 	"strconv"
 	"strings"
 )
@@ -20,7 +20,7 @@ import (
 	"bytes"
 	"context"
 	"errors"
-	"github.com/alexeyco/binder"
+	"github.com/starvn/sonic/modifier/interpreter/binder"
 	"github.com/starvn/turbo/transport/http/server"
 	lua "github.com/yuin/gopher-lua"
 	"io/ioutil"
@@ -20,7 +20,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/alexeyco/binder"
+	"github.com/starvn/sonic/modifier/interpreter/binder"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -45,6 +45,7 @@ func Example_RegisterBackendModule() {
 		SkipOpenLibs:        true,
 		IncludeGoStackTrace: true,
 	})
+	defer bindr.Close()
 
 	registerHTTPRequest(context.Background(), bindr)
 
@@ -19,8 +19,8 @@ package proxy
 import (
 	"context"
 	"errors"
-	"github.com/alexeyco/binder"
 	"github.com/starvn/sonic/modifier/interpreter"
+	"github.com/starvn/sonic/modifier/interpreter/binder"
 	"github.com/starvn/turbo/config"
 	"github.com/starvn/turbo/log"
 	"github.com/starvn/turbo/proxy"
@@ -76,6 +76,7 @@ func New(cfg interpreter.Config, next proxy.Proxy) proxy.Proxy {
 			SkipOpenLibs:        !cfg.AllowOpenLibs,
 			IncludeGoStackTrace: true,
 		})
+		defer b.Close()
 
 		interpreter.RegisterErrors(b)
 		registerHTTPRequest(ctx, b)
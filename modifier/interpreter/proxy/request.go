@@ -19,7 +19,7 @@ package proxy
 import (
 	"bytes"
 	"errors"
-	"github.com/alexeyco/binder"
+	"github.com/starvn/sonic/modifier/interpreter/binder"
 	"github.com/starvn/turbo/proxy"
 	"io/ioutil"
 	"net/url"
@@ -20,7 +20,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
-	"github.com/alexeyco/binder"
+	"github.com/starvn/sonic/modifier/interpreter/binder"
 	"github.com/starvn/turbo/proxy"
 	lua "github.com/yuin/gopher-lua"
 	"io/ioutil"
@@ -19,9 +19,9 @@ package gin
 import (
 	"bytes"
 	"errors"
-	"github.com/alexeyco/binder"
 	"github.com/gin-gonic/gin"
 	"github.com/starvn/sonic/modifier/interpreter"
+	"github.com/starvn/sonic/modifier/interpreter/binder"
 	"github.com/starvn/sonic/modifier/interpreter/route"
 	"github.com/starvn/turbo/config"
 	"github.com/starvn/turbo/log"
@@ -95,6 +95,7 @@ func process(c *gin.Context, cfg interpreter.Config) error {
 		SkipOpenLibs:        !cfg.AllowOpenLibs,
 		IncludeGoStackTrace: true,
 	})
+	defer b.Close()
 
 	interpreter.RegisterErrors(b)
 	registerCtxTable(c, b)
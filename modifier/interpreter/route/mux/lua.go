@@ -19,8 +19,8 @@ package mux
 import (
 	"bytes"
 	"errors"
-	"github.com/alexeyco/binder"
 	"github.com/starvn/sonic/modifier/interpreter"
+	"github.com/starvn/sonic/modifier/interpreter/binder"
 	"github.com/starvn/sonic/modifier/interpreter/route"
 	"github.com/starvn/turbo/config"
 	"github.com/starvn/turbo/log"
@@ -104,6 +104,7 @@ func process(r *http.Request, pe mux.ParamExtractor, cfg interpreter.Config) err
 		SkipOpenLibs:        !cfg.AllowOpenLibs,
 		IncludeGoStackTrace: true,
 	})
+	defer b.Close()
 
 	interpreter.RegisterErrors(b)
 	registerRequestTable(r, pe, b)
@@ -17,18 +17,27 @@
 package sonic
 
 import (
+	"context"
 	lua "github.com/starvn/sonic/modifier/interpreter/proxy"
+	cb "github.com/starvn/sonic/qos/circuitbreaker/gobreaker/proxy"
+	httpcache "github.com/starvn/sonic/qos/httpcache/proxy"
 	metrics "github.com/starvn/sonic/telemetry/metrics/gin"
 	"github.com/starvn/sonic/telemetry/opencensus"
 	"github.com/starvn/sonic/validation/explang"
 	"github.com/starvn/sonic/validation/jsonschema"
+	"github.com/starvn/turbo/discovery"
 	"github.com/starvn/turbo/log"
 	"github.com/starvn/turbo/proxy"
 )
 
 func NewProxyFactory(logger log.Logger, backendFactory proxy.BackendFactory, metricCollector *metrics.Metrics) proxy.Factory {
-	proxyFactory := proxy.NewDefaultFactory(backendFactory, logger)
+	return NewProxyFactoryWithContext(context.Background(), logger, backendFactory, metricCollector)
+}
+
+func NewProxyFactoryWithContext(ctx context.Context, logger log.Logger, backendFactory proxy.BackendFactory, metricCollector *metrics.Metrics) proxy.Factory {
+	proxyFactory := proxy.NewDefaultFactoryWithSubscriber(backendFactory, logger, cb.SubscriberFactory(discovery.GetSubscriber))
 	proxyFactory = proxy.NewShadowFactory(proxyFactory)
+	proxyFactory = httpcache.ProxyFactoryWithContext(ctx, logger, proxyFactory)
 	proxyFactory = jsonschema.ProxyFactory(logger, proxyFactory)
 	proxyFactory = explang.ProxyFactory(logger, proxyFactory)
 	proxyFactory = lua.ProxyFactory(logger, proxyFactory)
@@ -42,3 +51,7 @@ type proxyFactory struct{}
 func (p proxyFactory) NewProxyFactory(logger log.Logger, backendFactory proxy.BackendFactory, metricCollector *metrics.Metrics) proxy.Factory {
 	return NewProxyFactory(logger, backendFactory, metricCollector)
 }
+
+func (p proxyFactory) NewProxyFactoryWithContext(ctx context.Context, logger log.Logger, backendFactory proxy.BackendFactory, metricCollector *metrics.Metrics) proxy.Factory {
+	return NewProxyFactoryWithContext(ctx, logger, backendFactory, metricCollector)
+}
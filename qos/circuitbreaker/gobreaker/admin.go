@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gobreaker
+
+import (
+	"context"
+	"errors"
+	"github.com/starvn/sonic/support/admin"
+	"github.com/starvn/turbo/config"
+	"github.com/starvn/turbo/log"
+	"net/http"
+	"strings"
+)
+
+// AdminPath is the root path of the admin API of the circuit breakers
+const AdminPath = "/__circuitbreakers"
+
+var (
+	ErrNoConfig = errors.New("no admin config defined for the circuit breakers")
+	ErrNoToken  = admin.ErrNoToken
+)
+
+// RunAdmin starts the admin API of the circuit breakers if the service config defines it, with the
+// format {"admin": {"listen_address": ":8091", "token": "secret"}}. The server is shut down when
+// the context is cancelled
+func RunAdmin(ctx context.Context, e config.ExtraConfig, l log.Logger) error {
+	cfg, ok := admin.ConfigGetter(e, Namespace)
+	if !ok {
+		return ErrNoConfig
+	}
+	return admin.Run(ctx, cfg, AdminPath, NewAdminHandler(DefaultRegistry, cfg.Token), l, "[SERVICE: CircuitBreaker]")
+}
+
+// NewAdminHandler returns the handler listing the breakers of the registry (GET /__circuitbreakers)
+// and forcing their state (POST /__circuitbreakers/{open,close,reset}?name=...). The requests must
+// send the token in the Authorization header as a bearer token
+func NewAdminHandler(r *Registry, token string) http.Handler {
+	return admin.Authorize(token, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		action := strings.Trim(strings.TrimPrefix(req.URL.Path, AdminPath), "/")
+		if action == "" {
+			if req.Method != http.MethodGet {
+				http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			admin.WriteJSON(rw, r.List())
+			return
+		}
+
+		if req.Method != http.MethodPost {
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := req.URL.Query().Get("name")
+		b, ok := r.Get(name)
+		if !ok {
+			http.Error(rw, "unknown circuit breaker", http.StatusNotFound)
+			return
+		}
+		switch action {
+		case "open":
+			b.ForceOpen()
+		case "close":
+			b.ForceClose()
+		case "reset":
+			b.Reset()
+		default:
+			http.Error(rw, "unknown action", http.StatusNotFound)
+			return
+		}
+		status := b.Status()
+		status.Name = name
+		admin.WriteJSON(rw, status)
+	}))
+}
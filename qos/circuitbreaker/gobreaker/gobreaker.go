@@ -18,10 +18,14 @@
 package gobreaker
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/sony/gobreaker"
 	"github.com/starvn/turbo/config"
 	"github.com/starvn/turbo/log"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -33,10 +37,56 @@ type Config struct {
 	Timeout         int
 	MaxErrors       int
 	LogStatusChange bool
+	// FailureStatusCodes are the status codes of the responses counted as failures, even if the
+	// response was decoded. None by default
+	FailureStatusCodes []int
+	// FailureRatio, when set, trips the breaker if the ratio of failures is over it once there are
+	// MinRequests results in the interval (DefaultMinRequests if not set), instead of checking the
+	// consecutive failures
+	FailureRatio float64
+	MinRequests  int
+	// ExcludeClientCancellation prevents the requests cancelled by the client from being counted
+	// at all, since they say nothing about the health of the backend
+	ExcludeClientCancellation bool
+	// Fallback defines the response returned while the breaker rejects the requests
+	Fallback *FallbackConfig
+	// PerHost tracks a breaker for every host of the backend, ejecting the unhealthy ones from the
+	// balancer. The Timeout is the first ejection time, doubled on every consecutive ejection up
+	// to MaxEjectionTime
+	PerHost         bool
+	MaxEjectionTime int
 }
 
+// FallbackConfig defines the fallback response of a backend with an open circuit. The last successful
+// response takes precedence over the static one, and the degraded flag is added to both of them
+type FallbackConfig struct {
+	Static       map[string]interface{}
+	LastResponse bool
+	DegradedKey  string
+	// KeyHeaders are the request headers identifying the client, so the last responses are not
+	// shared between users. DefaultFallbackKeyHeaders if not set. The last responses of the
+	// requests without any of them are not kept, so the endpoint must forward them in its
+	// headers_to_pass. An empty list shares the last responses between all the clients
+	KeyHeaders []string
+}
+
+// DefaultFallbackKeyHeaders are the headers added to the key of the last responses if the config
+// does not define them
+var DefaultFallbackKeyHeaders = []string{"Authorization", "Cookie"}
+
 var ZeroCfg = Config{}
 
+// IsZero reports if the config is the ZeroCfg
+func (c Config) IsZero() bool {
+	return c.Name == "" && c.Interval == 0 && c.Timeout == 0 && c.MaxErrors == 0 && !c.LogStatusChange &&
+		c.FailureStatusCodes == nil && c.FailureRatio == 0 && c.MinRequests == 0 && !c.ExcludeClientCancellation &&
+		c.Fallback == nil && !c.PerHost && c.MaxEjectionTime == 0
+}
+
+// DefaultMinRequests is the number of results required to evaluate the failure ratio if the config
+// does not define it
+const DefaultMinRequests = 10
+
 func ConfigGetter(e config.ExtraConfig) interface{} {
 	v, ok := e[Namespace]
 	if !ok {
@@ -79,24 +129,169 @@ func ConfigGetter(e config.ExtraConfig) interface{} {
 	value, ok := tmp["log_status_change"].(bool)
 	cfg.LogStatusChange = ok && value
 
+	if v, ok := tmp["failure_status_codes"].([]interface{}); ok {
+		cfg.FailureStatusCodes = parseStatusCodes(v)
+	}
+	if v, ok := tmp["failure_ratio"]; ok {
+		switch i := v.(type) {
+		case int:
+			cfg.FailureRatio = float64(i)
+		case float64:
+			cfg.FailureRatio = i
+		}
+	}
+	if v, ok := tmp["min_requests"]; ok {
+		switch i := v.(type) {
+		case int:
+			cfg.MinRequests = i
+		case float64:
+			cfg.MinRequests = int(i)
+		}
+	}
+	value, ok = tmp["exclude_client_cancellation"].(bool)
+	cfg.ExcludeClientCancellation = ok && value
+
+	value, ok = tmp["per_host"].(bool)
+	cfg.PerHost = ok && value
+	if v, ok := tmp["max_ejection_time"]; ok {
+		switch i := v.(type) {
+		case int:
+			cfg.MaxEjectionTime = i
+		case float64:
+			cfg.MaxEjectionTime = int(i)
+		}
+	}
+
+	if v, ok := tmp["fallback"].(map[string]interface{}); ok {
+		fallback := FallbackConfig{}
+		fallback.Static, _ = v["static"].(map[string]interface{})
+		value, ok = v["last_response"].(bool)
+		fallback.LastResponse = ok && value
+		if key, ok := v["degraded_key"].(string); ok {
+			fallback.DegradedKey = key
+		}
+		fallback.KeyHeaders = DefaultFallbackKeyHeaders
+		if headers, ok := v["key_headers"].([]interface{}); ok {
+			fallback.KeyHeaders = make([]string, 0, len(headers))
+			for _, h := range headers {
+				if h, ok := h.(string); ok {
+					fallback.KeyHeaders = append(fallback.KeyHeaders, h)
+				}
+			}
+		}
+		cfg.Fallback = &fallback
+	}
+
 	return cfg
 }
 
+// parseStatusCodes accepts both single status codes (503) and classes of them ("5xx")
+func parseStatusCodes(values []interface{}) []int {
+	codes := []int{}
+	for _, v := range values {
+		switch code := v.(type) {
+		case int:
+			codes = append(codes, code)
+		case float64:
+			codes = append(codes, int(code))
+		case string:
+			code = strings.ToLower(strings.TrimSpace(code))
+			if len(code) == 3 && strings.HasSuffix(code, "xx") {
+				if class, err := strconv.Atoi(code[:1]); err == nil {
+					codes = append(codes, statusCodeClass(class)...)
+				}
+				continue
+			}
+			if i, err := strconv.Atoi(code); err == nil {
+				codes = append(codes, i)
+			}
+		}
+	}
+	return codes
+}
+
+func statusCodeClass(class int) []int {
+	codes := make([]int, 100)
+	for i := range codes {
+		codes[i] = class*100 + i
+	}
+	return codes
+}
+
+// StatusCodeError is reported to the circuit breaker when the response of the backend has one of
+// the failure status codes
+type StatusCodeError struct {
+	Code int
+}
+
+func (e StatusCodeError) Error() string {
+	return fmt.Sprintf("the backend returned a failure status code: %d", e.Code)
+}
+
+// NewStatusClassifier returns a function reporting if the status code is a failure for the given config
+func NewStatusClassifier(cfg Config) func(int) bool {
+	codes := make(map[int]struct{}, len(cfg.FailureStatusCodes))
+	for _, c := range cfg.FailureStatusCodes {
+		codes[c] = struct{}{}
+	}
+	return func(code int) bool {
+		_, ok := codes[code]
+		return ok
+	}
+}
+
+// NewReadyToTrip returns the tripping condition for the given config
+func NewReadyToTrip(cfg Config) func(gobreaker.Counts) bool {
+	if cfg.FailureRatio > 0 {
+		minRequests := cfg.MinRequests
+		if minRequests <= 0 {
+			minRequests = DefaultMinRequests
+		}
+		return func(counts gobreaker.Counts) bool {
+			// the excluded requests are counted by the breaker, but they have no result
+			results := counts.TotalSuccesses + counts.TotalFailures
+			if results == 0 || results < uint32(minRequests) {
+				return false
+			}
+			return float64(counts.TotalFailures)/float64(results) > cfg.FailureRatio
+		}
+	}
+	return func(counts gobreaker.Counts) bool {
+		return counts.ConsecutiveFailures > uint32(cfg.MaxErrors)
+	}
+}
+
+// NewIsExcluded returns the function deciding if the error returned by the backend must not be
+// reported to the breaker. Client cancellations are not failures of the backend, so they can be excluded
+func NewIsExcluded(cfg Config) func(error) bool {
+	return func(err error) bool {
+		return err != nil && cfg.ExcludeClientCancellation && errors.Is(err, context.Canceled)
+	}
+}
+
+// NewCircuitBreaker returns a plain breaker for the config. It reports every error as a failure, so
+// only the Breaker skips the excluded ones
 func NewCircuitBreaker(cfg Config, logger log.Logger) *gobreaker.CircuitBreaker {
+	return gobreaker.NewCircuitBreaker(newSettings(cfg, logger, nil))
+}
+
+func newSettings(cfg Config, logger log.Logger, onStateChange func(string, gobreaker.State, gobreaker.State)) gobreaker.Settings {
 	settings := gobreaker.Settings{
-		Name:     cfg.Name,
-		Interval: time.Duration(cfg.Interval) * time.Second,
-		Timeout:  time.Duration(cfg.Timeout) * time.Second,
-		ReadyToTrip: func(counts gobreaker.Counts) bool {
-			return counts.ConsecutiveFailures > uint32(cfg.MaxErrors)
-		},
+		Name:          cfg.Name,
+		Interval:      time.Duration(cfg.Interval) * time.Second,
+		Timeout:       time.Duration(cfg.Timeout) * time.Second,
+		ReadyToTrip:   NewReadyToTrip(cfg),
+		OnStateChange: onStateChange,
 	}
 
 	if cfg.LogStatusChange {
 		settings.OnStateChange = func(name string, from gobreaker.State, to gobreaker.State) {
 			logger.Warning(fmt.Sprintf("[CB] Circuit circuitbreaker named '%s' went from '%s' to '%s'", name, from.String(), to.String()))
+			if onStateChange != nil {
+				onStateChange(name, from, to)
+			}
 		}
 	}
 
-	return gobreaker.NewCircuitBreaker(settings)
+	return settings
 }
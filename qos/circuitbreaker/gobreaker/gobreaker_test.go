@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gobreaker
+
+import (
+	"encoding/json"
+	"github.com/sony/gobreaker"
+	"github.com/starvn/turbo/config"
+	"testing"
+)
+
+func TestConfigGetter(t *testing.T) {
+	serializedCfg := []byte(`{
+		"github.com/starvn/sonic/qos/circuitbreaker/gobreaker": {
+			"interval": 60,
+			"timeout": 10,
+			"failure_ratio": 0.5,
+			"min_requests": 20,
+			"failure_status_codes": ["5xx", 429, "408"],
+			"exclude_client_cancellation": true
+		}
+	}`)
+	var dat config.ExtraConfig
+	if err := json.Unmarshal(serializedCfg, &dat); err != nil {
+		t.Error(err.Error())
+	}
+	cfg := ConfigGetter(dat).(Config)
+	if cfg.Interval != 60 || cfg.Timeout != 10 || cfg.FailureRatio != 0.5 || cfg.MinRequests != 20 || !cfg.ExcludeClientCancellation {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+	if len(cfg.FailureStatusCodes) != 102 {
+		t.Errorf("unexpected status codes: %v", cfg.FailureStatusCodes)
+	}
+	isFailure := NewStatusClassifier(cfg)
+	for _, code := range []int{500, 503, 599, 429, 408} {
+		if !isFailure(code) {
+			t.Errorf("%d should be a failure", code)
+		}
+	}
+	for _, code := range []int{200, 404, 600} {
+		if isFailure(code) {
+			t.Errorf("%d should not be a failure", code)
+		}
+	}
+}
+
+func TestConfigGetter_noStatusCodes(t *testing.T) {
+	cfg := ConfigGetter(config.ExtraConfig{Namespace: map[string]interface{}{"max_errors": 1.0}}).(Config)
+	if isFailure := NewStatusClassifier(cfg); isFailure(502) || isFailure(429) {
+		t.Errorf("the status codes should be opt-in: %v", cfg.FailureStatusCodes)
+	}
+
+	cfg = ConfigGetter(config.ExtraConfig{Namespace: map[string]interface{}{"failure_status_codes": []interface{}{}}}).(Config)
+	if NewStatusClassifier(cfg)(500) {
+		t.Error("an empty list should disable the status codes")
+	}
+}
+
+func TestNewReadyToTrip_defaultMinRequests(t *testing.T) {
+	readyToTrip := NewReadyToTrip(Config{FailureRatio: 0.5})
+	if readyToTrip(gobreaker.Counts{Requests: 1, TotalFailures: 1}) {
+		t.Error("a single failure should not trip the breaker")
+	}
+	if readyToTrip(gobreaker.Counts{Requests: 20, TotalSuccesses: 1, TotalFailures: 8}) {
+		t.Error("the requests without result should not be taken into account")
+	}
+	if !readyToTrip(gobreaker.Counts{Requests: 10, TotalSuccesses: 4, TotalFailures: 6}) {
+		t.Error("the breaker should trip")
+	}
+}
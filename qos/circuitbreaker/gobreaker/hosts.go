@@ -0,0 +1,203 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gobreaker
+
+import (
+	"github.com/sony/gobreaker"
+	"github.com/starvn/turbo/log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var now = time.Now
+
+// Hosts keeps a breaker for every host of a backend. A host is ejected when its breaker trips and
+// readmitted once the ejection time is over, so the next request probes it: a failure ejects it
+// again for twice the time, while a success restores it
+type Hosts struct {
+	cfg           Config
+	backend       string
+	logger        log.Logger
+	onStateChange func(string, gobreaker.State, gobreaker.State)
+	registry      *Registry
+	baseEjection  time.Duration
+	maxEjection   time.Duration
+	mu            *sync.Mutex
+	hosts         map[string]*host
+}
+
+type host struct {
+	breaker   *Breaker
+	name      string
+	ejections int
+	until     time.Time
+	probing   bool
+}
+
+// NewHosts returns the set of breakers for the hosts of the backend with the given url pattern.
+// The breakers are added to the registry, named after the breaker of the backend and the host
+func NewHosts(cfg Config, backend string, logger log.Logger, registry *Registry, onStateChange func(string, gobreaker.State, gobreaker.State)) *Hosts {
+	if cfg.Name == "" {
+		cfg.Name = backend
+	}
+	base := time.Duration(cfg.Timeout) * time.Second
+	if base <= 0 {
+		base = 60 * time.Second
+	}
+	maxEjection := time.Duration(cfg.MaxEjectionTime) * time.Second
+	if maxEjection < base {
+		maxEjection = 10 * base
+	}
+	return &Hosts{
+		cfg:           cfg,
+		backend:       backend,
+		logger:        logger,
+		onStateChange: onStateChange,
+		registry:      registry,
+		baseEjection:  base,
+		maxEjection:   maxEjection,
+		mu:            new(sync.Mutex),
+		hosts:         map[string]*host{},
+	}
+}
+
+// HostKey returns the scheme and the host of the address, the key used to track the host
+func HostKey(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil || u.Host == "" {
+		return addr
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// Breaker returns the breaker of the host, readmitting it if its ejection time is over
+func (h *Hosts) Breaker(addr string) *Breaker {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hs := h.get(addr)
+	h.readmit(hs, now())
+	return hs.breaker
+}
+
+// Done updates the state of the host with the result of a request, ejecting it if its breaker
+// tripped or if it failed the probe after its readmission
+func (h *Hosts) Done(addr string, failed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hs, ok := h.hosts[addr]
+	if !ok || !hs.until.IsZero() {
+		return
+	}
+	if hs.probing {
+		if failed {
+			h.eject(addr, hs)
+			return
+		}
+		hs.probing = false
+		hs.ejections = 0
+		return
+	}
+	if hs.breaker.State() == gobreaker.StateOpen {
+		h.eject(addr, hs)
+	}
+}
+
+// Filter removes the ejected hosts from the list. All the hosts are returned if none is healthy
+func (h *Hosts) Filter(addrs []string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t := now()
+	res := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		hs, ok := h.hosts[HostKey(addr)]
+		if ok {
+			h.readmit(hs, t)
+			if hs.breaker.State() == gobreaker.StateOpen {
+				continue
+			}
+		}
+		res = append(res, addr)
+	}
+	if len(res) == 0 {
+		return addrs
+	}
+	return res
+}
+
+// Ejected returns the number of hosts currently ejected
+func (h *Hosts) Ejected() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	total := 0
+	for _, hs := range h.hosts {
+		if !hs.until.IsZero() {
+			total++
+		}
+	}
+	return total
+}
+
+// Close unregisters the breakers of the hosts. The hosts are still tracked, but their breakers are
+// not registered anymore
+func (h *Hosts) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.registry == nil {
+		return
+	}
+	for _, hs := range h.hosts {
+		h.registry.Remove(hs.name)
+	}
+	h.registry = nil
+}
+
+func (h *Hosts) get(addr string) *host {
+	hs, ok := h.hosts[addr]
+	if ok {
+		return hs
+	}
+	cfg := h.cfg
+	cfg.Name = h.cfg.Name + "@" + addr
+	hs = &host{breaker: NewBreaker(cfg, h.backend, h.logger, h.onStateChange)}
+	if h.registry != nil {
+		hs.name = h.registry.Add(hs.breaker)
+	}
+	h.hosts[addr] = hs
+	return hs
+}
+
+func (h *Hosts) eject(addr string, hs *host) {
+	hs.ejections++
+	d := h.baseEjection << uint(hs.ejections-1)
+	if d > h.maxEjection || d <= 0 {
+		d = h.maxEjection
+	}
+	hs.until = now().Add(d)
+	hs.probing = false
+	hs.breaker.ForceOpen()
+	h.logger.Warning("[BACKEND: "+h.backend+"][CB]", "Ejecting the host", addr, "for", d.String())
+}
+
+func (h *Hosts) readmit(hs *host, t time.Time) {
+	if hs.until.IsZero() || t.Before(hs.until) {
+		return
+	}
+	hs.until = time.Time{}
+	hs.probing = true
+	hs.breaker.Reset()
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gobreaker
+
+import (
+	"errors"
+	gologging "github.com/op/go-logging"
+	"github.com/sony/gobreaker"
+	"testing"
+	"time"
+)
+
+var errTest = errors.New("test error")
+
+func TestHosts(t *testing.T) {
+	defer func() { now = time.Now }()
+	current := time.Date(2021, time.February, 14, 10, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+
+	r := NewRegistry()
+	hosts := NewHosts(Config{Name: "b", Interval: 60, Timeout: 10, MaxErrors: 1, MaxEjectionTime: 30}, "/foo", gologging.MustGetLogger("gobreaker_test"), r, nil)
+	addrs := []string{"http://a:8080", "http://b:8080/"}
+
+	fail := func(addr string) {
+		hosts.Breaker(addr).Execute(func() (interface{}, error) { return nil, errTest })
+		hosts.Done(addr, true)
+	}
+	assertHosts := func(expected ...string) {
+		res := hosts.Filter(addrs)
+		if len(res) != len(expected) {
+			t.Errorf("unexpected hosts: %v", res)
+			return
+		}
+		for i, h := range expected {
+			if res[i] != h {
+				t.Errorf("unexpected hosts: %v", res)
+			}
+		}
+	}
+
+	fail("http://a:8080")
+	assertHosts(addrs...)
+	fail("http://a:8080")
+	assertHosts("http://b:8080/")
+	if hosts.Ejected() != 1 {
+		t.Errorf("unexpected ejected hosts: %d", hosts.Ejected())
+	}
+	if b, ok := r.Get("b@http://a:8080"); !ok || b.State() != gobreaker.StateOpen {
+		t.Error("the breaker of the host should be registered and open")
+	}
+
+	// the probe fails, so the host is ejected for twice the time
+	current = current.Add(10 * time.Second)
+	assertHosts(addrs...)
+	fail("http://a:8080")
+	assertHosts("http://b:8080/")
+	current = current.Add(19 * time.Second)
+	assertHosts("http://b:8080/")
+
+	// all the hosts are returned when none of them is healthy
+	fail("http://b:8080")
+	fail("http://b:8080")
+	assertHosts(addrs...)
+
+	// the probe succeeds, so the host is restored
+	current = current.Add(time.Second)
+	hosts.Breaker("http://a:8080").Execute(func() (interface{}, error) { return nil, nil })
+	hosts.Done("http://a:8080", false)
+	fail("http://a:8080")
+	assertHosts("http://a:8080")
+	fail("http://a:8080")
+	current = current.Add(10 * time.Second)
+	assertHosts(addrs...)
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gobreaker
+
+import (
+	"context"
+	"github.com/sony/gobreaker"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+var (
+	keyName  = tag.MustNewKey("sonic_circuit_breaker")
+	keyState = tag.MustNewKey("sonic_circuit_breaker_state")
+
+	stateMeasure = stats.Int64("sonic/circuit_breaker/state", "State of the circuit breaker: 0 closed, 1 half-open, 2 open", stats.UnitDimensionless)
+
+	// OpenCensusViews are the views of the state and the transitions of the circuit breakers
+	OpenCensusViews = []*view.View{
+		{
+			Name:        "sonic/circuit_breaker/state",
+			Description: "Current state of the circuit breakers",
+			Measure:     stateMeasure,
+			TagKeys:     []tag.Key{keyName},
+			Aggregation: view.LastValue(),
+		},
+		{
+			Name:        "sonic/circuit_breaker/transitions",
+			Description: "Number of state transitions of the circuit breakers, by destination state",
+			Measure:     stateMeasure,
+			TagKeys:     []tag.Key{keyName, keyState},
+			Aggregation: view.Count(),
+		},
+	}
+)
+
+func recordStateChange(name string, to gobreaker.State) {
+	_ = stats.RecordWithTags(
+		context.Background(),
+		[]tag.Mutator{tag.Upsert(keyName, name), tag.Upsert(keyState, to.String())},
+		stateMeasure.M(int64(to)),
+	)
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/starvn/sonic/qos/circuitbreaker/gobreaker"
+	"github.com/starvn/turbo/config"
+	"github.com/starvn/turbo/log"
+	"github.com/starvn/turbo/proxy"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// HeaderName is the header added to the metadata of the responses with the state of the breaker
+const HeaderName = "X-Sonic-Circuit-Breaker"
+
+// maxLastResponses caps the number of successful responses kept for the fallbacks of every backend
+const maxLastResponses = 1000
+
+type fallback struct {
+	cfg     gobreaker.FallbackConfig
+	headers []string
+	mu      *sync.RWMutex
+	last    map[string]*proxy.Response
+	// warn reports the first request without any of the key headers
+	warn func()
+}
+
+func newFallback(cfg gobreaker.FallbackConfig, remote *config.Backend, logger log.Logger) *fallback {
+	keyHeaders := cfg.KeyHeaders
+	if keyHeaders == nil {
+		keyHeaders = gobreaker.DefaultFallbackKeyHeaders
+	}
+	headers := make([]string, len(keyHeaders))
+	for i, h := range keyHeaders {
+		headers[i] = http.CanonicalHeaderKey(h)
+	}
+	once := new(sync.Once)
+	return &fallback{
+		cfg:     cfg,
+		headers: headers,
+		mu:      new(sync.RWMutex),
+		last:    map[string]*proxy.Response{},
+		warn: func() {
+			once.Do(func() {
+				logger.Warning(fmt.Sprintf("[BACKEND: %s][CB] The requests have none of the key headers %v of the last responses, so they are not kept. Check the headers_to_pass of the endpoint", remote.URLPattern, keyHeaders))
+			})
+		},
+	}
+}
+
+// requestKey identifies the last response of the request. The values of the key headers are hashed,
+// so the responses of different clients are kept apart without storing their credentials. The
+// requests without any of the key headers have no key, as the endpoint may not forward them, and
+// sharing their last response could leak it to other clients
+func (f *fallback) requestKey(r *proxy.Request) (string, bool) {
+	key := r.Method + " " + r.Path + "?" + r.Query.Encode()
+	if len(f.headers) == 0 {
+		return key, true
+	}
+	extra := url.Values{}
+	for _, h := range f.headers {
+		if v := r.Headers[h]; len(v) > 0 {
+			extra[h] = v
+		}
+	}
+	if len(extra) == 0 {
+		f.warn()
+		return "", false
+	}
+	sum := sha256.Sum256([]byte(extra.Encode()))
+	return key + "#" + hex.EncodeToString(sum[:]), true
+}
+
+// store keeps a copy of the successful response, if the last response fallback is enabled
+func (f *fallback) store(r *proxy.Request, resp *proxy.Response) {
+	if !f.cfg.LastResponse || resp == nil || !resp.IsComplete {
+		return
+	}
+	key, ok := f.requestKey(r)
+	if !ok {
+		return
+	}
+	cp := copyResponse(resp)
+
+	f.mu.Lock()
+	if _, ok := f.last[key]; !ok && len(f.last) >= maxLastResponses {
+		for k := range f.last {
+			delete(f.last, k)
+			break
+		}
+	}
+	f.last[key] = cp
+	f.mu.Unlock()
+}
+
+// response returns the fallback response for the request, if any
+func (f *fallback) response(r *proxy.Request) (*proxy.Response, bool) {
+	var resp *proxy.Response
+	if key, ok := f.requestKey(r); ok && f.cfg.LastResponse {
+		f.mu.RLock()
+		if last, ok := f.last[key]; ok {
+			resp = copyResponse(last)
+		}
+		f.mu.RUnlock()
+	}
+	if resp == nil && f.cfg.Static != nil {
+		resp = &proxy.Response{Data: copyMap(f.cfg.Static)}
+	}
+	if resp == nil && f.cfg.DegradedKey != "" {
+		resp = &proxy.Response{Data: map[string]interface{}{}}
+	}
+	if resp == nil {
+		return nil, false
+	}
+
+	if resp.Data == nil {
+		resp.Data = map[string]interface{}{}
+	}
+	if f.cfg.DegradedKey != "" {
+		resp.Data[f.cfg.DegradedKey] = true
+	}
+	// the fallbacks are partial responses, so the endpoint is not marked as completed
+	resp.IsComplete = false
+	return resp, true
+}
+
+func setStateHeader(resp *proxy.Response, state string) {
+	if resp.Metadata.Headers == nil {
+		resp.Metadata.Headers = map[string][]string{}
+	}
+	resp.Metadata.Headers[HeaderName] = []string{state}
+}
+
+func copyResponse(resp *proxy.Response) *proxy.Response {
+	cp := &proxy.Response{
+		Data:       copyMap(resp.Data),
+		IsComplete: resp.IsComplete,
+		Metadata: proxy.Metadata{
+			StatusCode: resp.Metadata.StatusCode,
+			Headers:    make(map[string][]string, len(resp.Metadata.Headers)),
+		},
+	}
+	for k, v := range resp.Metadata.Headers {
+		cp.Metadata.Headers[k] = append([]string{}, v...)
+	}
+	return cp
+}
+
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	cp := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		cp[k] = copyValue(v)
+	}
+	return cp
+}
+
+func copyValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		return copyMap(val)
+	case []interface{}:
+		cp := make([]interface{}, len(val))
+		for i, item := range val {
+			cp[i] = copyValue(item)
+		}
+		return cp
+	default:
+		return v
+	}
+}
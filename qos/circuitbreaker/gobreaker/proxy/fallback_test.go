@@ -0,0 +1,251 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	gologging "github.com/op/go-logging"
+	"github.com/starvn/sonic/qos/circuitbreaker/gobreaker"
+	"github.com/starvn/sonic/qos/httpcache"
+	"github.com/starvn/turbo/config"
+	"github.com/starvn/turbo/encoding"
+	"github.com/starvn/turbo/log"
+	"github.com/starvn/turbo/proxy"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewMiddleware_fallbackStatic(t *testing.T) {
+	mdw := NewMiddleware(&config.Backend{
+		ExtraConfig: map[string]interface{}{
+			gobreaker.Namespace: map[string]interface{}{
+				"interval":   100.0,
+				"timeout":    100.0,
+				"max_errors": 0.0,
+				"fallback": map[string]interface{}{
+					"static":       map[string]interface{}{"items": []interface{}{}},
+					"degraded_key": "degraded",
+				},
+			},
+		},
+	}, gologging.MustGetLogger("proxy_test"))
+	p := mdw(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		return nil, fmt.Errorf("Some error")
+	})
+
+	request := proxy.Request{
+		Path: "/turbo",
+	}
+
+	if _, err := p(context.Background(), &request); err == nil {
+		t.Error("error expected")
+	}
+
+	for i := 0; i < 2; i++ {
+		r, err := p(context.Background(), &request)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		if r.IsComplete {
+			t.Error("the fallback should not be complete")
+		}
+		if _, ok := r.Data["items"]; !ok || r.Data["degraded"] != true {
+			t.Errorf("unexpected data: %v", r.Data)
+		}
+		if h := r.Metadata.Headers[HeaderName]; len(h) != 1 || h[0] != "open" {
+			t.Errorf("unexpected state header: %v", h)
+		}
+		r.Data["items"] = "modified"
+	}
+}
+
+func TestNewMiddleware_fallbackLastResponse(t *testing.T) {
+	calls := uint64(0)
+	mdw := NewMiddleware(&config.Backend{
+		ExtraConfig: map[string]interface{}{
+			gobreaker.Namespace: map[string]interface{}{
+				"interval":   100.0,
+				"timeout":    100.0,
+				"max_errors": 0.0,
+				"fallback": map[string]interface{}{
+					"last_response": true,
+				},
+			},
+		},
+	}, gologging.MustGetLogger("proxy_test"))
+	p := mdw(func(_ context.Context, r *proxy.Request) (*proxy.Response, error) {
+		if atomic.AddUint64(&calls, 1) > 2 {
+			return nil, fmt.Errorf("Some error")
+		}
+		return &proxy.Response{
+			IsComplete: true,
+			Data:       map[string]interface{}{"id": r.Query.Get("id"), "nested": map[string]interface{}{"a": 1}},
+		}, nil
+	})
+
+	alice := map[string][]string{"Authorization": {"Bearer alice"}}
+	for _, id := range []string{"1", "2"} {
+		r, err := p(context.Background(), &proxy.Request{Path: "/turbo", Query: url.Values{"id": []string{id}}, Headers: alice})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		if h := r.Metadata.Headers[HeaderName]; len(h) != 1 || h[0] != "closed" {
+			t.Errorf("unexpected state header: %v", h)
+		}
+		r.Data["nested"].(map[string]interface{})["a"] = 2
+	}
+
+	if _, err := p(context.Background(), &proxy.Request{Path: "/turbo", Query: url.Values{"id": []string{"1"}}, Headers: alice}); err == nil {
+		t.Error("error expected")
+	}
+
+	bob := map[string][]string{"Authorization": {"Bearer bob"}}
+	if _, err := p(context.Background(), &proxy.Request{Path: "/turbo", Query: url.Values{"id": []string{"2"}}, Headers: bob}); err == nil || err.Error() != "circuit breaker is open" {
+		t.Errorf("the last response of another client should not be returned: %v", err)
+	}
+
+	r, err := p(context.Background(), &proxy.Request{Path: "/turbo", Query: url.Values{"id": []string{"2"}}, Headers: alice})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if r.IsComplete || r.Data["id"] != "2" || r.Data["nested"].(map[string]interface{})["a"] != 1 {
+		t.Errorf("unexpected fallback: %+v", r)
+	}
+
+	if _, err := p(context.Background(), &proxy.Request{Path: "/turbo", Query: url.Values{"id": []string{"3"}}, Headers: alice}); err == nil || err.Error() != "circuit breaker is open" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNewMiddleware_fallbackLastResponseWithoutKeyHeaders(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l, _ := log.NewLogger("DEBUG", buf, "")
+	calls := uint64(0)
+	mdw := NewMiddleware(&config.Backend{
+		URLPattern: "/private",
+		ExtraConfig: map[string]interface{}{
+			gobreaker.Namespace: map[string]interface{}{
+				"interval":   100.0,
+				"timeout":    100.0,
+				"max_errors": 0.0,
+				"fallback": map[string]interface{}{
+					"last_response": true,
+				},
+			},
+		},
+	}, l)
+	p := mdw(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		if atomic.AddUint64(&calls, 1) > 1 {
+			return nil, fmt.Errorf("Some error")
+		}
+		return &proxy.Response{IsComplete: true, Data: map[string]interface{}{"user": "alice"}}, nil
+	})
+
+	// the endpoint does not forward the Authorization header of alice
+	if _, err := p(context.Background(), &proxy.Request{Path: "/private"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if _, err := p(context.Background(), &proxy.Request{Path: "/private"}); err == nil {
+		t.Error("error expected")
+	}
+	if _, err := p(context.Background(), &proxy.Request{Path: "/private"}); err == nil || err.Error() != "circuit breaker is open" {
+		t.Errorf("the last response of a request without key headers should not be kept: %v", err)
+	}
+	if !strings.Contains(buf.String(), "[BACKEND: /private][CB] The requests have none of the key headers") {
+		t.Errorf("the missing key headers should be reported: %s", buf.String())
+	}
+}
+
+func TestNewMiddleware_staleCache(t *testing.T) {
+	calls := uint64(0)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&calls, 1)
+		if r.URL.Path != "/ok" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Date", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprint(w, `{"status":"ok"}`)
+	}))
+	defer ts.Close()
+
+	remote := &config.Backend{
+		URLPattern: "/stale",
+		Decoder:    encoding.JSONDecoder,
+		ExtraConfig: map[string]interface{}{
+			gobreaker.Namespace: map[string]interface{}{
+				"interval":   100.0,
+				"timeout":    100.0,
+				"max_errors": 0.0,
+			},
+			httpcache.Namespace: map[string]interface{}{
+				"ttl":            "10s",
+				"stale_if_error": "10m",
+			},
+		},
+	}
+	next := proxy.CustomHTTPProxyFactory(httpcache.NewHTTPClient(remote))(remote)
+	p := NewMiddleware(remote, gologging.MustGetLogger("proxy_test"))(next)
+
+	newRequest := func(path string) *proxy.Request {
+		u, _ := url.Parse(ts.URL + path)
+		return &proxy.Request{
+			Method: "GET",
+			URL:    u,
+			Body:   ioutil.NopCloser(bytes.NewBufferString("")),
+		}
+	}
+
+	if _, err := p(context.Background(), newRequest("/ok")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if _, err := p(context.Background(), newRequest("/ko")); err == nil {
+		t.Error("error expected")
+	}
+
+	r, err := p(context.Background(), newRequest("/ok"))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if r.Data["status"] != "ok" {
+		t.Errorf("unexpected data: %v", r.Data)
+	}
+	if h := r.Metadata.Headers[HeaderName]; len(h) != 1 || h[0] != "open" {
+		t.Errorf("unexpected state header: %v", h)
+	}
+	if _, err := p(context.Background(), newRequest("/ko")); err == nil {
+		t.Error("error expected for the requests without cached responses")
+	}
+	if c := atomic.LoadUint64(&calls); c != 2 {
+		t.Errorf("the open circuit should not reach the upstream: %d calls", c)
+	}
+}
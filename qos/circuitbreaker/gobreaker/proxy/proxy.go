@@ -18,38 +18,160 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	sony "github.com/sony/gobreaker"
 	"github.com/starvn/sonic/qos/circuitbreaker/gobreaker"
+	"github.com/starvn/sonic/qos/httpcache"
+	"github.com/starvn/sonic/telemetry/metrics"
 	"github.com/starvn/turbo/config"
 	"github.com/starvn/turbo/log"
 	"github.com/starvn/turbo/proxy"
 )
 
 func BackendFactory(next proxy.BackendFactory, logger log.Logger) proxy.BackendFactory {
+	return BackendFactoryWithMetrics(next, logger, nil)
+}
+
+// BackendFactoryWithMetrics returns a backend factory reporting the state and the transitions of the
+// breakers to the given metrics collector
+func BackendFactoryWithMetrics(next proxy.BackendFactory, logger log.Logger, m *metrics.Metrics) proxy.BackendFactory {
+	return BackendFactoryWithContext(context.Background(), next, logger, m)
+}
+
+// BackendFactoryWithContext returns a backend factory whose breakers are unregistered from the
+// gobreaker.DefaultRegistry when the context is done
+func BackendFactoryWithContext(ctx context.Context, next proxy.BackendFactory, logger log.Logger, m *metrics.Metrics) proxy.BackendFactory {
 	return func(cfg *config.Backend) proxy.Proxy {
-		return NewMiddleware(cfg, logger)(next(cfg))
+		return NewMiddlewareWithContext(ctx, cfg, logger, m)(next(cfg))
 	}
 }
 
 func NewMiddleware(remote *config.Backend, logger log.Logger) proxy.Middleware {
+	return NewMiddlewareWithMetrics(remote, logger, nil)
+}
+
+func NewMiddlewareWithMetrics(remote *config.Backend, logger log.Logger, m *metrics.Metrics) proxy.Middleware {
+	return NewMiddlewareWithContext(context.Background(), remote, logger, m)
+}
+
+// NewMiddlewareWithContext returns a circuit breaker middleware. The breaker is added to the
+// gobreaker.DefaultRegistry, so it can be inspected and controlled from the admin API, until the
+// context is done. While the breaker is open, the stale responses of the http cache are served if
+// the backend enables its stale_if_error option, before falling back to the configured fallback
+func NewMiddlewareWithContext(ctx context.Context, remote *config.Backend, logger log.Logger, m *metrics.Metrics) proxy.Middleware {
 	data := gobreaker.ConfigGetter(remote.ExtraConfig).(gobreaker.Config)
-	if data == gobreaker.ZeroCfg {
+	if data.IsZero() {
 		return proxy.EmptyMiddleware
 	}
-	cb := gobreaker.NewCircuitBreaker(data, logger)
 
-	logger.Debug(fmt.Sprintf("[BACKEND: %s][CB] Creating the circuit breaker named '%s'", remote.URLPattern, data.Name))
+	transition := func() {}
+	enabled := m != nil && m.Config != nil && !m.Config.BackendDisabled
+	labels := "layer.backend.name." + remote.URLPattern
+	if enabled {
+		counter := m.Proxy.Counter("circuitbreaker.transitions", labels)
+		transition = func() { counter.Inc(1) }
+	}
+	onStateChange := func(_ string, _, _ sony.State) { transition() }
+
+	// breaker returns the breaker handling the request and the function reporting if it failed
+	var breaker func(*proxy.Request) (*gobreaker.Breaker, func(bool))
+	if data.PerHost {
+		hosts := gobreaker.NewHosts(data, remote.URLPattern, logger, gobreaker.DefaultRegistry, onStateChange)
+		registerHosts(remote, hosts)
+		if done := ctx.Done(); done != nil {
+			go func() {
+				<-done
+				unregisterHosts(remote)
+				hosts.Close()
+			}()
+		}
+		breaker = func(r *proxy.Request) (*gobreaker.Breaker, func(bool)) {
+			addr := requestHost(r)
+			return hosts.Breaker(addr), func(failed bool) { hosts.Done(addr, failed) }
+		}
+		if enabled {
+			m.Proxy.FunctionalGauge(func() int64 { return int64(hosts.Ejected()) }, "circuitbreaker.ejected", labels)
+		}
+		logger.Debug(fmt.Sprintf("[BACKEND: %s][CB] Creating a circuit breaker per host", remote.URLPattern))
+	} else {
+		cb := gobreaker.NewBreaker(data, remote.URLPattern, logger, onStateChange)
+		name := gobreaker.DefaultRegistry.Add(cb)
+		if done := ctx.Done(); done != nil {
+			go func() {
+				<-done
+				gobreaker.DefaultRegistry.Remove(name)
+			}()
+		}
+		breaker = func(_ *proxy.Request) (*gobreaker.Breaker, func(bool)) { return cb, func(bool) {} }
+		if enabled {
+			m.Proxy.FunctionalGauge(func() int64 { return int64(cb.State()) }, "circuitbreaker.state", labels)
+		}
+		logger.Debug(fmt.Sprintf("[BACKEND: %s][CB] Creating the circuit breaker named '%s'", remote.URLPattern, name))
+	}
+	isFailure := gobreaker.NewStatusClassifier(data)
+	isExcluded := gobreaker.NewIsExcluded(data)
+
+	var fb *fallback
+	if data.Fallback != nil {
+		fb = newFallback(*data.Fallback, remote, logger)
+	}
+	staleIfError := httpcache.ConfigGetter(remote.ExtraConfig).(httpcache.Config).StaleIfError > 0
 
 	return func(next ...proxy.Proxy) proxy.Proxy {
 		if len(next) > 1 {
 			panic(proxy.ErrTooManyProxies)
 		}
 		return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
-			result, err := cb.Execute(func() (interface{}, error) { return next[0](ctx, request) })
-			if err != nil {
+			cb, done := breaker(request)
+			result, err := cb.Execute(func() (interface{}, error) {
+				resp, err := next[0](ctx, request)
+				if err == nil && resp != nil && isFailure(resp.Metadata.StatusCode) {
+					// the response is still returned, but the breaker counts it as a failure
+					return resp, gobreaker.StatusCodeError{Code: resp.Metadata.StatusCode}
+				}
+				return resp, err
+			})
+			if err == sony.ErrOpenState || err == sony.ErrTooManyRequests {
+				if staleIfError {
+					// the request is restricted to the cache, so it does not reach the upstream
+					if resp, err := next[0](httpcache.StaleOnly(ctx), request); err == nil && resp != nil {
+						setStateHeader(resp, cb.State().String())
+						return resp, nil
+					}
+				}
+				if fb != nil {
+					if resp, ok := fb.response(request); ok {
+						setStateHeader(resp, cb.State().String())
+						return resp, nil
+					}
+				}
 				return nil, err
 			}
-			return result.(*proxy.Response), err
+			if !isExcluded(err) {
+				done(err != nil)
+			}
+			if err != nil {
+				var statusErr gobreaker.StatusCodeError
+				if !errors.As(err, &statusErr) {
+					return nil, err
+				}
+			}
+			resp := result.(*proxy.Response)
+			if resp != nil {
+				if fb != nil && err == nil {
+					fb.store(request, resp)
+				}
+				setStateHeader(resp, cb.State().String())
+			}
+			return resp, nil
 		}
 	}
 }
+
+func requestHost(r *proxy.Request) string {
+	if r.URL == nil {
+		return ""
+	}
+	return r.URL.Scheme + "://" + r.URL.Host
+}
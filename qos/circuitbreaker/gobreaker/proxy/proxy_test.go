@@ -18,13 +18,16 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	gologging "github.com/op/go-logging"
 	"github.com/starvn/sonic/qos/circuitbreaker/gobreaker"
+	"github.com/starvn/sonic/telemetry/metrics"
 	"github.com/starvn/turbo/config"
 	"github.com/starvn/turbo/proxy"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestNewMiddleware_multipleNext(t *testing.T) {
@@ -89,6 +92,9 @@ func TestNewMiddleware_ok(t *testing.T) {
 		if &resp != r {
 			t.Fail()
 		}
+		if h := r.Metadata.Headers[HeaderName]; len(h) != 1 || h[0] != "closed" {
+			t.Errorf("unexpected state header: %v", h)
+		}
 	}
 }
 
@@ -134,3 +140,186 @@ func TestNewMiddleware_ko(t *testing.T) {
 		t.Error("not nil response")
 	}
 }
+
+func TestNewMiddleware_failureStatusCodes(t *testing.T) {
+	calls := uint64(0)
+	mdw := NewMiddleware(&config.Backend{
+		ExtraConfig: map[string]interface{}{
+			gobreaker.Namespace: map[string]interface{}{
+				"interval":             100.0,
+				"timeout":              100.0,
+				"max_errors":           1.0,
+				"failure_status_codes": []interface{}{"5xx"},
+			},
+		},
+	}, gologging.MustGetLogger("proxy_test"))
+	p := mdw(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		if total := atomic.AddUint64(&calls, 1); total > 2 {
+			t.Error("This proxy shouldn't been executed!")
+		}
+		return &proxy.Response{IsComplete: true, Metadata: proxy.Metadata{StatusCode: 503}}, nil
+	})
+
+	request := proxy.Request{
+		Path: "/turbo",
+	}
+
+	for i := 0; i < 2; i++ {
+		r, err := p(context.Background(), &request)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if r == nil || r.Metadata.StatusCode != 503 {
+			t.Errorf("unexpected response: %v", r)
+		}
+	}
+	if _, err := p(context.Background(), &request); err == nil || err.Error() != "circuit breaker is open" {
+		t.Error("error expected")
+	}
+}
+
+func TestNewMiddleware_failureRatio(t *testing.T) {
+	calls := uint64(0)
+	mdw := NewMiddleware(&config.Backend{
+		ExtraConfig: map[string]interface{}{
+			gobreaker.Namespace: map[string]interface{}{
+				"interval":      100.0,
+				"timeout":       100.0,
+				"failure_ratio": 0.5,
+				"min_requests":  10.0,
+			},
+		},
+	}, gologging.MustGetLogger("proxy_test"))
+	p := mdw(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		if atomic.AddUint64(&calls, 1)%3 == 0 {
+			return &proxy.Response{IsComplete: true}, nil
+		}
+		return nil, fmt.Errorf("Some error")
+	})
+
+	request := proxy.Request{
+		Path: "/turbo",
+	}
+
+	for i := 0; i < 9; i++ {
+		if _, err := p(context.Background(), &request); err != nil && err.Error() == "circuit breaker is open" {
+			t.Errorf("the breaker should not trip before the min requests. iteration #%d", i)
+		}
+	}
+	p(context.Background(), &request)
+	if _, err := p(context.Background(), &request); err == nil || err.Error() != "circuit breaker is open" {
+		t.Error("error expected")
+	}
+}
+
+func TestNewMiddleware_excludeClientCancellation(t *testing.T) {
+	mdw := NewMiddleware(&config.Backend{
+		ExtraConfig: map[string]interface{}{
+			gobreaker.Namespace: map[string]interface{}{
+				"interval":                    100.0,
+				"timeout":                     100.0,
+				"max_errors":                  1.0,
+				"exclude_client_cancellation": true,
+			},
+		},
+	}, gologging.MustGetLogger("proxy_test"))
+	p := mdw(func(ctx context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		<-ctx.Done()
+		return nil, fmt.Errorf("wrapped: %w", ctx.Err())
+	})
+
+	request := proxy.Request{
+		Path: "/turbo",
+	}
+
+	for i := 0; i < 5; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := p(ctx, &request); !errors.Is(err, context.Canceled) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		if _, err := p(ctx, &request); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if _, err := p(ctx, &request); err == nil || err.Error() != "circuit breaker is open" {
+		t.Error("error expected")
+	}
+}
+
+func TestNewMiddlewareWithMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := metrics.New(ctx, config.ExtraConfig{metrics.Namespace: map[string]interface{}{}}, gologging.MustGetLogger("proxy_test"))
+
+	p := NewMiddlewareWithMetrics(&config.Backend{
+		URLPattern: "/metrics",
+		ExtraConfig: map[string]interface{}{
+			gobreaker.Namespace: map[string]interface{}{
+				"name":       "metrics_test",
+				"interval":   100.0,
+				"timeout":    100.0,
+				"max_errors": 0.0,
+			},
+		},
+	}, gologging.MustGetLogger("proxy_test"), m)(dummyProxy(nil, fmt.Errorf("Some error")))
+
+	p(context.Background(), &proxy.Request{})
+
+	stats := m.TakeSnapshot()
+	if v := stats.Gauges["sonic.proxy.circuitbreaker.state.layer.backend.name./metrics"]; v != 2 {
+		t.Errorf("unexpected state gauge: %d", v)
+	}
+	if v := stats.Counters["sonic.proxy.circuitbreaker.transitions.layer.backend.name./metrics"]; v != 1 {
+		t.Errorf("unexpected transitions counter: %d", v)
+	}
+
+	b, ok := gobreaker.DefaultRegistry.Get("metrics_test")
+	if !ok {
+		t.Error("the breaker should be registered")
+		return
+	}
+	b.ForceClose()
+	if _, err := p(context.Background(), &proxy.Request{}); err == nil || err.Error() != "Some error" {
+		t.Errorf("the forced breaker should accept the requests: %v", err)
+	}
+
+	stats = m.TakeSnapshot()
+	if v := stats.Gauges["sonic.proxy.circuitbreaker.state.layer.backend.name./metrics"]; v != 0 {
+		t.Errorf("unexpected state gauge: %d", v)
+	}
+	if v := stats.Counters["sonic.proxy.circuitbreaker.transitions.layer.backend.name./metrics"]; v != 2 {
+		t.Errorf("unexpected transitions counter: %d", v)
+	}
+}
+
+func TestNewMiddlewareWithContext_unregister(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	NewMiddlewareWithContext(ctx, &config.Backend{
+		URLPattern: "/unregister",
+		ExtraConfig: map[string]interface{}{
+			gobreaker.Namespace: map[string]interface{}{
+				"name":       "unregister_test",
+				"max_errors": 1.0,
+			},
+		},
+	}, gologging.MustGetLogger("proxy_test"), nil)
+
+	if _, ok := gobreaker.DefaultRegistry.Get("unregister_test"); !ok {
+		t.Error("the breaker should be registered")
+	}
+	cancel()
+	for i := 0; i < 100; i++ {
+		if _, ok := gobreaker.DefaultRegistry.Get("unregister_test"); !ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Error("the breaker should be unregistered once the context is done")
+}
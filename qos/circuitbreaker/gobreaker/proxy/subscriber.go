@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/starvn/sonic/qos/circuitbreaker/gobreaker"
+	"github.com/starvn/turbo/config"
+	"github.com/starvn/turbo/discovery"
+	"sync"
+)
+
+var (
+	hostsMu        = new(sync.RWMutex)
+	hostsByBackend = map[*config.Backend]*gobreaker.Hosts{}
+)
+
+func registerHosts(remote *config.Backend, hosts *gobreaker.Hosts) {
+	hostsMu.Lock()
+	hostsByBackend[remote] = hosts
+	hostsMu.Unlock()
+}
+
+func unregisterHosts(remote *config.Backend) {
+	hostsMu.Lock()
+	delete(hostsByBackend, remote)
+	hostsMu.Unlock()
+}
+
+func getHosts(remote *config.Backend) (*gobreaker.Hosts, bool) {
+	hostsMu.RLock()
+	hosts, ok := hostsByBackend[remote]
+	hostsMu.RUnlock()
+	return hosts, ok
+}
+
+// SubscriberFactory wraps the subscribers of the backends with per-host breakers, so the balancer
+// does not pick the ejected hosts
+func SubscriberFactory(sf discovery.SubscriberFactory) discovery.SubscriberFactory {
+	return func(remote *config.Backend) discovery.Subscriber {
+		s := sf(remote)
+		cfg := gobreaker.ConfigGetter(remote.ExtraConfig).(gobreaker.Config)
+		if !cfg.PerHost {
+			return s
+		}
+		return discovery.SubscriberFunc(func() ([]string, error) {
+			hs, err := s.Hosts()
+			if err != nil {
+				return hs, err
+			}
+			if hosts, ok := getHosts(remote); ok {
+				return hosts.Filter(hs), nil
+			}
+			return hs, nil
+		})
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	gologging "github.com/op/go-logging"
+	"github.com/starvn/sonic/qos/circuitbreaker/gobreaker"
+	"github.com/starvn/turbo/config"
+	"github.com/starvn/turbo/discovery"
+	"github.com/starvn/turbo/proxy"
+	"testing"
+)
+
+func TestNewMiddleware_perHost(t *testing.T) {
+	remote := &config.Backend{
+		URLPattern: "/per_host",
+		Host:       []string{"http://good", "http://bad"},
+		ExtraConfig: map[string]interface{}{
+			gobreaker.Namespace: map[string]interface{}{
+				"name":       "per_host_test",
+				"interval":   100.0,
+				"timeout":    100.0,
+				"max_errors": 1.0,
+				"per_host":   true,
+			},
+		},
+	}
+
+	calls := map[string]int{}
+	p := NewMiddleware(remote, gologging.MustGetLogger("proxy_test"))(func(_ context.Context, r *proxy.Request) (*proxy.Response, error) {
+		calls[r.URL.Host]++
+		if r.URL.Host == "bad" {
+			return nil, fmt.Errorf("Some error")
+		}
+		return &proxy.Response{IsComplete: true}, nil
+	})
+	p = proxy.NewRoundRobinLoadBalancedMiddlewareWithSubscriber(SubscriberFactory(discovery.FixedSubscriberFactory)(remote))(p)
+
+	for i := 0; i < 20; i++ {
+		p(context.Background(), &proxy.Request{Path: "/per_host"})
+	}
+
+	if calls["bad"] != 2 {
+		t.Errorf("the bad host should be ejected after 2 failures. calls: %v", calls)
+	}
+	if calls["good"] != 18 {
+		t.Errorf("the good host should keep serving. calls: %v", calls)
+	}
+	if b, ok := gobreaker.DefaultRegistry.Get("per_host_test@http://good"); !ok || b.State().String() != "closed" {
+		t.Error("the breaker of the good host should be closed")
+	}
+}
+
+func TestSubscriberFactory_notPerHost(t *testing.T) {
+	remote := &config.Backend{Host: []string{"http://a", "http://b"}}
+	if _, ok := SubscriberFactory(discovery.FixedSubscriberFactory)(remote).(discovery.FixedSubscriber); !ok {
+		t.Error("the subscriber should not be wrapped")
+	}
+}
@@ -0,0 +1,267 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gobreaker
+
+import (
+	"github.com/sony/gobreaker"
+	"github.com/starvn/turbo/log"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	notForced = iota
+	forcedOpen
+	forcedClosed
+)
+
+// Breaker is a circuit breaker supporting the introspection and the manual control of its state.
+// A forced state overrides the one of the breaker until the breaker is reset
+type Breaker struct {
+	Name       string
+	Backend    string
+	settings   gobreaker.Settings
+	isExcluded func(error) bool
+	mu         *sync.RWMutex
+	cb         *gobreaker.TwoStepCircuitBreaker
+	forced     int
+}
+
+// NewBreaker returns a breaker for the backend with the given url pattern. The state changes are
+// logged if the config requires it, recorded by the OpenCensus views and notified to the callback
+func NewBreaker(cfg Config, backend string, logger log.Logger, onStateChange func(string, gobreaker.State, gobreaker.State)) *Breaker {
+	name := cfg.Name
+	if name == "" {
+		name = backend
+	}
+	b := &Breaker{
+		Name:       name,
+		Backend:    backend,
+		isExcluded: NewIsExcluded(cfg),
+		mu:         new(sync.RWMutex),
+	}
+	b.settings = newSettings(cfg, logger, func(_ string, from, to gobreaker.State) {
+		b.stateChanged(from, to, onStateChange)
+	})
+	b.cb = gobreaker.NewTwoStepCircuitBreaker(b.settings)
+	return b
+}
+
+func (b *Breaker) stateChanged(from, to gobreaker.State, onStateChange func(string, gobreaker.State, gobreaker.State)) {
+	recordStateChange(b.Name, to)
+	if onStateChange != nil {
+		onStateChange(b.Name, from, to)
+	}
+}
+
+// Execute runs the request if the breaker accepts it. The excluded errors are not reported as
+// results to the breaker
+func (b *Breaker) Execute(req func() (interface{}, error)) (interface{}, error) {
+	b.mu.RLock()
+	cb, forced := b.cb, b.forced
+	b.mu.RUnlock()
+
+	switch forced {
+	case forcedOpen:
+		return nil, gobreaker.ErrOpenState
+	case forcedClosed:
+		return req()
+	}
+
+	done, err := cb.Allow()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			done(false)
+			panic(e)
+		}
+	}()
+
+	res, err := req()
+	if b.isExcluded(err) {
+		// the half-open breaker waits for the result of its probe, so it is released as a failure
+		// to keep probing after the timeout instead of rejecting all the requests forever
+		if cb.State() == gobreaker.StateHalfOpen {
+			done(false)
+		}
+		return res, err
+	}
+	done(err == nil)
+	return res, err
+}
+
+// State returns the current state of the breaker, taking into account the forced one
+func (b *Breaker) State() gobreaker.State {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	switch b.forced {
+	case forcedOpen:
+		return gobreaker.StateOpen
+	case forcedClosed:
+		return gobreaker.StateClosed
+	}
+	return b.cb.State()
+}
+
+func (b *Breaker) Counts() gobreaker.Counts {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.cb.Counts()
+}
+
+// ForceOpen rejects all the requests until the breaker is reset
+func (b *Breaker) ForceOpen() {
+	b.force(forcedOpen, gobreaker.StateOpen)
+}
+
+// ForceClose accepts all the requests, ignoring their failures, until the breaker is reset
+func (b *Breaker) ForceClose() {
+	b.force(forcedClosed, gobreaker.StateClosed)
+}
+
+// Reset releases the forced state, if any, and restarts the breaker in the closed state
+func (b *Breaker) Reset() {
+	b.mu.Lock()
+	from := b.stateLocked()
+	b.forced = notForced
+	b.cb = gobreaker.NewTwoStepCircuitBreaker(b.settings)
+	b.mu.Unlock()
+
+	if from != gobreaker.StateClosed {
+		b.settings.OnStateChange(b.Name, from, gobreaker.StateClosed)
+	}
+}
+
+func (b *Breaker) force(forced int, to gobreaker.State) {
+	b.mu.Lock()
+	from := b.stateLocked()
+	b.forced = forced
+	b.mu.Unlock()
+
+	if from != to {
+		b.settings.OnStateChange(b.Name, from, to)
+	}
+}
+
+func (b *Breaker) stateLocked() gobreaker.State {
+	switch b.forced {
+	case forcedOpen:
+		return gobreaker.StateOpen
+	case forcedClosed:
+		return gobreaker.StateClosed
+	}
+	return b.cb.State()
+}
+
+// Status is the snapshot of a breaker exposed by the admin API
+type Status struct {
+	Name    string `json:"name"`
+	Backend string `json:"backend"`
+	State   string `json:"state"`
+	Forced  bool   `json:"forced"`
+	Counts  Counts `json:"counts"`
+}
+
+type Counts struct {
+	Requests             uint32 `json:"requests"`
+	TotalSuccesses       uint32 `json:"total_successes"`
+	TotalFailures        uint32 `json:"total_failures"`
+	ConsecutiveSuccesses uint32 `json:"consecutive_successes"`
+	ConsecutiveFailures  uint32 `json:"consecutive_failures"`
+}
+
+func (b *Breaker) Status() Status {
+	b.mu.RLock()
+	state, forced, counts := b.stateLocked(), b.forced != notForced, b.cb.Counts()
+	b.mu.RUnlock()
+	return Status{
+		Name:    b.Name,
+		Backend: b.Backend,
+		State:   state.String(),
+		Forced:  forced,
+		Counts: Counts{
+			Requests:             counts.Requests,
+			TotalSuccesses:       counts.TotalSuccesses,
+			TotalFailures:        counts.TotalFailures,
+			ConsecutiveSuccesses: counts.ConsecutiveSuccesses,
+			ConsecutiveFailures:  counts.ConsecutiveFailures,
+		},
+	}
+}
+
+// Registry keeps all the breakers created by the proxy middlewares
+type Registry struct {
+	mu       *sync.RWMutex
+	breakers map[string]*Breaker
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		mu:       new(sync.RWMutex),
+		breakers: map[string]*Breaker{},
+	}
+}
+
+// DefaultRegistry is the registry used by the proxy middlewares
+var DefaultRegistry = NewRegistry()
+
+// Add registers the breaker and returns the name it is registered with. Breakers sharing the same
+// name are registered with a numeric suffix
+func (r *Registry) Add(b *Breaker) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name := b.Name
+	for i := 2; ; i++ {
+		if _, ok := r.breakers[name]; !ok {
+			break
+		}
+		name = b.Name + "#" + strconv.Itoa(i)
+	}
+	r.breakers[name] = b
+	return name
+}
+
+// Remove unregisters the breaker registered with the given name
+func (r *Registry) Remove(name string) {
+	r.mu.Lock()
+	delete(r.breakers, name)
+	r.mu.Unlock()
+}
+
+func (r *Registry) Get(name string) (*Breaker, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	b, ok := r.breakers[name]
+	return b, ok
+}
+
+// List returns the status of all the registered breakers, sorted by name
+func (r *Registry) List() []Status {
+	r.mu.RLock()
+	res := make([]Status, 0, len(r.breakers))
+	for name, b := range r.breakers {
+		status := b.Status()
+		status.Name = name
+		res = append(res, status)
+	}
+	r.mu.RUnlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gobreaker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	gologging "github.com/op/go-logging"
+	"github.com/sony/gobreaker"
+	"github.com/starvn/turbo/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBreaker_force(t *testing.T) {
+	var transitions []string
+	b := NewBreaker(Config{Interval: 100, Timeout: 100, MaxErrors: 1}, "/foo", gologging.MustGetLogger("gobreaker_test"), func(_ string, from, to gobreaker.State) {
+		transitions = append(transitions, from.String()+">"+to.String())
+	})
+	if b.Name != "/foo" {
+		t.Errorf("unexpected name: %s", b.Name)
+	}
+
+	ok := func() (interface{}, error) { return nil, nil }
+	ko := func() (interface{}, error) { return nil, errors.New("ko") }
+
+	b.ForceOpen()
+	if _, err := b.Execute(ok); err != gobreaker.ErrOpenState {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	b.ForceClose()
+	for i := 0; i < 5; i++ {
+		b.Execute(ko)
+	}
+	if b.State() != gobreaker.StateClosed {
+		t.Errorf("unexpected state: %s", b.State())
+	}
+
+	b.Reset()
+	for i := 0; i < 2; i++ {
+		b.Execute(ko)
+	}
+	if b.State() != gobreaker.StateOpen {
+		t.Errorf("unexpected state: %s", b.State())
+	}
+	b.Reset()
+	if b.State() != gobreaker.StateClosed || b.Counts().Requests != 0 {
+		t.Errorf("unexpected state after the reset: %s %+v", b.State(), b.Counts())
+	}
+
+	expected := []string{"closed>open", "open>closed", "closed>open", "open>closed"}
+	if len(transitions) != len(expected) {
+		t.Errorf("unexpected transitions: %v", transitions)
+		return
+	}
+	for i, tr := range expected {
+		if transitions[i] != tr {
+			t.Errorf("unexpected transitions: %v", transitions)
+		}
+	}
+}
+
+func TestBreaker_excludeClientCancellation(t *testing.T) {
+	b := NewBreaker(Config{Interval: 100, Timeout: 100, MaxErrors: 1, ExcludeClientCancellation: true}, "/foo", gologging.MustGetLogger("gobreaker_test"), nil)
+	ko := func() (interface{}, error) { return nil, errors.New("ko") }
+	cancelled := func() (interface{}, error) { return nil, context.Canceled }
+
+	b.Execute(ko)
+	for i := 0; i < 5; i++ {
+		if _, err := b.Execute(cancelled); err != context.Canceled {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if counts := b.Counts(); counts.TotalSuccesses != 0 || counts.ConsecutiveFailures != 1 {
+		t.Errorf("the cancellations should not be counted: %+v", counts)
+	}
+	b.Execute(ko)
+	if b.State() != gobreaker.StateOpen {
+		t.Errorf("unexpected state: %s", b.State())
+	}
+}
+
+func TestNewAdminHandler(t *testing.T) {
+	r := NewRegistry()
+	logger := gologging.MustGetLogger("gobreaker_test")
+	r.Add(NewBreaker(Config{Name: "b"}, "/foo", logger, nil))
+	r.Add(NewBreaker(Config{}, "/bar", logger, nil))
+	baz := NewBreaker(Config{Name: "b"}, "/baz", logger, nil)
+	if name := r.Add(baz); name != "b#2" || baz.Name != "b" {
+		t.Errorf("unexpected names: %s %s", name, baz.Name)
+	}
+	tmp := NewBreaker(Config{Name: "tmp"}, "/tmp", logger, nil)
+	r.Remove(r.Add(tmp))
+
+	h := NewAdminHandler(r, "secret")
+	newRequest := func(method, path string) *http.Request {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		return req
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(http.MethodGet, AdminPath))
+	var list []Status
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(list) != 3 || list[0].Name != "/bar" || list[1].Name != "b" || list[2].Name != "b#2" || list[2].Backend != "/baz" {
+		t.Errorf("unexpected list: %+v", list)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(http.MethodPost, AdminPath+"/open?name=b%232"))
+	var status Status
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Error(err)
+		return
+	}
+	if status.Name != "b#2" || status.State != "open" || !status.Forced {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	for _, tc := range []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodGet, AdminPath + "/open?name=b", http.StatusMethodNotAllowed},
+		{http.MethodPost, AdminPath, http.StatusMethodNotAllowed},
+		{http.MethodPost, AdminPath + "/open?name=unknown", http.StatusNotFound},
+		{http.MethodPost, AdminPath + "/explode?name=b", http.StatusNotFound},
+		{http.MethodPost, AdminPath + "/reset?name=b%232", http.StatusOK},
+	} {
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest(tc.method, tc.path))
+		if w.Code != tc.status {
+			t.Errorf("%s %s: unexpected status code %d", tc.method, tc.path, w.Code)
+		}
+	}
+	if b, _ := r.Get("b#2"); b.State() != gobreaker.StateClosed {
+		t.Errorf("unexpected state: %s", b.State())
+	}
+
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		req := httptest.NewRequest(http.MethodPost, AdminPath+"/open?name=b", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%q: unexpected status code %d", auth, w.Code)
+		}
+	}
+	if b, _ := r.Get("b"); b.State() != gobreaker.StateClosed {
+		t.Error("the unauthorized requests should not change the state")
+	}
+}
+
+func TestRunAdmin_noToken(t *testing.T) {
+	e := config.ExtraConfig{Namespace: map[string]interface{}{"admin": map[string]interface{}{"listen_address": ":0"}}}
+	if err := RunAdmin(context.Background(), e, gologging.MustGetLogger("gobreaker_test")); err != ErrNoToken {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package coalescing provides the settings and the groups collapsing the identical concurrent
+// requests to a backend into a single call, sharing its response with all the callers
+package coalescing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/starvn/turbo/config"
+	"github.com/starvn/turbo/proxy"
+	"sync"
+	"time"
+)
+
+const Namespace = "github.com/starvn/sonic/qos/coalescing"
+
+// DefaultMaxWait is the max time a request waits for the call in flight if the config does not
+// define it
+const DefaultMaxWait = time.Second
+
+var (
+	// ErrMaxWait is returned to the callers waiting for a call in flight longer than the max wait
+	ErrMaxWait = errors.New("coalescing: max wait exceeded")
+	// ErrNotShareable is returned to the callers waiting for a call with a streamed response
+	ErrNotShareable = errors.New("coalescing: the response can not be shared")
+)
+
+type Config struct {
+	// Headers narrow the request headers included in the key of the requests, besides the method
+	// and the URL. All the forwarded headers are included if they are not defined
+	Headers []string
+	// MaxWait is the max time a request waits for the identical call in flight before calling
+	// the backend by itself
+	MaxWait time.Duration
+}
+
+var ZeroCfg = Config{}
+
+func ConfigGetter(e config.ExtraConfig) interface{} {
+	v, ok := e[Namespace]
+	if !ok {
+		return ZeroCfg
+	}
+	tmp, ok := v.(map[string]interface{})
+	if !ok {
+		return ZeroCfg
+	}
+	cfg := Config{
+		MaxWait: DefaultMaxWait,
+	}
+	if v, ok := tmp["headers"].([]interface{}); ok {
+		cfg.Headers = make([]string, 0, len(v))
+		for _, h := range v {
+			cfg.Headers = append(cfg.Headers, fmt.Sprintf("%v", h))
+		}
+	}
+	if v, ok := tmp["max_wait"]; ok {
+		if d, err := time.ParseDuration(fmt.Sprintf("%v", v)); err == nil && d > 0 {
+			cfg.MaxWait = d
+		}
+	}
+	return cfg
+}
+
+// Group collapses the concurrent calls with the same key into a single call
+type Group struct {
+	mu    *sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	done    chan struct{}
+	resp    *proxy.Response
+	err     error
+	waiters int
+}
+
+func NewGroup() *Group {
+	return &Group{
+		mu:    new(sync.Mutex),
+		calls: map[string]*call{},
+	}
+}
+
+// Do calls fn and returns its result, unless there is a call with the same key in flight. In that
+// case, it waits up to maxWait for the result of that call, returning ErrMaxWait once it expires.
+// The shared flag reports if the result comes from another call. Every caller gets its own copy of
+// the response, except the streamed ones, which can not be shared
+func (g *Group) Do(ctx context.Context, key string, maxWait time.Duration, fn func() (*proxy.Response, error)) (resp *proxy.Response, shared bool, err error) {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		c.waiters++
+		g.mu.Unlock()
+		return c.wait(ctx, maxWait)
+	}
+	c := &call{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		waiters := c.waiters
+		g.mu.Unlock()
+		close(c.done)
+
+		// the waiters copy the original response, so the caller gets a copy too
+		if waiters > 0 && resp != nil && resp.Io == nil {
+			resp = CopyResponse(resp)
+		}
+	}()
+	c.resp, c.err = fn()
+	return c.resp, false, c.err
+}
+
+func (c *call) wait(ctx context.Context, maxWait time.Duration) (*proxy.Response, bool, error) {
+	t := time.NewTimer(maxWait)
+	defer t.Stop()
+
+	select {
+	case <-c.done:
+	case <-t.C:
+		return nil, true, ErrMaxWait
+	case <-ctx.Done():
+		return nil, true, ctx.Err()
+	}
+
+	if c.resp == nil && c.err != nil {
+		return nil, true, c.err
+	}
+	if c.resp == nil || c.resp.Io != nil {
+		return nil, true, ErrNotShareable
+	}
+	return CopyResponse(c.resp), true, c.err
+}
+
+// CopyResponse returns a deep copy of the response, without its stream
+func CopyResponse(resp *proxy.Response) *proxy.Response {
+	cp := &proxy.Response{
+		Data:       copyMap(resp.Data),
+		IsComplete: resp.IsComplete,
+		Metadata: proxy.Metadata{
+			StatusCode: resp.Metadata.StatusCode,
+		},
+	}
+	if resp.Metadata.Headers != nil {
+		cp.Metadata.Headers = make(map[string][]string, len(resp.Metadata.Headers))
+		for k, v := range resp.Metadata.Headers {
+			cp.Metadata.Headers[k] = append([]string(nil), v...)
+		}
+	}
+	return cp
+}
+
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	res := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		res[k] = copyValue(v)
+	}
+	return res
+}
+
+func copyValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		return copyMap(val)
+	case []interface{}:
+		res := make([]interface{}, len(val))
+		for i, item := range val {
+			res[i] = copyValue(item)
+		}
+		return res
+	case []map[string]interface{}:
+		res := make([]map[string]interface{}, len(val))
+		for i, item := range val {
+			res[i] = copyMap(item)
+		}
+		return res
+	}
+	return v
+}
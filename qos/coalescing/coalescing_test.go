@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package coalescing
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/starvn/turbo/config"
+	"github.com/starvn/turbo/proxy"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConfigGetter(t *testing.T) {
+	var dat config.ExtraConfig
+	if err := json.Unmarshal([]byte(`{
+		"github.com/starvn/sonic/qos/coalescing": {
+			"headers": ["X-Tenant"],
+			"max_wait": "500ms"
+		}
+	}`), &dat); err != nil {
+		t.Error(err)
+		return
+	}
+	cfg := ConfigGetter(dat).(Config)
+	expected := Config{Headers: []string{"X-Tenant"}, MaxWait: 500 * time.Millisecond}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+	if cfg := ConfigGetter(config.ExtraConfig{Namespace: map[string]interface{}{}}).(Config); cfg.MaxWait != DefaultMaxWait {
+		t.Errorf("unexpected default max wait: %v", cfg.MaxWait)
+	}
+}
+
+func TestGroup_Do(t *testing.T) {
+	g := NewGroup()
+	release := make(chan struct{})
+	calls := 0
+	fn := func() (*proxy.Response, error) {
+		calls++
+		<-release
+		return &proxy.Response{
+			Data:       map[string]interface{}{"items": []interface{}{map[string]interface{}{"id": 1}}},
+			IsComplete: true,
+		}, nil
+	}
+
+	total := 10
+	responses := make(chan *proxy.Response, total)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		resp, shared, err := g.Do(context.Background(), "key", time.Second, fn)
+		if shared || err != nil {
+			t.Errorf("unexpected result: %v %v", shared, err)
+		}
+		responses <- resp
+	}()
+	for !g.inFlight("key") {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i < total; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, shared, err := g.Do(context.Background(), "key", time.Second, fn)
+			if !shared || err != nil {
+				t.Errorf("unexpected result: %v %v", shared, err)
+			}
+			responses <- resp
+		}()
+	}
+	for g.waiters("key") < total-1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	close(responses)
+
+	if calls != 1 {
+		t.Errorf("unexpected calls: %d", calls)
+	}
+	seen := map[*proxy.Response]struct{}{}
+	for resp := range responses {
+		if _, ok := seen[resp]; ok {
+			t.Error("every caller should get its own response")
+		}
+		seen[resp] = struct{}{}
+		resp.Data["items"].([]interface{})[0].(map[string]interface{})["id"] = 2
+	}
+}
+
+func TestGroup_Do_maxWait(t *testing.T) {
+	g := NewGroup()
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		_, _, _ = g.Do(context.Background(), "key", time.Second, func() (*proxy.Response, error) {
+			<-release
+			return &proxy.Response{}, nil
+		})
+		close(done)
+	}()
+	for !g.inFlight("key") {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, shared, err := g.Do(context.Background(), "key", 10*time.Millisecond, func() (*proxy.Response, error) {
+		t.Error("the call in flight should be awaited")
+		return nil, nil
+	})
+	if !shared || err != ErrMaxWait {
+		t.Errorf("unexpected result: %v %v", shared, err)
+	}
+	close(release)
+	<-done
+}
+
+func (g *Group) inFlight(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.calls[key]
+	return ok
+}
+
+func (g *Group) waiters(key string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if c, ok := g.calls[key]; ok {
+		return c.waiters
+	}
+	return 0
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package proxy provides a backend proxy middleware collapsing the identical concurrent requests
+// into a single call to the backend, sharing its response with all the callers
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/starvn/sonic/qos/coalescing"
+	"github.com/starvn/sonic/qos/httpcache"
+	"github.com/starvn/sonic/telemetry/metrics"
+	"github.com/starvn/turbo/config"
+	"github.com/starvn/turbo/log"
+	"github.com/starvn/turbo/proxy"
+	"net/http"
+	"net/textproto"
+	"net/url"
+)
+
+func BackendFactory(next proxy.BackendFactory, logger log.Logger, m *metrics.Metrics) proxy.BackendFactory {
+	return func(cfg *config.Backend) proxy.Proxy {
+		return NewMiddleware(cfg, logger, m)(next(cfg))
+	}
+}
+
+// NewMiddleware returns a middleware collapsing the concurrent GET and HEAD requests with the same
+// method, path, query and forwarded headers, or only the keyed ones if the config defines them.
+// The requests waiting for a call longer than the max wait, or for a call cancelled by its own
+// client, call the backend by themselves
+func NewMiddleware(remote *config.Backend, logger log.Logger, m *metrics.Metrics) proxy.Middleware {
+	logPrefix := "[BACKEND: " + remote.URLPattern + "][Coalescing]"
+	cfg := coalescing.ConfigGetter(remote.ExtraConfig).(coalescing.Config)
+	if cfg.MaxWait <= 0 {
+		return proxy.EmptyMiddleware
+	}
+
+	var headers []string
+	if cfg.Headers != nil {
+		headers = make([]string, len(cfg.Headers))
+		for i, h := range cfg.Headers {
+			headers[i] = textproto.CanonicalMIMEHeaderKey(h)
+		}
+	}
+	group := coalescing.NewGroup()
+
+	report := func(collapsed, expired bool) {}
+	if m != nil && m.Config != nil && !m.Config.BackendDisabled {
+		labels := "layer.backend.name." + remote.URLPattern
+		collapsedCounter := m.Proxy.Counter("coalescing.collapsed", labels)
+		expiredCounter := m.Proxy.Counter("coalescing.max_wait_exceeded", labels)
+		report = func(collapsed, expired bool) {
+			if collapsed {
+				collapsedCounter.Inc(1)
+			}
+			if expired {
+				expiredCounter.Inc(1)
+			}
+		}
+	}
+
+	logger.Debug(logPrefix, "Collapsing the identical requests waiting up to", cfg.MaxWait)
+
+	return func(next ...proxy.Proxy) proxy.Proxy {
+		if len(next) > 1 {
+			panic(proxy.ErrTooManyProxies)
+		}
+		return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+			if request.Method != http.MethodGet && request.Method != http.MethodHead {
+				return next[0](ctx, request)
+			}
+
+			resp, shared, err := group.Do(ctx, requestKey(ctx, request, headers), cfg.MaxWait, func() (*proxy.Response, error) {
+				return next[0](ctx, request)
+			})
+			if !shared {
+				return resp, err
+			}
+			if retryable(ctx, err) {
+				report(false, err == coalescing.ErrMaxWait)
+				return next[0](ctx, request)
+			}
+			report(true, false)
+			return resp, err
+		}
+	}
+}
+
+// retryable reports if the error of a shared call requires calling the backend: the max wait
+// expired, the response can not be shared or the call was cancelled by the context of its caller
+func retryable(ctx context.Context, err error) bool {
+	if err == coalescing.ErrMaxWait || err == coalescing.ErrNotShareable {
+		return true
+	}
+	return ctx.Err() == nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded))
+}
+
+// requestKey identifies the identical requests. The requests restricted to the cache are never
+// collapsed with the ones reaching the backend
+func requestKey(ctx context.Context, r *proxy.Request, headers []string) string {
+	key := r.Method + " " + r.Path + "?" + r.Query.Encode()
+	if httpcache.IsStaleOnly(ctx) {
+		key = "stale-only " + key
+	}
+	values := url.Values{}
+	if headers == nil {
+		for h, v := range r.Headers {
+			values[h] = v
+		}
+	}
+	for _, h := range headers {
+		if v, ok := r.Headers[h]; ok {
+			values[h] = v
+		}
+	}
+	if len(values) == 0 {
+		return key
+	}
+	return key + " " + values.Encode()
+}
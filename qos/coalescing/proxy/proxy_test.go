@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	gologging "github.com/op/go-logging"
+	"github.com/starvn/sonic/qos/coalescing"
+	"github.com/starvn/sonic/qos/httpcache"
+	"github.com/starvn/sonic/telemetry/metrics"
+	"github.com/starvn/turbo/config"
+	"github.com/starvn/turbo/proxy"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewMiddleware(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := gologging.MustGetLogger("proxy_test")
+	m := metrics.New(ctx, config.ExtraConfig{metrics.Namespace: map[string]interface{}{}}, logger)
+
+	remote := &config.Backend{
+		URLPattern: "/coalescing",
+		ExtraConfig: map[string]interface{}{
+			coalescing.Namespace: map[string]interface{}{
+				"headers":  []interface{}{"x-tenant"},
+				"max_wait": "1s",
+			},
+		},
+	}
+	calls := int64(0)
+	p := NewMiddleware(remote, logger, m)(func(_ context.Context, r *proxy.Request) (*proxy.Response, error) {
+		atomic.AddInt64(&calls, 1)
+		time.Sleep(100 * time.Millisecond)
+		return &proxy.Response{Data: map[string]interface{}{"tenant": r.Headers["X-Tenant"][0]}, IsComplete: true}, nil
+	})
+
+	var wg sync.WaitGroup
+	for _, tc := range []struct {
+		method, tenant string
+		requests       int
+	}{
+		{"GET", "a", 5},
+		{"GET", "b", 5},
+		{"POST", "a", 3},
+	} {
+		for i := 0; i < tc.requests; i++ {
+			wg.Add(1)
+			go func(method, tenant string) {
+				defer wg.Done()
+				resp, err := p(context.Background(), &proxy.Request{
+					Method:  method,
+					Path:    "/foo",
+					Headers: map[string][]string{"X-Tenant": {tenant}},
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if resp.Data["tenant"] != tenant {
+					t.Errorf("unexpected response for the tenant %s: %v", tenant, resp.Data)
+				}
+			}(tc.method, tc.tenant)
+		}
+	}
+	wg.Wait()
+
+	if c := atomic.LoadInt64(&calls); c != 5 {
+		t.Errorf("unexpected calls to the backend: %d", c)
+	}
+	if v := m.TakeSnapshot().Counters["sonic.proxy.coalescing.collapsed.layer.backend.name./coalescing"]; v != 8 {
+		t.Errorf("unexpected collapsed requests: %d", v)
+	}
+}
+
+func TestRequestKey(t *testing.T) {
+	newRequest := func(user, tenant string) *proxy.Request {
+		return &proxy.Request{
+			Method:  "GET",
+			Path:    "/foo",
+			Headers: map[string][]string{"Authorization": {user}, "X-Tenant": {tenant}},
+		}
+	}
+	ctx := context.Background()
+
+	if requestKey(ctx, newRequest("alice", "a"), nil) == requestKey(ctx, newRequest("bob", "a"), nil) {
+		t.Error("all the forwarded headers should be in the key by default")
+	}
+	headers := []string{"X-Tenant"}
+	if requestKey(ctx, newRequest("alice", "a"), headers) != requestKey(ctx, newRequest("bob", "a"), headers) {
+		t.Error("the keyed headers should narrow the key")
+	}
+	if requestKey(ctx, newRequest("alice", "a"), headers) == requestKey(ctx, newRequest("alice", "b"), headers) {
+		t.Error("the keyed headers should be in the key")
+	}
+	if requestKey(ctx, newRequest("alice", "a"), nil) == requestKey(httpcache.StaleOnly(ctx), newRequest("alice", "a"), nil) {
+		t.Error("the requests restricted to the cache should have their own key")
+	}
+}
+
+func TestNewMiddleware_maxWait(t *testing.T) {
+	remote := &config.Backend{
+		ExtraConfig: map[string]interface{}{
+			coalescing.Namespace: map[string]interface{}{
+				"max_wait": "10ms",
+			},
+		},
+	}
+	calls := int64(0)
+	p := NewMiddleware(remote, gologging.MustGetLogger("proxy_test"), nil)(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		if atomic.AddInt64(&calls, 1) == 1 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return &proxy.Response{IsComplete: true}, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p(context.Background(), &proxy.Request{Method: "GET", Path: "/foo"}); err != nil {
+				t.Error(err)
+			}
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+	wg.Wait()
+
+	if c := atomic.LoadInt64(&calls); c != 2 {
+		t.Errorf("the request waiting over the max wait should call the backend: %d calls", c)
+	}
+}
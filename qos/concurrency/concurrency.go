@@ -0,0 +1,351 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package concurrency provides a limiter of the requests in flight against a backend, adapting the
+// limit to the latency observed with the AIMD or the gradient algorithms
+package concurrency
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/starvn/turbo/config"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+const Namespace = "github.com/starvn/sonic/qos/concurrency"
+
+const (
+	AIMD     = "aimd"
+	Gradient = "gradient"
+)
+
+var ErrLimited = errors.New("ERROR: concurrency limit exceeded")
+
+type Config struct {
+	Algorithm        string
+	InitialLimit     int
+	MinLimit         int
+	MaxLimit         int
+	QueueSize        int
+	QueueTimeout     time.Duration
+	BackoffRatio     float64
+	LatencyThreshold time.Duration
+	Smoothing        float64
+	Tolerance        float64
+}
+
+var ZeroCfg = Config{}
+
+func ConfigGetter(e config.ExtraConfig) interface{} {
+	v, ok := e[Namespace]
+	if !ok {
+		return ZeroCfg
+	}
+	tmp, ok := v.(map[string]interface{})
+	if !ok {
+		return ZeroCfg
+	}
+	cfg := Config{
+		Algorithm:    AIMD,
+		InitialLimit: 20,
+		MinLimit:     1,
+		MaxLimit:     1000,
+		QueueTimeout: 100 * time.Millisecond,
+		BackoffRatio: 0.9,
+		Smoothing:    0.2,
+		Tolerance:    1.5,
+	}
+	if v, ok := tmp["algorithm"]; ok {
+		cfg.Algorithm = strings.ToLower(fmt.Sprintf("%v", v))
+	}
+	if v, ok := tmp["initial_limit"]; ok {
+		cfg.InitialLimit = int(toFloat64(v))
+	}
+	if v, ok := tmp["min_limit"]; ok {
+		cfg.MinLimit = int(toFloat64(v))
+	}
+	if v, ok := tmp["max_limit"]; ok {
+		cfg.MaxLimit = int(toFloat64(v))
+	}
+	if v, ok := tmp["queue_size"]; ok {
+		cfg.QueueSize = int(toFloat64(v))
+	}
+	if v, ok := tmp["queue_timeout"]; ok {
+		if d, err := time.ParseDuration(fmt.Sprintf("%v", v)); err == nil {
+			cfg.QueueTimeout = d
+		}
+	}
+	if v, ok := tmp["backoff_ratio"]; ok {
+		if r := toFloat64(v); r > 0 && r < 1 {
+			cfg.BackoffRatio = r
+		}
+	}
+	if v, ok := tmp["latency_threshold"]; ok {
+		if d, err := time.ParseDuration(fmt.Sprintf("%v", v)); err == nil {
+			cfg.LatencyThreshold = d
+		}
+	}
+	if v, ok := tmp["smoothing"]; ok {
+		if s := toFloat64(v); s > 0 && s <= 1 {
+			cfg.Smoothing = s
+		}
+	}
+	if v, ok := tmp["tolerance"]; ok {
+		if t := toFloat64(v); t >= 1 {
+			cfg.Tolerance = t
+		}
+	}
+
+	if cfg.MinLimit < 1 {
+		cfg.MinLimit = 1
+	}
+	if cfg.MaxLimit < cfg.MinLimit {
+		cfg.MaxLimit = cfg.MinLimit
+	}
+	if cfg.InitialLimit < cfg.MinLimit {
+		cfg.InitialLimit = cfg.MinLimit
+	}
+	if cfg.InitialLimit > cfg.MaxLimit {
+		cfg.InitialLimit = cfg.MaxLimit
+	}
+	return cfg
+}
+
+func toFloat64(v interface{}) float64 {
+	switch val := v.(type) {
+	case int64:
+		return float64(val)
+	case int:
+		return float64(val)
+	case float64:
+		return val
+	}
+	return 0
+}
+
+// Algorithm computes the concurrency limit from the samples of the completed requests
+type Algorithm interface {
+	// Update returns the new limit after a request completed in the given time, with the given
+	// number of requests in flight. Dropped requests are the ones failed because of the backend
+	Update(limit int, rtt time.Duration, inflight int, dropped bool) int
+}
+
+// NewAlgorithm returns the algorithm named in the config, or an error if it is unknown
+func NewAlgorithm(cfg Config) (Algorithm, error) {
+	switch cfg.Algorithm {
+	case AIMD:
+		return &aimd{
+			backoffRatio: cfg.BackoffRatio,
+			threshold:    cfg.LatencyThreshold,
+		}, nil
+	case Gradient:
+		return &gradient{
+			backoffRatio: cfg.BackoffRatio,
+			smoothing:    cfg.Smoothing,
+			tolerance:    cfg.Tolerance,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown algorithm: %s", cfg.Algorithm)
+}
+
+// aimd increases the limit by one for every successful request while the limit is in use, and
+// decreases it multiplicatively when a request is dropped or slower than the threshold
+type aimd struct {
+	backoffRatio float64
+	threshold    time.Duration
+}
+
+func (a *aimd) Update(limit int, rtt time.Duration, inflight int, dropped bool) int {
+	if dropped || (a.threshold > 0 && rtt > a.threshold) {
+		return int(float64(limit) * a.backoffRatio)
+	}
+	if inflight*2 >= limit {
+		return limit + 1
+	}
+	return limit
+}
+
+// gradient compares the latency of every request with a long-term average of the latencies. The
+// limit shrinks while the requests get slower than the average and grows, by the square root of the
+// limit, while they don't. Dropped requests decrease the limit multiplicatively
+type gradient struct {
+	backoffRatio float64
+	smoothing    float64
+	tolerance    float64
+	longRTT      float64
+	estimate     float64
+}
+
+func (g *gradient) Update(limit int, rtt time.Duration, inflight int, dropped bool) int {
+	// the estimate is kept with decimals, so small limits can grow, unless the limiter clamped it
+	if int(g.estimate) != limit {
+		g.estimate = float64(limit)
+	}
+	if dropped {
+		g.estimate *= g.backoffRatio
+		return int(g.estimate)
+	}
+
+	short := float64(rtt)
+	if g.longRTT == 0 {
+		g.longRTT = short
+	} else {
+		g.longRTT = g.longRTT*0.95 + short*0.05
+	}
+
+	// the backend is not fully used, so there is no information about its capacity
+	if float64(inflight) < g.estimate/2 {
+		return limit
+	}
+
+	grad := 1.0
+	if short > 0 {
+		grad = math.Max(0.5, math.Min(1, g.tolerance*g.longRTT/short))
+	}
+	next := g.estimate*grad + math.Sqrt(g.estimate)
+	g.estimate = g.estimate*(1-g.smoothing) + next*g.smoothing
+	return int(g.estimate)
+}
+
+// Limiter admits requests while the number of them in flight is below the limit. Excess requests
+// wait in a bounded queue until a slot is released, the queue timeout expires or their context is
+// done
+type Limiter struct {
+	mu           *sync.Mutex
+	algorithm    Algorithm
+	limit        int
+	minLimit     int
+	maxLimit     int
+	inflight     int
+	queue        *list.List
+	queueSize    int
+	queueTimeout time.Duration
+}
+
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+func NewLimiter(cfg Config, a Algorithm) *Limiter {
+	return &Limiter{
+		mu:           new(sync.Mutex),
+		algorithm:    a,
+		limit:        cfg.InitialLimit,
+		minLimit:     cfg.MinLimit,
+		maxLimit:     cfg.MaxLimit,
+		queue:        list.New(),
+		queueSize:    cfg.QueueSize,
+		queueTimeout: cfg.QueueTimeout,
+	}
+}
+
+// Limit returns the current concurrency limit
+func (l *Limiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// InFlight returns the number of requests admitted and not released yet
+func (l *Limiter) InFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inflight
+}
+
+// Queued returns the number of requests waiting for a slot
+func (l *Limiter) Queued() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.queue.Len()
+}
+
+// Acquire reserves a slot for a request. Every successful call must be followed by a call to
+// Release once the request is completed
+func (l *Limiter) Acquire(ctx context.Context) error {
+	l.mu.Lock()
+	if l.inflight < l.limit {
+		l.inflight++
+		l.mu.Unlock()
+		return nil
+	}
+	if l.queue.Len() >= l.queueSize {
+		l.mu.Unlock()
+		return ErrLimited
+	}
+	w := &waiter{ready: make(chan struct{})}
+	e := l.queue.PushBack(w)
+	l.mu.Unlock()
+
+	t := time.NewTimer(l.queueTimeout)
+	defer t.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-t.C:
+		err = ErrLimited
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w.granted {
+		// the slot was granted while giving up, so it is handed to the next waiter
+		l.inflight--
+		l.dequeue()
+		return err
+	}
+	l.queue.Remove(e)
+	return err
+}
+
+// Release frees the slot of a completed request and updates the limit with its latency. Requests
+// not completed because of their own context should not be reported as samples
+func (l *Limiter) Release(rtt time.Duration, dropped, sample bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if sample {
+		limit := l.algorithm.Update(l.limit, rtt, l.inflight, dropped)
+		if limit < l.minLimit {
+			limit = l.minLimit
+		}
+		if limit > l.maxLimit {
+			limit = l.maxLimit
+		}
+		l.limit = limit
+	}
+	l.inflight--
+	l.dequeue()
+}
+
+func (l *Limiter) dequeue() {
+	for l.inflight < l.limit && l.queue.Len() > 0 {
+		w := l.queue.Remove(l.queue.Front()).(*waiter)
+		w.granted = true
+		l.inflight++
+		close(w.ready)
+	}
+}
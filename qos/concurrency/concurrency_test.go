@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package concurrency
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/starvn/turbo/config"
+	"testing"
+	"time"
+)
+
+func TestConfigGetter(t *testing.T) {
+	serializedCfg := []byte(`{
+		"github.com/starvn/sonic/qos/concurrency": {
+			"algorithm": "Gradient",
+			"initial_limit": 10,
+			"max_limit": 50,
+			"queue_size": 5,
+			"queue_timeout": "50ms",
+			"latency_threshold": "1s"
+		}
+	}`)
+	var dat config.ExtraConfig
+	if err := json.Unmarshal(serializedCfg, &dat); err != nil {
+		t.Error(err.Error())
+	}
+	cfg := ConfigGetter(dat).(Config)
+	expected := Config{
+		Algorithm:        Gradient,
+		InitialLimit:     10,
+		MinLimit:         1,
+		MaxLimit:         50,
+		QueueSize:        5,
+		QueueTimeout:     50 * time.Millisecond,
+		BackoffRatio:     0.9,
+		LatencyThreshold: time.Second,
+		Smoothing:        0.2,
+		Tolerance:        1.5,
+	}
+	if cfg != expected {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+
+	if cfg := ConfigGetter(config.ExtraConfig{}); cfg != ZeroCfg {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+}
+
+func TestNewAlgorithm_aimd(t *testing.T) {
+	a, err := NewAlgorithm(Config{Algorithm: AIMD, BackoffRatio: 0.5, LatencyThreshold: time.Second})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if l := a.Update(10, time.Millisecond, 5, false); l != 11 {
+		t.Errorf("the limit should grow while in use: %d", l)
+	}
+	if l := a.Update(10, time.Millisecond, 1, false); l != 10 {
+		t.Errorf("the limit should not grow while unused: %d", l)
+	}
+	if l := a.Update(10, 2*time.Second, 10, false); l != 5 {
+		t.Errorf("slow requests should decrease the limit: %d", l)
+	}
+	if l := a.Update(10, time.Millisecond, 10, true); l != 5 {
+		t.Errorf("dropped requests should decrease the limit: %d", l)
+	}
+
+	if _, err := NewAlgorithm(Config{Algorithm: "unknown"}); err == nil {
+		t.Error("error expected")
+	}
+}
+
+func TestNewAlgorithm_gradient(t *testing.T) {
+	a, _ := NewAlgorithm(Config{Algorithm: Gradient, BackoffRatio: 0.5, Smoothing: 1, Tolerance: 1})
+
+	limit := 16
+	for i := 0; i < 5; i++ {
+		next := a.Update(limit, 10*time.Millisecond, limit, false)
+		if next <= limit {
+			t.Errorf("#%d: the limit should grow while the latency is stable: %d", i, next)
+		}
+		limit = next
+	}
+
+	if next := a.Update(limit, 100*time.Millisecond, limit, false); next >= limit {
+		t.Errorf("the limit should shrink when the latency increases: %d", next)
+	}
+	if next := a.Update(20, 10*time.Millisecond, 20, true); next != 10 {
+		t.Errorf("dropped requests should decrease the limit: %d", next)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	a, _ := NewAlgorithm(Config{Algorithm: AIMD, BackoffRatio: 0.5})
+	l := NewLimiter(Config{InitialLimit: 1, MinLimit: 1, MaxLimit: 1, QueueSize: 1, QueueTimeout: time.Second}, a)
+
+	if err := l.Acquire(context.Background()); err != nil {
+		t.Error(err)
+	}
+
+	queued := make(chan error)
+	go func() { queued <- l.Acquire(context.Background()) }()
+	for l.Queued() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := l.Acquire(context.Background()); err != ErrLimited {
+		t.Errorf("the request should be rejected when the queue is full: %v", err)
+	}
+
+	l.Release(time.Millisecond, false, true)
+	if err := <-queued; err != nil {
+		t.Errorf("the queued request should get the released slot: %v", err)
+	}
+	if l.InFlight() != 1 || l.Queued() != 0 {
+		t.Errorf("unexpected state: %d in flight, %d queued", l.InFlight(), l.Queued())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("the queued request should honour its context: %v", err)
+	}
+	if l.Queued() != 0 {
+		t.Error("the expired request should leave the queue")
+	}
+
+	l.Release(time.Millisecond, false, true)
+	if l.InFlight() != 0 {
+		t.Errorf("unexpected requests in flight: %d", l.InFlight())
+	}
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package proxy provides a backend proxy middleware limiting the requests in flight with an
+// adaptive concurrency limit
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/starvn/sonic/qos/concurrency"
+	"github.com/starvn/sonic/telemetry/metrics"
+	"github.com/starvn/turbo/config"
+	"github.com/starvn/turbo/log"
+	"github.com/starvn/turbo/proxy"
+	"time"
+)
+
+func BackendFactory(next proxy.BackendFactory, logger log.Logger, m *metrics.Metrics) proxy.BackendFactory {
+	return func(cfg *config.Backend) proxy.Proxy {
+		return NewMiddleware(cfg, logger, m)(next(cfg))
+	}
+}
+
+func NewMiddleware(remote *config.Backend, logger log.Logger, m *metrics.Metrics) proxy.Middleware {
+	logPrefix := "[BACKEND: " + remote.URLPattern + "][Concurrency]"
+	cfg := concurrency.ConfigGetter(remote.ExtraConfig).(concurrency.Config)
+	if cfg == concurrency.ZeroCfg {
+		return proxy.EmptyMiddleware
+	}
+	a, err := concurrency.NewAlgorithm(cfg)
+	if err != nil {
+		logger.Error(logPrefix, err.Error())
+		return proxy.EmptyMiddleware
+	}
+	limiter := concurrency.NewLimiter(cfg, a)
+
+	rejected := func() {}
+	if m != nil && m.Config != nil && !m.Config.BackendDisabled {
+		labels := "layer.backend.name." + remote.URLPattern
+		m.Proxy.FunctionalGauge(func() int64 { return int64(limiter.Limit()) }, "concurrency.limit", labels)
+		m.Proxy.FunctionalGauge(func() int64 { return int64(limiter.InFlight()) }, "concurrency.inflight", labels)
+		m.Proxy.FunctionalGauge(func() int64 { return int64(limiter.Queued()) }, "concurrency.queued", labels)
+		counter := m.Proxy.Counter("concurrency.rejected", labels)
+		rejected = func() { counter.Inc(1) }
+	}
+
+	logger.Debug(logPrefix, "Adaptive concurrency limit enabled with the", cfg.Algorithm, "algorithm")
+
+	return func(next ...proxy.Proxy) proxy.Proxy {
+		if len(next) > 1 {
+			panic(proxy.ErrTooManyProxies)
+		}
+		return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+			if err := limiter.Acquire(ctx); err != nil {
+				rejected()
+				return nil, err
+			}
+			begin := time.Now()
+			resp, err := next[0](ctx, request)
+			// requests cancelled by the client say nothing about the state of the backend
+			sample := !errors.Is(err, context.Canceled)
+			limiter.Release(time.Since(begin), err != nil, sample)
+			return resp, err
+		}
+	}
+}
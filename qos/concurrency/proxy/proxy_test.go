@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	gologging "github.com/op/go-logging"
+	"github.com/starvn/sonic/qos/concurrency"
+	"github.com/starvn/sonic/telemetry/metrics"
+	"github.com/starvn/turbo/config"
+	"github.com/starvn/turbo/proxy"
+	"testing"
+)
+
+func TestNewMiddleware_multipleNext(t *testing.T) {
+	defer func() {
+		if r := recover(); r != proxy.ErrTooManyProxies {
+			t.Error("The code did not panic")
+		}
+	}()
+
+	NewMiddleware(&config.Backend{}, gologging.MustGetLogger("proxy_test"), nil)(proxy.NoopProxy, proxy.NoopProxy)
+}
+
+func TestNewMiddleware_zeroConfig(t *testing.T) {
+	for _, cfg := range []*config.Backend{
+		{},
+		{ExtraConfig: map[string]interface{}{concurrency.Namespace: 42}},
+		{ExtraConfig: map[string]interface{}{concurrency.Namespace: map[string]interface{}{"algorithm": "unknown"}}},
+	} {
+		resp := proxy.Response{}
+		p := NewMiddleware(cfg, gologging.MustGetLogger("proxy_test"), nil)(dummyProxy(&resp, nil))
+
+		for i := 0; i < 100; i++ {
+			r, err := p(context.Background(), &proxy.Request{Path: "/turbo"})
+			if err != nil {
+				t.Error(err.Error())
+				return
+			}
+			if &resp != r {
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestNewMiddleware_ko(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := metrics.New(ctx, config.ExtraConfig{metrics.Namespace: map[string]interface{}{}}, gologging.MustGetLogger("proxy_test"))
+
+	remote := &config.Backend{
+		URLPattern: "/slow",
+		ExtraConfig: map[string]interface{}{
+			concurrency.Namespace: map[string]interface{}{
+				"initial_limit": 2,
+				"queue_size":    1,
+				"queue_timeout": "10ms",
+			},
+		},
+	}
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	p := NewMiddleware(remote, gologging.MustGetLogger("proxy_test"), m)(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		started <- struct{}{}
+		<-release
+		return &proxy.Response{IsComplete: true}, nil
+	})
+
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := p(context.Background(), &proxy.Request{})
+			done <- err
+		}()
+	}
+	<-started
+	<-started
+
+	if _, err := p(context.Background(), &proxy.Request{}); err != concurrency.ErrLimited {
+		t.Errorf("the request should be rejected after waiting in the queue: %v", err)
+	}
+
+	stats := m.TakeSnapshot()
+	if v := stats.Gauges["sonic.proxy.concurrency.inflight.layer.backend.name./slow"]; v != 2 {
+		t.Errorf("unexpected in flight gauge: %d", v)
+	}
+	if v := stats.Gauges["sonic.proxy.concurrency.limit.layer.backend.name./slow"]; v != 2 {
+		t.Errorf("unexpected limit gauge: %d", v)
+	}
+	if v := stats.Counters["sonic.proxy.concurrency.rejected.layer.backend.name./slow"]; v != 1 {
+		t.Errorf("unexpected rejected counter: %d", v)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+
+	if v := m.TakeSnapshot().Gauges["sonic.proxy.concurrency.inflight.layer.backend.name./slow"]; v != 0 {
+		t.Errorf("unexpected in flight gauge: %d", v)
+	}
+}
+
+func dummyProxy(r *proxy.Response, err error) proxy.Proxy {
+	return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		return r, err
+	}
+}
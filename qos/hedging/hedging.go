@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package hedging provides the settings and the latency tracking of the hedged requests: a second
+// request sent to another host when the first one is slower than a fixed or a percentile delay
+package hedging
+
+import (
+	"fmt"
+	"github.com/starvn/turbo/config"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const Namespace = "github.com/starvn/sonic/qos/hedging"
+
+type Config struct {
+	// Delay is the time to wait before sending the hedged request. When a percentile is set, it is
+	// only used until enough latencies are observed
+	Delay time.Duration
+	// Percentile of the observed latencies used as delay, between 0 and 100
+	Percentile float64
+	// MaxRatio caps the hedged requests to a ratio of the requests, limiting the extra load
+	MaxRatio float64
+}
+
+var ZeroCfg = Config{}
+
+func ConfigGetter(e config.ExtraConfig) interface{} {
+	v, ok := e[Namespace]
+	if !ok {
+		return ZeroCfg
+	}
+	tmp, ok := v.(map[string]interface{})
+	if !ok {
+		return ZeroCfg
+	}
+	cfg := Config{
+		Delay:    100 * time.Millisecond,
+		MaxRatio: 0.1,
+	}
+	if v, ok := tmp["delay"]; ok {
+		if d, err := time.ParseDuration(fmt.Sprintf("%v", v)); err == nil && d > 0 {
+			cfg.Delay = d
+		}
+	}
+	if v, ok := tmp["percentile"]; ok {
+		if p := toFloat64(v); p > 0 && p < 100 {
+			cfg.Percentile = p
+		}
+	}
+	if v, ok := tmp["max_ratio"]; ok {
+		if r := toFloat64(v); r >= 0 {
+			cfg.MaxRatio = r
+		}
+	}
+	return cfg
+}
+
+func toFloat64(v interface{}) float64 {
+	switch val := v.(type) {
+	case int64:
+		return float64(val)
+	case int:
+		return float64(val)
+	case float64:
+		return val
+	}
+	return 0
+}
+
+const (
+	sampleSize = 1024
+	minSamples = 100
+	// refreshEvery is the number of new samples triggering the calculation of the percentile
+	refreshEvery = 64
+)
+
+// Delay returns the hedging delay, tracking the latencies of the backend if the config uses a
+// percentile
+type Delay struct {
+	cfg     Config
+	mu      *sync.Mutex
+	samples []time.Duration
+	next    int
+	pending int
+	current time.Duration
+}
+
+func NewDelay(cfg Config) *Delay {
+	return &Delay{
+		cfg:     cfg,
+		mu:      new(sync.Mutex),
+		samples: make([]time.Duration, 0, sampleSize),
+		current: cfg.Delay,
+	}
+}
+
+// Get returns the current delay
+func (d *Delay) Get() time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.current
+}
+
+// Observe records the latency of a response
+func (d *Delay) Observe(latency time.Duration) {
+	if d.cfg.Percentile == 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.samples) < sampleSize {
+		d.samples = append(d.samples, latency)
+	} else {
+		d.samples[d.next] = latency
+		d.next = (d.next + 1) % sampleSize
+	}
+	d.pending++
+	if len(d.samples) < minSamples || d.pending < refreshEvery {
+		return
+	}
+	d.pending = 0
+
+	sorted := make([]time.Duration, len(d.samples))
+	copy(sorted, d.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(math.Ceil(d.cfg.Percentile/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	d.current = sorted[i]
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hedging
+
+import (
+	"encoding/json"
+	"github.com/starvn/turbo/config"
+	"testing"
+	"time"
+)
+
+func TestConfigGetter(t *testing.T) {
+	serializedCfg := []byte(`{
+		"github.com/starvn/sonic/qos/hedging": {
+			"delay": "20ms",
+			"percentile": 95,
+			"max_ratio": 0.05
+		}
+	}`)
+	var dat config.ExtraConfig
+	if err := json.Unmarshal(serializedCfg, &dat); err != nil {
+		t.Error(err.Error())
+	}
+	cfg := ConfigGetter(dat).(Config)
+	expected := Config{
+		Delay:      20 * time.Millisecond,
+		Percentile: 95,
+		MaxRatio:   0.05,
+	}
+	if cfg != expected {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	d := NewDelay(Config{Delay: time.Second})
+	d.Observe(time.Millisecond)
+	if d.Get() != time.Second {
+		t.Errorf("the fixed delay should be used: %v", d.Get())
+	}
+
+	d = NewDelay(Config{Delay: time.Second, Percentile: 90})
+	for i := 1; i < minSamples; i++ {
+		d.Observe(time.Duration(i) * time.Millisecond)
+	}
+	if d.Get() != time.Second {
+		t.Errorf("the fixed delay should be used until there are enough samples: %v", d.Get())
+	}
+	for i := minSamples; i <= 2*refreshEvery+minSamples; i++ {
+		d.Observe(time.Duration(i%100+1) * time.Millisecond)
+	}
+	if v := d.Get(); v < 85*time.Millisecond || v > 95*time.Millisecond {
+		t.Errorf("unexpected percentile delay: %v", v)
+	}
+}
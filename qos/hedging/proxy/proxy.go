@@ -0,0 +1,207 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package proxy provides a backend proxy middleware hedging the slow requests: if the first host
+// does not answer within the delay, the same request is sent to another host and the first
+// successful response is used
+package proxy
+
+import (
+	"context"
+	"github.com/starvn/sonic/qos/hedging"
+	"github.com/starvn/sonic/qos/httpcache"
+	"github.com/starvn/sonic/qos/retry"
+	"github.com/starvn/sonic/telemetry/metrics"
+	"github.com/starvn/turbo/config"
+	"github.com/starvn/turbo/discovery"
+	"github.com/starvn/turbo/log"
+	"github.com/starvn/turbo/proxy"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// budgetWindow is the window used to cap the ratio of hedged requests
+const budgetWindow = 10 * time.Second
+
+func BackendFactory(next proxy.BackendFactory, logger log.Logger, m *metrics.Metrics) proxy.BackendFactory {
+	return func(cfg *config.Backend) proxy.Proxy {
+		return NewMiddleware(cfg, logger, m)(next(cfg))
+	}
+}
+
+func NewMiddleware(remote *config.Backend, logger log.Logger, m *metrics.Metrics) proxy.Middleware {
+	return NewMiddlewareWithSubscriber(remote, discovery.GetSubscriber(remote), logger, m)
+}
+
+// NewMiddlewareWithSubscriber returns a hedging middleware sending the hedged requests to the hosts
+// of the given subscriber
+func NewMiddlewareWithSubscriber(remote *config.Backend, subscriber discovery.Subscriber, logger log.Logger, m *metrics.Metrics) proxy.Middleware {
+	logPrefix := "[BACKEND: " + remote.URLPattern + "][Hedging]"
+	cfg := hedging.ConfigGetter(remote.ExtraConfig).(hedging.Config)
+	if cfg == hedging.ZeroCfg {
+		return proxy.EmptyMiddleware
+	}
+
+	delay := hedging.NewDelay(cfg)
+	budget := retry.NewBudget(cfg.MaxRatio, 0, budgetWindow)
+	var hedged, won int64
+
+	report := func(hedge, win bool) {}
+	if m != nil && m.Config != nil && !m.Config.BackendDisabled {
+		labels := "layer.backend.name." + remote.URLPattern
+		hedgedCounter := m.Proxy.Counter("hedging.requests", labels)
+		wonCounter := m.Proxy.Counter("hedging.wins", labels)
+		m.Proxy.FunctionalGauge(func() int64 {
+			h := atomic.LoadInt64(&hedged)
+			if h == 0 {
+				return 0
+			}
+			return 100 * atomic.LoadInt64(&won) / h
+		}, "hedging.win_rate", labels)
+		report = func(hedge, win bool) {
+			if hedge {
+				hedgedCounter.Inc(1)
+			}
+			if win {
+				wonCounter.Inc(1)
+			}
+		}
+	}
+
+	logger.Debug(logPrefix, "Hedging the requests slower than", cfg.Delay)
+
+	return func(next ...proxy.Proxy) proxy.Proxy {
+		if len(next) > 1 {
+			panic(proxy.ErrTooManyProxies)
+		}
+		return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+			if httpcache.IsStaleOnly(ctx) {
+				return next[0](ctx, request)
+			}
+			budget.Request()
+			if request.URL == nil || (request.Method != http.MethodGet && request.Method != http.MethodHead) {
+				return next[0](ctx, request)
+			}
+
+			results := make(chan result, 2)
+			begin := time.Now()
+			primary := start(ctx, next[0], proxy.CloneRequest(request), false, results)
+
+			timer := time.NewTimer(delay.Get())
+			defer timer.Stop()
+
+			var hedge *branch
+			select {
+			case r := <-results:
+				delay.Observe(time.Since(begin))
+				r.branch.keep(ctx, r.resp)
+				return r.resp, r.err
+			case <-timer.C:
+			}
+
+			if u, ok := hedgeURL(request.URL, subscriber); ok && budget.Retry() {
+				hedgeRequest := proxy.CloneRequest(request)
+				hedgeRequest.URL = u
+				hedge = start(ctx, next[0], hedgeRequest, true, results)
+				atomic.AddInt64(&hedged, 1)
+			}
+
+			pending := 1
+			if hedge != nil {
+				pending = 2
+			}
+			var last result
+			for ; pending > 0; pending-- {
+				last = <-results
+				if last.err == nil || pending == 1 {
+					break
+				}
+			}
+			delay.Observe(time.Since(begin))
+
+			// the loser is cancelled, while the winner keeps its context until the parent one is done
+			for _, b := range []*branch{primary, hedge} {
+				if b != nil && b != last.branch {
+					b.cancel()
+				}
+			}
+			last.branch.keep(ctx, last.resp)
+
+			win := last.branch.hedged && last.err == nil
+			if win {
+				atomic.AddInt64(&won, 1)
+			}
+			report(hedge != nil, win)
+			return last.resp, last.err
+		}
+	}
+}
+
+type branch struct {
+	cancel context.CancelFunc
+	hedged bool
+}
+
+type result struct {
+	branch *branch
+	resp   *proxy.Response
+	err    error
+}
+
+func start(ctx context.Context, next proxy.Proxy, request *proxy.Request, hedged bool, results chan<- result) *branch {
+	ctx, cancel := context.WithCancel(ctx)
+	b := &branch{cancel: cancel, hedged: hedged}
+	go func() {
+		resp, err := next(ctx, request)
+		results <- result{branch: b, resp: resp, err: err}
+	}()
+	return b
+}
+
+// keep releases the context of the winner branch. The streamed responses still have to be
+// consumed, so their context is released with the parent one
+func (b *branch) keep(ctx context.Context, resp *proxy.Response) {
+	if resp == nil || resp.Io == nil {
+		b.cancel()
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		b.cancel()
+	}()
+}
+
+// hedgeURL returns the url of the request pointing to a host of the subscriber different from the
+// one of the first request
+func hedgeURL(original *url.URL, subscriber discovery.Subscriber) (*url.URL, bool) {
+	hosts, err := subscriber.Hosts()
+	if err != nil {
+		return nil, false
+	}
+	for _, h := range hosts {
+		u, err := url.Parse(h)
+		if err != nil || u.Host == "" || (u.Host == original.Host && u.Scheme == original.Scheme) {
+			continue
+		}
+		hedged := *original
+		hedged.Scheme = u.Scheme
+		hedged.Host = u.Host
+		return &hedged, true
+	}
+	return nil, false
+}
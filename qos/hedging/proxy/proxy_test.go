@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	gologging "github.com/op/go-logging"
+	"github.com/starvn/sonic/qos/hedging"
+	"github.com/starvn/sonic/qos/httpcache"
+	"github.com/starvn/sonic/telemetry/metrics"
+	"github.com/starvn/turbo/config"
+	"github.com/starvn/turbo/discovery"
+	"github.com/starvn/turbo/proxy"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newRequest(method string) *proxy.Request {
+	u, _ := url.Parse("http://slow/hedging")
+	return &proxy.Request{Method: method, URL: u, Path: "/hedging"}
+}
+
+func newHedgedProxy(cfg map[string]interface{}, m *metrics.Metrics, next proxy.Proxy) proxy.Proxy {
+	remote := &config.Backend{
+		URLPattern:  "/hedging",
+		Host:        []string{"http://slow", "http://fast"},
+		ExtraConfig: map[string]interface{}{hedging.Namespace: cfg},
+	}
+	return NewMiddlewareWithSubscriber(remote, discovery.FixedSubscriberFactory(remote), gologging.MustGetLogger("proxy_test"), m)(next)
+}
+
+// hostProxy answers after the delay of the host, reporting the cancelled requests
+type hostProxy struct {
+	mu        *sync.Mutex
+	delays    map[string]time.Duration
+	calls     map[string]int
+	cancelled map[string]int
+}
+
+func newHostProxy(delays map[string]time.Duration) *hostProxy {
+	return &hostProxy{mu: new(sync.Mutex), delays: delays, calls: map[string]int{}, cancelled: map[string]int{}}
+}
+
+func (h *hostProxy) proxy(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+	h.mu.Lock()
+	h.calls[r.URL.Host]++
+	h.mu.Unlock()
+	select {
+	case <-time.After(h.delays[r.URL.Host]):
+		return &proxy.Response{IsComplete: true, Data: map[string]interface{}{"host": r.URL.Host}}, nil
+	case <-ctx.Done():
+		h.mu.Lock()
+		h.cancelled[r.URL.Host]++
+		h.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (h *hostProxy) count(m map[string]int, host string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return m[host]
+}
+
+func TestNewMiddleware_hedged(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := metrics.New(ctx, config.ExtraConfig{metrics.Namespace: map[string]interface{}{}}, gologging.MustGetLogger("proxy_test"))
+
+	hosts := newHostProxy(map[string]time.Duration{"slow": time.Second, "fast": time.Millisecond})
+	p := newHedgedProxy(map[string]interface{}{"delay": "10ms", "max_ratio": 1}, m, hosts.proxy)
+
+	begin := time.Now()
+	resp, err := p(context.Background(), newRequest("GET"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if resp.Data["host"] != "fast" {
+		t.Errorf("the hedged request should win: %v", resp.Data)
+	}
+	if d := time.Since(begin); d > 500*time.Millisecond {
+		t.Errorf("the response took too long: %v", d)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if hosts.count(hosts.cancelled, "slow") != 1 {
+		t.Error("the slow request should be cancelled")
+	}
+
+	stats := m.TakeSnapshot()
+	if v := stats.Counters["sonic.proxy.hedging.requests.layer.backend.name./hedging"]; v != 1 {
+		t.Errorf("unexpected hedged requests: %d", v)
+	}
+	if v := stats.Counters["sonic.proxy.hedging.wins.layer.backend.name./hedging"]; v != 1 {
+		t.Errorf("unexpected wins: %d", v)
+	}
+	if v := stats.Gauges["sonic.proxy.hedging.win_rate.layer.backend.name./hedging"]; v != 100 {
+		t.Errorf("unexpected win rate: %d", v)
+	}
+}
+
+func TestNewMiddleware_notHedged(t *testing.T) {
+	hosts := newHostProxy(map[string]time.Duration{"slow": 30 * time.Millisecond, "fast": time.Millisecond})
+
+	p := newHedgedProxy(map[string]interface{}{"delay": "100ms", "max_ratio": 1}, nil, hosts.proxy)
+	if resp, err := p(context.Background(), newRequest("GET")); err != nil || resp.Data["host"] != "slow" {
+		t.Errorf("the request should not be hedged before the delay: %v %v", resp, err)
+	}
+
+	p = newHedgedProxy(map[string]interface{}{"delay": "1ms", "max_ratio": 1}, nil, hosts.proxy)
+	if resp, err := p(context.Background(), newRequest("POST")); err != nil || resp.Data["host"] != "slow" {
+		t.Errorf("the non read-only requests should not be hedged: %v %v", resp, err)
+	}
+	if resp, err := p(httpcache.StaleOnly(context.Background()), newRequest("GET")); err != nil || resp.Data["host"] != "slow" {
+		t.Errorf("the requests restricted to the cache should not be hedged: %v %v", resp, err)
+	}
+
+	if calls := hosts.count(hosts.calls, "fast"); calls != 0 {
+		t.Errorf("unexpected hedged requests: %d", calls)
+	}
+}
+
+func TestNewMiddleware_maxRatio(t *testing.T) {
+	hosts := newHostProxy(map[string]time.Duration{"slow": 20 * time.Millisecond, "fast": time.Millisecond})
+	p := newHedgedProxy(map[string]interface{}{"delay": "1ms", "max_ratio": 0.25}, nil, hosts.proxy)
+
+	for i := 0; i < 8; i++ {
+		p(context.Background(), newRequest("GET"))
+	}
+	if calls := hosts.count(hosts.calls, "fast"); calls != 2 {
+		t.Errorf("the hedged requests should be capped: %d", calls)
+	}
+}
+
+func TestNewMiddleware_firstError(t *testing.T) {
+	p := newHedgedProxy(map[string]interface{}{"delay": "5ms", "max_ratio": 1}, nil, func(_ context.Context, r *proxy.Request) (*proxy.Response, error) {
+		if r.URL.Host == "fast" {
+			return nil, errors.New("hedge failed")
+		}
+		time.Sleep(20 * time.Millisecond)
+		return &proxy.Response{IsComplete: true}, nil
+	})
+	if resp, err := p(context.Background(), newRequest("GET")); err != nil || !resp.IsComplete {
+		t.Errorf("the successful response should be used: %v %v", resp, err)
+	}
+}
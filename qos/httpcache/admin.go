@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpcache
+
+import (
+	"context"
+	"errors"
+	"github.com/starvn/sonic/support/admin"
+	"github.com/starvn/turbo/config"
+	"github.com/starvn/turbo/log"
+	"net/http"
+	"strings"
+)
+
+// AdminPath is the root path of the admin API of the cache
+const AdminPath = "/__httpcache"
+
+var (
+	ErrNoConfig = errors.New("no admin config defined for the http cache")
+	ErrNoToken  = admin.ErrNoToken
+)
+
+// RunAdmin starts the admin API of the cache if the service config defines it, with the format
+// {"admin": {"listen_address": ":8092", "token": "secret"}}. The server is shut down when the
+// context is cancelled
+func RunAdmin(ctx context.Context, e config.ExtraConfig, l log.Logger) error {
+	cfg, ok := admin.ConfigGetter(e, Namespace)
+	if !ok {
+		return ErrNoConfig
+	}
+	return admin.Run(ctx, cfg, AdminPath, NewAdminHandler(DefaultRegistry, cfg.Token), l, "[SERVICE: HTTPCache]")
+}
+
+// StoreStatus is the state of a store of the registry
+type StoreStatus struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Keys int    `json:"keys"`
+}
+
+// NewAdminHandler returns the handler listing the stores of the registry (GET /__httpcache) and
+// purging their responses (POST /__httpcache/purge?key=...&prefix=...&tag=...&store=...). The
+// requests must send the token in the Authorization header as a bearer token
+func NewAdminHandler(r *Registry, token string) http.Handler {
+	return admin.Authorize(token, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		action := strings.Trim(strings.TrimPrefix(req.URL.Path, AdminPath), "/")
+		switch action {
+		case "":
+			if req.Method != http.MethodGet {
+				http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			names := r.Names()
+			res := make([]StoreStatus, 0, len(names))
+			for _, name := range names {
+				if s, ok := r.Get(name); ok {
+					res = append(res, StoreStatus{Name: name, Size: s.Size(), Keys: len(s.Keys())})
+				}
+			}
+			admin.WriteJSON(rw, res)
+		case "purge":
+			if req.Method != http.MethodPost {
+				http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			params := req.URL.Query()
+			q := PurgeQuery{
+				Key:    params.Get("key"),
+				Prefix: params.Get("prefix"),
+				Tag:    params.Get("tag"),
+			}
+			if q.isZero() {
+				http.Error(rw, ErrEmptyPurge.Error(), http.StatusBadRequest)
+				return
+			}
+			if name := params.Get("store"); name != "" {
+				s, ok := r.Get(name)
+				if !ok {
+					http.Error(rw, "unknown store", http.StatusNotFound)
+					return
+				}
+				n, _ := s.Purge(q)
+				admin.WriteJSON(rw, map[string]map[string]int{"purged": {name: n}})
+				return
+			}
+			purged, _ := r.Purge(q)
+			admin.WriteJSON(rw, map[string]map[string]int{"purged": purged})
+		default:
+			http.Error(rw, "unknown action", http.StatusNotFound)
+		}
+	}))
+}
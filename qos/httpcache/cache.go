@@ -14,32 +14,309 @@
  * limitations under the License.
  */
 
-// Package httpcache introduces an in-memory-cached http client into the Sonic stack
+// Package httpcache introduces a cached http client into the Sonic stack, with bounded memory or
+// disk stores. The gateway can override the freshness of the responses, serve stale responses
+// while they are revalidated or when the upstream fails, and choose the parts of the request
+// identifying the cached responses
 package httpcache
 
 import (
 	"context"
-	"github.com/gregjones/httpcache"
+	"fmt"
+	"github.com/starvn/sonic/telemetry/metrics"
 	"github.com/starvn/turbo/config"
+	"github.com/starvn/turbo/log"
 	"github.com/starvn/turbo/proxy"
 	"github.com/starvn/turbo/transport/http/client"
 	"net/http"
+	"sync"
+	"time"
 )
 
 const Namespace = "github.com/starvn/sonic/qos/httpcache"
 
+const (
+	MemoryStoreName = "memory"
+	DiskStoreName   = "disk"
+)
+
+// DefaultMaxSize is the max size of the stores, in bytes, if the config does not define it
+const DefaultMaxSize = 64 << 20
+
+type Config struct {
+	// Store is the kind of store: memory (default) or disk
+	Store string
+	// MaxSize is the max size of the store, in bytes
+	MaxSize int64
+	// Shared is the name of the store shared with other backends. Without it, every backend has
+	// its own store
+	Shared string
+	// Path is the directory of the disk store
+	Path string
+	// TTL overrides the lifetime declared by the upstream for the successful responses
+	TTL time.Duration
+	// DefaultTTL is the lifetime of the successful responses without cache headers
+	DefaultTTL time.Duration
+	// StaleWhileRevalidate is the time a stale response is served while it is refreshed in the
+	// background
+	StaleWhileRevalidate time.Duration
+	// StaleIfError is the time a stale response is served when the upstream fails or its circuit
+	// breaker is open
+	StaleIfError time.Duration
+	// Key selects the parts of the request identifying the cached responses. Without it, the
+	// responses are identified by their URL
+	Key *KeyConfig
+	// SurrogateKeyHeader is the response header with the tags of the responses, used by the purges
+	SurrogateKeyHeader string
+}
+
+// KeyConfig defines the cache key of the responses. The query parameters are all included unless
+// some of them are selected. The claims are read from the bearer token of the request, so the
+// endpoint must validate it
+type KeyConfig struct {
+	Headers []string
+	Query   []string
+	Claims  []string
+}
+
+var ZeroCfg = Config{}
+
+func ConfigGetter(e config.ExtraConfig) interface{} {
+	v, ok := e[Namespace]
+	if !ok {
+		return ZeroCfg
+	}
+	tmp, ok := v.(map[string]interface{})
+	if !ok {
+		return ZeroCfg
+	}
+	cfg := Config{
+		Store:              MemoryStoreName,
+		MaxSize:            DefaultMaxSize,
+		SurrogateKeyHeader: DefaultSurrogateKeyHeader,
+	}
+	if v, ok := tmp["store"]; ok {
+		cfg.Store = fmt.Sprintf("%v", v)
+	}
+	if v, ok := tmp["max_size"]; ok {
+		switch val := v.(type) {
+		case int64:
+			cfg.MaxSize = val
+		case int:
+			cfg.MaxSize = int64(val)
+		case float64:
+			cfg.MaxSize = int64(val)
+		}
+	}
+	if v, ok := tmp["shared"]; ok {
+		cfg.Shared = fmt.Sprintf("%v", v)
+	}
+	if v, ok := tmp["path"]; ok {
+		cfg.Path = fmt.Sprintf("%v", v)
+	}
+	if v, ok := tmp["surrogate_key_header"]; ok {
+		cfg.SurrogateKeyHeader = fmt.Sprintf("%v", v)
+	}
+	cfg.TTL = parseDuration(tmp["ttl"])
+	cfg.DefaultTTL = parseDuration(tmp["default_ttl"])
+	cfg.StaleWhileRevalidate = parseDuration(tmp["stale_while_revalidate"])
+	cfg.StaleIfError = parseDuration(tmp["stale_if_error"])
+	if v, ok := tmp["cache_key"].(map[string]interface{}); ok {
+		cfg.Key = &KeyConfig{
+			Headers: parseStrings(v["headers"]),
+			Query:   parseStrings(v["query"]),
+			Claims:  parseStrings(v["claims"]),
+		}
+	}
+	return cfg
+}
+
+func parseDuration(v interface{}) time.Duration {
+	if v == nil {
+		return 0
+	}
+	d, err := time.ParseDuration(fmt.Sprintf("%v", v))
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
+
+func parseStrings(v interface{}) []string {
+	values, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	res := make([]string, 0, len(values))
+	for _, value := range values {
+		res = append(res, fmt.Sprintf("%v", value))
+	}
+	return res
+}
+
 var (
-	memTransport = httpcache.NewMemoryCacheTransport()
-	memClient    = http.Client{Transport: memTransport}
+	sharedStores   = map[sharedStoreKey]*TaggedStore{}
+	sharedStoresMu = new(sync.Mutex)
 )
 
+// sharedStoreKey identifies a shared or disk store within the context of the service creating it
+type sharedStoreKey struct {
+	ctx context.Context
+	key string
+}
+
+// NewStore returns the store defined by the config for the named backend, reporting its hits,
+// misses and evictions and adding it to the DefaultRegistry. The shared stores and the disk stores
+// are created once per name or path
+func NewStore(cfg Config, name string, m *metrics.Metrics) (*TaggedStore, error) {
+	return NewStoreWithContext(context.Background(), cfg, name, m)
+}
+
+// NewStoreWithContext returns the store defined by the config for the named backend, like NewStore.
+// The shared stores and the disk stores are created once per name or path and context, and the
+// stores are removed from the DefaultRegistry when the context is done
+func NewStoreWithContext(ctx context.Context, cfg Config, name string, m *metrics.Metrics) (*TaggedStore, error) {
+	labels := "layer.backend.name." + name
+	key := ""
+	if cfg.Shared != "" {
+		key = "shared:" + cfg.Shared
+		name = cfg.Shared
+		labels = "httpcache.store." + cfg.Shared
+	} else if cfg.Store == DiskStoreName {
+		key = "disk:" + cfg.Path
+	}
+	if key == "" {
+		return registerStore(ctx, cfg, name, m, labels, func() {})
+	}
+
+	sharedStoresMu.Lock()
+	defer sharedStoresMu.Unlock()
+	k := sharedStoreKey{ctx: ctx, key: key}
+	if s, ok := sharedStores[k]; ok {
+		return s, nil
+	}
+	s, err := registerStore(ctx, cfg, name, m, labels, func() {
+		sharedStoresMu.Lock()
+		delete(sharedStores, k)
+		sharedStoresMu.Unlock()
+	})
+	if err != nil {
+		return nil, err
+	}
+	sharedStores[k] = s
+	return s, nil
+}
+
+// registerStore creates the store and adds it to the DefaultRegistry until the context is done,
+// calling release before removing it
+func registerStore(ctx context.Context, cfg Config, name string, m *metrics.Metrics, labels string, release func()) (*TaggedStore, error) {
+	s, err := newStore(cfg, m, labels)
+	if err != nil {
+		return nil, err
+	}
+	registered := DefaultRegistry.Add(name, s)
+	if done := ctx.Done(); done != nil {
+		go func() {
+			<-done
+			release()
+			DefaultRegistry.Remove(registered)
+		}()
+	}
+	return s, nil
+}
+
+func newStore(cfg Config, m *metrics.Metrics, labels string) (*TaggedStore, error) {
+	var tagged *TaggedStore
+	untag := func(key string) {
+		if tagged != nil {
+			tagged.Untag(key)
+		}
+	}
+	enabled := m != nil && m.Config != nil && !m.Config.BackendDisabled
+	onEvict := untag
+	if enabled {
+		evictions := m.Proxy.Counter("httpcache.evictions", labels)
+		onEvict = func(key string) {
+			evictions.Inc(1)
+			untag(key)
+		}
+	}
+
+	var s Store
+	switch cfg.Store {
+	case DiskStoreName:
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("the disk store requires a path")
+		}
+		ds, err := NewDiskStore(cfg.Path, cfg.MaxSize, onEvict)
+		if err != nil {
+			return nil, err
+		}
+		s = ds
+	case MemoryStoreName, "":
+		s = NewMemoryStore(cfg.MaxSize, onEvict)
+	default:
+		return nil, fmt.Errorf("unknown store: %s", cfg.Store)
+	}
+
+	if enabled {
+		m.Proxy.FunctionalGauge(s.Size, "httpcache.size", labels)
+		s = &instrumentedStore{
+			Store:  s,
+			hits:   m.Proxy.Counter("httpcache.hits", labels),
+			misses: m.Proxy.Counter("httpcache.misses", labels),
+		}
+	}
+	tagged = NewTaggedStore(s, cfg.SurrogateKeyHeader)
+	return tagged, nil
+}
+
+type instrumentedStore struct {
+	Store
+	hits   counter
+	misses counter
+}
+
+type counter interface {
+	Inc(int64)
+}
+
+func (s *instrumentedStore) Get(key string) ([]byte, bool) {
+	v, ok := s.Store.Get(key)
+	if ok {
+		s.hits.Inc(1)
+	} else {
+		s.misses.Inc(1)
+	}
+	return v, ok
+}
+
 func NewHTTPClient(cfg *config.Backend) client.HTTPClientFactory {
-	_, ok := cfg.ExtraConfig[Namespace]
-	if !ok {
+	return NewHTTPClientWithMetrics(cfg, log.NoOp, nil)
+}
+
+// NewHTTPClientWithMetrics returns a client factory caching the responses in the store defined by
+// the backend config, reporting the state of the store to the metrics collector. The stale
+// responses are revalidated in the background within the timeout of the backend
+func NewHTTPClientWithMetrics(cfg *config.Backend, logger log.Logger, m *metrics.Metrics) client.HTTPClientFactory {
+	return NewHTTPClientWithContext(context.Background(), cfg, logger, m)
+}
+
+// NewHTTPClientWithContext returns a client factory like NewHTTPClientWithMetrics, whose store is
+// removed from the DefaultRegistry when the context is done
+func NewHTTPClientWithContext(ctx context.Context, cfg *config.Backend, logger log.Logger, m *metrics.Metrics) client.HTTPClientFactory {
+	data := ConfigGetter(cfg.ExtraConfig).(Config)
+	if data == ZeroCfg {
+		return client.NewHTTPClient
+	}
+	store, err := NewStoreWithContext(ctx, data, cfg.URLPattern, m)
+	if err != nil {
+		logger.Error("[BACKEND: "+cfg.URLPattern+"][HTTPCache]", "Unable to create the store:", err.Error())
 		return client.NewHTTPClient
 	}
+	c := &http.Client{Transport: NewTransport(data, store, cfg.Timeout)}
 	return func(_ context.Context) *http.Client {
-		return &memClient
+		return c
 	}
 }
 
@@ -20,8 +20,10 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"github.com/starvn/sonic/telemetry/metrics"
 	"github.com/starvn/turbo/config"
 	"github.com/starvn/turbo/encoding"
+	logging "github.com/starvn/turbo/log"
 	"github.com/starvn/turbo/proxy"
 	"io/ioutil"
 	"log"
@@ -30,6 +32,7 @@ import (
 	"net/url"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestClient_ok(t *testing.T) {
@@ -123,3 +126,97 @@ func testCacheSystem(t *testing.T, f func(*testing.T, string), expected uint64)
 		t.Errorf("the server should not being hited just %d time(s). Total requests: %d\n", expected, opsFinal)
 	}
 }
+
+func TestNewHTTPClientWithMetrics_shared(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := metrics.New(ctx, config.ExtraConfig{metrics.Namespace: map[string]interface{}{}}, logging.NoOp)
+
+	newCfg := func(pattern string) *config.Backend {
+		return &config.Backend{
+			URLPattern: pattern,
+			ExtraConfig: map[string]interface{}{
+				Namespace: map[string]interface{}{
+					"shared":   "shared_test",
+					"max_size": 1024,
+				},
+			},
+		}
+	}
+
+	testCacheSystem(t, func(t *testing.T, URL string) {
+		for _, cfg := range []*config.Backend{newCfg("/a"), newCfg("/b")} {
+			c := NewHTTPClientWithMetrics(cfg, logging.NoOp, m)(context.Background())
+			for i := 0; i < 50; i++ {
+				resp, err := c.Get(URL)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				_, _ = ioutil.ReadAll(resp.Body)
+				_ = resp.Body.Close()
+			}
+		}
+	}, 1)
+
+	stats := m.TakeSnapshot()
+	if v := stats.Counters["sonic.proxy.httpcache.misses.httpcache.store.shared_test"]; v != 1 {
+		t.Errorf("unexpected misses: %d", v)
+	}
+	if v := stats.Counters["sonic.proxy.httpcache.hits.httpcache.store.shared_test"]; v != 99 {
+		t.Errorf("unexpected hits: %d", v)
+	}
+	if v := stats.Gauges["sonic.proxy.httpcache.size.httpcache.store.shared_test"]; v <= 0 || v > 1024 {
+		t.Errorf("unexpected size: %d", v)
+	}
+}
+
+func TestNewStoreWithContext(t *testing.T) {
+	cfg := Config{Store: MemoryStoreName, MaxSize: 1024, Shared: "context_test"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s1, err := NewStoreWithContext(ctx, cfg, "/a", nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if s, _ := NewStoreWithContext(ctx, cfg, "/b", nil); s != s1 {
+		t.Error("the backends of the same context should share the store")
+	}
+	s2, _ := NewStoreWithContext(context.Background(), cfg, "/c", nil)
+	if s2 == s1 {
+		t.Error("the backends of different contexts should not share the store")
+	}
+	own, _ := NewStoreWithContext(ctx, Config{Store: MemoryStoreName, MaxSize: 1024}, "/context_test_own", nil)
+	if s, ok := DefaultRegistry.Get("context_test"); !ok || s != s1 {
+		t.Error("the store should be registered")
+	}
+	if s, ok := DefaultRegistry.Get("/context_test_own"); !ok || s != own {
+		t.Error("the store of the backend should be registered")
+	}
+
+	cancel()
+	for i := 0; i < 100; i++ {
+		_, shared := DefaultRegistry.Get("context_test")
+		_, backend := DefaultRegistry.Get("/context_test_own")
+		if !shared && !backend {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, ok := DefaultRegistry.Get("context_test"); ok {
+		t.Error("the shared store should be unregistered once the context is done")
+	}
+	if _, ok := DefaultRegistry.Get("/context_test_own"); ok {
+		t.Error("the store of the backend should be unregistered once the context is done")
+	}
+	if s, ok := DefaultRegistry.Get("context_test#2"); !ok || s != s2 {
+		t.Error("the store of the other context should stay registered")
+	}
+	sharedStoresMu.Lock()
+	_, ok := sharedStores[sharedStoreKey{ctx: ctx, key: "shared:context_test"}]
+	sharedStoresMu.Unlock()
+	if ok {
+		t.Error("the shared store should be released once the context is done")
+	}
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DiskStore keeps the responses as files in a directory, evicting the least recently used ones
+// once its size is over the max size. Every file starts with the line of its key, so the index is
+// rebuilt from the directory at creation time and the responses survive a restart
+type DiskStore struct {
+	mu      *sync.Mutex
+	path    string
+	maxSize int64
+	size    int64
+	ll      *list.List
+	items   map[string]*list.Element
+	onEvict func(key string)
+}
+
+type diskEntry struct {
+	key  string
+	name string
+	size int64
+}
+
+// NewDiskStore returns a disk store holding up to maxSize bytes in the given directory
+func NewDiskStore(path string, maxSize int64, onEvict func(key string)) (*DiskStore, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	s := &DiskStore{
+		mu:      new(sync.Mutex),
+		path:    path,
+		maxSize: maxSize,
+		ll:      list.New(),
+		items:   map[string]*list.Element{},
+		onEvict: onEvict,
+	}
+
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	// the most recently modified files are the most recently used ones
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().After(files[j].ModTime()) })
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != "" {
+			continue
+		}
+		key, err := readKey(filepath.Join(path, f.Name()))
+		if err != nil || fileName(key) != f.Name() {
+			continue
+		}
+		s.items[key] = s.ll.PushBack(&diskEntry{key: key, name: f.Name(), size: f.Size()})
+		s.size += f.Size()
+	}
+	s.evict()
+	return s, nil
+}
+
+func fileName(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+func readKey(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	key, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(key, "\n"), nil
+}
+
+func (s *DiskStore) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	e, ok := s.items[key]
+	if ok {
+		s.ll.MoveToFront(e)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(filepath.Join(s.path, e.Value.(*diskEntry).name))
+	if err != nil {
+		return nil, false
+	}
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return nil, false
+	}
+	return data[i+1:], true
+}
+
+func (s *DiskStore) Set(key string, value []byte) {
+	name := fileName(key)
+	if int64(len(value)) > s.maxSize {
+		s.Delete(key)
+		return
+	}
+
+	tmp, err := ioutil.TempFile(s.path, name+".*.tmp")
+	if err != nil {
+		return
+	}
+	_, err = tmp.WriteString(key + "\n")
+	if err == nil {
+		_, err = tmp.Write(value)
+	}
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	s.mu.Lock()
+	if err := os.Rename(tmp.Name(), filepath.Join(s.path, name)); err != nil {
+		s.mu.Unlock()
+		os.Remove(tmp.Name())
+		return
+	}
+	size := int64(len(key) + 1 + len(value))
+	if e, ok := s.items[key]; ok {
+		s.size -= s.ll.Remove(e).(*diskEntry).size
+	}
+	s.items[key] = s.ll.PushFront(&diskEntry{key: key, name: name, size: size})
+	s.size += size
+	evicted := s.evict()
+	s.mu.Unlock()
+
+	if s.onEvict != nil {
+		for _, k := range evicted {
+			s.onEvict(k)
+		}
+	}
+}
+
+func (s *DiskStore) Delete(key string) {
+	s.mu.Lock()
+	if e, ok := s.items[key]; ok {
+		s.removeElement(e)
+	}
+	s.mu.Unlock()
+}
+
+func (s *DiskStore) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+func (s *DiskStore) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.items))
+	for k := range s.items {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// evict removes the least recently used files until the size is under the max size, returning
+// their keys
+func (s *DiskStore) evict() []string {
+	var evicted []string
+	for s.size > s.maxSize {
+		e := s.ll.Back()
+		evicted = append(evicted, e.Value.(*diskEntry).key)
+		s.removeElement(e)
+	}
+	return evicted
+}
+
+func (s *DiskStore) removeElement(e *list.Element) {
+	entry := s.ll.Remove(e).(*diskEntry)
+	delete(s.items, entry.key)
+	s.size -= entry.size
+	os.Remove(filepath.Join(s.path, entry.name))
+}
@@ -0,0 +1,342 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package proxy provides an endpoint level cache, keeping the final responses of the endpoints so
+// the cache hits skip the backends and the merging of their responses
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/starvn/sonic/qos/httpcache"
+	"github.com/starvn/turbo/config"
+	"github.com/starvn/turbo/log"
+	"github.com/starvn/turbo/proxy"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const Namespace = "github.com/starvn/sonic/qos/httpcache/proxy"
+
+var now = time.Now
+
+// privateHeaders are the response headers set for a single user, so they are never cached
+var privateHeaders = map[string]struct{}{
+	"Set-Cookie":          {},
+	"Set-Cookie2":         {},
+	"Authentication-Info": {},
+}
+
+type Config struct {
+	// TTL is the lifetime of the cached responses. The cache_ttl of the endpoint is used by default
+	TTL time.Duration
+	// MaxSize is the max size of the cache of the endpoint, in bytes
+	MaxSize int64
+	Key     KeyConfig
+}
+
+// KeyConfig defines the cache key of the responses. All the params and the query strings are
+// included unless some of them are selected. The claims are read from the bearer token of the
+// request, so the endpoint must validate it and pass the Authorization header
+type KeyConfig struct {
+	Params  []string
+	Query   []string
+	Headers []string
+	Claims  []string
+}
+
+// ConfigGetter returns the cache config of the endpoint, if any
+func ConfigGetter(e config.ExtraConfig) (Config, bool) {
+	v, ok := e[Namespace]
+	if !ok {
+		return Config{}, false
+	}
+	tmp, ok := v.(map[string]interface{})
+	if !ok {
+		return Config{}, false
+	}
+	cfg := Config{
+		MaxSize: httpcache.DefaultMaxSize,
+	}
+	if v, ok := tmp["ttl"]; ok {
+		if d, err := time.ParseDuration(fmt.Sprintf("%v", v)); err == nil && d > 0 {
+			cfg.TTL = d
+		}
+	}
+	if v, ok := tmp["max_size"]; ok {
+		switch val := v.(type) {
+		case int64:
+			cfg.MaxSize = val
+		case int:
+			cfg.MaxSize = int64(val)
+		case float64:
+			cfg.MaxSize = int64(val)
+		}
+	}
+	if v, ok := tmp["cache_key"].(map[string]interface{}); ok {
+		cfg.Key = KeyConfig{
+			Params:  parseStrings(v["params"]),
+			Query:   parseStrings(v["query"]),
+			Headers: parseStrings(v["headers"]),
+			Claims:  parseStrings(v["claims"]),
+		}
+	}
+	return cfg, true
+}
+
+func parseStrings(v interface{}) []string {
+	values, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	res := make([]string, 0, len(values))
+	for _, value := range values {
+		res = append(res, fmt.Sprintf("%v", value))
+	}
+	return res
+}
+
+// ProxyFactory returns a proxy factory caching the complete responses of the GET endpoints with a
+// cache config. The caches are added to the httpcache.DefaultRegistry, so they can be purged from
+// the admin API of the http cache
+func ProxyFactory(l log.Logger, pf proxy.Factory) proxy.Factory {
+	return ProxyFactoryWithContext(context.Background(), l, pf)
+}
+
+// ProxyFactoryWithContext returns a proxy factory like ProxyFactory, whose caches are removed from
+// the httpcache.DefaultRegistry when the context is done
+func ProxyFactoryWithContext(ctx context.Context, l log.Logger, pf proxy.Factory) proxy.Factory {
+	return proxy.FactoryFunc(func(remote *config.EndpointConfig) (proxy.Proxy, error) {
+		next, err := pf.New(remote)
+		if err != nil {
+			return next, err
+		}
+		cfg, ok := ConfigGetter(remote.ExtraConfig)
+		if !ok {
+			return next, nil
+		}
+
+		logPrefix := "[ENDPOINT: " + remote.Endpoint + "][HTTPCache]"
+		if remote.Method != http.MethodGet {
+			l.Warning(logPrefix, "Only the responses of the GET endpoints are cached")
+			return next, nil
+		}
+		ttl := cfg.TTL
+		if ttl <= 0 {
+			ttl = remote.CacheTTL
+		}
+		if ttl <= 0 {
+			l.Warning(logPrefix, "The cache requires a ttl or a cache_ttl")
+			return next, nil
+		}
+
+		for _, h := range cfg.Key.Headers {
+			if !passed(remote.HeadersToPass, h) {
+				l.Warning(logPrefix, "The header", h, "of the cache key is not in the headers_to_pass, so the responses are never cached")
+			}
+		}
+		if len(cfg.Key.Claims) > 0 && !passed(remote.HeadersToPass, "Authorization") {
+			l.Warning(logPrefix, "The claims of the cache key require the Authorization header in the headers_to_pass, so the responses are never cached")
+		}
+
+		store := httpcache.NewTaggedStore(httpcache.NewMemoryStore(cfg.MaxSize, nil), "")
+		name := httpcache.DefaultRegistry.Add("endpoint:"+remote.Endpoint, store)
+		if done := ctx.Done(); done != nil {
+			go func() {
+				<-done
+				httpcache.DefaultRegistry.Remove(name)
+			}()
+		}
+		l.Debug(logPrefix, "Caching the responses for", ttl)
+
+		return NewMiddleware(store, ttl, NewKeyFunc(remote.Endpoint, cfg.Key))(next), nil
+	})
+}
+
+// NewMiddleware returns a middleware keeping the complete responses in the store for the given
+// ttl. Every hit returns a new copy of the cached response. The requests with an empty key bypass
+// the cache
+func NewMiddleware(store httpcache.Store, ttl time.Duration, key func(*proxy.Request) string) proxy.Middleware {
+	return func(next ...proxy.Proxy) proxy.Proxy {
+		if len(next) > 1 {
+			panic(proxy.ErrTooManyProxies)
+		}
+		return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+			k := key(request)
+			if k == "" {
+				return next[0](ctx, request)
+			}
+			if v, ok := store.Get(k); ok {
+				if resp, ok := decode(v); ok {
+					return resp, nil
+				}
+				store.Delete(k)
+			}
+
+			resp, err := next[0](ctx, request)
+			if err != nil || resp == nil || !resp.IsComplete || resp.Io != nil {
+				return resp, err
+			}
+			if v, err := encode(resp, now().Add(ttl)); err == nil {
+				store.Set(k, v)
+			}
+			return resp, nil
+		}
+	}
+}
+
+type entry struct {
+	Expiration time.Time              `json:"expiration"`
+	Data       map[string]interface{} `json:"data"`
+	StatusCode int                    `json:"status_code"`
+	Headers    map[string][]string    `json:"headers,omitempty"`
+}
+
+// encode returns the cached entry of the response, without its private headers
+func encode(resp *proxy.Response, expiration time.Time) ([]byte, error) {
+	var headers map[string][]string
+	for k, v := range resp.Metadata.Headers {
+		if _, ok := privateHeaders[textproto.CanonicalMIMEHeaderKey(k)]; ok {
+			continue
+		}
+		if headers == nil {
+			headers = make(map[string][]string, len(resp.Metadata.Headers))
+		}
+		headers[k] = v
+	}
+	return json.Marshal(entry{
+		Expiration: expiration,
+		Data:       resp.Data,
+		StatusCode: resp.Metadata.StatusCode,
+		Headers:    headers,
+	})
+}
+
+// decode returns the cached response, unless it is expired
+func decode(v []byte) (*proxy.Response, bool) {
+	e := entry{}
+	d := json.NewDecoder(bytes.NewReader(v))
+	d.UseNumber()
+	if err := d.Decode(&e); err != nil || !now().Before(e.Expiration) {
+		return nil, false
+	}
+	return &proxy.Response{
+		Data:       e.Data,
+		IsComplete: true,
+		Metadata: proxy.Metadata{
+			StatusCode: e.StatusCode,
+			Headers:    e.Headers,
+		},
+	}, true
+}
+
+// NewKeyFunc returns the function building the cache key of the requests to the endpoint. The
+// headers and the claims selected by the config are hashed and appended to the key, so the
+// responses of different users are never mixed. The key is empty if any of them is missing, so the
+// request bypasses the cache
+func NewKeyFunc(endpoint string, cfg KeyConfig) func(*proxy.Request) string {
+	headers := make([]string, len(cfg.Headers))
+	for i, h := range cfg.Headers {
+		headers[i] = textproto.CanonicalMIMEHeaderKey(h)
+	}
+
+	return func(r *proxy.Request) string {
+		values := url.Values{}
+		if cfg.Params == nil {
+			for k, v := range r.Params {
+				values.Set("param:"+k, v)
+			}
+		}
+		for _, name := range cfg.Params {
+			if v, ok := param(r, name); ok {
+				values.Set("param:"+name, v)
+			}
+		}
+		for k, v := range r.Query {
+			if cfg.Query == nil || contains(cfg.Query, k) {
+				values["query:"+k] = v
+			}
+		}
+		key := endpoint + "?" + values.Encode()
+
+		extra := url.Values{}
+		for _, h := range headers {
+			v := r.Headers[h]
+			if len(v) == 0 {
+				return ""
+			}
+			extra["header:"+h] = v
+		}
+		if len(cfg.Claims) > 0 {
+			var claims map[string]interface{}
+			if v := r.Headers["Authorization"]; len(v) > 0 {
+				claims = httpcache.BearerClaims(v[0])
+			}
+			for _, name := range cfg.Claims {
+				v, ok := claims[name]
+				if !ok {
+					return ""
+				}
+				b, _ := json.Marshal(v)
+				extra.Set("claim:"+name, string(b))
+			}
+		}
+		if len(extra) == 0 {
+			return key
+		}
+		sum := sha256.Sum256([]byte(extra.Encode()))
+		return key + "#" + hex.EncodeToString(sum[:])
+	}
+}
+
+// param returns the parameter with the given name. The router capitalizes the names of the
+// parameters, so both forms are accepted
+func param(r *proxy.Request, name string) (string, bool) {
+	if name == "" {
+		return "", false
+	}
+	if v, ok := r.Params[strings.ToUpper(name[:1])+name[1:]]; ok {
+		return v, true
+	}
+	v, ok := r.Params[name]
+	return v, ok
+}
+
+// passed reports if the endpoint forwards the header to its backends
+func passed(headersToPass []string, header string) bool {
+	for _, h := range headersToPass {
+		if h == "*" || strings.EqualFold(h, header) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
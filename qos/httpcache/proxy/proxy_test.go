@@ -0,0 +1,282 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	gologging "github.com/op/go-logging"
+	"github.com/starvn/sonic/qos/httpcache"
+	"github.com/starvn/turbo/config"
+	"github.com/starvn/turbo/log"
+	"github.com/starvn/turbo/proxy"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigGetter(t *testing.T) {
+	var dat config.ExtraConfig
+	if err := json.Unmarshal([]byte(`{
+		"github.com/starvn/sonic/qos/httpcache/proxy": {
+			"ttl": "30s",
+			"max_size": 1024,
+			"cache_key": {
+				"params": ["id"],
+				"query": ["page"],
+				"headers": ["X-Tenant"],
+				"claims": ["sub"]
+			}
+		}
+	}`), &dat); err != nil {
+		t.Error(err)
+		return
+	}
+	cfg, ok := ConfigGetter(dat)
+	expected := Config{
+		TTL:     30 * time.Second,
+		MaxSize: 1024,
+		Key: KeyConfig{
+			Params:  []string{"id"},
+			Query:   []string{"page"},
+			Headers: []string{"X-Tenant"},
+			Claims:  []string{"sub"},
+		},
+	}
+	if !ok || !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+	if _, ok := ConfigGetter(config.ExtraConfig{}); ok {
+		t.Error("the cache should not be enabled")
+	}
+}
+
+func TestProxyFactory(t *testing.T) {
+	defer func() { now = time.Now }()
+	current := time.Now()
+	now = func() time.Time { return current }
+
+	calls := 0
+	pf := proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return func(_ context.Context, r *proxy.Request) (*proxy.Response, error) {
+			calls++
+			return &proxy.Response{
+				Data:       map[string]interface{}{"items": []interface{}{json.Number("1")}, "calls": calls},
+				IsComplete: r.Query.Get("complete") != "false",
+				Metadata:   proxy.Metadata{StatusCode: 200},
+			}, nil
+		}, nil
+	})
+	p, err := ProxyFactory(gologging.MustGetLogger("proxy_test"), pf).New(&config.EndpointConfig{
+		Endpoint: "/cached",
+		Method:   "GET",
+		CacheTTL: time.Minute,
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	get := func(query string) *proxy.Response {
+		q, _ := url.ParseQuery(query)
+		resp, err := p(context.Background(), &proxy.Request{Method: "GET", Query: q})
+		if err != nil {
+			t.Error(err)
+			return &proxy.Response{}
+		}
+		return resp
+	}
+
+	for i := 0; i < 3; i++ {
+		resp := get("a=1")
+		if fmt.Sprintf("%v", resp.Data["calls"]) != "1" || !resp.IsComplete || resp.Metadata.StatusCode != 200 {
+			t.Errorf("unexpected response: %+v", resp)
+		}
+		resp.Data["items"].([]interface{})[0] = "modified"
+	}
+	if resp := get("a=1"); resp.Data["items"].([]interface{})[0] != json.Number("1") {
+		t.Errorf("the cached responses should not be modified: %v", resp.Data)
+	}
+	get("a=2")
+	get("complete=false")
+	get("complete=false")
+	if calls != 4 {
+		t.Errorf("unexpected calls: %d", calls)
+	}
+
+	current = current.Add(time.Minute)
+	if resp := get("a=1"); fmt.Sprintf("%v", resp.Data["calls"]) != "5" {
+		t.Errorf("the expired responses should be refreshed: %v", resp.Data)
+	}
+
+	s, ok := httpcache.DefaultRegistry.Get("endpoint:/cached")
+	if !ok {
+		t.Error("the cache should be registered")
+		return
+	}
+	if n, _ := s.Purge(httpcache.PurgeQuery{Prefix: "/cached?"}); n != 2 {
+		t.Errorf("unexpected purged responses: %d", n)
+	}
+}
+
+func TestProxyFactoryWithContext_unregister(t *testing.T) {
+	pf := proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return proxy.NoopProxy, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := ProxyFactoryWithContext(ctx, gologging.MustGetLogger("proxy_test"), pf).New(&config.EndpointConfig{
+		Endpoint: "/unregister",
+		Method:   "GET",
+		CacheTTL: time.Minute,
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{},
+		},
+	})
+	if err != nil {
+		cancel()
+		t.Error(err)
+		return
+	}
+
+	if _, ok := httpcache.DefaultRegistry.Get("endpoint:/unregister"); !ok {
+		t.Error("the cache should be registered")
+	}
+	cancel()
+	for i := 0; i < 100; i++ {
+		if _, ok := httpcache.DefaultRegistry.Get("endpoint:/unregister"); !ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Error("the cache should be unregistered once the context is done")
+}
+
+func TestNewKeyFunc(t *testing.T) {
+	token := func(sub string) []string {
+		payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"` + sub + `"}`))
+		return []string{"Bearer header." + payload + ".signature"}
+	}
+	newRequest := func(id, query, tenant, sub string) *proxy.Request {
+		q, _ := url.ParseQuery(query)
+		return &proxy.Request{
+			Params:  map[string]string{"Id": id},
+			Query:   q,
+			Headers: map[string][]string{"X-Tenant": {tenant}, "Authorization": token(sub)},
+		}
+	}
+
+	key := NewKeyFunc("/foo/{id}", KeyConfig{})
+	if k := key(newRequest("1", "a=1", "x", "alice")); k != "/foo/{id}?param%3AId=1&query%3Aa=1" {
+		t.Errorf("unexpected default key: %s", k)
+	}
+
+	key = NewKeyFunc("/foo/{id}", KeyConfig{Params: []string{"id"}, Query: []string{"page"}, Headers: []string{"x-tenant"}, Claims: []string{"sub"}})
+	base := key(newRequest("1", "page=1&utm=a", "x", "alice"))
+	for _, tc := range []struct {
+		req  *proxy.Request
+		same bool
+	}{
+		{newRequest("1", "page=1&utm=b", "x", "alice"), true},
+		{newRequest("2", "page=1", "x", "alice"), false},
+		{newRequest("1", "page=2", "x", "alice"), false},
+		{newRequest("1", "page=1", "y", "alice"), false},
+		{newRequest("1", "page=1", "x", "bob"), false},
+	} {
+		if k := key(tc.req); (k == base) != tc.same {
+			t.Errorf("unexpected key for %+v: %s", tc.req, k)
+		}
+	}
+
+	noTenant := newRequest("1", "page=1", "x", "alice")
+	delete(noTenant.Headers, "X-Tenant")
+	noToken := newRequest("1", "page=1", "x", "alice")
+	delete(noToken.Headers, "Authorization")
+	for _, r := range []*proxy.Request{noTenant, noToken} {
+		if k := key(r); k != "" {
+			t.Errorf("the request %v should bypass the cache: %s", r.Headers, k)
+		}
+	}
+}
+
+func TestProxyFactory_private(t *testing.T) {
+	calls := 0
+	pf := proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			calls++
+			return &proxy.Response{
+				Data:       map[string]interface{}{"calls": calls},
+				IsComplete: true,
+				Metadata: proxy.Metadata{
+					StatusCode: 200,
+					Headers:    map[string][]string{"Set-Cookie": {"session=alice"}, "X-Version": {"1"}},
+				},
+			}, nil
+		}, nil
+	})
+	buf := new(bytes.Buffer)
+	l, _ := log.NewLogger("WARNING", buf, "")
+	p, err := ProxyFactory(l, pf).New(&config.EndpointConfig{
+		Endpoint:      "/private",
+		Method:        "GET",
+		CacheTTL:      time.Minute,
+		HeadersToPass: []string{"X-Tenant"},
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"cache_key": map[string]interface{}{"headers": []interface{}{"x-tenant"}, "claims": []interface{}{"sub"}},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.Contains(buf.String(), "Authorization header in the headers_to_pass") {
+		t.Errorf("the missing Authorization header should be reported: %s", buf.String())
+	}
+
+	for i := 0; i < 2; i++ {
+		p(context.Background(), &proxy.Request{Method: "GET", Headers: map[string][]string{"X-Tenant": {"a"}}})
+	}
+	if calls != 2 {
+		t.Errorf("the requests without a part of the key should not be cached: %d", calls)
+	}
+
+	p2, _ := ProxyFactory(l, pf).New(&config.EndpointConfig{
+		Endpoint:    "/private2",
+		Method:      "GET",
+		CacheTTL:    time.Minute,
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{}},
+	})
+	if resp, _ := p2(context.Background(), &proxy.Request{Method: "GET"}); len(resp.Metadata.Headers["Set-Cookie"]) != 1 {
+		t.Errorf("the response of the first client should keep its cookies: %v", resp.Metadata.Headers)
+	}
+	resp, _ := p2(context.Background(), &proxy.Request{Method: "GET"})
+	if fmt.Sprintf("%v", resp.Data["calls"]) != "3" {
+		t.Errorf("the response should be cached: %v", resp.Data)
+	}
+	if _, ok := resp.Metadata.Headers["Set-Cookie"]; ok || resp.Metadata.Headers["X-Version"][0] != "1" {
+		t.Errorf("unexpected cached headers: %v", resp.Metadata.Headers)
+	}
+}
@@ -0,0 +1,235 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultSurrogateKeyHeader is the response header listing the surrogate keys (tags) of the
+// responses, separated by spaces
+const DefaultSurrogateKeyHeader = "Surrogate-Key"
+
+// ErrEmptyPurge is returned when a purge does not define the responses to remove
+var ErrEmptyPurge = errors.New("the purge requires a key, a prefix or a tag")
+
+// PurgeQuery selects the responses to purge. All the defined fields must match
+type PurgeQuery struct {
+	Key    string
+	Prefix string
+	Tag    string
+}
+
+func (q PurgeQuery) isZero() bool {
+	return q.Key == "" && q.Prefix == "" && q.Tag == ""
+}
+
+// TaggedStore is a store indexing the responses by the surrogate keys listed in one of their
+// headers, so they can be purged by tag. The index lives in memory, so the responses restored by a
+// disk store are not tagged until they are stored again
+type TaggedStore struct {
+	Store
+	header string
+	mu     *sync.Mutex
+	tags   map[string]map[string]struct{}
+	keys   map[string][]string
+}
+
+// NewTaggedStore returns a store indexing the responses by the surrogate keys of the given header
+func NewTaggedStore(s Store, header string) *TaggedStore {
+	return &TaggedStore{
+		Store:  s,
+		header: header,
+		mu:     new(sync.Mutex),
+		tags:   map[string]map[string]struct{}{},
+		keys:   map[string][]string{},
+	}
+}
+
+// Set stores the value and indexes it by its surrogate keys. The value is only tagged if the store
+// kept it, so the values rejected by the store, as the oversized ones, never reach the index
+func (s *TaggedStore) Set(key string, value []byte) {
+	s.Store.Set(key, value)
+	stored, ok := peek(s.Store, key)
+	if ok && !bytes.Equal(stored, value) {
+		// the store failed to replace the previous value, which keeps its tags
+		return
+	}
+	tags := surrogateKeys(value, s.header)
+
+	s.mu.Lock()
+	s.untag(key)
+	if ok && len(tags) > 0 {
+		s.keys[key] = tags
+		for _, tag := range tags {
+			if _, ok := s.tags[tag]; !ok {
+				s.tags[tag] = map[string]struct{}{}
+			}
+			s.tags[tag][key] = struct{}{}
+		}
+	}
+	s.mu.Unlock()
+}
+
+// peek reads the key without reporting a hit or a miss to the metrics of the store
+func peek(s Store, key string) ([]byte, bool) {
+	if i, ok := s.(*instrumentedStore); ok {
+		return i.Store.Get(key)
+	}
+	return s.Get(key)
+}
+
+func (s *TaggedStore) Delete(key string) {
+	s.Store.Delete(key)
+	s.Untag(key)
+}
+
+// Untag removes the key from the index. The stores call it for every evicted response
+func (s *TaggedStore) Untag(key string) {
+	s.mu.Lock()
+	s.untag(key)
+	s.mu.Unlock()
+}
+
+func (s *TaggedStore) untag(key string) {
+	for _, tag := range s.keys[key] {
+		delete(s.tags[tag], key)
+		if len(s.tags[tag]) == 0 {
+			delete(s.tags, tag)
+		}
+	}
+	delete(s.keys, key)
+}
+
+// Purge removes the responses matching the query, returning the number of removed responses
+func (s *TaggedStore) Purge(q PurgeQuery) (int, error) {
+	if q.isZero() {
+		return 0, ErrEmptyPurge
+	}
+
+	var keys []string
+	if q.Tag != "" {
+		s.mu.Lock()
+		for k := range s.tags[q.Tag] {
+			keys = append(keys, k)
+		}
+		s.mu.Unlock()
+	} else {
+		keys = s.Store.Keys()
+	}
+
+	purged := 0
+	for _, k := range keys {
+		if (q.Key != "" && k != q.Key) || !strings.HasPrefix(k, q.Prefix) {
+			continue
+		}
+		s.Delete(k)
+		purged++
+	}
+	return purged, nil
+}
+
+func surrogateKeys(value []byte, header string) []string {
+	if header == "" {
+		return nil
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(value)), nil)
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(resp.Header.Get(header))
+}
+
+// Registry keeps the stores of the cache by name, so they can be purged from the admin API
+type Registry struct {
+	mu     *sync.RWMutex
+	stores map[string]*TaggedStore
+}
+
+// DefaultRegistry is the registry used by the http clients and the admin API
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{
+		mu:     new(sync.RWMutex),
+		stores: map[string]*TaggedStore{},
+	}
+}
+
+// Add registers the store with the given name, returning the registered name. The name gets a
+// numeric suffix if it is already in use
+func (r *Registry) Add(name string, s *TaggedStore) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	registered := name
+	for i := 2; ; i++ {
+		if _, ok := r.stores[registered]; !ok {
+			break
+		}
+		registered = name + "#" + strconv.Itoa(i)
+	}
+	r.stores[registered] = s
+	return registered
+}
+
+// Remove unregisters the store registered with the given name
+func (r *Registry) Remove(name string) {
+	r.mu.Lock()
+	delete(r.stores, name)
+	r.mu.Unlock()
+}
+
+func (r *Registry) Get(name string) (*TaggedStore, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.stores[name]
+	return s, ok
+}
+
+// Names returns the sorted names of the registered stores
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.stores))
+	for name := range r.stores {
+		names = append(names, name)
+	}
+	r.mu.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// Purge removes the responses matching the query from all the stores, returning the number of
+// removed responses per store
+func (r *Registry) Purge(q PurgeQuery) (map[string]int, error) {
+	if q.isZero() {
+		return nil, ErrEmptyPurge
+	}
+	res := map[string]int{}
+	for _, name := range r.Names() {
+		if s, ok := r.Get(name); ok {
+			res[name], _ = s.Purge(q)
+		}
+	}
+	return res, nil
+}
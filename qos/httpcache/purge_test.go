@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func dumpResponse(tags string) []byte {
+	return []byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nSurrogate-Key: %s\r\nContent-Length: 2\r\n\r\n{}", tags))
+}
+
+func TestTaggedStore_Purge(t *testing.T) {
+	s := NewTaggedStore(NewMemoryStore(DefaultMaxSize, nil), DefaultSurrogateKeyHeader)
+	s.Set("http://example.com/users/1", dumpResponse("users user-1"))
+	s.Set("http://example.com/users/2", dumpResponse("users user-2"))
+	s.Set("http://example.com/orders/1", dumpResponse("orders user-1"))
+
+	if _, err := s.Purge(PurgeQuery{}); err != ErrEmptyPurge {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		q       PurgeQuery
+		purged  int
+		pending int
+	}{
+		{PurgeQuery{Key: "http://example.com/unknown"}, 0, 3},
+		{PurgeQuery{Tag: "user-1", Prefix: "http://example.com/orders"}, 1, 2},
+		{PurgeQuery{Tag: "users"}, 2, 0},
+	} {
+		if n, err := s.Purge(tc.q); err != nil || n != tc.purged {
+			t.Errorf("%+v: unexpected purge: %d %v", tc.q, n, err)
+		}
+		if keys := s.Keys(); len(keys) != tc.pending {
+			t.Errorf("%+v: unexpected keys: %v", tc.q, keys)
+		}
+	}
+	if len(s.tags) != 0 || len(s.keys) != 0 {
+		t.Errorf("the index should be empty: %v %v", s.tags, s.keys)
+	}
+}
+
+func TestTaggedStore_evictions(t *testing.T) {
+	value := dumpResponse("a")
+	var s *TaggedStore
+	s = NewTaggedStore(NewMemoryStore(int64(len(value)), func(key string) { s.Untag(key) }), DefaultSurrogateKeyHeader)
+	s.Set("first", value)
+	s.Set("second", value)
+
+	if len(s.keys) != 1 || len(s.tags["a"]) != 1 {
+		t.Errorf("the evicted responses should be removed from the index: %v %v", s.keys, s.tags)
+	}
+}
+
+func TestTaggedStore_rejected(t *testing.T) {
+	value := dumpResponse("a")
+	s := NewTaggedStore(NewMemoryStore(int64(len(value)), nil), DefaultSurrogateKeyHeader)
+	s.Set("small", value)
+	s.Set("large", dumpResponse("a b"))
+
+	if _, ok := s.Get("large"); ok {
+		t.Error("the oversized response should be rejected by the store")
+	}
+	if len(s.keys) != 1 || len(s.tags["a"]) != 1 || len(s.tags["b"]) != 0 {
+		t.Errorf("the rejected responses should not be indexed: %v %v", s.keys, s.tags)
+	}
+	if n, _ := s.Purge(PurgeQuery{Tag: "a"}); n != 1 {
+		t.Errorf("unexpected purge: %d", n)
+	}
+}
+
+func TestNewAdminHandler(t *testing.T) {
+	r := NewRegistry()
+	for _, name := range []string{"a", "b"} {
+		s := NewTaggedStore(NewMemoryStore(DefaultMaxSize, nil), DefaultSurrogateKeyHeader)
+		s.Set("http://example.com/"+name, dumpResponse("all "+name))
+		r.Add(name, s)
+	}
+	ts := httptest.NewServer(NewAdminHandler(r, "secret"))
+	defer ts.Close()
+
+	do := func(method, path, token string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return &http.Response{}
+		}
+		return resp
+	}
+
+	for _, tc := range []struct {
+		method, path, token string
+		status              int
+	}{
+		{"GET", AdminPath, "", http.StatusUnauthorized},
+		{"GET", AdminPath, "wrong", http.StatusUnauthorized},
+		{"GET", AdminPath, "secret", http.StatusOK},
+		{"GET", AdminPath + "/purge?tag=all", "secret", http.StatusMethodNotAllowed},
+		{"POST", AdminPath + "/purge", "secret", http.StatusBadRequest},
+		{"POST", AdminPath + "/purge?tag=all&store=c", "secret", http.StatusNotFound},
+	} {
+		resp := do(tc.method, tc.path, tc.token)
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s %s: unexpected status code %d", tc.method, tc.path, resp.StatusCode)
+		}
+		if resp.Body != nil {
+			_ = resp.Body.Close()
+		}
+	}
+
+	resp := do("POST", AdminPath+"/purge?tag=all&store=a", "secret")
+	res := map[string]map[string]int{}
+	_ = json.NewDecoder(resp.Body).Decode(&res)
+	_ = resp.Body.Close()
+	if res["purged"]["a"] != 1 || len(res["purged"]) != 1 {
+		t.Errorf("unexpected purge: %v", res)
+	}
+
+	resp = do("POST", AdminPath+"/purge?prefix=http://example.com/", "secret")
+	res = map[string]map[string]int{}
+	_ = json.NewDecoder(resp.Body).Decode(&res)
+	_ = resp.Body.Close()
+	if res["purged"]["a"] != 0 || res["purged"]["b"] != 1 {
+		t.Errorf("unexpected purge: %v", res)
+	}
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpcache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Store is a cache of responses with a bounded size, in bytes
+type Store interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte)
+	Delete(key string)
+	// Size returns the bytes stored
+	Size() int64
+	// Keys returns the keys of the stored responses
+	Keys() []string
+}
+
+// MemoryStore is an in-memory store evicting the least recently used responses once its size
+// is over the max size
+type MemoryStore struct {
+	mu      *sync.Mutex
+	maxSize int64
+	size    int64
+	ll      *list.List
+	items   map[string]*list.Element
+	onEvict func(key string)
+}
+
+type memoryEntry struct {
+	key   string
+	value []byte
+}
+
+// NewMemoryStore returns a memory store holding up to maxSize bytes. The onEvict callback, if any,
+// is called with the key of every evicted response
+func NewMemoryStore(maxSize int64, onEvict func(key string)) *MemoryStore {
+	return &MemoryStore{
+		mu:      new(sync.Mutex),
+		maxSize: maxSize,
+		ll:      list.New(),
+		items:   map[string]*list.Element{},
+		onEvict: onEvict,
+	}
+}
+
+func (s *MemoryStore) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	s.ll.MoveToFront(e)
+	return e.Value.(*memoryEntry).value, true
+}
+
+func (s *MemoryStore) Set(key string, value []byte) {
+	s.mu.Lock()
+	var evicted []string
+	if e, ok := s.items[key]; ok {
+		s.removeElement(e)
+	}
+	if int64(len(value)) <= s.maxSize {
+		s.items[key] = s.ll.PushFront(&memoryEntry{key: key, value: value})
+		s.size += int64(len(value))
+		for s.size > s.maxSize {
+			e := s.ll.Back()
+			s.removeElement(e)
+			evicted = append(evicted, e.Value.(*memoryEntry).key)
+		}
+	}
+	s.mu.Unlock()
+
+	if s.onEvict != nil {
+		for _, k := range evicted {
+			s.onEvict(k)
+		}
+	}
+}
+
+func (s *MemoryStore) Delete(key string) {
+	s.mu.Lock()
+	if e, ok := s.items[key]; ok {
+		s.removeElement(e)
+	}
+	s.mu.Unlock()
+}
+
+func (s *MemoryStore) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+func (s *MemoryStore) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.items))
+	for k := range s.items {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (s *MemoryStore) removeElement(e *list.Element) {
+	entry := s.ll.Remove(e).(*memoryEntry)
+	delete(s.items, entry.key)
+	s.size -= int64(len(entry.value))
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpcache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	var evicted []string
+	s := NewMemoryStore(10, func(k string) { evicted = append(evicted, k) })
+	testStore(t, s, &evicted)
+}
+
+func TestDiskStore(t *testing.T) {
+	dir := t.TempDir()
+	var evicted []string
+	s, err := NewDiskStore(dir, 10+3*2, func(k string) { evicted = append(evicted, k) })
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	testStore(t, s, &evicted)
+
+	// the index is restored from the directory
+	restored, err := NewDiskStore(dir, 10+3*2, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if restored.Size() != s.Size() {
+		t.Errorf("unexpected size after the restore: %d", restored.Size())
+	}
+	if v, ok := restored.Get("c"); !ok || string(v) != "cccc" {
+		t.Errorf("unexpected value after the restore: %s", v)
+	}
+}
+
+// testStore checks a store holding 10 bytes of values (plus the overhead of 2 bytes per key of the
+// disk store)
+func testStore(t *testing.T, s Store, evicted *[]string) {
+	s.Set("a", []byte("aaaa"))
+	s.Set("b", []byte("bbbb"))
+	if v, ok := s.Get("a"); !ok || string(v) != "aaaa" {
+		t.Errorf("unexpected value: %s", v)
+	}
+	s.Set("c", []byte("cccc"))
+	if _, ok := s.Get("b"); ok {
+		t.Error("the least recently used value should be evicted")
+	}
+	if fmt.Sprintf("%v", *evicted) != "[b]" {
+		t.Errorf("unexpected evictions: %v", *evicted)
+	}
+
+	s.Set("d", []byte("ddddddddddddddddddddddddd"))
+	if _, ok := s.Get("d"); ok {
+		t.Error("the values larger than the store should not be stored")
+	}
+
+	s.Delete("a")
+	if _, ok := s.Get("a"); ok {
+		t.Error("the value should be deleted")
+	}
+	if _, ok := s.Get("c"); !ok {
+		t.Error("the value should be stored")
+	}
+}
@@ -0,0 +1,439 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gregjones/httpcache"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotCached is returned by the requests restricted to the cache when there is no response to serve
+var ErrNotCached = errors.New("httpcache: no cached response to serve")
+
+type staleOnlyKey struct{}
+
+// StaleOnly returns a context restricting the requests to the cached responses still within their
+// stale-if-error window, so they do not reach the upstream. The circuit breakers use it to serve
+// stale responses while they are open
+func StaleOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, staleOnlyKey{}, true)
+}
+
+// IsStaleOnly reports if the context restricts the requests to the stale responses of the cache, so
+// the middlewares sending more requests upstream, like the retries and the hedging, skip them
+func IsStaleOnly(ctx context.Context) bool {
+	v, _ := ctx.Value(staleOnlyKey{}).(bool)
+	return v
+}
+
+// Transport is an http.RoundTripper caching the responses with the github.com/gregjones/httpcache
+// transport and applying the gateway side policies of the config: the freshness overrides, the
+// stale responses served while they are revalidated or on errors, and the custom cache keys
+type Transport struct {
+	store        Store
+	next         http.RoundTripper
+	origin       http.RoundTripper
+	key          func(*http.Request) string
+	timeout      time.Duration
+	mu           *sync.Mutex
+	revalidating map[string]struct{}
+}
+
+// NewTransport returns a transport caching the responses in the store. The background
+// revalidations are cancelled after the timeout, if any
+func NewTransport(cfg Config, store Store, timeout time.Duration) *Transport {
+	next := http.DefaultTransport
+	origin := &policyTransport{
+		next:       next,
+		ttl:        cfg.TTL,
+		defaultTTL: cfg.DefaultTTL,
+		stale: []staleDirective{
+			{name: "stale-while-revalidate", window: cfg.StaleWhileRevalidate},
+			{name: "stale-if-error", window: cfg.StaleIfError},
+		},
+	}
+	return &Transport{
+		store:        store,
+		next:         next,
+		origin:       origin,
+		key:          NewKeyFunc(cfg.Key),
+		timeout:      timeout,
+		mu:           new(sync.Mutex),
+		revalidating: map[string]struct{}{},
+	}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := t.key(req)
+	if key == "" {
+		// the request lacks a part of its key, so it is neither read from the cache nor stored
+		if IsStaleOnly(req.Context()) {
+			return nil, ErrNotCached
+		}
+		return t.next.RoundTrip(req)
+	}
+	s := &requestStore{Store: t.store, key: key}
+	cacheable := (req.Method == http.MethodGet || req.Method == http.MethodHead) && req.Header.Get("Range") == ""
+
+	if IsStaleOnly(req.Context()) {
+		if cacheable {
+			if resp := cachedResponse(s, req); resp != nil && servable(resp.Header, "stale-if-error", false) {
+				return markStale(resp, `111 - "Revalidation Failed"`), nil
+			}
+		}
+		return nil, ErrNotCached
+	}
+
+	if cacheable {
+		if resp := cachedResponse(s, req); resp != nil && servable(resp.Header, "stale-while-revalidate", true) {
+			t.revalidate(key, req)
+			return markStale(resp, `110 - "Response is Stale"`), nil
+		}
+	}
+
+	return t.cache(s).RoundTrip(req)
+}
+
+func (t *Transport) cache(s httpcache.Cache) *httpcache.Transport {
+	return &httpcache.Transport{
+		Transport:           t.origin,
+		Cache:               s,
+		MarkCachedResponses: true,
+	}
+}
+
+// revalidate refreshes the cached response of the request in the background, unless it is already
+// being refreshed
+func (t *Transport) revalidate(key string, req *http.Request) {
+	t.mu.Lock()
+	if _, ok := t.revalidating[key]; ok {
+		t.mu.Unlock()
+		return
+	}
+	t.revalidating[key] = struct{}{}
+	t.mu.Unlock()
+
+	ctx, cancel := context.Background(), func() {}
+	if t.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+	}
+	r := req.Clone(ctx)
+	r.Body = http.NoBody
+	r.ContentLength = 0
+
+	go func() {
+		defer func() {
+			cancel()
+			t.mu.Lock()
+			delete(t.revalidating, key)
+			t.mu.Unlock()
+		}()
+		resp, err := t.cache(&requestStore{Store: t.store, key: key}).RoundTrip(r)
+		if err != nil {
+			return
+		}
+		// the response is stored once its body is consumed
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+}
+
+// requestStore is the view of the store for a single request, replacing the keys of the
+// github.com/gregjones/httpcache transport with the key of the request. The first read is kept, so
+// the store is read once per request
+type requestStore struct {
+	Store
+	key    string
+	loaded bool
+	value  []byte
+	ok     bool
+}
+
+func (s *requestStore) Get(_ string) ([]byte, bool) {
+	if !s.loaded {
+		s.value, s.ok = s.Store.Get(s.key)
+		s.loaded = true
+	}
+	return s.value, s.ok
+}
+
+// Set stores the response unless it is private or the upstream forbids storing it, since the store
+// is shared by all the clients
+func (s *requestStore) Set(_ string, value []byte) {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(value)), nil)
+	if err != nil || !shareable(resp.Header) {
+		s.Store.Delete(s.key)
+		return
+	}
+	s.Store.Set(s.key, value)
+}
+
+func shareable(h http.Header) bool {
+	cc := parseCacheControl(h)
+	_, private := cc["private"]
+	_, noStore := cc["no-store"]
+	return !private && !noStore
+}
+
+func (s *requestStore) Delete(_ string) {
+	s.Store.Delete(s.key)
+}
+
+func cachedResponse(s *requestStore, req *http.Request) *http.Response {
+	resp, err := httpcache.CachedResponse(s, req)
+	if err != nil || resp == nil || !varyMatches(resp, req) {
+		return nil
+	}
+	return resp
+}
+
+func varyMatches(resp *http.Response, req *http.Request) bool {
+	for _, v := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" && req.Header.Get(name) != resp.Header.Get("X-Varied-"+name) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func markStale(resp *http.Response, warning string) *http.Response {
+	resp.Header.Set(httpcache.XFromCache, "1")
+	resp.Header.Add("Warning", warning)
+	return resp
+}
+
+// servable reports if the cached response is within the window of the given stale directive. If
+// stale is true, the fresh responses are not servable
+func servable(h http.Header, directive string, stale bool) bool {
+	staleness, ok := staleness(h)
+	if !ok || (stale && staleness <= 0) {
+		return false
+	}
+	w, ok := directiveDuration(parseCacheControl(h), directive)
+	return ok && staleness <= w
+}
+
+// staleness returns the time elapsed since the response expired. It is negative for the fresh
+// responses
+func staleness(h http.Header) (time.Duration, bool) {
+	date, err := httpcache.Date(h)
+	if err != nil {
+		return 0, false
+	}
+	cc := parseCacheControl(h)
+	if _, ok := cc["no-cache"]; ok {
+		return 0, false
+	}
+	var lifetime time.Duration
+	if d, ok := directiveDuration(cc, "max-age"); ok {
+		lifetime = d
+	} else if expires, err := time.Parse(time.RFC1123, h.Get("Expires")); err == nil {
+		lifetime = expires.Sub(date)
+	}
+	return time.Since(date) - lifetime, true
+}
+
+func directiveDuration(cc map[string]string, directive string) (time.Duration, bool) {
+	v, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+func parseCacheControl(h http.Header) map[string]string {
+	cc := map[string]string{}
+	for _, part := range strings.Split(h.Get("Cache-Control"), ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if i := strings.Index(part, "="); i >= 0 {
+			cc[strings.ToLower(strings.TrimSpace(part[:i]))] = strings.Trim(strings.TrimSpace(part[i+1:]), `"`)
+			continue
+		}
+		cc[strings.ToLower(part)] = ""
+	}
+	return cc
+}
+
+// policyTransport applies the freshness and the stale directives of the config to the successful
+// responses of the upstream, before the cache evaluates them
+type policyTransport struct {
+	next       http.RoundTripper
+	ttl        time.Duration
+	defaultTTL time.Duration
+	stale      []staleDirective
+}
+
+type staleDirective struct {
+	name   string
+	window time.Duration
+}
+
+func (t *policyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || (resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotModified) {
+		return resp, err
+	}
+
+	h := resp.Header
+	if h.Get("Date") == "" {
+		h.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	if !shareable(h) {
+		// the overrides never make the private responses shareable
+		return resp, nil
+	}
+	var directives []string
+	switch cc := h.Get("Cache-Control"); {
+	case t.ttl > 0:
+		h.Del("Expires")
+		h.Del("Pragma")
+		directives = append(directives, maxAge(t.ttl))
+	case cc != "":
+		directives = append(directives, cc)
+	case t.defaultTTL > 0 && h.Get("Expires") == "":
+		directives = append(directives, maxAge(t.defaultTTL))
+	}
+
+	cc := parseCacheControl(http.Header{"Cache-Control": directives})
+	for _, d := range t.stale {
+		if _, ok := cc[d.name]; !ok && d.window > 0 {
+			directives = append(directives, fmt.Sprintf("%s=%d", d.name, int64(d.window/time.Second)))
+		}
+	}
+	if len(directives) > 0 {
+		h.Set("Cache-Control", strings.Join(directives, ", "))
+	}
+	return resp, nil
+}
+
+func maxAge(d time.Duration) string {
+	return fmt.Sprintf("max-age=%d", int64(d/time.Second))
+}
+
+// NewKeyFunc returns the function building the cache key of the requests. Without a config, the
+// key is the URL of the request, prefixed by its method unless it is a GET. The headers and the
+// claims selected by the config are hashed and appended to the URL, so the responses of different
+// users are never mixed. The key is empty if any of them is missing, so the request bypasses the cache
+func NewKeyFunc(cfg *KeyConfig) func(*http.Request) string {
+	if cfg == nil {
+		return func(req *http.Request) string {
+			return requestKey(req.Method, req.URL)
+		}
+	}
+
+	headers := make([]string, len(cfg.Headers))
+	for i, h := range cfg.Headers {
+		headers[i] = http.CanonicalHeaderKey(h)
+	}
+
+	return func(req *http.Request) string {
+		u := req.URL
+		if len(cfg.Query) > 0 {
+			query := req.URL.Query()
+			selected := url.Values{}
+			for _, name := range cfg.Query {
+				if v, ok := query[name]; ok {
+					selected[name] = v
+				}
+			}
+			cp := *req.URL
+			cp.RawQuery = selected.Encode()
+			u = &cp
+		}
+		key := requestKey(req.Method, u)
+
+		extra := url.Values{}
+		for _, h := range headers {
+			v := req.Header.Values(h)
+			if len(v) == 0 {
+				return ""
+			}
+			extra["header:"+h] = v
+		}
+		if len(cfg.Claims) > 0 {
+			claims := BearerClaims(req.Header.Get("Authorization"))
+			for _, name := range cfg.Claims {
+				v, ok := claims[name]
+				if !ok {
+					return ""
+				}
+				b, _ := json.Marshal(v)
+				extra.Set("claim:"+name, string(b))
+			}
+		}
+		if len(extra) == 0 {
+			return key
+		}
+		sum := sha256.Sum256([]byte(extra.Encode()))
+		return key + "#" + hex.EncodeToString(sum[:])
+	}
+}
+
+func requestKey(method string, u *url.URL) string {
+	if method == http.MethodGet {
+		return u.String()
+	}
+	return method + " " + u.String()
+}
+
+// BearerClaims returns the claims of the bearer token of the Authorization header, without
+// validating it
+func BearerClaims(authorization string) map[string]interface{} {
+	parts := strings.Fields(authorization)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") {
+		return nil
+	}
+	segments := strings.Split(parts[1], ".")
+	if len(segments) != 3 {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segments[1], "="))
+	if err != nil {
+		return nil
+	}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil
+	}
+	return claims
+}
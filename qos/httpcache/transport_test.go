@@ -0,0 +1,269 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpcache
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/starvn/turbo/config"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConfigGetter(t *testing.T) {
+	var dat config.ExtraConfig
+	if err := json.Unmarshal([]byte(`{
+		"github.com/starvn/sonic/qos/httpcache": {
+			"ttl": "1m",
+			"default_ttl": "30s",
+			"stale_while_revalidate": "10s",
+			"stale_if_error": "1h",
+			"cache_key": {
+				"headers": ["X-Tenant"],
+				"query": ["page"],
+				"claims": ["sub"]
+			}
+		}
+	}`), &dat); err != nil {
+		t.Error(err)
+		return
+	}
+	cfg := ConfigGetter(dat).(Config)
+	expected := Config{
+		Store:                MemoryStoreName,
+		MaxSize:              DefaultMaxSize,
+		SurrogateKeyHeader:   DefaultSurrogateKeyHeader,
+		TTL:                  time.Minute,
+		DefaultTTL:           30 * time.Second,
+		StaleWhileRevalidate: 10 * time.Second,
+		StaleIfError:         time.Hour,
+		Key: &KeyConfig{
+			Headers: []string{"X-Tenant"},
+			Query:   []string{"page"},
+			Claims:  []string{"sub"},
+		},
+	}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+}
+
+func TestTransport_ttl(t *testing.T) {
+	for name, tc := range map[string]struct {
+		cacheControl string
+		cfg          Config
+		calls        uint64
+	}{
+		"no headers":       {cfg: Config{}, calls: 10},
+		"default ttl":      {cfg: Config{DefaultTTL: time.Minute}, calls: 1},
+		"upstream headers": {cacheControl: "no-store", cfg: Config{DefaultTTL: time.Minute}, calls: 10},
+		"ttl override":     {cacheControl: "max-age=0", cfg: Config{TTL: time.Minute}, calls: 1},
+		"ttl no-store":     {cacheControl: "no-store", cfg: Config{TTL: time.Minute}, calls: 10},
+		"ttl private":      {cacheControl: "private, max-age=60", cfg: Config{TTL: time.Minute}, calls: 10},
+		"private":          {cacheControl: "private, max-age=60", cfg: Config{}, calls: 10},
+	} {
+		calls := uint64(0)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			atomic.AddUint64(&calls, 1)
+			if tc.cacheControl != "" {
+				w.Header().Set("Cache-Control", tc.cacheControl)
+			}
+			_, _ = fmt.Fprint(w, statusOKMsg)
+		}))
+		c := &http.Client{Transport: NewTransport(tc.cfg, NewMemoryStore(DefaultMaxSize, nil), 0)}
+		for i := 0; i < 10; i++ {
+			if body, err := get(c, ts.URL); err != nil || body != statusOKMsg {
+				t.Errorf("%s: unexpected response: %s %v", name, body, err)
+			}
+		}
+		ts.Close()
+		if c := atomic.LoadUint64(&calls); c != tc.calls {
+			t.Errorf("%s: unexpected calls to the upstream: %d", name, c)
+		}
+	}
+}
+
+func TestTransport_staleWhileRevalidate(t *testing.T) {
+	calls := uint64(0)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		c := atomic.AddUint64(&calls, 1)
+		w.Header().Set("Date", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat))
+		_, _ = fmt.Fprintf(w, "response #%d", c)
+	}))
+	defer ts.Close()
+
+	cfg := Config{TTL: 30 * time.Second, StaleWhileRevalidate: time.Hour}
+	c := &http.Client{Transport: NewTransport(cfg, NewMemoryStore(DefaultMaxSize, nil), time.Second)}
+
+	if body, err := get(c, ts.URL); err != nil || body != "response #1" {
+		t.Errorf("unexpected response: %s %v", body, err)
+	}
+	if body, err := get(c, ts.URL); err != nil || body != "response #1" {
+		t.Errorf("the stale response should be served: %s %v", body, err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadUint64(&calls) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c := atomic.LoadUint64(&calls); c != 2 {
+		t.Errorf("the stale response should be revalidated in the background: %d calls", c)
+		return
+	}
+	for time.Now().Before(deadline) {
+		if body, _ := get(c, ts.URL); body == "response #2" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("the revalidated response should be stored")
+}
+
+func TestTransport_staleIfError(t *testing.T) {
+	failing := int32(0)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0")
+		_, _ = fmt.Fprint(w, statusOKMsg)
+	}))
+	defer ts.Close()
+
+	tr := NewTransport(Config{StaleIfError: time.Hour}, NewMemoryStore(DefaultMaxSize, nil), 0)
+	c := &http.Client{Transport: tr}
+
+	if body, err := get(c, ts.URL); err != nil || body != statusOKMsg {
+		t.Errorf("unexpected response: %s %v", body, err)
+	}
+	atomic.StoreInt32(&failing, 1)
+	if body, err := get(c, ts.URL); err != nil || body != statusOKMsg {
+		t.Errorf("the stale response should be served on errors: %s %v", body, err)
+	}
+
+	req, _ := http.NewRequestWithContext(StaleOnly(context.Background()), "GET", ts.URL, nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Errorf("the stale response should be served: %v", err)
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.Header.Get("Warning") == "" {
+		t.Error("the stale response should have a warning")
+	}
+
+	req, _ = http.NewRequestWithContext(StaleOnly(context.Background()), "GET", ts.URL+"/unknown", nil)
+	if _, err := tr.RoundTrip(req); err != ErrNotCached {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNewKeyFunc(t *testing.T) {
+	token := func(sub string) string {
+		payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"` + sub + `"}`))
+		return "Bearer header." + payload + ".signature"
+	}
+	newRequest := func(u, tenant, authorization string) *http.Request {
+		req, _ := http.NewRequest("GET", u, nil)
+		if tenant != "" {
+			req.Header.Set("X-Tenant", tenant)
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		return req
+	}
+
+	key := NewKeyFunc(nil)
+	if k := key(newRequest("http://example.com/a?b=1", "", "")); k != "http://example.com/a?b=1" {
+		t.Errorf("unexpected default key: %s", k)
+	}
+
+	key = NewKeyFunc(&KeyConfig{Headers: []string{"x-tenant"}, Query: []string{"page"}, Claims: []string{"sub"}})
+	base := key(newRequest("http://example.com/a?page=1&utm=x", "a", token("alice")))
+	for _, tc := range []struct {
+		req  *http.Request
+		same bool
+	}{
+		{newRequest("http://example.com/a?utm=y&page=1", "a", token("alice")), true},
+		{newRequest("http://example.com/a?page=2", "a", token("alice")), false},
+		{newRequest("http://example.com/a?page=1", "b", token("alice")), false},
+		{newRequest("http://example.com/a?page=1", "a", token("bob")), false},
+	} {
+		if k := key(tc.req); (k == base) != tc.same {
+			t.Errorf("unexpected key for %s %v: %s", tc.req.URL, tc.req.Header, k)
+		}
+	}
+
+	for _, req := range []*http.Request{
+		newRequest("http://example.com/a?page=1", "a", ""),
+		newRequest("http://example.com/a?page=1", "", token("alice")),
+		newRequest("http://example.com/a?page=1", "a", "Bearer opaque"),
+	} {
+		if k := key(req); k != "" {
+			t.Errorf("the request %v should bypass the cache: %s", req.Header, k)
+		}
+	}
+}
+
+func TestTransport_missingKey(t *testing.T) {
+	calls := uint64(0)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddUint64(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60, stale-if-error=60")
+		_, _ = fmt.Fprint(w, statusOKMsg)
+	}))
+	defer ts.Close()
+
+	store := NewMemoryStore(DefaultMaxSize, nil)
+	tr := NewTransport(Config{Key: &KeyConfig{Headers: []string{"X-Tenant"}}}, store, 0)
+	c := &http.Client{Transport: tr}
+	for i := 0; i < 3; i++ {
+		if body, err := get(c, ts.URL); err != nil || body != statusOKMsg {
+			t.Errorf("unexpected response: %s %v", body, err)
+		}
+	}
+	if c := atomic.LoadUint64(&calls); c != 3 {
+		t.Errorf("unexpected calls to the upstream: %d", c)
+	}
+	if len(store.Keys()) != 0 {
+		t.Errorf("unexpected stored keys: %v", store.Keys())
+	}
+
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	if _, err := tr.RoundTrip(req.WithContext(StaleOnly(req.Context()))); err != ErrNotCached {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func get(c *http.Client, u string) (string, error) {
+	resp, err := c.Get(u)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return string(b), err
+}
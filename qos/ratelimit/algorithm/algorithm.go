@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package algorithm selects the limiter implementation used by the rate-limit middlewares, so all of
+// them accept the same rate and capacity settings regardless of the algorithm enforcing them
+package algorithm
+
+import (
+	"context"
+	srate "github.com/starvn/sonic/qos/ratelimit"
+	"github.com/starvn/sonic/qos/ratelimit/gcra"
+	"github.com/starvn/sonic/qos/ratelimit/juju"
+	"github.com/starvn/sonic/qos/ratelimit/sliding"
+	"strings"
+	"time"
+)
+
+const (
+	TokenBucket   = "token-bucket"
+	SlidingWindow = "sliding-window"
+	GCRA          = "gcra"
+)
+
+// Factory returns a limiter admitting maxRate calls per second, with bursts up to capacity calls
+type Factory func(maxRate float64, capacity int64) srate.Limiter
+
+var factories = map[string]Factory{
+	TokenBucket: func(maxRate float64, capacity int64) srate.Limiter {
+		return juju.NewLimiter(maxRate, capacity)
+	},
+	// the sliding window admits capacity calls in every window long enough to refill them at maxRate.
+	// As the token bucket, it panics if the rate or the capacity are not positive
+	SlidingWindow: func(maxRate float64, capacity int64) srate.Limiter {
+		if maxRate <= 0 {
+			panic("sliding window rate is not > 0")
+		}
+		return sliding.NewLimiter(capacity, time.Duration(float64(capacity)/maxRate*float64(time.Second)))
+	},
+	GCRA: func(maxRate float64, capacity int64) srate.Limiter {
+		return gcra.NewLimiter(maxRate, capacity)
+	},
+}
+
+// Get returns the factory of the named algorithm and a flag reporting if it is known. Unknown names
+// get the token bucket, the default algorithm
+func Get(name string) (Factory, bool) {
+	if name == "" {
+		return factories[TokenBucket], true
+	}
+	f, ok := factories[strings.ToLower(name)]
+	if !ok {
+		return factories[TokenBucket], false
+	}
+	return f, true
+}
+
+func NewLimiterStore(f Factory, maxRate float64, capacity int64, backend srate.Backend) srate.LimiterStore {
+	fn := func() interface{} { return f(maxRate, capacity) }
+	return func(t string) srate.Limiter {
+		return backend.Load(t, fn).(srate.Limiter)
+	}
+}
+
+func NewMemoryStore(f Factory, maxRate float64, capacity int64) srate.LimiterStore {
+	return NewLimiterStore(f, maxRate, capacity, srate.DefaultShardedMemoryBackend(context.Background()))
+}
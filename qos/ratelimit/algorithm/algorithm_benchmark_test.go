@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package algorithm
+
+import (
+	"fmt"
+	srate "github.com/starvn/sonic/qos/ratelimit"
+	"github.com/starvn/sonic/qos/ratelimit/rate"
+	"testing"
+)
+
+func benchmarkFactories() map[string]Factory {
+	return map[string]Factory{
+		TokenBucket:   factories[TokenBucket],
+		SlidingWindow: factories[SlidingWindow],
+		GCRA:          factories[GCRA],
+		"x-time-rate": func(maxRate float64, capacity int64) srate.Limiter {
+			return rate.NewLimiter(maxRate, int(capacity))
+		},
+	}
+}
+
+func BenchmarkLimiter_Allow(b *testing.B) {
+	for name, f := range benchmarkFactories() {
+		for _, cfg := range []struct {
+			name     string
+			maxRate  float64
+			capacity int64
+		}{
+			{"ok", 1e12, 1e9},
+			{"ko", 1, 1},
+		} {
+			l := f(cfg.maxRate, cfg.capacity)
+			b.Run(name+"/"+cfg.name, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					l.Allow()
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkLimiter_Take_parallel(b *testing.B) {
+	for name, f := range benchmarkFactories() {
+		l := f(1e6, 1e3)
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					l.Take()
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkMemoryStore(b *testing.B) {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("client-%d", i)
+	}
+	for name, f := range benchmarkFactories() {
+		store := NewMemoryStore(f, 100, 100)
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					store(keys[i%len(keys)]).Allow()
+					i++
+				}
+			})
+		})
+	}
+}
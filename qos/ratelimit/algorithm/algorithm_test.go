@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package algorithm
+
+import (
+	"github.com/starvn/sonic/qos/ratelimit/gcra"
+	"github.com/starvn/sonic/qos/ratelimit/juju"
+	"github.com/starvn/sonic/qos/ratelimit/sliding"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	for name, check := range map[string]func(interface{}) bool{
+		"":               func(l interface{}) bool { _, ok := l.(juju.Limiter); return ok },
+		"token-bucket":   func(l interface{}) bool { _, ok := l.(juju.Limiter); return ok },
+		"Sliding-Window": func(l interface{}) bool { _, ok := l.(*sliding.Limiter); return ok },
+		"gcra":           func(l interface{}) bool { _, ok := l.(*gcra.Limiter); return ok },
+	} {
+		f, ok := Get(name)
+		if !ok {
+			t.Errorf("%s: unknown algorithm", name)
+			continue
+		}
+		if l := f(10, 10); !check(l) {
+			t.Errorf("%s: unexpected limiter %T", name, l)
+		}
+	}
+
+	f, ok := Get("leaky-bucket")
+	if ok {
+		t.Error("unexpected algorithm")
+	}
+	if _, ok := f(10, 10).(juju.Limiter); !ok {
+		t.Error("unknown algorithms should default to the token bucket")
+	}
+}
+
+func TestNewMemoryStore(t *testing.T) {
+	for _, name := range []string{TokenBucket, SlidingWindow, GCRA} {
+		f, _ := Get(name)
+		store := NewMemoryStore(f, 1, 1)
+		if !store("1").Allow() {
+			t.Errorf("%s: the limiter should allow the first call", name)
+		}
+		if store("1").Allow() {
+			t.Errorf("%s: the limiter should block the second call", name)
+		}
+		if !store("2").Allow() {
+			t.Errorf("%s: the limiter should allow the third call because it requests a new limiter", name)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cluster
+
+import (
+	"context"
+	srate "github.com/starvn/sonic/qos/ratelimit"
+	"math"
+	"sync"
+	"time"
+)
+
+// Backend wraps the token buckets loaded from it into limiters enforcing the share of the node.
+// Limiters not exposing their bucket are kept as they are
+type Backend struct {
+	node  *Node
+	name  string
+	local srate.Backend
+}
+
+// NewBackend returns a backend for the limiters of the given name, keeping them in memory
+func NewBackend(ctx context.Context, node *Node, name string) *Backend {
+	return NewBackendWithLocal(node, name, srate.DefaultShardedMemoryBackend(ctx))
+}
+
+func NewBackendWithLocal(node *Node, name string, local srate.Backend) *Backend {
+	return &Backend{
+		node:  node,
+		name:  name,
+		local: local,
+	}
+}
+
+func (b *Backend) Load(key string, f func() interface{}) interface{} {
+	return b.local.Load(key, func() interface{} {
+		v := f()
+		tb, ok := v.(srate.TokenBucket)
+		if !ok {
+			return v
+		}
+		return NewLimiter(b.node, b.name+":"+key, tb.Rate(), tb.Capacity())
+	})
+}
+
+func (b *Backend) Store(key string, v interface{}) error {
+	return b.local.Store(key, v)
+}
+
+// Limiter is a token bucket refilled at the share of the global rate assigned to the node
+type Limiter struct {
+	mu       *sync.Mutex
+	node     *Node
+	key      string
+	rate     float64
+	capacity int64
+	tokens   float64
+	last     time.Time
+}
+
+// NewLimiter returns a limiter for the key enforcing the share of the node of the given global rate
+// and capacity
+func NewLimiter(node *Node, key string, rate float64, capacity int64) *Limiter {
+	return &Limiter{
+		mu:       new(sync.Mutex),
+		node:     node,
+		key:      key,
+		rate:     rate,
+		capacity: capacity,
+		tokens:   float64(capacity) * node.Share(key),
+		last:     now(),
+	}
+}
+
+func (l *Limiter) Allow() bool {
+	ok, _ := l.TakeN(1)
+	return ok
+}
+
+func (l *Limiter) Take() (bool, srate.Status) {
+	return l.TakeN(1)
+}
+
+func (l *Limiter) TakeN(n int64) (bool, srate.Status) {
+	l.node.record(l.key, n)
+	share := l.node.Share(l.key)
+	rate := l.rate * share
+	capacity := math.Max(1, float64(l.capacity)*share)
+
+	t := now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if elapsed := t.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * rate
+		l.last = t
+	}
+	if l.tokens > capacity {
+		l.tokens = capacity
+	}
+
+	ok := l.tokens >= float64(n)
+	if ok {
+		l.tokens -= float64(n)
+	}
+	return ok, srate.NewBucketStatusN(l.tokens, n, int64(math.Ceil(capacity)), rate)
+}
+
+func (l *Limiter) Rate() float64 {
+	return l.rate
+}
+
+func (l *Limiter) Capacity() int64 {
+	return l.capacity
+}
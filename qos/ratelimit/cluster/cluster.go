@@ -0,0 +1,429 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package cluster provides a rate-limit backend sharing the limits between several gateway
+// replicas without an external store. The replicas gossip their membership and the demand of every
+// limited key over UDP, and each one enforces its share of the global limit
+package cluster
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInterval = time.Second
+	defaultPeerTTL  = 5 * time.Second
+	maxMessageSize  = 64 * 1024
+	// maxPeers bounds the number of peers tracked by a node
+	maxPeers = 1024
+)
+
+var now = time.Now
+
+// ErrNoSecret is returned when the node is configured without the secret authenticating the gossip
+var ErrNoSecret = errors.New("cluster: no secret defined")
+
+// Config defines the gossip endpoint of the node and how to find its peers
+type Config struct {
+	// Address is the host:port the node listens to
+	Address string
+	// Advertise is the address announced to the peers, if it differs from the listening one
+	Advertise string
+	// Peers is a static list of peer addresses
+	Peers []string
+	// DNS is a name resolving to the addresses of the peers, all of them listening to DNSPort
+	DNS      string
+	DNSPort  int
+	Interval time.Duration
+	PeerTTL  time.Duration
+	// Secret is the key shared by all the nodes to authenticate their messages
+	Secret string
+}
+
+// ParseConfig extracts the cluster configuration from the value of the "cluster" entry of a
+// rate-limit extra config
+func ParseConfig(v interface{}) (Config, bool) {
+	tmp, ok := v.(map[string]interface{})
+	if !ok {
+		return Config{}, false
+	}
+	cfg := Config{
+		Interval: defaultInterval,
+		PeerTTL:  defaultPeerTTL,
+	}
+	if v, ok := tmp["address"]; ok {
+		cfg.Address = fmt.Sprintf("%v", v)
+	}
+	if cfg.Address == "" {
+		return Config{}, false
+	}
+	if v, ok := tmp["advertise"]; ok {
+		cfg.Advertise = fmt.Sprintf("%v", v)
+	}
+	if v, ok := tmp["peers"].([]interface{}); ok {
+		for _, p := range v {
+			cfg.Peers = append(cfg.Peers, fmt.Sprintf("%v", p))
+		}
+	}
+	if v, ok := tmp["dns"]; ok {
+		cfg.DNS = fmt.Sprintf("%v", v)
+	}
+	if v, ok := tmp["dnsPort"]; ok {
+		switch val := v.(type) {
+		case int:
+			cfg.DNSPort = val
+		case int64:
+			cfg.DNSPort = int(val)
+		case float64:
+			cfg.DNSPort = int(val)
+		}
+	}
+	if cfg.DNS != "" && cfg.DNSPort == 0 {
+		if _, port, err := net.SplitHostPort(cfg.Address); err == nil {
+			cfg.DNSPort, _ = strconv.Atoi(port)
+		}
+	}
+	if v, ok := tmp["interval"]; ok {
+		if d, err := time.ParseDuration(fmt.Sprintf("%v", v)); err == nil && d > 0 {
+			cfg.Interval = d
+		}
+	}
+	if v, ok := tmp["peerTTL"]; ok {
+		if d, err := time.ParseDuration(fmt.Sprintf("%v", v)); err == nil && d > 0 {
+			cfg.PeerTTL = d
+		}
+	}
+	if v, ok := tmp["secret"]; ok {
+		cfg.Secret = fmt.Sprintf("%v", v)
+	}
+	return cfg, true
+}
+
+// message is the payload gossiped by every node on each interval. It is sent after its HMAC, and
+// its sender is the address it comes from. The id lets the nodes ignore their own messages when
+// they are known by the peers under another address
+type message struct {
+	ID     string           `json:"id"`
+	Peers  []string         `json:"peers,omitempty"`
+	Demand map[string]int64 `json:"demand,omitempty"`
+}
+
+// peer is a node known by this one. Peers learnt from others are probed until they answer or
+// their probe expires
+type peer struct {
+	lastSeen time.Time
+	probedAt time.Time
+	demand   map[string]int64
+}
+
+// Node is a member of the cluster. It tracks the peers alive and the demand of every key on each of
+// them, so the limiters can compute the share of the global limit assigned to the node
+type Node struct {
+	mu         *sync.RWMutex
+	cfg        Config
+	conn       net.PacketConn
+	addr       string
+	id         string
+	secret     []byte
+	peers      map[string]*peer
+	demand     map[string]int64
+	lastDemand map[string]int64
+}
+
+// NewNode starts a node listening to the configured address and gossiping with its peers until
+// the context is cancelled. The messages not authenticated with the secret of the node are ignored
+func NewNode(ctx context.Context, cfg Config) (*Node, error) {
+	if cfg.Secret == "" {
+		return nil, ErrNoSecret
+	}
+	conn, err := net.ListenPacket("udp", cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultInterval
+	}
+	if cfg.PeerTTL <= 0 {
+		cfg.PeerTTL = defaultPeerTTL
+	}
+
+	addr := cfg.Advertise
+	if addr == "" {
+		addr = conn.LocalAddr().String()
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	n := &Node{
+		mu:         new(sync.RWMutex),
+		cfg:        cfg,
+		conn:       conn,
+		addr:       addr,
+		id:         hex.EncodeToString(id),
+		secret:     []byte(cfg.Secret),
+		peers:      map[string]*peer{},
+		demand:     map[string]int64{},
+		lastDemand: map[string]int64{},
+	}
+
+	go n.listen()
+	go n.gossip(ctx)
+
+	return n, nil
+}
+
+var (
+	nodes   = map[string]*Node{}
+	nodesMu = new(sync.Mutex)
+)
+
+// GetNode returns the node listening to the configured address, starting it if required. All the
+// limiters of the gateway share the same node
+func GetNode(cfg Config) (*Node, error) {
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+
+	if n, ok := nodes[cfg.Address]; ok {
+		return n, nil
+	}
+	n, err := NewNode(context.Background(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	nodes[cfg.Address] = n
+	return n, nil
+}
+
+// Addr returns the address announced to the peers
+func (n *Node) Addr() string {
+	return n.addr
+}
+
+// Members returns the addresses of the nodes alive, including this one
+func (n *Node) Members() []string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.members(now())
+}
+
+func (n *Node) members(t time.Time) []string {
+	res := []string{n.addr}
+	for addr, p := range n.peers {
+		if t.Sub(p.lastSeen) < n.cfg.PeerTTL {
+			res = append(res, addr)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Share returns the fraction of the global limit of the key assigned to this node. Every node gets
+// a share proportional to its demand during the last interval, smoothed so idle nodes keep a part
+// of the limit. Without demand, the limit is split evenly between the nodes alive
+func (n *Node) Share(key string) float64 {
+	t := now()
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	alive := 1
+	total := n.lastDemand[key]
+	for _, p := range n.peers {
+		if t.Sub(p.lastSeen) >= n.cfg.PeerTTL {
+			continue
+		}
+		alive++
+		total += p.demand[key]
+	}
+	if total == 0 {
+		return 1 / float64(alive)
+	}
+	// every node is granted the average demand on top of its own, so the idle ones can still admit
+	// some requests until the next round of gossip
+	avg := float64(total) / float64(alive)
+	return (float64(n.lastDemand[key]) + avg) / (float64(total) + avg*float64(alive))
+}
+
+// record accounts the requests received for the key
+func (n *Node) record(key string, hits int64) {
+	n.mu.Lock()
+	n.demand[key] += hits
+	n.mu.Unlock()
+}
+
+func (n *Node) listen() {
+	buf := make([]byte, maxMessageSize)
+	for {
+		size, from, err := n.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		data, ok := n.open(buf[:size])
+		if !ok || from.String() == n.addr {
+			continue
+		}
+		var msg message
+		if err := json.Unmarshal(data, &msg); err != nil || msg.ID == n.id {
+			continue
+		}
+		n.receive(from.String(), msg)
+	}
+}
+
+// seal prepends the HMAC of the payload
+func (n *Node) seal(data []byte) []byte {
+	mac := hmac.New(sha256.New, n.secret)
+	mac.Write(data)
+	return append(mac.Sum(nil), data...)
+}
+
+// open returns the payload of the packet if its HMAC is valid
+func (n *Node) open(packet []byte) ([]byte, bool) {
+	if len(packet) < sha256.Size {
+		return nil, false
+	}
+	mac := hmac.New(sha256.New, n.secret)
+	mac.Write(packet[sha256.Size:])
+	if !hmac.Equal(mac.Sum(nil), packet[:sha256.Size]) {
+		return nil, false
+	}
+	return packet[sha256.Size:], true
+}
+
+func (n *Node) receive(from string, msg message) {
+	t := now()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.peers[from]; !ok && len(n.peers) >= maxPeers {
+		return
+	}
+	n.peers[from] = &peer{lastSeen: t, demand: msg.Demand}
+	// the peers known by the sender are probed, so the membership spreads across the cluster
+	for _, addr := range msg.Peers {
+		if addr == n.addr || len(n.peers) >= maxPeers {
+			continue
+		}
+		if _, ok := n.peers[addr]; !ok {
+			n.peers[addr] = &peer{probedAt: t}
+		}
+	}
+}
+
+func (n *Node) gossip(ctx context.Context) {
+	t := time.NewTicker(n.cfg.Interval)
+	defer t.Stop()
+
+	n.round(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			n.conn.Close()
+			return
+		case <-t.C:
+			n.round(ctx)
+		}
+	}
+}
+
+// round closes the current demand interval and sends the state of the node to all its peers
+func (n *Node) round(ctx context.Context) {
+	targets := map[string]struct{}{}
+	for _, addr := range n.cfg.Peers {
+		targets[addr] = struct{}{}
+	}
+	for _, addr := range n.discover(ctx) {
+		targets[addr] = struct{}{}
+	}
+
+	t := now()
+	n.mu.Lock()
+	n.lastDemand = n.demand
+	n.demand = map[string]int64{}
+	for addr, p := range n.peers {
+		if p.lastSeen.IsZero() {
+			// probed peers that never answer are forgotten once their probe expires
+			if t.Sub(p.probedAt) > n.cfg.PeerTTL {
+				delete(n.peers, addr)
+				continue
+			}
+			targets[addr] = struct{}{}
+			continue
+		}
+		if t.Sub(p.lastSeen) < n.cfg.PeerTTL {
+			targets[addr] = struct{}{}
+			continue
+		}
+		// peers gone for a long time are forgotten, unless they are configured or discovered
+		if t.Sub(p.lastSeen) > 10*n.cfg.PeerTTL {
+			delete(n.peers, addr)
+		}
+	}
+	msg := message{
+		ID:     n.id,
+		Peers:  n.members(t),
+		Demand: n.lastDemand,
+	}
+	n.mu.Unlock()
+
+	delete(targets, n.addr)
+	data, err := json.Marshal(msg)
+	if err != nil || len(data)+sha256.Size > maxMessageSize {
+		return
+	}
+	data = n.seal(data)
+	for addr := range targets {
+		ua, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			continue
+		}
+		_, _ = n.conn.WriteTo(data, ua)
+	}
+}
+
+func (n *Node) discover(ctx context.Context) []string {
+	if n.cfg.DNS == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, n.cfg.Interval)
+	defer cancel()
+	hosts, err := net.DefaultResolver.LookupHost(ctx, n.cfg.DNS)
+	if err != nil {
+		return nil
+	}
+	res := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		res = append(res, net.JoinHostPort(h, strconv.Itoa(n.cfg.DNSPort)))
+	}
+	return res
+}
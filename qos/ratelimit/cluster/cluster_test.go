@@ -0,0 +1,230 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, ok := ParseConfig(map[string]interface{}{
+		"address":  "0.0.0.0:7946",
+		"peers":    []interface{}{"10.0.0.2:7946", "10.0.0.3:7946"},
+		"dns":      "gateway.internal",
+		"interval": "500ms",
+		"secret":   "s3cr3t",
+	})
+	if !ok {
+		t.Error("the config should be valid")
+		return
+	}
+	if cfg.Address != "0.0.0.0:7946" || len(cfg.Peers) != 2 || cfg.DNS != "gateway.internal" || cfg.DNSPort != 7946 {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+	if cfg.Interval != 500*time.Millisecond || cfg.PeerTTL != defaultPeerTTL || cfg.Secret != "s3cr3t" {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+
+	if _, ok := ParseConfig(map[string]interface{}{"peers": []interface{}{"10.0.0.2:7946"}}); ok {
+		t.Error("the config should require an address")
+	}
+}
+
+func TestNode_membership(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first := newTestNode(ctx, t)
+	second := newTestNode(ctx, t, first.Addr())
+	// the third node only knows the second one, so it must learn about the first one through it
+	lastCtx, stopLast := context.WithCancel(ctx)
+	third := newTestNode(lastCtx, t, second.Addr())
+
+	for _, n := range []*Node{first, second, third} {
+		waitFor(t, func() bool { return len(n.Members()) == 3 })
+	}
+	if s := first.Share("key"); s < 0.33 || s > 0.34 {
+		t.Errorf("unexpected share without demand: %v", s)
+	}
+
+	stopLast()
+	waitFor(t, func() bool { return len(first.Members()) == 2 && len(second.Members()) == 2 })
+	if s := first.Share("key"); s != 0.5 {
+		t.Errorf("the share should be rebalanced when a node leaves: %v", s)
+	}
+}
+
+func TestNewNode_noSecret(t *testing.T) {
+	if _, err := NewNode(context.Background(), Config{Address: "127.0.0.1:0"}); err != ErrNoSecret {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNode_authentication(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := newTestNode(ctx, t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ua, _ := net.ResolveUDPAddr("udp", n.Addr())
+
+	forged := &Node{secret: []byte("wrong")}
+	data, _ := json.Marshal(message{Peers: []string{"10.0.0.9:7946"}})
+	for _, packet := range [][]byte{data, forged.seal(data)} {
+		if _, err := conn.WriteTo(packet, ua); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := conn.WriteTo(n.seal(data), ua); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool { return len(n.Members()) == 2 })
+	members := n.Members()
+	if members[0] != conn.LocalAddr().String() && members[1] != conn.LocalAddr().String() {
+		t.Errorf("the sender should be the address the message comes from: %v", members)
+	}
+}
+
+func TestNode_probeExpiration(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := newTestNode(ctx, t)
+	n.receive("127.0.0.1:1", message{Peers: []string{"127.0.0.1:2", "127.0.0.1:3"}})
+
+	n.mu.RLock()
+	probed := len(n.peers)
+	n.mu.RUnlock()
+	if probed != 3 {
+		t.Errorf("the peers of the sender should be probed: %d", probed)
+	}
+
+	waitFor(t, func() bool {
+		n.mu.RLock()
+		defer n.mu.RUnlock()
+		return len(n.peers) == 1
+	})
+}
+
+func TestNode_Share(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first := newTestNode(ctx, t)
+	second := newTestNode(ctx, t, first.Addr())
+	waitFor(t, func() bool { return len(first.Members()) == 2 && len(second.Members()) == 2 })
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				first.record("key", 1)
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	waitFor(t, func() bool { return first.Share("key") > 0.6 && second.Share("key") < 0.4 })
+}
+
+func TestBackend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var nodes []*Node
+	for i := 0; i < 3; i++ {
+		var peers []string
+		if i > 0 {
+			peers = append(peers, nodes[0].Addr())
+		}
+		nodes = append(nodes, newTestNode(ctx, t, peers...))
+	}
+	for _, n := range nodes {
+		waitFor(t, func() bool { return len(n.Members()) == 3 })
+	}
+
+	allowed := 0
+	for _, n := range nodes {
+		l := NewBackend(ctx, n, "test").Load("client", func() interface{} { return bucket{rate: 0.001, capacity: 30} }).(*Limiter)
+		for i := 0; i < 30; i++ {
+			if l.Allow() {
+				allowed++
+			}
+		}
+	}
+	if allowed < 27 || allowed > 33 {
+		t.Errorf("the nodes should enforce their share of the global capacity: %d", allowed)
+	}
+
+	v := NewBackend(ctx, nodes[0], "test").Load("other", func() interface{} { return 42 })
+	if v != 42 {
+		t.Errorf("the values not exposing a bucket should be kept as they are: %v", v)
+	}
+}
+
+func newTestNode(ctx context.Context, t *testing.T, peers ...string) *Node {
+	n, err := NewNode(ctx, Config{
+		Address:  "127.0.0.1:0",
+		Peers:    peers,
+		Interval: 10 * time.Millisecond,
+		PeerTTL:  100 * time.Millisecond,
+		Secret:   "s3cr3t",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.ResolveUDPAddr("udp", n.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the cluster to converge")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+type bucket struct {
+	rate     float64
+	capacity int64
+}
+
+func (bucket) Allow() bool { return true }
+
+func (b bucket) Rate() float64 { return b.rate }
+
+func (b bucket) Capacity() int64 { return b.capacity }
@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package gcra provides a limiter implementing the generic cell rate algorithm. It enforces the
+// same rate and burst as a token bucket, but keeps a single timestamp per client: the theoretical
+// arrival time of the next call
+package gcra
+
+import (
+	"context"
+	srate "github.com/starvn/sonic/qos/ratelimit"
+	"sync"
+	"time"
+)
+
+var now = time.Now
+
+// NewLimiter returns a limiter admitting maxRate calls per second, with bursts up to capacity calls
+func NewLimiter(maxRate float64, capacity int64) *Limiter {
+	interval := time.Duration(float64(time.Second) / maxRate)
+	if interval <= 0 {
+		interval = time.Nanosecond
+	}
+	return &Limiter{
+		mu:        new(sync.Mutex),
+		capacity:  capacity,
+		interval:  interval,
+		tolerance: interval * time.Duration(capacity),
+	}
+}
+
+type Limiter struct {
+	mu        *sync.Mutex
+	capacity  int64
+	interval  time.Duration
+	tolerance time.Duration
+	tat       time.Time
+}
+
+func (l *Limiter) Allow() bool {
+	ok, _ := l.TakeN(1)
+	return ok
+}
+
+func (l *Limiter) Take() (bool, srate.Status) {
+	return l.TakeN(1)
+}
+
+func (l *Limiter) TakeN(n int64) (bool, srate.Status) {
+	t := now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tat := l.tat
+	if tat.Before(t) {
+		tat = t
+	}
+	next := tat.Add(time.Duration(n) * l.interval)
+
+	status := srate.Status{Limit: l.capacity}
+	allowed := next.Sub(t) <= l.tolerance
+	if allowed {
+		l.tat = next
+		tat = next
+	} else {
+		status.RetryAfter = next.Sub(t) - l.tolerance
+	}
+
+	status.Reset = tat.Sub(t)
+	status.Remaining = int64((l.tolerance - status.Reset) / l.interval)
+	return allowed, status
+}
+
+func NewLimiterStore(maxRate float64, capacity int64, backend srate.Backend) srate.LimiterStore {
+	f := func() interface{} { return NewLimiter(maxRate, capacity) }
+	return func(t string) srate.Limiter {
+		return backend.Load(t, f).(srate.Limiter)
+	}
+}
+
+func NewMemoryStore(maxRate float64, capacity int64) srate.LimiterStore {
+	return NewLimiterStore(maxRate, capacity, srate.DefaultShardedMemoryBackend(context.Background()))
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gcra
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter_Take(t *testing.T) {
+	defer func() { now = time.Now }()
+	current := time.Date(2021, time.February, 14, 10, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+
+	l := NewLimiter(2, 4)
+	for i := 0; i < 4; i++ {
+		if !l.Allow() {
+			t.Errorf("call #%d should be allowed by the burst", i)
+		}
+	}
+	ok, status := l.Take()
+	if ok {
+		t.Error("the burst should be exhausted")
+	}
+	if status.Limit != 4 || status.Remaining != 0 || status.Reset != 2*time.Second || status.RetryAfter != 500*time.Millisecond {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	current = current.Add(500 * time.Millisecond)
+	ok, status = l.Take()
+	if !ok {
+		t.Error("the limiter should admit a call per emission interval")
+	}
+	if status.Remaining != 0 || status.Reset != 2*time.Second {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	current = current.Add(time.Second)
+	if ok, status := l.TakeN(3); ok || status.Remaining != 2 || status.RetryAfter != 500*time.Millisecond {
+		t.Errorf("unexpected status: %+v", status)
+	}
+	if ok, status := l.TakeN(2); !ok || status.Remaining != 0 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func TestNewMemoryStore(t *testing.T) {
+	store := NewMemoryStore(1, 1)
+	if !store("1").Allow() {
+		t.Error("The limiter should allow the first call")
+	}
+	if store("1").Allow() {
+		t.Error("The limiter should block the second call")
+	}
+	if !store("2").Allow() {
+		t.Error("The limiter should allow the third call because it requests a new limiter")
+	}
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ratelimit
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	HeaderLimit      = "RateLimit-Limit"
+	HeaderRemaining  = "RateLimit-Remaining"
+	HeaderReset      = "RateLimit-Reset"
+	HeaderRetryAfter = "Retry-After"
+)
+
+// SetHeaders writes the status of a limiter into the response headers. When several limiters
+// protect the same endpoint, the headers describe the most restrictive one, unless a limiter
+// rejects the request: its status always replaces the previous ones, along with the Retry-After
+func SetHeaders(h http.Header, s Status, allowed bool) {
+	if prev := h.Get(HeaderRemaining); allowed && prev != "" {
+		if r, err := strconv.ParseInt(prev, 10, 64); err == nil && r < s.Remaining {
+			return
+		}
+	}
+
+	h.Set(HeaderLimit, strconv.FormatInt(s.Limit, 10))
+	h.Set(HeaderRemaining, strconv.FormatInt(s.Remaining, 10))
+	h.Set(HeaderReset, strconv.FormatInt(seconds(s.Reset), 10))
+
+	if allowed {
+		h.Del(HeaderRetryAfter)
+		return
+	}
+
+	retry := seconds(s.RetryAfter)
+	if retry < 1 {
+		retry = 1
+	}
+	h.Set(HeaderRetryAfter, strconv.FormatInt(retry, 10))
+}
+
+func seconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ratelimit
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewBucketStatus(t *testing.T) {
+	s := NewBucketStatus(2.5, 10, 5)
+	if s.Limit != 10 || s.Remaining != 2 {
+		t.Errorf("unexpected status: %+v", s)
+	}
+	if s.Reset != 1500*time.Millisecond {
+		t.Errorf("unexpected reset: %v", s.Reset)
+	}
+	if s.RetryAfter != 0 {
+		t.Errorf("unexpected retry after: %v", s.RetryAfter)
+	}
+
+	s = NewBucketStatus(0.5, 1, 2)
+	if s.Remaining != 0 || s.RetryAfter != 250*time.Millisecond {
+		t.Errorf("unexpected status: %+v", s)
+	}
+}
+
+func TestSetHeaders(t *testing.T) {
+	h := http.Header{}
+	SetHeaders(h, Status{Limit: 10, Remaining: 5, Reset: 1500 * time.Millisecond}, true)
+	if h.Get(HeaderLimit) != "10" || h.Get(HeaderRemaining) != "5" || h.Get(HeaderReset) != "2" {
+		t.Errorf("unexpected headers: %v", h)
+	}
+	if h.Get(HeaderRetryAfter) != "" {
+		t.Errorf("unexpected retry-after header: %v", h)
+	}
+
+	SetHeaders(h, Status{Limit: 100, Remaining: 50, Reset: time.Second}, true)
+	if h.Get(HeaderLimit) != "10" || h.Get(HeaderRemaining) != "5" {
+		t.Errorf("the less restrictive limiter should not overwrite the headers: %v", h)
+	}
+
+	SetHeaders(h, Status{Limit: 1, Remaining: 0, Reset: time.Second, RetryAfter: 100 * time.Millisecond}, false)
+	if h.Get(HeaderLimit) != "1" || h.Get(HeaderRemaining) != "0" || h.Get(HeaderRetryAfter) != "1" {
+		t.Errorf("unexpected headers: %v", h)
+	}
+
+	h = http.Header{}
+	SetHeaders(h, Status{Limit: 10, Remaining: 0, Reset: time.Second}, true)
+	SetHeaders(h, Status{Limit: 100, Remaining: 3, Reset: 3 * time.Second, RetryAfter: 2 * time.Second}, false)
+	if h.Get(HeaderLimit) != "100" || h.Get(HeaderRemaining) != "3" || h.Get(HeaderRetryAfter) != "2" {
+		t.Errorf("the rejecting limiter should always set its headers: %v", h)
+	}
+}
@@ -35,10 +35,27 @@ func (l Limiter) Allow() bool {
 	return l.limiter.TakeAvailable(1) > 0
 }
 
+func (l Limiter) Take() (bool, srate.Status) {
+	return l.TakeN(1)
+}
+
+func (l Limiter) TakeN(n int64) (bool, srate.Status) {
+	_, ok := l.limiter.TakeMaxDuration(n, 0)
+	return ok, srate.NewBucketStatusN(float64(l.limiter.Available()), n, l.limiter.Capacity(), l.limiter.Rate())
+}
+
+func (l Limiter) Rate() float64 {
+	return l.limiter.Rate()
+}
+
+func (l Limiter) Capacity() int64 {
+	return l.limiter.Capacity()
+}
+
 func NewLimiterStore(maxRate float64, capacity int64, backend srate.Backend) srate.LimiterStore {
 	f := func() interface{} { return NewLimiter(maxRate, capacity) }
 	return func(t string) srate.Limiter {
-		return backend.Load(t, f).(Limiter)
+		return backend.Load(t, f).(srate.Limiter)
 	}
 }
 
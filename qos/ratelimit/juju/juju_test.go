@@ -34,3 +34,22 @@ func TestNewMemoryStore(t *testing.T) {
 		t.Error("The limiter should allow the fourth call because it requests a new limiter")
 	}
 }
+
+func TestLimiter_Take(t *testing.T) {
+	l := NewLimiter(1, 2)
+	ok, status := l.Take()
+	if !ok {
+		t.Error("The limiter should allow the first call")
+	}
+	if status.Limit != 2 || status.Remaining != 1 || status.Reset <= 0 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+	l.Take()
+	ok, status = l.Take()
+	if ok {
+		t.Error("The limiter should block the third call")
+	}
+	if status.Remaining != 0 || status.RetryAfter <= 0 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
@@ -19,10 +19,21 @@ package proxy
 
 import (
 	"context"
+	"fmt"
 	srate "github.com/starvn/sonic/qos/ratelimit"
+	"github.com/starvn/sonic/qos/ratelimit/algorithm"
+	"github.com/starvn/sonic/qos/ratelimit/cluster"
 	"github.com/starvn/sonic/qos/ratelimit/juju"
+	"github.com/starvn/sonic/qos/ratelimit/redis"
+	"github.com/starvn/sonic/telemetry/metrics"
 	"github.com/starvn/turbo/config"
+	"github.com/starvn/turbo/log"
 	"github.com/starvn/turbo/proxy"
+	"math"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
 )
 
 const Namespace = "github.com/starvn/sonic/qos/ratelimit/juju/proxy"
@@ -30,33 +41,206 @@ const Namespace = "github.com/starvn/sonic/qos/ratelimit/juju/proxy"
 type Config struct {
 	MaxRate  float64
 	Capacity int64
+	// Strategy, Key, ClientMaxRate and ClientCapacity define the bucket of every client
+	Strategy       string
+	Key            string
+	ClientMaxRate  float64
+	ClientCapacity int64
+	// Algorithm is the limiter enforcing the rate (token-bucket, sliding-window or gcra). The redis
+	// backend always uses a token bucket
+	Algorithm string
+	Redis     *redis.Config
+	// Cluster shares the limits between the replicas of the gateway, without an external store
+	Cluster *cluster.Config
+	// Queue enables the spike-arrest mode, making the requests over the limit wait for a token
+	Queue *srate.QueueConfig
 }
 
 func BackendFactory(next proxy.BackendFactory) proxy.BackendFactory {
+	return BackendFactoryWithMetrics(next, nil)
+}
+
+// BackendFactoryWithMetrics returns a backend factory reporting the state of the spike-arrest queues
+// to the given metrics collector
+func BackendFactoryWithMetrics(next proxy.BackendFactory, m *metrics.Metrics) proxy.BackendFactory {
+	return BackendFactoryWithContext(context.Background(), next, log.NoOp, m)
+}
+
+// BackendFactoryWithContext returns a backend factory whose shared limiters are bound to the given
+// context, so their local caches are released with the service
+func BackendFactoryWithContext(ctx context.Context, next proxy.BackendFactory, l log.Logger, m *metrics.Metrics) proxy.BackendFactory {
 	return func(cfg *config.Backend) proxy.Proxy {
-		return NewMiddleware(cfg)(next(cfg))
+		return NewMiddlewareWithContext(ctx, cfg, l, m)(next(cfg))
 	}
 }
 
 func NewMiddleware(remote *config.Backend) proxy.Middleware {
+	return NewMiddlewareWithMetrics(remote, nil)
+}
+
+func NewMiddlewareWithMetrics(remote *config.Backend, m *metrics.Metrics) proxy.Middleware {
+	return NewMiddlewareWithContext(context.Background(), remote, log.NoOp, m)
+}
+
+func NewMiddlewareWithContext(ctx context.Context, remote *config.Backend, l log.Logger, m *metrics.Metrics) proxy.Middleware {
 	cfg := ConfigGetter(remote.ExtraConfig).(Config)
-	if cfg == ZeroCfg || cfg.MaxRate <= 0 {
+	if cfg == ZeroCfg || (cfg.MaxRate <= 0 && cfg.ClientMaxRate <= 0) {
 		return proxy.EmptyMiddleware
 	}
-	tb := juju.NewLimiter(cfg.MaxRate, cfg.Capacity)
+
+	name := remote.Method + " " + strings.Join(remote.Host, ",") + remote.URLPattern
+	f, ok := algorithm.Get(cfg.Algorithm)
+	if !ok {
+		l.Error("[BACKEND: "+remote.URLPattern+"][Ratelimit] Unknown algorithm:", cfg.Algorithm, "- using the token bucket")
+	}
+
+	// newBackend returns the backend sharing the buckets between the replicas, if any
+	var newBackend func(string) srate.Backend
+	if cfg.Redis != nil {
+		client := redis.NewClientWithContext(ctx, *cfg.Redis)
+		newBackend = func(name string) srate.Backend {
+			return redis.NewBackend(ctx, client, *cfg.Redis, name)
+		}
+	} else if cfg.Cluster != nil {
+		// the limits are enforced locally if the node can't join the cluster
+		if node, err := cluster.GetNode(*cfg.Cluster); err == nil {
+			newBackend = func(name string) srate.Backend {
+				return cluster.NewBackend(ctx, node, name)
+			}
+		}
+	}
+
+	var tb srate.Limiter
+	if cfg.MaxRate > 0 {
+		tb = f(cfg.MaxRate, cfg.Capacity)
+		if newBackend != nil {
+			tb = juju.NewLimiterStore(cfg.MaxRate, cfg.Capacity, newBackend("proxy"))(name)
+		}
+	}
+
+	var te TokenExtractor
+	var store srate.LimiterStore
+	if cfg.ClientMaxRate > 0 {
+		if te = NewTokenExtractor(cfg.Strategy, cfg.Key); te != nil {
+			if newBackend != nil {
+				store = juju.NewLimiterStore(cfg.ClientMaxRate, cfg.ClientCapacity, newBackend("proxy:client:"+name))
+			} else {
+				store = algorithm.NewLimiterStore(f, cfg.ClientMaxRate, cfg.ClientCapacity, srate.DefaultShardedMemoryBackend(ctx))
+			}
+		}
+	}
+	if tb == nil && store == nil {
+		return proxy.EmptyMiddleware
+	}
+
+	var q *srate.Queue
+	if cfg.Queue != nil {
+		q = newQueue(*cfg.Queue, remote, m)
+	}
+
 	return func(next ...proxy.Proxy) proxy.Proxy {
 		if len(next) > 1 {
 			panic(proxy.ErrTooManyProxies)
 		}
 		return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
-			if !tb.Allow() {
-				return nil, srate.ErrLimited
+			// the client is checked first, so the calls over its own limit don't consume the
+			// tokens shared by all the clients
+			if store != nil {
+				tokenKey := te(request)
+				if tokenKey == "" {
+					return nil, srate.ErrLimited
+				}
+				if ok, _ := q.Take(ctx, store(tokenKey)); !ok {
+					return nil, srate.ErrLimited
+				}
+			}
+			if tb != nil {
+				if ok, _ := q.Take(ctx, tb); !ok {
+					return nil, srate.ErrLimited
+				}
 			}
 			return next[0](ctx, request)
 		}
 	}
 }
 
+func newQueue(qc srate.QueueConfig, remote *config.Backend, m *metrics.Metrics) *srate.Queue {
+	q := srate.NewQueue(qc)
+	if m == nil || m.Config == nil || m.Config.BackendDisabled {
+		return q
+	}
+	labels := "layer.backend.name." + remote.URLPattern
+	m.Proxy.FunctionalGauge(q.Depth, "ratelimit.queue.depth", labels)
+	wait := m.Proxy.Histogram("ratelimit.queue.wait", labels)
+	rejected := m.Proxy.Counter("ratelimit.queue.rejected", labels)
+	q.OnWait = func(d time.Duration, served bool) {
+		wait.Update(d.Nanoseconds())
+		if !served {
+			rejected.Inc(1)
+		}
+	}
+	return q
+}
+
+// TokenExtractor returns the identifier of the client sending the request
+type TokenExtractor func(*proxy.Request) string
+
+// NewTokenExtractor returns the extractor of the client identifier for the given strategy, or nil
+// if the strategy is not supported. The ip strategy reads the first address of the header named by
+// the key (X-Forwarded-For by default). The header strategy also covers the claims propagated as
+// headers by the jose validator. The param strategy reads a parameter of the endpoint
+func NewTokenExtractor(strategy, key string) TokenExtractor {
+	switch strings.ToLower(strategy) {
+	case "ip":
+		if key == "" {
+			key = "X-Forwarded-For"
+		}
+		return NewIPTokenExtractor(key)
+	case "header":
+		return HeaderTokenExtractor(key)
+	case "param":
+		return ParamTokenExtractor(key)
+	}
+	return nil
+}
+
+func NewIPTokenExtractor(header string) TokenExtractor {
+	h := HeaderTokenExtractor(header)
+	return func(r *proxy.Request) string {
+		clientIP := strings.TrimSpace(strings.Split(h(r), ",")[0])
+		ip := strings.Split(clientIP, ":")[0]
+		if parsedIP := net.ParseIP(ip); parsedIP != nil {
+			return ip
+		}
+		return ""
+	}
+}
+
+func HeaderTokenExtractor(header string) TokenExtractor {
+	header = textproto.CanonicalMIMEHeaderKey(header)
+	return func(r *proxy.Request) string {
+		if v := r.Headers[header]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+}
+
+// ParamTokenExtractor reads the parameter with the given name. The router capitalizes the names of
+// the parameters, so both forms are accepted
+func ParamTokenExtractor(param string) TokenExtractor {
+	capitalized := param
+	if param != "" {
+		capitalized = strings.ToUpper(param[:1]) + param[1:]
+	}
+	return func(r *proxy.Request) string {
+		if v, ok := r.Params[capitalized]; ok {
+			return v
+		}
+		return r.Params[param]
+	}
+}
+
 var ZeroCfg = Config{}
 
 func ConfigGetter(e config.ExtraConfig) interface{} {
@@ -89,5 +273,52 @@ func ConfigGetter(e config.ExtraConfig) interface{} {
 			cfg.Capacity = int64(val)
 		}
 	}
+	if v, ok := tmp["strategy"]; ok {
+		cfg.Strategy = fmt.Sprintf("%v", v)
+	}
+	if v, ok := tmp["key"]; ok {
+		cfg.Key = fmt.Sprintf("%v", v)
+	}
+	if v, ok := tmp["clientMaxRate"]; ok {
+		switch val := v.(type) {
+		case float64:
+			cfg.ClientMaxRate = val
+		case int:
+			cfg.ClientMaxRate = float64(val)
+		case int64:
+			cfg.ClientMaxRate = float64(val)
+		}
+	}
+	if v, ok := tmp["clientCapacity"]; ok {
+		switch val := v.(type) {
+		case int64:
+			cfg.ClientCapacity = val
+		case int:
+			cfg.ClientCapacity = int64(val)
+		case float64:
+			cfg.ClientCapacity = int64(val)
+		}
+	}
+	if cfg.ClientCapacity <= 0 {
+		cfg.ClientCapacity = int64(math.Ceil(cfg.ClientMaxRate))
+	}
+	if v, ok := tmp["algorithm"]; ok {
+		cfg.Algorithm = fmt.Sprintf("%v", v)
+	}
+	if v, ok := tmp["queue"]; ok {
+		if qc, ok := srate.ParseQueueConfig(v); ok {
+			cfg.Queue = &qc
+		}
+	}
+	if v, ok := tmp["cluster"]; ok {
+		if cc, ok := cluster.ParseConfig(v); ok {
+			cfg.Cluster = &cc
+		}
+	}
+	if v, ok := tmp["redis"]; ok {
+		if rc, ok := redis.ParseConfig(v); ok {
+			cfg.Redis = &rc
+		}
+	}
 	return cfg
 }
@@ -17,12 +17,19 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
+	"github.com/alicebob/miniredis/v2"
+	gologging "github.com/op/go-logging"
 	srate "github.com/starvn/sonic/qos/ratelimit"
+	"github.com/starvn/sonic/telemetry/metrics"
 	"github.com/starvn/turbo/config"
+	"github.com/starvn/turbo/log"
 	"github.com/starvn/turbo/proxy"
+	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestNewMiddleware_multipleNext(t *testing.T) {
@@ -117,6 +124,226 @@ func TestNewMiddleware_ko(t *testing.T) {
 	}
 }
 
+func TestNewMiddleware_algorithm(t *testing.T) {
+	for _, algorithm := range []string{"sliding-window", "gcra"} {
+		calls := uint64(0)
+		mdw := NewMiddleware(&config.Backend{
+			ExtraConfig: map[string]interface{}{Namespace: map[string]interface{}{"maxRate": 1.0, "capacity": 2.0, "algorithm": algorithm}},
+		})
+		p := mdw(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			atomic.AddUint64(&calls, 1)
+			return &proxy.Response{}, nil
+		})
+
+		for i := 0; i < 10; i++ {
+			_, _ = p(context.Background(), &proxy.Request{Path: "/turbo"})
+		}
+		if _, err := p(context.Background(), &proxy.Request{Path: "/turbo"}); err != srate.ErrLimited {
+			t.Errorf("%s: error expected", algorithm)
+		}
+		if calls != 2 {
+			t.Errorf("%s: unexpected number of calls to the proxy: %d", algorithm, calls)
+		}
+	}
+}
+
+func TestNewMiddleware_clientBeforeEndpoint(t *testing.T) {
+	mdw := NewMiddleware(&config.Backend{
+		ExtraConfig: map[string]interface{}{Namespace: map[string]interface{}{
+			"maxRate":        1.0,
+			"capacity":       2.0,
+			"strategy":       "header",
+			"key":            "X-Client",
+			"clientMaxRate":  1.0,
+			"clientCapacity": 1.0,
+		}},
+	})
+	p := mdw(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		return &proxy.Response{}, nil
+	})
+
+	call := func(client string) error {
+		_, err := p(context.Background(), &proxy.Request{Headers: map[string][]string{"X-Client": {client}}})
+		return err
+	}
+
+	if err := call("a"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := call("a"); err != srate.ErrLimited {
+		t.Error("the client should be limited")
+	}
+	if err := call("b"); err != nil {
+		t.Errorf("the calls rejected by the client limit should not consume the endpoint tokens: %v", err)
+	}
+}
+
+func TestNewMiddlewareWithContext_unknownAlgorithm(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l, _ := log.NewLogger("ERROR", buf, "")
+	mdw := NewMiddlewareWithContext(context.Background(), &config.Backend{
+		URLPattern:  "/turbo",
+		ExtraConfig: map[string]interface{}{Namespace: map[string]interface{}{"maxRate": 1.0, "capacity": 1.0, "algorithm": "leaky-bucket"}},
+	}, l, nil)
+	p := mdw(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		return &proxy.Response{}, nil
+	})
+
+	if !strings.Contains(buf.String(), "Unknown algorithm: leaky-bucket") {
+		t.Errorf("the unknown algorithm should be reported: %s", buf.String())
+	}
+	if _, err := p(context.Background(), &proxy.Request{Path: "/turbo"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := p(context.Background(), &proxy.Request{Path: "/turbo"}); err != srate.ErrLimited {
+		t.Error("the token bucket should limit the calls")
+	}
+}
+
+func TestNewMiddlewareWithMetrics_queue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := metrics.New(ctx, config.ExtraConfig{metrics.Namespace: map[string]interface{}{}}, gologging.MustGetLogger("proxy_test"))
+
+	calls := uint64(0)
+	mdw := NewMiddlewareWithMetrics(&config.Backend{
+		URLPattern: "/batch",
+		ExtraConfig: map[string]interface{}{Namespace: map[string]interface{}{
+			"maxRate":  20.0,
+			"capacity": 1.0,
+			"queue":    map[string]interface{}{"size": 10.0, "maxWait": "1s"},
+		}},
+	}, m)
+	p := mdw(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		atomic.AddUint64(&calls, 1)
+		return &proxy.Response{}, nil
+	})
+
+	for i := 0; i < 5; i++ {
+		if _, err := p(context.Background(), &proxy.Request{Path: "/turbo"}); err != nil {
+			t.Errorf("#%d: the request should wait for a token: %v", i, err)
+		}
+	}
+
+	short, cancelShort := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancelShort()
+	if _, err := p(short, &proxy.Request{Path: "/turbo"}); err != srate.ErrLimited {
+		t.Errorf("the request should be rejected before its deadline: %v", err)
+	}
+	if calls != 5 {
+		t.Errorf("unexpected number of calls to the proxy: %d", calls)
+	}
+
+	stats := m.TakeSnapshot()
+	if v := stats.Counters["sonic.proxy.ratelimit.queue.rejected.layer.backend.name./batch"]; v != 1 {
+		t.Errorf("unexpected rejected counter: %d", v)
+	}
+	if h, ok := stats.Histograms["sonic.proxy.ratelimit.queue.wait.layer.backend.name./batch"]; !ok || h.Max <= 0 {
+		t.Errorf("unexpected wait histogram: %+v", h)
+	}
+	if _, ok := stats.Gauges["sonic.proxy.ratelimit.queue.depth.layer.backend.name./batch"]; !ok {
+		t.Error("the queue depth gauge should be registered")
+	}
+}
+
+func TestNewMiddleware_clients(t *testing.T) {
+	for _, tc := range []struct {
+		strategy string
+		key      string
+		request  func(string) *proxy.Request
+	}{
+		{
+			strategy: "header",
+			key:      "x-user",
+			request: func(client string) *proxy.Request {
+				return &proxy.Request{Headers: map[string][]string{"X-User": {client}}}
+			},
+		},
+		{
+			strategy: "param",
+			key:      "tenant",
+			request: func(client string) *proxy.Request {
+				return &proxy.Request{Params: map[string]string{"Tenant": client}}
+			},
+		},
+		{
+			strategy: "ip",
+			request: func(client string) *proxy.Request {
+				return &proxy.Request{Headers: map[string][]string{"X-Forwarded-For": {"10.0.0." + client + ", 192.168.1.1"}}}
+			},
+		},
+	} {
+		calls := uint64(0)
+		p := NewMiddleware(&config.Backend{
+			ExtraConfig: map[string]interface{}{Namespace: map[string]interface{}{
+				"strategy":      tc.strategy,
+				"key":           tc.key,
+				"clientMaxRate": 1.0,
+			}},
+		})(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			atomic.AddUint64(&calls, 1)
+			return &proxy.Response{}, nil
+		})
+
+		for i := 0; i < 10; i++ {
+			_, _ = p(context.Background(), tc.request("1"))
+		}
+		if _, err := p(context.Background(), tc.request("1")); err != srate.ErrLimited {
+			t.Errorf("%s: the noisy client should be limited", tc.strategy)
+		}
+		if _, err := p(context.Background(), tc.request("2")); err != nil {
+			t.Errorf("%s: other clients should have their own bucket: %v", tc.strategy, err)
+		}
+		if _, err := p(context.Background(), &proxy.Request{}); err != srate.ErrLimited {
+			t.Errorf("%s: requests without client identifier should be rejected", tc.strategy)
+		}
+		if calls != 2 {
+			t.Errorf("%s: unexpected number of calls to the proxy: %d", tc.strategy, calls)
+		}
+	}
+}
+
+func TestNewMiddleware_redis(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer s.Close()
+
+	remote := &config.Backend{
+		Method:     "GET",
+		Host:       []string{"http://example.com"},
+		URLPattern: "/turbo",
+		ExtraConfig: map[string]interface{}{Namespace: map[string]interface{}{
+			"maxRate":  1.0,
+			"capacity": 2.0,
+			// the default timeout of the store is too tight for miniredis on a loaded machine, and
+			// the limiter would fall back to its local bucket
+			"redis": map[string]interface{}{"address": s.Addr(), "timeout": "1s"},
+		}},
+	}
+
+	calls := uint64(0)
+	next := func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		atomic.AddUint64(&calls, 1)
+		return &proxy.Response{}, nil
+	}
+	replicas := []proxy.Proxy{NewMiddleware(remote)(next), NewMiddleware(remote)(next)}
+
+	request := proxy.Request{
+		Path: "/turbo",
+	}
+
+	for i := 0; i < 10; i++ {
+		_, _ = replicas[i%2](context.Background(), &request)
+	}
+
+	if calls != 2 {
+		t.Errorf("unexpected number of calls to the proxy: %d", calls)
+	}
+}
+
 func dummyProxy(r *proxy.Response, err error) proxy.Proxy {
 	return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
 		return r, err
@@ -17,50 +17,240 @@
 package gin
 
 import (
+	"context"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/starvn/sonic/auth/jose"
+	ginjose "github.com/starvn/sonic/auth/jose/gin"
 	srate "github.com/starvn/sonic/qos/ratelimit"
+	"github.com/starvn/sonic/qos/ratelimit/algorithm"
+	"github.com/starvn/sonic/qos/ratelimit/cluster"
 	"github.com/starvn/sonic/qos/ratelimit/juju"
 	"github.com/starvn/sonic/qos/ratelimit/juju/router"
+	"github.com/starvn/sonic/qos/ratelimit/redis"
+	"github.com/starvn/sonic/telemetry/metrics"
 	"github.com/starvn/turbo/config"
+	"github.com/starvn/turbo/log"
 	"github.com/starvn/turbo/proxy"
 	sgin "github.com/starvn/turbo/route/gin"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 )
 
 var HandlerFactory = NewRateLimiterMw(sgin.EndpointHandler)
 
 func NewRateLimiterMw(next sgin.HandlerFactory) sgin.HandlerFactory {
+	return NewRateLimiterMwWithMetrics(next, nil)
+}
+
+// NewRateLimiterMwWithMetrics returns a handler factory reporting the state of the spike-arrest
+// queues to the given metrics collector
+func NewRateLimiterMwWithMetrics(next sgin.HandlerFactory, m *metrics.Metrics) sgin.HandlerFactory {
+	return NewRateLimiterMwWithContext(context.Background(), log.NoOp, next, m)
+}
+
+// NewRateLimiterMwWithContext returns a handler factory whose shared limiters are bound to the
+// given context, so their local caches are released with the service
+func NewRateLimiterMwWithContext(ctx context.Context, l log.Logger, next sgin.HandlerFactory, m *metrics.Metrics) sgin.HandlerFactory {
 	return func(remote *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
 		handlerFunc := next(remote, p)
 
 		cfg := router.ConfigGetter(remote.ExtraConfig).(router.Config)
-		if cfg == router.ZeroCfg || (cfg.MaxRate <= 0 && cfg.ClientMaxRate <= 0) {
+		if cfg == router.ZeroCfg || (cfg.MaxRate <= 0 && cfg.ClientMaxRate <= 0 && cfg.Plans == nil) {
 			return handlerFunc
 		}
 
+		f, ok := algorithm.Get(cfg.Algorithm)
+		if !ok {
+			l.Error("[ENDPOINT: "+remote.Endpoint+"][Ratelimit] Unknown algorithm:", cfg.Algorithm, "- using the token bucket")
+			cfg.Algorithm = algorithm.TokenBucket
+		}
+
+		q := newQueue(cfg, remote, m)
+
+		if cfg.Redis != nil {
+			client := redis.NewClientWithContext(ctx, *cfg.Redis)
+			return newSharedLimiterMw(ctx, cfg, f, remote, q, func(name string) srate.Backend {
+				return redis.NewBackend(ctx, client, *cfg.Redis, name)
+			})(handlerFunc)
+		}
+		if cfg.Cluster != nil {
+			// the limits are enforced locally if the node can't join the cluster
+			if node, err := cluster.GetNode(*cfg.Cluster); err == nil {
+				return newSharedLimiterMw(ctx, cfg, f, remote, q, func(name string) srate.Backend {
+					return cluster.NewBackend(ctx, node, name)
+				})(handlerFunc)
+			}
+		}
+
+		if cfg.MaxRate > 0 {
+			handlerFunc = NewQueuedEndpointRateLimiterMw(f(float64(cfg.MaxRate), cfg.MaxRate), q)(handlerFunc)
+		}
+		if cfg.Plans != nil {
+			return newPlansLimiterMw(ctx, cfg, f, remote, q)(handlerFunc)
+		}
+		if cfg.ClientMaxRate > 0 {
+			if te := NewTokenExtractorWithContext(ctx, cfg.Strategy, cfg.Key, remote); te != nil {
+				store := algorithm.NewLimiterStore(f, float64(cfg.ClientMaxRate), cfg.ClientMaxRate, srate.DefaultShardedMemoryBackend(ctx))
+				handlerFunc = NewQueuedTokenLimiterMw(te, store, q)(handlerFunc)
+			}
+		}
+		return handlerFunc
+	}
+}
+
+// newQueue returns the spike-arrest queue of the endpoint, or nil if the limiters must reject the
+// requests over the limits immediately
+func newQueue(cfg router.Config, remote *config.EndpointConfig, m *metrics.Metrics) *srate.Queue {
+	if cfg.Queue == nil {
+		return nil
+	}
+	q := srate.NewQueue(*cfg.Queue)
+	if m == nil || m.Config == nil || m.Config.RouterDisabled {
+		return q
+	}
+	labels := "layer.endpoint.name." + remote.Endpoint
+	m.Router.FunctionalGauge(q.Depth, "ratelimit.queue.depth", labels)
+	wait := m.Router.Histogram("ratelimit.queue.wait", labels)
+	rejected := m.Router.Counter("ratelimit.queue.rejected", labels)
+	q.OnWait = func(d time.Duration, served bool) {
+		wait.Update(d.Nanoseconds())
+		if !served {
+			rejected.Inc(1)
+		}
+	}
+	return q
+}
+
+// newSharedLimiterMw limits the endpoint and its clients with buckets shared between the replicas
+// of the gateway through the backends returned by newBackend
+func newSharedLimiterMw(ctx context.Context, cfg router.Config, f algorithm.Factory, remote *config.EndpointConfig, q *srate.Queue, newBackend func(string) srate.Backend) EndpointMw {
+	name := "router:" + remote.Method + " " + remote.Endpoint
+
+	return func(handlerFunc gin.HandlerFunc) gin.HandlerFunc {
 		if cfg.MaxRate > 0 {
-			handlerFunc = NewEndpointRateLimiterMw(juju.NewLimiter(float64(cfg.MaxRate), cfg.MaxRate))(handlerFunc)
+			b := newBackend(name)
+			store := juju.NewLimiterStore(float64(cfg.MaxRate), cfg.MaxRate, b)
+			handlerFunc = NewQueuedEndpointRateLimiterMw(store("endpoint"), q)(handlerFunc)
+		}
+		if cfg.Plans != nil {
+			return newPlansLimiterMw(ctx, cfg, f, remote, q)(handlerFunc)
 		}
 		if cfg.ClientMaxRate > 0 {
-			switch strings.ToLower(cfg.Strategy) {
-			case "ip":
-				handlerFunc = NewIpLimiterWithKeyMw(cfg.Key, float64(cfg.ClientMaxRate), cfg.ClientMaxRate)(handlerFunc)
-			case "header":
-				handlerFunc = NewHeaderLimiterMw(cfg.Key, float64(cfg.ClientMaxRate), cfg.ClientMaxRate)(handlerFunc)
+			te := NewTokenExtractorWithContext(ctx, cfg.Strategy, cfg.Key, remote)
+			if te == nil {
+				return handlerFunc
 			}
+			b := newBackend(name + ":client")
+			store := juju.NewLimiterStore(float64(cfg.ClientMaxRate), cfg.ClientMaxRate, b)
+			handlerFunc = NewQueuedTokenLimiterMw(te, store, q)(handlerFunc)
 		}
 		return handlerFunc
 	}
 }
 
+func newPlansLimiterMw(ctx context.Context, cfg router.Config, f algorithm.Factory, remote *config.EndpointConfig, q *srate.Queue) EndpointMw {
+	clientExtractor := NewTokenExtractorWithContext(ctx, cfg.Strategy, cfg.Key, remote)
+	planExtractor := NewTokenExtractorWithContext(ctx, cfg.Plans.Strategy, cfg.Plans.Key, remote)
+	if clientExtractor == nil || planExtractor == nil {
+		return func(next gin.HandlerFunc) gin.HandlerFunc { return next }
+	}
+
+	stores := make(map[string]srate.LimiterStore, len(cfg.Plans.Tiers))
+	for name, plan := range cfg.Plans.Tiers {
+		stores[name] = planStore(ctx, plan, cfg.Algorithm, f, cfg.Redis)
+	}
+	return NewQueuedPlanLimiterMw(clientExtractor, planExtractor, *cfg.Plans, remote.Endpoint, stores, q)
+}
+
+// NewTokenExtractor returns the extractor of the client identifier for the given strategy (ip,
+// header or jwt), or nil if the strategy is not supported. The jwt extractor aborts the requests
+// with an invalid token
+func NewTokenExtractor(strategy, key string, remote *config.EndpointConfig) TokenExtractor {
+	return NewTokenExtractorWithContext(context.Background(), strategy, key, remote)
+}
+
+// NewTokenExtractorWithContext returns the extractor of the client identifier like
+// NewTokenExtractor, sharing the token validators of the endpoints of the context
+func NewTokenExtractorWithContext(ctx context.Context, strategy, key string, remote *config.EndpointConfig) TokenExtractor {
+	switch strings.ToLower(strategy) {
+	case "ip":
+		if key != "" {
+			return NewIPTokenExtractor(key)
+		}
+		return IPTokenExtractor
+	case "header":
+		return HeaderTokenExtractor(key)
+	case "jwt":
+		return NewJWTTokenExtractor(key, ginjose.NewClaimsExtractorWithContext(ctx, remote))
+	}
+	return nil
+}
+
+var (
+	planStores   = map[planStoreKey]srate.LimiterStore{}
+	planStoresMu = new(sync.Mutex)
+)
+
+// planStoreKey identifies a plan store within the context of the service creating it
+type planStoreKey struct {
+	ctx context.Context
+	key string
+}
+
+// planStore returns the limiter store of the plan. Stores are shared by all the endpoints of the
+// context declaring the same tier, so the costs of the calls to all of them are consumed from the
+// same buckets, and released once the context is done. The namespace includes the parameters of
+// the buckets, so tiers with the same name and different limits never share them
+func planStore(ctx context.Context, plan router.Plan, alg string, f algorithm.Factory, rc *redis.Config) srate.LimiterStore {
+	ns := fmt.Sprintf("%s:%v:%d:%s", plan.Name, plan.MaxRate, plan.Capacity, strings.ToLower(alg))
+	k := planStoreKey{ctx: ctx, key: ns}
+	if rc != nil {
+		k.key += "|" + rc.Address
+	}
+
+	planStoresMu.Lock()
+	defer planStoresMu.Unlock()
+
+	if store, ok := planStores[k]; ok {
+		return store
+	}
+	var store srate.LimiterStore
+	if rc == nil {
+		store = algorithm.NewLimiterStore(f, plan.MaxRate, plan.Capacity, srate.DefaultShardedMemoryBackend(ctx))
+	} else {
+		b := redis.NewBackend(ctx, redis.NewClientWithContext(ctx, *rc), *rc, "plan:"+ns)
+		store = juju.NewLimiterStore(plan.MaxRate, plan.Capacity, b)
+	}
+	planStores[k] = store
+	if done := ctx.Done(); done != nil {
+		go func() {
+			<-done
+			planStoresMu.Lock()
+			delete(planStores, k)
+			planStoresMu.Unlock()
+		}()
+	}
+	return store
+}
+
 type EndpointMw func(gin.HandlerFunc) gin.HandlerFunc
 
-func NewEndpointRateLimiterMw(tb juju.Limiter) EndpointMw {
+func NewEndpointRateLimiterMw(tb srate.Limiter) EndpointMw {
+	return NewQueuedEndpointRateLimiterMw(tb, nil)
+}
+
+// NewQueuedEndpointRateLimiterMw limits the endpoint, making the requests over the limit wait in
+// the queue. A nil queue rejects them immediately
+func NewQueuedEndpointRateLimiterMw(tb srate.Limiter, q *srate.Queue) EndpointMw {
 	return func(next gin.HandlerFunc) gin.HandlerFunc {
 		return func(c *gin.Context) {
-			if !tb.Allow() {
+			ok, status := q.Take(c.Request.Context(), tb)
+			srate.SetHeaders(c.Writer.Header(), status, ok)
+			if !ok {
 				_ = c.AbortWithError(503, srate.ErrLimited)
 				return
 			}
@@ -84,6 +274,12 @@ func NewIpLimiterWithKeyMw(header string, maxRate float64, capacity int64) Endpo
 	return NewTokenLimiterMw(NewIPTokenExtractor(header), juju.NewMemoryStore(maxRate, capacity))
 }
 
+// NewJWTLimiterMw limits the clients by the value of the given claim of their validated token.
+// Nested claims are separated by dots
+func NewJWTLimiterMw(remote *config.EndpointConfig, claim string, maxRate float64, capacity int64) EndpointMw {
+	return NewTokenLimiterMw(NewJWTTokenExtractor(claim, ginjose.NewClaimsExtractor(remote)), juju.NewMemoryStore(maxRate, capacity))
+}
+
 type TokenExtractor func(*gin.Context) string
 
 func IPTokenExtractor(c *gin.Context) string { return c.ClientIP() }
@@ -104,15 +300,82 @@ func HeaderTokenExtractor(header string) TokenExtractor {
 	return func(c *gin.Context) string { return c.Request.Header.Get(header) }
 }
 
+func NewJWTTokenExtractor(claim string, claims func(*gin.Context) (map[string]interface{}, bool)) TokenExtractor {
+	return func(c *gin.Context) string {
+		cl, ok := claims(c)
+		if !ok {
+			return ""
+		}
+		v, _ := jose.Claims(cl).GetNested(claim)
+		return v
+	}
+}
+
+// NewPlanLimiterMw limits the clients with the buckets of their quota plans. Every call consumes
+// the number of tokens defined by the plan for the endpoint
+func NewPlanLimiterMw(clientExtractor, planExtractor TokenExtractor, plans router.Plans, endpoint string, stores map[string]srate.LimiterStore) EndpointMw {
+	return NewQueuedPlanLimiterMw(clientExtractor, planExtractor, plans, endpoint, stores, nil)
+}
+
+// NewQueuedPlanLimiterMw limits the clients with the buckets of their quota plans, making the
+// requests over the limits wait in the queue. A nil queue rejects them immediately
+func NewQueuedPlanLimiterMw(clientExtractor, planExtractor TokenExtractor, plans router.Plans, endpoint string, stores map[string]srate.LimiterStore, q *srate.Queue) EndpointMw {
+	return func(next gin.HandlerFunc) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			tokenKey := clientExtractor(c)
+			if c.IsAborted() {
+				// the token of the request is not valid
+				return
+			}
+			if tokenKey == "" {
+				_ = c.AbortWithError(http.StatusTooManyRequests, srate.ErrLimited)
+				return
+			}
+			plan, ok := plans.Get(planExtractor(c))
+			if c.IsAborted() {
+				return
+			}
+			if !ok {
+				_ = c.AbortWithError(http.StatusTooManyRequests, srate.ErrLimited)
+				return
+			}
+			store, ok := stores[plan.Name]
+			if !ok {
+				_ = c.AbortWithError(http.StatusTooManyRequests, srate.ErrLimited)
+				return
+			}
+			ok, status := q.TakeN(c.Request.Context(), store(tokenKey), plan.Cost(endpoint))
+			srate.SetHeaders(c.Writer.Header(), status, ok)
+			if !ok {
+				_ = c.AbortWithError(http.StatusTooManyRequests, srate.ErrLimited)
+				return
+			}
+			next(c)
+		}
+	}
+}
+
 func NewTokenLimiterMw(tokenExtractor TokenExtractor, limiterStore srate.LimiterStore) EndpointMw {
+	return NewQueuedTokenLimiterMw(tokenExtractor, limiterStore, nil)
+}
+
+// NewQueuedTokenLimiterMw limits the clients, making the requests over the limit wait in the
+// queue. A nil queue rejects them immediately
+func NewQueuedTokenLimiterMw(tokenExtractor TokenExtractor, limiterStore srate.LimiterStore, q *srate.Queue) EndpointMw {
 	return func(next gin.HandlerFunc) gin.HandlerFunc {
 		return func(c *gin.Context) {
 			tokenKey := tokenExtractor(c)
+			if c.IsAborted() {
+				// the token of the request is not valid
+				return
+			}
 			if tokenKey == "" {
 				_ = c.AbortWithError(http.StatusTooManyRequests, srate.ErrLimited)
 				return
 			}
-			if !limiterStore(tokenKey).Allow() {
+			ok, status := q.Take(c.Request.Context(), limiterStore(tokenKey))
+			srate.SetHeaders(c.Writer.Header(), status, ok)
+			if !ok {
 				_ = c.AbortWithError(http.StatusTooManyRequests, srate.ErrLimited)
 				return
 			}
@@ -18,10 +18,17 @@ package gin
 
 import (
 	"context"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/gin-gonic/gin"
+	"github.com/starvn/sonic/auth/jose"
+	ginjose "github.com/starvn/sonic/auth/jose/gin"
+	"github.com/starvn/sonic/qos/ratelimit/algorithm"
+	"github.com/starvn/sonic/qos/ratelimit/cluster"
 	"github.com/starvn/sonic/qos/ratelimit/juju/router"
+	"github.com/starvn/sonic/qos/ratelimit/redis"
 	"github.com/starvn/turbo/config"
 	"github.com/starvn/turbo/proxy"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"sync/atomic"
@@ -69,6 +76,151 @@ func TestNewRateLimiterMw_CustomHeader(t *testing.T) {
 	testRateLimiterMw(t, rd, cfg)
 }
 
+func TestNewRateLimiterMw_JWT(t *testing.T) {
+	cfg := &config.EndpointConfig{
+		ExtraConfig: map[string]interface{}{
+			router.Namespace: map[string]interface{}{
+				"strategy":      "jwt",
+				"clientMaxRate": 1,
+				"key":           "app.client_id",
+			},
+		},
+	}
+
+	p := func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+		return &proxy.Response{}, nil
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", func(c *gin.Context) {
+		if id := c.Request.Header.Get("X-Client"); id != "" {
+			c.Set(ginjose.ClaimsKey, map[string]interface{}{"app": map[string]interface{}{"client_id": id}})
+		}
+	}, HandlerFactory(cfg, p))
+
+	for i, tc := range []struct {
+		client string
+		status int
+	}{
+		{client: "a", status: 200},
+		{client: "a", status: 429},
+		{client: "b", status: 200},
+		{client: "", status: 429},
+	} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("X-Client", tc.client)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Result().StatusCode != tc.status {
+			t.Errorf("#%d: unexpected status code. have: %d, want: %d", i, w.Result().StatusCode, tc.status)
+		}
+	}
+}
+
+func TestNewRateLimiterMw_JWTInvalidToken(t *testing.T) {
+	cfg := &config.EndpointConfig{
+		Endpoint: "/invalid_token",
+		ExtraConfig: map[string]interface{}{
+			router.Namespace: map[string]interface{}{
+				"strategy":      "jwt",
+				"clientMaxRate": 1,
+				"key":           "sub",
+			},
+			jose.ValidatorNamespace: map[string]interface{}{
+				"alg":                  "HS256",
+				"jwk_url":              "http://localhost:1/jwk",
+				"disable_jwk_security": true,
+			},
+		},
+	}
+
+	p := func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+		return &proxy.Response{}, nil
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", HandlerFactory(cfg, p))
+
+	for _, auth := range []string{"", "Bearer invalid"} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Result().StatusCode != http.StatusUnauthorized {
+			t.Errorf("%q: unexpected status code. have: %d, want: %d", auth, w.Result().StatusCode, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestNewRateLimiterMw_plans(t *testing.T) {
+	plans := map[string]interface{}{
+		"strategy": "header",
+		"key":      "X-Plan",
+		"default":  "free",
+		"tiers": map[string]interface{}{
+			"free": map[string]interface{}{"maxRate": 0.001, "capacity": 2},
+			"pro": map[string]interface{}{
+				"maxRate":  0.001,
+				"capacity": 10,
+				"costs":    map[string]interface{}{"/search": 5},
+			},
+		},
+	}
+	newCfg := func(endpoint string) *config.EndpointConfig {
+		return &config.EndpointConfig{
+			Endpoint: endpoint,
+			ExtraConfig: map[string]interface{}{
+				router.Namespace: map[string]interface{}{
+					"strategy": "header",
+					"key":      "X-Client",
+					"plans":    plans,
+				},
+			},
+		}
+	}
+
+	p := func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+		return &proxy.Response{}, nil
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/search", HandlerFactory(newCfg("/search"), p))
+	r.GET("/items", HandlerFactory(newCfg("/items"), p))
+
+	for i, tc := range []struct {
+		path      string
+		client    string
+		plan      string
+		status    int
+		remaining string
+	}{
+		{path: "/items", client: "a", status: 200, remaining: "1"},
+		{path: "/search", client: "a", plan: "unknown", status: 200, remaining: "0"},
+		{path: "/items", client: "a", status: 429, remaining: "0"},
+		{path: "/search", client: "b", plan: "pro", status: 200, remaining: "5"},
+		{path: "/items", client: "b", plan: "pro", status: 200, remaining: "4"},
+		{path: "/search", client: "b", plan: "pro", status: 429, remaining: "4"},
+		{path: "/items", client: "b", plan: "pro", status: 200, remaining: "3"},
+	} {
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		req.Header.Add("X-Client", tc.client)
+		req.Header.Add("X-Plan", tc.plan)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Result().StatusCode != tc.status {
+			t.Errorf("#%d: unexpected status code. have: %d, want: %d", i, w.Result().StatusCode, tc.status)
+		}
+		if rem := w.Result().Header.Get("RateLimit-Remaining"); rem != tc.remaining {
+			t.Errorf("#%d: unexpected remaining tokens. have: %s, want: %s", i, rem, tc.remaining)
+		}
+	}
+}
+
 func TestNewRateLimiterMw_DefaultIP(t *testing.T) {
 	cfg := &config.EndpointConfig{
 		ExtraConfig: map[string]interface{}{
@@ -84,6 +236,252 @@ func TestNewRateLimiterMw_DefaultIP(t *testing.T) {
 	testRateLimiterMw(t, rd, cfg)
 }
 
+func TestNewRateLimiterMw_headers(t *testing.T) {
+	cfg := &config.EndpointConfig{
+		ExtraConfig: map[string]interface{}{
+			router.Namespace: map[string]interface{}{
+				"maxRate":       100,
+				"strategy":      "header",
+				"clientMaxRate": 2,
+				"key":           "X-Client",
+			},
+		},
+	}
+
+	p := func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+		return &proxy.Response{}, nil
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", HandlerFactory(cfg, p))
+
+	for i, tc := range []struct {
+		status     int
+		remaining  string
+		retryAfter string
+	}{
+		{status: 200, remaining: "1"},
+		{status: 200, remaining: "0"},
+		{status: 429, remaining: "0", retryAfter: "1"},
+	} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("X-Client", "a")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Result().StatusCode != tc.status {
+			t.Errorf("#%d: unexpected status code: %d", i, w.Result().StatusCode)
+		}
+		h := w.Result().Header
+		if h.Get("RateLimit-Limit") != "2" {
+			t.Errorf("#%d: unexpected limit header: %s", i, h.Get("RateLimit-Limit"))
+		}
+		if h.Get("RateLimit-Remaining") != tc.remaining {
+			t.Errorf("#%d: unexpected remaining header: %s", i, h.Get("RateLimit-Remaining"))
+		}
+		if h.Get("RateLimit-Reset") == "" {
+			t.Errorf("#%d: missing reset header", i)
+		}
+		if h.Get("Retry-After") != tc.retryAfter {
+			t.Errorf("#%d: unexpected retry-after header: %s", i, h.Get("Retry-After"))
+		}
+	}
+}
+
+func TestNewRateLimiterMw_algorithm(t *testing.T) {
+	for _, algorithm := range []string{"sliding-window", "gcra"} {
+		cfg := &config.EndpointConfig{
+			ExtraConfig: map[string]interface{}{
+				router.Namespace: map[string]interface{}{
+					"algorithm":     algorithm,
+					"strategy":      "header",
+					"clientMaxRate": 2,
+					"key":           "X-Client",
+				},
+			},
+		}
+
+		p := func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{}, nil
+		}
+
+		gin.SetMode(gin.TestMode)
+		r := gin.New()
+		r.GET("/", HandlerFactory(cfg, p))
+
+		for i, status := range []int{200, 200, 429} {
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.Header.Add("X-Client", "a")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Result().StatusCode != status {
+				t.Errorf("%s #%d: unexpected status code: %d", algorithm, i, w.Result().StatusCode)
+			}
+			if h := w.Result().Header.Get("RateLimit-Limit"); h != "2" {
+				t.Errorf("%s #%d: unexpected limit header: %s", algorithm, i, h)
+			}
+		}
+	}
+}
+
+func TestNewRateLimiterMw_queue(t *testing.T) {
+	cfg := &config.EndpointConfig{
+		Endpoint: "/batch",
+		ExtraConfig: map[string]interface{}{
+			router.Namespace: map[string]interface{}{
+				"strategy":      "header",
+				"clientMaxRate": 20,
+				"key":           "X-Client",
+				"queue":         map[string]interface{}{"size": 10, "maxWait": "1s"},
+			},
+		},
+	}
+
+	p := func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+		return &proxy.Response{}, nil
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", HandlerFactory(cfg, p))
+
+	for i := 0; i < 25; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("X-Client", "a")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Result().StatusCode != 200 {
+			t.Errorf("#%d: the request should wait for a token: %d", i, w.Result().StatusCode)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "/", nil)
+	req.Header.Add("X-Client", "a")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Result().StatusCode != 429 {
+		t.Errorf("the request should be rejected before its deadline: %d", w.Result().StatusCode)
+	}
+}
+
+func TestNewRateLimiterMw_Redis(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer s.Close()
+
+	cfg := &config.EndpointConfig{
+		Endpoint: "/",
+		Method:   "GET",
+		ExtraConfig: map[string]interface{}{
+			router.Namespace: map[string]interface{}{
+				"strategy":      "header",
+				"clientMaxRate": 5,
+				"key":           "X-Client",
+				"redis": map[string]interface{}{
+					"address": s.Addr(),
+					"timeout": "1s",
+				},
+			},
+		},
+	}
+
+	p := func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+		return &proxy.Response{}, nil
+	}
+
+	gin.SetMode(gin.TestMode)
+	var replicas []*gin.Engine
+	for i := 0; i < 3; i++ {
+		r := gin.New()
+		r.GET("/", HandlerFactory(cfg, p))
+		replicas = append(replicas, r)
+	}
+
+	var ok, ko int
+	for i := 0; i < 30; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("X-Client", "a")
+		w := httptest.NewRecorder()
+		replicas[i%len(replicas)].ServeHTTP(w, req)
+		switch w.Result().StatusCode {
+		case 200:
+			ok++
+		case 429:
+			ko++
+		}
+	}
+
+	if ok > 6 {
+		t.Errorf("the replicas should share the client bucket. ok: %d, ko: %d", ok, ko)
+	}
+	if ok+ko != 30 {
+		t.Errorf("not all the requests were tracked: %d/%d", ok, ko)
+	}
+}
+
+func TestPlanStore_namespace(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rc, _ := redis.ParseConfig(map[string]interface{}{"address": s.Addr(), "timeout": "1s"})
+	small := planStore(ctx, router.Plan{Name: "tier", MaxRate: 1, Capacity: 1}, "", nil, &rc)
+	large := planStore(ctx, router.Plan{Name: "tier", MaxRate: 1, Capacity: 5}, "", nil, &rc)
+
+	if !small("a").Allow() {
+		t.Error("the first call to the small bucket should be allowed")
+	}
+	if small("a").Allow() {
+		t.Error("the small bucket should be empty")
+	}
+	if !large("a").Allow() {
+		t.Error("the tiers with different limits should not share their buckets")
+	}
+}
+
+func TestPlanStore_context(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	other, cancelOther := context.WithCancel(context.Background())
+	defer cancelOther()
+	f, _ := algorithm.Get(algorithm.TokenBucket)
+	plan := router.Plan{Name: "context", MaxRate: 1, Capacity: 1}
+
+	store := planStore(ctx, plan, "", f, nil)
+	if !store("a").Allow() {
+		t.Error("the first call should be allowed")
+	}
+	if planStore(ctx, plan, "", f, nil)("a").Allow() {
+		t.Error("the endpoints of the same context should share the plan buckets")
+	}
+	if !planStore(other, plan, "", f, nil)("a").Allow() {
+		t.Error("the plan buckets should not be shared with other contexts")
+	}
+
+	cancel()
+	<-time.After(10 * time.Millisecond)
+
+	planStoresMu.Lock()
+	_, ok := planStores[planStoreKey{ctx: ctx, key: "context:1:1:"}]
+	planStoresMu.Unlock()
+	if ok {
+		t.Error("the plan store should be released with its context")
+	}
+}
+
 type requestDecorator func(*http.Request)
 
 func testRateLimiterMw(t *testing.T, rd requestDecorator, cfg *config.EndpointConfig) {
@@ -128,3 +526,82 @@ func testRateLimiterMw(t *testing.T, rd requestDecorator, cfg *config.EndpointCo
 		t.Errorf("not all the requests were tracked: %d/%d", ok, ko)
 	}
 }
+
+func TestNewRateLimiterMw_cluster(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		addrs = append(addrs, conn.LocalAddr().String())
+		conn.Close()
+	}
+
+	p := func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+		return &proxy.Response{}, nil
+	}
+
+	gin.SetMode(gin.TestMode)
+	var replicas []*gin.Engine
+	for _, addr := range addrs {
+		cfg := &config.EndpointConfig{
+			Endpoint: "/",
+			Method:   "GET",
+			ExtraConfig: map[string]interface{}{
+				router.Namespace: map[string]interface{}{
+					"strategy":      "header",
+					"clientMaxRate": 30,
+					"key":           "X-Client",
+					"cluster": map[string]interface{}{
+						"address":  addr,
+						"peers":    []interface{}{addrs[0]},
+						"interval": "10ms",
+						"secret":   "s3cr3t",
+					},
+				},
+			},
+		}
+		r := gin.New()
+		r.GET("/", HandlerFactory(cfg, p))
+		replicas = append(replicas, r)
+	}
+
+	for _, addr := range addrs {
+		node, err := cluster.GetNode(cluster.Config{Address: addr})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for len(node.Members()) != 3 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if len(node.Members()) != 3 {
+			t.Errorf("the replica %s did not join the cluster: %v", addr, node.Members())
+			return
+		}
+	}
+
+	var ok, ko int
+	for i := 0; i < 60; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("X-Client", "a")
+		w := httptest.NewRecorder()
+		replicas[i%len(replicas)].ServeHTTP(w, req)
+		switch w.Result().StatusCode {
+		case 200:
+			ok++
+		case 429:
+			ko++
+		}
+	}
+
+	if ok < 27 || ok > 33 {
+		t.Errorf("the replicas should enforce their share of the client limit. ok: %d, ko: %d", ok, ko)
+	}
+	if ok+ko != 60 {
+		t.Errorf("not all the requests were tracked: %d/%d", ok, ko)
+	}
+}
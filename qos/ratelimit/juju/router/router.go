@@ -19,6 +19,9 @@ package router
 
 import (
 	"fmt"
+	srate "github.com/starvn/sonic/qos/ratelimit"
+	"github.com/starvn/sonic/qos/ratelimit/cluster"
+	"github.com/starvn/sonic/qos/ratelimit/redis"
 	"github.com/starvn/turbo/config"
 )
 
@@ -29,6 +32,60 @@ type Config struct {
 	Strategy      string
 	ClientMaxRate int64
 	Key           string
+	// Algorithm is the limiter enforcing the rates (token-bucket, sliding-window or gcra). The
+	// redis backend always uses a token bucket
+	Algorithm string
+	Redis     *redis.Config
+	// Cluster shares the endpoint and client limits between the replicas of the gateway, without an
+	// external store. The buckets of the plans are not shared
+	Cluster *cluster.Config
+	Plans   *Plans
+	// Queue enables the spike-arrest mode, making the requests over the limits wait for a token
+	Queue *srate.QueueConfig
+}
+
+// Plans defines the quota tiers of the clients. The plan of every client is selected by the value
+// of a header or a claim of its token
+type Plans struct {
+	Strategy string
+	Key      string
+	Default  string
+	Tiers    map[string]Plan
+}
+
+// Plan defines the bucket of a quota tier and the cost of the calls to specific endpoints. Tiers
+// with a cost over their capacity are rejected, since those calls could never be admitted
+type Plan struct {
+	Name     string
+	MaxRate  float64
+	Capacity int64
+	Costs    map[string]int64
+}
+
+// Get returns the plan with the given name or the default one
+func (p Plans) Get(name string) (Plan, bool) {
+	if plan, ok := p.Tiers[name]; ok {
+		return plan, true
+	}
+	plan, ok := p.Tiers[p.Default]
+	return plan, ok
+}
+
+// Cost returns the number of tokens consumed by every call to the endpoint
+func (p Plan) Cost(endpoint string) int64 {
+	if c, ok := p.Costs[endpoint]; ok && c > 0 {
+		return c
+	}
+	return 1
+}
+
+func (p Plan) valid() bool {
+	for _, c := range p.Costs {
+		if c > p.Capacity {
+			return false
+		}
+	}
+	return true
 }
 
 var ZeroCfg = Config{}
@@ -69,5 +126,93 @@ func ConfigGetter(e config.ExtraConfig) interface{} {
 	if v, ok := tmp["key"]; ok {
 		cfg.Key = fmt.Sprintf("%v", v)
 	}
+	if v, ok := tmp["algorithm"]; ok {
+		cfg.Algorithm = fmt.Sprintf("%v", v)
+	}
+	if v, ok := tmp["redis"]; ok {
+		if rc, ok := redis.ParseConfig(v); ok {
+			cfg.Redis = &rc
+		}
+	}
+	if v, ok := tmp["cluster"]; ok {
+		if cc, ok := cluster.ParseConfig(v); ok {
+			cfg.Cluster = &cc
+		}
+	}
+	if v, ok := tmp["queue"]; ok {
+		if qc, ok := srate.ParseQueueConfig(v); ok {
+			cfg.Queue = &qc
+		}
+	}
+	if v, ok := tmp["plans"]; ok {
+		if plans, ok := parsePlans(v); ok {
+			cfg.Plans = &plans
+		}
+	}
 	return cfg
 }
+
+func parsePlans(v interface{}) (Plans, bool) {
+	tmp, ok := v.(map[string]interface{})
+	if !ok {
+		return Plans{}, false
+	}
+	plans := Plans{Tiers: map[string]Plan{}}
+	if v, ok := tmp["strategy"]; ok {
+		plans.Strategy = fmt.Sprintf("%v", v)
+	}
+	if v, ok := tmp["key"]; ok {
+		plans.Key = fmt.Sprintf("%v", v)
+	}
+	if v, ok := tmp["default"]; ok {
+		plans.Default = fmt.Sprintf("%v", v)
+	}
+	tiers, ok := tmp["tiers"].(map[string]interface{})
+	if !ok {
+		return Plans{}, false
+	}
+	for name, t := range tiers {
+		tier, ok := t.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		plan := Plan{Name: name, Costs: map[string]int64{}}
+		if v, ok := tier["maxRate"]; ok {
+			plan.MaxRate = toFloat64(v)
+		}
+		if v, ok := tier["capacity"]; ok {
+			plan.Capacity = int64(toFloat64(v))
+		}
+		if plan.Capacity <= 0 {
+			plan.Capacity = int64(plan.MaxRate)
+		}
+		if plan.MaxRate <= 0 || plan.Capacity <= 0 {
+			continue
+		}
+		if costs, ok := tier["costs"].(map[string]interface{}); ok {
+			for endpoint, c := range costs {
+				plan.Costs[endpoint] = int64(toFloat64(c))
+			}
+		}
+		if !plan.valid() {
+			continue
+		}
+		plans.Tiers[name] = plan
+	}
+	if len(plans.Tiers) == 0 {
+		return Plans{}, false
+	}
+	return plans, true
+}
+
+func toFloat64(v interface{}) float64 {
+	switch val := v.(type) {
+	case int64:
+		return float64(val)
+	case int:
+		return float64(val)
+	case float64:
+		return val
+	}
+	return 0
+}
@@ -25,7 +25,8 @@ import (
 func TestConfigGetter(t *testing.T) {
 	serializedCfg := []byte(`{
 		"github.com/starvn/sonic/qos/ratelimit/juju/router": {
-			"maxRate":10
+			"maxRate":10,
+			"algorithm":"gcra"
 		}
 	}`)
 	var dat config.ExtraConfig
@@ -45,4 +46,64 @@ func TestConfigGetter(t *testing.T) {
 	if cfg.Key != "" {
 		t.Errorf("wrong value for Key. Want: '', have: %s", cfg.Key)
 	}
+	if cfg.Algorithm != "gcra" {
+		t.Errorf("wrong value for Algorithm. Want: 'gcra', have: %s", cfg.Algorithm)
+	}
+}
+
+func TestConfigGetter_plans(t *testing.T) {
+	serializedCfg := []byte(`{
+		"github.com/starvn/sonic/qos/ratelimit/juju/router": {
+			"strategy": "header",
+			"key": "X-Api-Key",
+			"plans": {
+				"strategy": "jwt",
+				"key": "plan",
+				"default": "free",
+				"tiers": {
+					"free": {"maxRate": 1, "capacity": 5},
+					"pro": {"maxRate": 10, "costs": {"/search": 5}},
+					"broken": {"capacity": 10},
+					"greedy": {"maxRate": 1, "capacity": 2, "costs": {"/search": 3}}
+				}
+			}
+		}
+	}`)
+	var dat config.ExtraConfig
+	if err := json.Unmarshal(serializedCfg, &dat); err != nil {
+		t.Error(err.Error())
+	}
+	cfg := ConfigGetter(dat).(Config)
+	if cfg.Plans == nil {
+		t.Error("plans not parsed")
+		return
+	}
+	if cfg.Plans.Strategy != "jwt" || cfg.Plans.Key != "plan" || cfg.Plans.Default != "free" {
+		t.Errorf("unexpected plans: %+v", cfg.Plans)
+	}
+	if len(cfg.Plans.Tiers) != 2 {
+		t.Errorf("unexpected tiers: %+v", cfg.Plans.Tiers)
+	}
+	if _, ok := cfg.Plans.Tiers["greedy"]; ok {
+		t.Error("a tier with a cost over its capacity should be rejected")
+	}
+
+	free, ok := cfg.Plans.Get("unknown")
+	if !ok || free.Name != "free" || free.MaxRate != 1 || free.Capacity != 5 {
+		t.Errorf("unexpected default plan: %+v", free)
+	}
+	if c := free.Cost("/search"); c != 1 {
+		t.Errorf("unexpected cost: %d", c)
+	}
+
+	pro, ok := cfg.Plans.Get("pro")
+	if !ok || pro.MaxRate != 10 || pro.Capacity != 10 {
+		t.Errorf("unexpected plan: %+v", pro)
+	}
+	if c := pro.Cost("/search"); c != 5 {
+		t.Errorf("unexpected cost: %d", c)
+	}
+	if c := pro.Cost("/other"); c != 1 {
+		t.Errorf("unexpected cost: %d", c)
+	}
 }
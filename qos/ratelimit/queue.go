@@ -0,0 +1,253 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ratelimit
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QueueConfig defines the spike-arrest mode of a limiter: the requests over the limit wait up to
+// MaxWait for a token, with up to Size of them waiting at the same time
+type QueueConfig struct {
+	Size    int64
+	MaxWait time.Duration
+}
+
+// ParseQueueConfig parses the queue definition of a rate limit config
+func ParseQueueConfig(v interface{}) (QueueConfig, bool) {
+	tmp, ok := v.(map[string]interface{})
+	if !ok {
+		return QueueConfig{}, false
+	}
+	cfg := QueueConfig{}
+	if v, ok := tmp["size"]; ok {
+		switch val := v.(type) {
+		case int64:
+			cfg.Size = val
+		case int:
+			cfg.Size = int64(val)
+		case float64:
+			cfg.Size = int64(val)
+		}
+	}
+	if v, ok := tmp["maxWait"]; ok {
+		if d, err := time.ParseDuration(fmt.Sprintf("%v", v)); err == nil {
+			cfg.MaxWait = d
+		}
+	}
+	if cfg.Size <= 0 || cfg.MaxWait <= 0 {
+		return QueueConfig{}, false
+	}
+	return cfg, true
+}
+
+// Queue smooths the traffic over the limit. Instead of being rejected, the requests wait until the
+// limiter admits them, while the queue has room for them and the max wait or the deadline of their
+// context is not reached. The requests waiting for the same limiter are served in arrival order:
+// only the first one polls the limiter, handing its turn over to the next one when it leaves
+type Queue struct {
+	depth   int64
+	size    int64
+	maxWait time.Duration
+	mu      *sync.Mutex
+	lines   map[interface{}]*line
+	// OnWait, if set, is called with the time spent in the queue by every request and whether it
+	// was served
+	OnWait func(time.Duration, bool)
+}
+
+// line is the FIFO list of the requests waiting for a limiter, with the last status reported by it
+type line struct {
+	waiters *list.List
+	status  Status
+}
+
+func NewQueue(cfg QueueConfig) *Queue {
+	return &Queue{
+		size:    cfg.Size,
+		maxWait: cfg.MaxWait,
+		mu:      new(sync.Mutex),
+		lines:   map[interface{}]*line{},
+	}
+}
+
+// Depth returns the number of requests waiting
+func (q *Queue) Depth() int64 {
+	return atomic.LoadInt64(&q.depth)
+}
+
+// Take tries to consume a token from the limiter, waiting for it if required
+func (q *Queue) Take(ctx context.Context, l Limiter) (bool, Status) {
+	return q.TakeN(ctx, l, 1)
+}
+
+// TakeN tries to consume n tokens from the limiter, waiting for them if required. A nil queue
+// rejects immediately. The requests don't jump ahead of the ones already waiting for the limiter
+func (q *Queue) TakeN(ctx context.Context, l Limiter, n int64) (bool, Status) {
+	if q == nil {
+		return l.TakeN(n)
+	}
+
+	key := lineKey(l)
+	status, queued := q.lastStatus(key)
+	if !queued {
+		var ok bool
+		if ok, status = l.TakeN(n); ok {
+			return true, status
+		}
+	}
+
+	if atomic.AddInt64(&q.depth, 1) > q.size {
+		atomic.AddInt64(&q.depth, -1)
+		q.observe(0, false)
+		return false, status
+	}
+	defer atomic.AddInt64(&q.depth, -1)
+
+	start := time.Now()
+	deadline := start.Add(q.maxWait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	// the request would not be served in time, so there is no point in waiting
+	if start.Add(status.RetryAfter).After(deadline) {
+		q.observe(0, false)
+		return false, status
+	}
+
+	ln, turn := q.join(key, status)
+	defer q.leave(key, ln, turn)
+
+	t := time.NewTimer(deadline.Sub(start))
+	select {
+	case <-ctx.Done():
+		t.Stop()
+		q.observe(time.Since(start), false)
+		return false, status
+	case <-t.C:
+		q.observe(time.Since(start), false)
+		return false, status
+	case <-turn.Value.(chan struct{}):
+		t.Stop()
+	}
+
+	// the status is fresh if the request just tried the limiter, so it waits before trying again
+	fresh := !queued
+	for {
+		if !fresh {
+			var ok bool
+			if ok, status = l.TakeN(n); ok {
+				q.observe(time.Since(start), true)
+				return true, status
+			}
+			q.update(ln, status)
+		}
+		fresh = false
+
+		wait := status.RetryAfter
+		if wait <= 0 {
+			wait = time.Millisecond
+		}
+		if time.Now().Add(wait).After(deadline) {
+			q.observe(time.Since(start), false)
+			return false, status
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			q.observe(time.Since(start), false)
+			return false, status
+		case <-t.C:
+		}
+	}
+}
+
+// lineKey returns the key of the line of the limiter. Limiters that can't be compared get a line
+// of their own
+func lineKey(l Limiter) interface{} {
+	if reflect.TypeOf(l).Comparable() {
+		return l
+	}
+	return new(int)
+}
+
+// lastStatus returns the last status reported to the requests waiting for the limiter, and whether
+// there are any of them
+func (q *Queue) lastStatus(key interface{}) (Status, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ln, ok := q.lines[key]
+	if !ok {
+		return Status{}, false
+	}
+	return ln.status, true
+}
+
+// join adds the request to the end of the line of the limiter. The returned element receives a
+// signal when the request is the first in the line
+func (q *Queue) join(key interface{}, status Status) (*line, *list.Element) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ln, ok := q.lines[key]
+	if !ok {
+		ln = &line{waiters: list.New(), status: status}
+		q.lines[key] = ln
+	}
+	e := ln.waiters.PushBack(make(chan struct{}, 1))
+	if ln.waiters.Front() == e {
+		e.Value.(chan struct{}) <- struct{}{}
+	}
+	return ln, e
+}
+
+// leave removes the request from the line, handing the turn over to the next one if it was first
+func (q *Queue) leave(key interface{}, ln *line, e *list.Element) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	first := ln.waiters.Front() == e
+	ln.waiters.Remove(e)
+	if ln.waiters.Len() == 0 {
+		delete(q.lines, key)
+		return
+	}
+	if first {
+		ln.waiters.Front().Value.(chan struct{}) <- struct{}{}
+	}
+}
+
+func (q *Queue) update(ln *line, status Status) {
+	q.mu.Lock()
+	ln.status = status
+	q.mu.Unlock()
+}
+
+func (q *Queue) observe(d time.Duration, served bool) {
+	if q.OnWait != nil {
+		q.OnWait(d, served)
+	}
+}
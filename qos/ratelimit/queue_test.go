@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseQueueConfig(t *testing.T) {
+	cfg, ok := ParseQueueConfig(map[string]interface{}{"size": 10.0, "maxWait": "500ms"})
+	if !ok || cfg.Size != 10 || cfg.MaxWait != 500*time.Millisecond {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+	for _, v := range []interface{}{
+		42,
+		map[string]interface{}{"size": 10.0},
+		map[string]interface{}{"maxWait": "1s"},
+	} {
+		if _, ok := ParseQueueConfig(v); ok {
+			t.Errorf("unexpected config for %v", v)
+		}
+	}
+}
+
+func TestQueue_Take(t *testing.T) {
+	l := &dummyLimiter{free: 1, retryAfter: 10 * time.Millisecond}
+	q := NewQueue(QueueConfig{Size: 1, MaxWait: time.Second})
+
+	var waits []time.Duration
+	var served []bool
+	q.OnWait = func(d time.Duration, ok bool) {
+		waits = append(waits, d)
+		served = append(served, ok)
+	}
+
+	if ok, _ := q.Take(context.Background(), l); !ok {
+		t.Error("the first request should be admitted")
+	}
+
+	done := make(chan bool)
+	go func() {
+		ok, _ := q.Take(context.Background(), l)
+		done <- ok
+	}()
+	for q.Depth() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if ok, _ := q.Take(context.Background(), l); ok {
+		t.Error("the request should be rejected when the queue is full")
+	}
+
+	l.refill(1)
+	if !<-done {
+		t.Error("the queued request should be served once the limiter admits it")
+	}
+	if q.Depth() != 0 {
+		t.Errorf("unexpected depth: %d", q.Depth())
+	}
+	if len(served) != 2 || served[0] || !served[1] || waits[1] <= 0 {
+		t.Errorf("unexpected observations: %v %v", served, waits)
+	}
+}
+
+func TestQueue_fifo(t *testing.T) {
+	l := &dummyLimiter{retryAfter: 5 * time.Millisecond}
+	q := NewQueue(QueueConfig{Size: 3, MaxWait: 5 * time.Second})
+
+	served := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			if ok, _ := q.Take(context.Background(), l); ok {
+				served <- i
+			}
+		}(i)
+		for q.Depth() != int64(i+1) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if ok, _ := q.Take(context.Background(), &dummyLimiter{free: 1}); !ok {
+		t.Error("the requests for other limiters should not wait in the line")
+	}
+
+	for i := 0; i < 3; i++ {
+		l.refill(1)
+		if s := <-served; s != i {
+			t.Errorf("the request #%d was served instead of #%d", s, i)
+		}
+	}
+	if q.Depth() != 0 || len(q.lines) != 0 {
+		t.Errorf("unexpected state: depth %d, lines %d", q.Depth(), len(q.lines))
+	}
+}
+
+func TestQueue_deadline(t *testing.T) {
+	l := &dummyLimiter{retryAfter: time.Second}
+	q := NewQueue(QueueConfig{Size: 1, MaxWait: 10 * time.Second})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if ok, _ := q.Take(ctx, l); ok {
+		t.Error("the request should be rejected")
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("the request should not wait when it can't be served before its deadline: %v", d)
+	}
+
+	var q0 *Queue
+	if ok, _ := q0.Take(context.Background(), l); ok {
+		t.Error("a nil queue should reject immediately")
+	}
+}
+
+type dummyLimiter struct {
+	mu         sync.Mutex
+	free       int64
+	retryAfter time.Duration
+}
+
+func (d *dummyLimiter) refill(n int64) {
+	d.mu.Lock()
+	d.free += n
+	d.mu.Unlock()
+}
+
+func (d *dummyLimiter) Allow() bool {
+	ok, _ := d.TakeN(1)
+	return ok
+}
+
+func (d *dummyLimiter) Take() (bool, Status) {
+	return d.TakeN(1)
+}
+
+func (d *dummyLimiter) TakeN(n int64) (bool, Status) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.free >= n {
+		d.free -= n
+		return true, Status{Limit: 1, Remaining: d.free}
+	}
+	return false, Status{Limit: 1, RetryAfter: d.retryAfter}
+}
@@ -0,0 +1,225 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package quota provides long-window quotas (hourly, daily, monthly) counting the calls of every
+// client over windows aligned to UTC boundaries, with the counters persisted across restarts
+package quota
+
+import (
+	"fmt"
+	srate "github.com/starvn/sonic/qos/ratelimit"
+	"github.com/starvn/sonic/qos/ratelimit/sliding"
+	"github.com/starvn/turbo/config"
+	"strings"
+	"time"
+)
+
+const Namespace = "github.com/starvn/sonic/qos/ratelimit/quota"
+
+var now = time.Now
+
+// Period returns the boundaries of the window containing the given time
+type Period func(time.Time) (time.Time, time.Time)
+
+var periods = map[string]Period{
+	"minute": func(t time.Time) (time.Time, time.Time) {
+		start := t.UTC().Truncate(time.Minute)
+		return start, start.Add(time.Minute)
+	},
+	"hour": func(t time.Time) (time.Time, time.Time) {
+		start := t.UTC().Truncate(time.Hour)
+		return start, start.Add(time.Hour)
+	},
+	"day": func(t time.Time) (time.Time, time.Time) {
+		t = t.UTC()
+		start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 1)
+	},
+	"month": func(t time.Time) (time.Time, time.Time) {
+		t = t.UTC()
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	},
+}
+
+// GetPeriod returns the period with the given name (minute, hour, day or month)
+func GetPeriod(name string) (Period, bool) {
+	p, ok := periods[strings.ToLower(name)]
+	return p, ok
+}
+
+type Config struct {
+	// Name is the namespace of the counters. Endpoints with the same name share the quotas of their
+	// clients. The handlers default it to the method and the path of the endpoint
+	Name             string
+	Strategy         string
+	Key              string
+	Limit            int64
+	Window           string
+	Sliding          bool
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+}
+
+var ZeroCfg = Config{}
+
+func ConfigGetter(e config.ExtraConfig) interface{} {
+	v, ok := e[Namespace]
+	if !ok {
+		return ZeroCfg
+	}
+	tmp, ok := v.(map[string]interface{})
+	if !ok {
+		return ZeroCfg
+	}
+	cfg := Config{
+		Window:           "day",
+		SnapshotInterval: time.Minute,
+	}
+	if v, ok := tmp["name"]; ok {
+		cfg.Name = fmt.Sprintf("%v", v)
+	}
+	if v, ok := tmp["strategy"]; ok {
+		cfg.Strategy = fmt.Sprintf("%v", v)
+	}
+	if v, ok := tmp["key"]; ok {
+		cfg.Key = fmt.Sprintf("%v", v)
+	}
+	if v, ok := tmp["limit"]; ok {
+		switch val := v.(type) {
+		case int64:
+			cfg.Limit = val
+		case int:
+			cfg.Limit = int64(val)
+		case float64:
+			cfg.Limit = int64(val)
+		}
+	}
+	if v, ok := tmp["window"]; ok {
+		cfg.Window = fmt.Sprintf("%v", v)
+	}
+	if v, ok := tmp["sliding"]; ok {
+		cfg.Sliding, _ = v.(bool)
+	}
+	if v, ok := tmp["snapshotPath"]; ok {
+		cfg.SnapshotPath = fmt.Sprintf("%v", v)
+	}
+	if v, ok := tmp["snapshotInterval"]; ok {
+		if d, err := time.ParseDuration(fmt.Sprintf("%v", v)); err == nil {
+			cfg.SnapshotInterval = d
+		}
+	}
+	return cfg
+}
+
+// NewLimiterStore returns a store of quotas for the clients of the named quota
+func NewLimiterStore(store *Store, name string, limit int64, period Period, sliding bool) srate.LimiterStore {
+	return func(client string) srate.Limiter {
+		return Quota{
+			store:   store,
+			key:     name + ":" + client,
+			limit:   limit,
+			period:  period,
+			sliding: sliding,
+		}
+	}
+}
+
+// Quota is a limiter admitting a maximum number of calls per window. Sliding quotas weight the
+// calls of the previous window by the part of it still overlapping the sliding window
+type Quota struct {
+	store   *Store
+	key     string
+	limit   int64
+	period  Period
+	sliding bool
+}
+
+func (q Quota) Allow() bool {
+	ok, _ := q.TakeN(1)
+	return ok
+}
+
+func (q Quota) Take() (bool, srate.Status) {
+	return q.TakeN(1)
+}
+
+func (q Quota) TakeN(n int64) (bool, srate.Status) {
+	t := now()
+	start, end := q.period(t)
+
+	q.store.mu.Lock()
+	c, ok := q.store.counters[q.key]
+	if !ok {
+		c = &counter{Start: start, End: end}
+		q.store.counters[q.key] = c
+	}
+	c.advance(start, end)
+
+	used := c.Current
+	if q.sliding {
+		used += sliding.WeightedPrevious(c.Previous, t.Sub(c.Start), c.End.Sub(c.Start))
+	}
+	allowed := used+n <= q.limit
+	if allowed {
+		c.Current += n
+		used += n
+	}
+
+	status := srate.Status{
+		Limit:     q.limit,
+		Remaining: q.limit - used,
+		Reset:     end.Sub(t),
+	}
+	if !allowed {
+		status.RetryAfter = status.Reset
+		if q.sliding {
+			status.RetryAfter = sliding.RetryAfter(q.limit, c.Current, c.Previous, n, t.Sub(c.Start), c.End.Sub(c.Start))
+		}
+	}
+	q.store.mu.Unlock()
+
+	if status.Remaining < 0 {
+		status.Remaining = 0
+	}
+	return allowed, status
+}
+
+type counter struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Current  int64     `json:"current"`
+	Previous int64     `json:"previous"`
+}
+
+func (c *counter) advance(start, end time.Time) {
+	if c.Start.Equal(start) {
+		return
+	}
+	if c.End.Equal(start) {
+		c.Previous = c.Current
+	} else {
+		c.Previous = 0
+	}
+	c.Current = 0
+	c.Start = start
+	c.End = end
+}
+
+// stale reports if the counter can't affect any window after the given time
+func (c *counter) stale(t time.Time) bool {
+	return !t.Before(c.End.Add(c.End.Sub(c.Start)))
+}
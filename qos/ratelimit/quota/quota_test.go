@@ -0,0 +1,238 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/starvn/turbo/config"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfigGetter(t *testing.T) {
+	serializedCfg := []byte(`{
+		"github.com/starvn/sonic/qos/ratelimit/quota": {
+			"strategy": "header",
+			"key": "X-Api-Key",
+			"limit": 10000,
+			"window": "month",
+			"sliding": true,
+			"snapshotPath": "/tmp/quota.json",
+			"snapshotInterval": "10s"
+		}
+	}`)
+	var dat config.ExtraConfig
+	if err := json.Unmarshal(serializedCfg, &dat); err != nil {
+		t.Error(err.Error())
+	}
+	cfg := ConfigGetter(dat).(Config)
+	expected := Config{
+		Strategy:         "header",
+		Key:              "X-Api-Key",
+		Limit:            10000,
+		Window:           "month",
+		Sliding:          true,
+		SnapshotPath:     "/tmp/quota.json",
+		SnapshotInterval: 10 * time.Second,
+	}
+	if cfg != expected {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+}
+
+func TestGetPeriod(t *testing.T) {
+	ts := time.Date(2021, time.February, 14, 15, 30, 0, 0, time.FixedZone("UTC+7", 7*3600))
+	for name, expected := range map[string][2]time.Time{
+		"hour":  {time.Date(2021, time.February, 14, 8, 0, 0, 0, time.UTC), time.Date(2021, time.February, 14, 9, 0, 0, 0, time.UTC)},
+		"day":   {time.Date(2021, time.February, 14, 0, 0, 0, 0, time.UTC), time.Date(2021, time.February, 15, 0, 0, 0, 0, time.UTC)},
+		"month": {time.Date(2021, time.February, 1, 0, 0, 0, 0, time.UTC), time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		p, ok := GetPeriod(name)
+		if !ok {
+			t.Errorf("%s: unknown period", name)
+			continue
+		}
+		start, end := p(ts)
+		if !start.Equal(expected[0]) || !end.Equal(expected[1]) {
+			t.Errorf("%s: unexpected window [%v, %v)", name, start, end)
+		}
+	}
+	if _, ok := GetPeriod("week"); ok {
+		t.Error("unexpected period")
+	}
+}
+
+func TestQuota_fixed(t *testing.T) {
+	defer func() { now = time.Now }()
+	current := time.Date(2021, time.February, 14, 23, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+
+	s, _ := NewStore(context.Background(), "", 0)
+	period, _ := GetPeriod("day")
+	store := NewLimiterStore(s, "test", 2, period, false)
+
+	for i := 0; i < 2; i++ {
+		if !store("a").Allow() {
+			t.Errorf("call #%d should be allowed", i)
+		}
+	}
+	ok, status := store("a").Take()
+	if ok {
+		t.Error("the quota should be exhausted")
+	}
+	if status.Limit != 2 || status.Remaining != 0 || status.Reset != time.Hour || status.RetryAfter != time.Hour {
+		t.Errorf("unexpected status: %+v", status)
+	}
+	if !store("b").Allow() {
+		t.Error("other clients should have their own quota")
+	}
+
+	current = current.Add(time.Hour)
+	ok, status = store("a").Take()
+	if !ok {
+		t.Error("the quota should be restored in the new window")
+	}
+	if status.Remaining != 1 || status.Reset != 24*time.Hour {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func TestQuota_sliding(t *testing.T) {
+	defer func() { now = time.Now }()
+	current := time.Date(2021, time.February, 14, 10, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+
+	s, _ := NewStore(context.Background(), "", 0)
+	period, _ := GetPeriod("hour")
+	store := NewLimiterStore(s, "test", 10, period, true)
+
+	for i := 0; i < 10; i++ {
+		if !store("a").Allow() {
+			t.Errorf("call #%d should be allowed", i)
+		}
+	}
+
+	current = current.Add(75 * time.Minute)
+	for i := 0; i < 2; i++ {
+		if !store("a").Allow() {
+			t.Errorf("call #%d should be allowed by the sliding window", i)
+		}
+	}
+	ok, status := store("a").Take()
+	if ok {
+		t.Error("the sliding window should be exhausted")
+	}
+	if status.Remaining != 0 || status.RetryAfter != 3*time.Minute {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	current = current.Add(3 * time.Minute)
+	if !store("a").Allow() {
+		t.Error("the sliding window should admit a new call")
+	}
+}
+
+func TestStore_snapshot(t *testing.T) {
+	defer func() { now = time.Now }()
+	current := time.Date(2021, time.February, 14, 10, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+
+	path := filepath.Join(t.TempDir(), "quota.json")
+	period, _ := GetPeriod("day")
+
+	s, err := NewStore(context.Background(), path, 0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	store := NewLimiterStore(s, "test", 3, period, false)
+	store("a").Allow()
+	store("a").Allow()
+	if err := s.Snapshot(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	restored, err := NewStore(context.Background(), path, 0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	store = NewLimiterStore(restored, "test", 3, period, false)
+	if ok, status := store("a").Take(); !ok || status.Remaining != 0 {
+		t.Errorf("the counters should be restored: %+v", status)
+	}
+
+	current = current.Add(48 * time.Hour)
+	if err := restored.Snapshot(); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(restored.counters) != 0 {
+		t.Errorf("stale counters should be dropped: %v", restored.counters)
+	}
+}
+
+func TestStore_prune(t *testing.T) {
+	defer func() { now = time.Now }()
+	current := time.Date(2021, time.February, 14, 10, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+
+	s, _ := NewStore(context.Background(), "", 0)
+	period, _ := GetPeriod("day")
+	NewLimiterStore(s, "test", 3, period, false)("a").Allow()
+
+	s.Prune()
+	if len(s.counters) != 1 {
+		t.Errorf("the counters in use should be kept: %v", s.counters)
+	}
+
+	current = current.Add(48 * time.Hour)
+	s.Prune()
+	if len(s.counters) != 0 {
+		t.Errorf("stale counters should be dropped without a snapshot path: %v", s.counters)
+	}
+}
+
+func TestGetStore_invalidSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	if err := ioutil.WriteFile(path, []byte("not json"), 0600); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if s, err := GetStore(ctx, path, 0); err == nil || s != nil {
+		t.Errorf("the invalid snapshot should be reported: %v %v", s, err)
+	}
+	if _, ok := stores[path]; ok {
+		t.Error("the failed store should not be kept")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{}"), 0600); err != nil {
+		t.Error(err)
+		return
+	}
+	if s, err := GetStore(ctx, path, 0); err != nil || s == nil {
+		t.Errorf("the store should be created once the snapshot is fixed: %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gin
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	jujugin "github.com/starvn/sonic/qos/ratelimit/juju/router/gin"
+	"github.com/starvn/sonic/qos/ratelimit/quota"
+	"github.com/starvn/turbo/config"
+	"github.com/starvn/turbo/log"
+	"github.com/starvn/turbo/proxy"
+	sgin "github.com/starvn/turbo/route/gin"
+)
+
+func HandlerFactory(l log.Logger, next sgin.HandlerFactory) sgin.HandlerFactory {
+	return HandlerFactoryWithContext(context.Background(), l, next)
+}
+
+// HandlerFactoryWithContext returns a handler factory whose stores are pruned and persisted until
+// the given context is cancelled
+func HandlerFactoryWithContext(ctx context.Context, l log.Logger, next sgin.HandlerFactory) sgin.HandlerFactory {
+	return func(remote *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		logPrefix := "[ENDPOINT: " + remote.Endpoint + "][Quota]"
+		handlerFunc := next(remote, p)
+
+		cfg := quota.ConfigGetter(remote.ExtraConfig).(quota.Config)
+		if cfg == quota.ZeroCfg || cfg.Limit <= 0 {
+			return handlerFunc
+		}
+
+		period, ok := quota.GetPeriod(cfg.Window)
+		if !ok {
+			l.Error(logPrefix, "Unknown window:", cfg.Window)
+			return handlerFunc
+		}
+
+		te := jujugin.NewTokenExtractorWithContext(ctx, cfg.Strategy, cfg.Key, remote)
+		if te == nil {
+			l.Error(logPrefix, "Unknown strategy:", cfg.Strategy)
+			return handlerFunc
+		}
+
+		store, err := quota.GetStore(ctx, cfg.SnapshotPath, cfg.SnapshotInterval)
+		if err != nil {
+			// the snapshot is kept untouched and the quota is enforced without persistence
+			l.Error(logPrefix, "Unable to restore the snapshot:", err.Error())
+			store, _ = quota.NewStore(ctx, "", cfg.SnapshotInterval)
+		}
+
+		if cfg.Name == "" {
+			cfg.Name = remote.Method + " " + remote.Endpoint
+		}
+
+		l.Debug(logPrefix, "Middleware is now ready")
+
+		limiterStore := quota.NewLimiterStore(store, cfg.Name, cfg.Limit, period, cfg.Sliding)
+		return jujugin.NewTokenLimiterMw(te, limiterStore)(handlerFunc)
+	}
+}
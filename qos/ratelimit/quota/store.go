@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultPruneInterval is the interval between prunes of the stale counters of the stores without
+// a snapshot interval
+const DefaultPruneInterval = time.Minute
+
+// Store keeps the counters of the quotas. If it has a path, the counters are loaded from it at
+// creation time and periodically saved to it, so a restart does not reset the consumed quotas
+type Store struct {
+	mu       *sync.Mutex
+	counters map[string]*counter
+	path     string
+}
+
+// NewStore returns a store dropping its stale counters and snapshotting the rest to the given path
+// every interval, until the context is cancelled. The counters of a previous snapshot are restored.
+// If the snapshot can't be restored, no store is returned, so it is never overwritten
+func NewStore(ctx context.Context, path string, interval time.Duration) (*Store, error) {
+	s := &Store{
+		mu:       new(sync.Mutex),
+		counters: map[string]*counter{},
+		path:     path,
+	}
+	if path != "" {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	if interval <= 0 {
+		if path != "" {
+			// the snapshots are managed by the caller
+			return s, nil
+		}
+		interval = DefaultPruneInterval
+	}
+	go s.maintainEvery(ctx, interval)
+
+	return s, nil
+}
+
+var (
+	stores   = map[string]*Store{}
+	storesMu = new(sync.Mutex)
+)
+
+// GetStore returns the store persisted at the given path, creating it if required. All the quotas
+// using the same path share the same store. Stores failing to restore their snapshot are not kept,
+// so the next call tries again
+func GetStore(ctx context.Context, path string, interval time.Duration) (*Store, error) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+
+	if s, ok := stores[path]; ok {
+		return s, nil
+	}
+	s, err := NewStore(ctx, path, interval)
+	if err != nil {
+		return nil, err
+	}
+	stores[path] = s
+	return s, nil
+}
+
+// Prune drops the counters that can't affect any current or future window
+func (s *Store) Prune() {
+	t := now()
+	s.mu.Lock()
+	for k, c := range s.counters {
+		if c.stale(t) {
+			delete(s.counters, k)
+		}
+	}
+	s.mu.Unlock()
+}
+
+// Snapshot saves the counters in use to the path of the store, dropping the stale ones
+func (s *Store) Snapshot() error {
+	if s.path == "" {
+		return nil
+	}
+
+	s.Prune()
+	s.mu.Lock()
+	data, err := json.Marshal(s.counters)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *Store) load() error {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	counters := map[string]*counter{}
+	if err := json.Unmarshal(data, &counters); err != nil {
+		return err
+	}
+
+	t := now()
+	s.mu.Lock()
+	for k, c := range counters {
+		if !c.stale(t) {
+			s.counters[k] = c
+		}
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// maintainEvery prunes the store every interval, snapshotting it if it has a path
+func (s *Store) maintainEvery(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	for {
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			_ = s.Snapshot()
+			return
+		case <-t.C:
+			if s.path == "" {
+				s.Prune()
+				continue
+			}
+			_ = s.Snapshot()
+		}
+	}
+}
@@ -20,8 +20,10 @@ import (
 	"context"
 	srate "github.com/starvn/sonic/qos/ratelimit"
 	"github.com/starvn/sonic/qos/ratelimit/rate"
+	"github.com/starvn/sonic/qos/ratelimit/redis"
 	"github.com/starvn/turbo/config"
 	"github.com/starvn/turbo/proxy"
+	"strings"
 )
 
 const Namespace = "github.com/starvn/sonic/qos/ratelimit/rate/proxy"
@@ -29,20 +31,37 @@ const Namespace = "github.com/starvn/sonic/qos/ratelimit/rate/proxy"
 type Config struct {
 	MaxRate  float64
 	Capacity int
+	Redis    *redis.Config
 }
 
 func BackendFactory(next proxy.BackendFactory) proxy.BackendFactory {
+	return BackendFactoryWithContext(context.Background(), next)
+}
+
+// BackendFactoryWithContext returns a backend factory whose redis clients and local caches are
+// released when the context is done
+func BackendFactoryWithContext(ctx context.Context, next proxy.BackendFactory) proxy.BackendFactory {
 	return func(cfg *config.Backend) proxy.Proxy {
-		return NewMiddleware(cfg)(next(cfg))
+		return NewMiddlewareWithContext(ctx, cfg)(next(cfg))
 	}
 }
 
 func NewMiddleware(remote *config.Backend) proxy.Middleware {
+	return NewMiddlewareWithContext(context.Background(), remote)
+}
+
+// NewMiddlewareWithContext returns a rate limiter middleware whose redis client and local cache are
+// bound to the context
+func NewMiddlewareWithContext(ctx context.Context, remote *config.Backend) proxy.Middleware {
 	cfg := ConfigGetter(remote.ExtraConfig).(Config)
 	if cfg == ZeroCfg || cfg.MaxRate <= 0 {
 		return proxy.EmptyMiddleware
 	}
-	tb := rate.NewLimiter(cfg.MaxRate, cfg.Capacity)
+	var tb srate.Limiter = rate.NewLimiter(cfg.MaxRate, cfg.Capacity)
+	if cfg.Redis != nil {
+		b := redis.NewBackend(ctx, redis.NewClientWithContext(ctx, *cfg.Redis), *cfg.Redis, "proxy")
+		tb = rate.NewLimiterStore(cfg.MaxRate, cfg.Capacity, b)(remote.Method + " " + strings.Join(remote.Host, ",") + remote.URLPattern)
+	}
 	return func(next ...proxy.Proxy) proxy.Proxy {
 		if len(next) > 1 {
 			panic(proxy.ErrTooManyProxies)
@@ -84,5 +103,10 @@ func ConfigGetter(e config.ExtraConfig) interface{} {
 			cfg.Capacity = int(val)
 		}
 	}
+	if v, ok := tmp["redis"]; ok {
+		if rc, ok := redis.ParseConfig(v); ok {
+			cfg.Redis = &rc
+		}
+	}
 	return cfg
 }
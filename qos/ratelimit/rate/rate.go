@@ -21,6 +21,7 @@ import (
 	"context"
 	sonicrate "github.com/starvn/sonic/qos/ratelimit"
 	"golang.org/x/time/rate"
+	"time"
 )
 
 func NewLimiter(maxRate float64, capacity int) Limiter {
@@ -35,10 +36,27 @@ func (l Limiter) Allow() bool {
 	return l.limiter.Allow()
 }
 
+func (l Limiter) Take() (bool, sonicrate.Status) {
+	return l.TakeN(1)
+}
+
+func (l Limiter) TakeN(n int64) (bool, sonicrate.Status) {
+	ok := l.limiter.AllowN(time.Now(), int(n))
+	return ok, sonicrate.NewBucketStatusN(l.limiter.Tokens(), n, int64(l.limiter.Burst()), float64(l.limiter.Limit()))
+}
+
+func (l Limiter) Rate() float64 {
+	return float64(l.limiter.Limit())
+}
+
+func (l Limiter) Capacity() int64 {
+	return int64(l.limiter.Burst())
+}
+
 func NewLimiterStore(maxRate float64, capacity int, backend sonicrate.Backend) sonicrate.LimiterStore {
 	f := func() interface{} { return NewLimiter(maxRate, capacity) }
 	return func(t string) sonicrate.Limiter {
-		return backend.Load(t, f).(Limiter)
+		return backend.Load(t, f).(sonicrate.Limiter)
 	}
 }
 
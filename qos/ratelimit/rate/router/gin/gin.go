@@ -17,10 +17,12 @@
 package gin
 
 import (
+	"context"
 	"github.com/gin-gonic/gin"
 	srate "github.com/starvn/sonic/qos/ratelimit"
 	"github.com/starvn/sonic/qos/ratelimit/rate"
 	"github.com/starvn/sonic/qos/ratelimit/rate/router"
+	"github.com/starvn/sonic/qos/ratelimit/redis"
 	"github.com/starvn/turbo/config"
 	"github.com/starvn/turbo/proxy"
 	sgin "github.com/starvn/turbo/route/gin"
@@ -31,6 +33,12 @@ import (
 var HandlerFactory = NewRateLimiterMw(sgin.EndpointHandler)
 
 func NewRateLimiterMw(next sgin.HandlerFactory) sgin.HandlerFactory {
+	return NewRateLimiterMwWithContext(context.Background(), next)
+}
+
+// NewRateLimiterMwWithContext returns a handler factory whose redis clients and local caches are
+// released when the context is done
+func NewRateLimiterMwWithContext(ctx context.Context, next sgin.HandlerFactory) sgin.HandlerFactory {
 	return func(remote *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
 		handlerFunc := next(remote, p)
 
@@ -39,6 +47,10 @@ func NewRateLimiterMw(next sgin.HandlerFactory) sgin.HandlerFactory {
 			return handlerFunc
 		}
 
+		if cfg.Redis != nil {
+			return newRedisLimiterMw(ctx, cfg, remote)(handlerFunc)
+		}
+
 		if cfg.MaxRate > 0 {
 			handlerFunc = NewEndpointRateLimiterMw(rate.NewLimiter(float64(cfg.MaxRate), cfg.MaxRate))(handlerFunc)
 		}
@@ -54,12 +66,42 @@ func NewRateLimiterMw(next sgin.HandlerFactory) sgin.HandlerFactory {
 	}
 }
 
+func newRedisLimiterMw(ctx context.Context, cfg router.Config, remote *config.EndpointConfig) EndpointMw {
+	client := redis.NewClientWithContext(ctx, *cfg.Redis)
+	name := "router:" + remote.Method + " " + remote.Endpoint
+
+	return func(handlerFunc gin.HandlerFunc) gin.HandlerFunc {
+		if cfg.MaxRate > 0 {
+			b := redis.NewBackend(ctx, client, *cfg.Redis, name)
+			store := rate.NewLimiterStore(float64(cfg.MaxRate), cfg.MaxRate, b)
+			handlerFunc = NewEndpointRateLimiterMw(store("endpoint"))(handlerFunc)
+		}
+		if cfg.ClientMaxRate > 0 {
+			var te TokenExtractor
+			switch strings.ToLower(cfg.Strategy) {
+			case "ip":
+				te = IPTokenExtractor
+			case "header":
+				te = HeaderTokenExtractor(cfg.Key)
+			default:
+				return handlerFunc
+			}
+			b := redis.NewBackend(ctx, client, *cfg.Redis, name+":client")
+			store := rate.NewLimiterStore(float64(cfg.ClientMaxRate), cfg.ClientMaxRate, b)
+			handlerFunc = NewTokenLimiterMw(te, store)(handlerFunc)
+		}
+		return handlerFunc
+	}
+}
+
 type EndpointMw func(gin.HandlerFunc) gin.HandlerFunc
 
-func NewEndpointRateLimiterMw(tb rate.Limiter) EndpointMw {
+func NewEndpointRateLimiterMw(tb srate.Limiter) EndpointMw {
 	return func(next gin.HandlerFunc) gin.HandlerFunc {
 		return func(c *gin.Context) {
-			if !tb.Allow() {
+			ok, status := tb.Take()
+			srate.SetHeaders(c.Writer.Header(), status, ok)
+			if !ok {
 				_ = c.AbortWithError(503, srate.ErrLimited)
 				return
 			}
@@ -92,7 +134,9 @@ func NewTokenLimiterMw(tokenExtractor TokenExtractor, limiterStore srate.Limiter
 				_ = c.AbortWithError(http.StatusTooManyRequests, srate.ErrLimited)
 				return
 			}
-			if !limiterStore(tokenKey).Allow() {
+			ok, status := limiterStore(tokenKey).Take()
+			srate.SetHeaders(c.Writer.Header(), status, ok)
+			if !ok {
 				_ = c.AbortWithError(http.StatusTooManyRequests, srate.ErrLimited)
 				return
 			}
@@ -19,6 +19,7 @@ package router
 
 import (
 	"fmt"
+	"github.com/starvn/sonic/qos/ratelimit/redis"
 	"github.com/starvn/turbo/config"
 )
 
@@ -29,6 +30,7 @@ type Config struct {
 	Strategy      string
 	ClientMaxRate int
 	Key           string
+	Redis         *redis.Config
 }
 
 var ZeroCfg = Config{}
@@ -65,5 +67,10 @@ func ConfigGetter(e config.ExtraConfig) interface{} {
 	if v, ok := tmp["key"]; ok {
 		cfg.Key = fmt.Sprintf("%v", v)
 	}
+	if v, ok := tmp["redis"]; ok {
+		if rc, ok := redis.ParseConfig(v); ok {
+			cfg.Redis = &rc
+		}
+	}
 	return cfg
 }
@@ -0,0 +1,350 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package redis provides a rate-limit backend sharing the token buckets between several gateway
+// replicas through any server speaking the redis protocol
+package redis
+
+import (
+	"context"
+	"fmt"
+	goredis "github.com/go-redis/redis/v8"
+	srate "github.com/starvn/sonic/qos/ratelimit"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultKeyPrefix     = "sonic:ratelimit"
+	defaultTimeout       = 50 * time.Millisecond
+	defaultRetryInterval = 5 * time.Second
+)
+
+var now = time.Now
+
+// tokenBucket refills and consumes the bucket stored at KEYS[1] in a single atomic step.
+// ARGV: rate (tokens per second), capacity, tokens requested.
+// The clock of the store is used, so the replicas agree on the refill regardless of their own
+// clocks. It returns the admission flag and the tokens left in the bucket
+var tokenBucket = goredis.NewScript(`
+local rate = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local requested = tonumber(ARGV[3])
+
+-- TIME is not deterministic, so older servers must replicate the effects instead of the script
+pcall(redis.replicate_commands)
+local clock = redis.call("TIME")
+local ts = tonumber(clock[1]) * 1000 + math.floor(tonumber(clock[2]) / 1000)
+
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1])
+local last = tonumber(state[2])
+if tokens == nil or last == nil then
+	tokens = capacity
+	last = ts
+end
+
+if ts > last then
+	tokens = math.min(capacity, tokens + (ts - last) * rate / 1000)
+	last = ts
+end
+
+local allowed = 0
+if tokens >= requested then
+	tokens = tokens - requested
+	allowed = 1
+end
+
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(last))
+redis.call("PEXPIRE", KEYS[1], math.ceil(capacity * 1000 / rate) + 1000)
+
+return {allowed, tostring(tokens)}
+`)
+
+// Config defines the connection to the shared store and the namespace of the keys
+type Config struct {
+	Address       string
+	Password      string
+	DB            int
+	KeyPrefix     string
+	Timeout       time.Duration
+	RetryInterval time.Duration
+}
+
+// ParseConfig extracts the store configuration from the value of the "redis" entry of a
+// rate-limit extra config
+func ParseConfig(v interface{}) (Config, bool) {
+	tmp, ok := v.(map[string]interface{})
+	if !ok {
+		return Config{}, false
+	}
+	cfg := Config{
+		KeyPrefix:     defaultKeyPrefix,
+		Timeout:       defaultTimeout,
+		RetryInterval: defaultRetryInterval,
+	}
+	if v, ok := tmp["address"]; ok {
+		cfg.Address = fmt.Sprintf("%v", v)
+	}
+	if cfg.Address == "" {
+		return Config{}, false
+	}
+	if v, ok := tmp["password"]; ok {
+		cfg.Password = fmt.Sprintf("%v", v)
+	}
+	if v, ok := tmp["db"]; ok {
+		switch val := v.(type) {
+		case int:
+			cfg.DB = val
+		case int64:
+			cfg.DB = int(val)
+		case float64:
+			cfg.DB = int(val)
+		}
+	}
+	if v, ok := tmp["keyPrefix"]; ok {
+		cfg.KeyPrefix = fmt.Sprintf("%v", v)
+	}
+	if v, ok := tmp["timeout"]; ok {
+		if d, err := time.ParseDuration(fmt.Sprintf("%v", v)); err == nil {
+			cfg.Timeout = d
+		}
+	}
+	if v, ok := tmp["retryInterval"]; ok {
+		if d, err := time.ParseDuration(fmt.Sprintf("%v", v)); err == nil {
+			cfg.RetryInterval = d
+		}
+	}
+	return cfg, true
+}
+
+var (
+	clients   = map[clientKey]goredis.UniversalClient{}
+	clientsMu = new(sync.Mutex)
+)
+
+// clientKey identifies a client within the context of the service creating it
+type clientKey struct {
+	ctx  context.Context
+	addr string
+}
+
+// NewClient returns a client for the configured store. Clients are shared between all the
+// limiters pointing to the same server and database
+func NewClient(cfg Config) goredis.UniversalClient {
+	return NewClientWithContext(context.Background(), cfg)
+}
+
+// NewClientWithContext returns a client for the configured store, shared between all the limiters
+// of the context pointing to the same server and database. The client is closed once the context
+// is done
+func NewClientWithContext(ctx context.Context, cfg Config) goredis.UniversalClient {
+	k := clientKey{ctx: ctx, addr: fmt.Sprintf("%s|%d|%s", cfg.Address, cfg.DB, cfg.Password)}
+
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	if c, ok := clients[k]; ok {
+		return c
+	}
+	c := goredis.NewUniversalClient(&goredis.UniversalOptions{
+		Addrs:        []string{cfg.Address},
+		Password:     cfg.Password,
+		DB:           cfg.DB,
+		DialTimeout:  cfg.Timeout,
+		ReadTimeout:  cfg.Timeout,
+		WriteTimeout: cfg.Timeout,
+		MaxRetries:   -1,
+	})
+	clients[k] = c
+	if done := ctx.Done(); done != nil {
+		go func() {
+			<-done
+			clientsMu.Lock()
+			delete(clients, k)
+			clientsMu.Unlock()
+			_ = c.Close()
+		}()
+	}
+	return c
+}
+
+// Backend is a srate.Backend that keeps the state of the token buckets in the shared store.
+// The limiters are cached in a local backend, so every key is backed by a local token bucket
+// used as fallback while the store can't be reached
+type Backend struct {
+	downUntil     int64
+	client        goredis.UniversalClient
+	local         srate.Backend
+	localPrefix   string
+	prefix        string
+	timeout       time.Duration
+	retryInterval time.Duration
+}
+
+// NewBackend returns a Backend storing the buckets under the key space of the given name. The
+// limiters are cached in the local backend shared by all the Backends bound to the same context
+func NewBackend(ctx context.Context, client goredis.UniversalClient, cfg Config, name string) *Backend {
+	return NewBackendWithLocal(client, cfg, name, localBackend(ctx))
+}
+
+var (
+	backends uint64
+	locals   = map[context.Context]srate.Backend{}
+	localsMu = new(sync.Mutex)
+)
+
+// localBackend returns the local backend shared by all the Backends bound to the given context.
+// It is forgotten once the context is done, when its janitors stop
+func localBackend(ctx context.Context) srate.Backend {
+	localsMu.Lock()
+	defer localsMu.Unlock()
+
+	if b, ok := locals[ctx]; ok {
+		return b
+	}
+	b := srate.DefaultShardedMemoryBackend(ctx)
+	locals[ctx] = b
+	if done := ctx.Done(); done != nil {
+		go func() {
+			<-done
+			localsMu.Lock()
+			delete(locals, ctx)
+			localsMu.Unlock()
+		}()
+	}
+	return b
+}
+
+// NewBackendWithLocal returns a Backend using the injected local backend for caching the limiters
+func NewBackendWithLocal(client goredis.UniversalClient, cfg Config, name string, local srate.Backend) *Backend {
+	prefix := cfg.KeyPrefix
+	if prefix == "" {
+		prefix = defaultKeyPrefix
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	retryInterval := cfg.RetryInterval
+	if retryInterval <= 0 {
+		retryInterval = defaultRetryInterval
+	}
+	// the local backend may be shared, so the limiters of every Backend are kept apart, even from
+	// the ones of other Backends with the same name
+	id := atomic.AddUint64(&backends, 1)
+	return &Backend{
+		client:        client,
+		local:         local,
+		localPrefix:   strconv.FormatUint(id, 10) + ":",
+		prefix:        prefix + ":" + name + ":",
+		timeout:       timeout,
+		retryInterval: retryInterval,
+	}
+}
+
+// Load returns a distributed limiter wrapping the one created by f. If the limiter returned by f
+// does not expose its bucket parameters, it is kept local
+func (b *Backend) Load(key string, f func() interface{}) interface{} {
+	return b.local.Load(b.localPrefix+key, func() interface{} {
+		v := f()
+		l, ok := v.(srate.Limiter)
+		if !ok {
+			return v
+		}
+		tb, ok := v.(srate.TokenBucket)
+		if !ok || tb.Rate() <= 0 || tb.Capacity() <= 0 {
+			return v
+		}
+		return &Limiter{
+			backend:  b,
+			key:      b.prefix + key,
+			rate:     tb.Rate(),
+			capacity: tb.Capacity(),
+			fallback: l,
+		}
+	})
+}
+
+func (b *Backend) Store(key string, v interface{}) error {
+	return b.local.Store(b.localPrefix+key, v)
+}
+
+func (b *Backend) available() bool {
+	return now().UnixNano() >= atomic.LoadInt64(&b.downUntil)
+}
+
+func (b *Backend) markDown() {
+	atomic.StoreInt64(&b.downUntil, now().Add(b.retryInterval).UnixNano())
+}
+
+// Limiter is a token bucket evaluated atomically on the shared store
+type Limiter struct {
+	backend  *Backend
+	key      string
+	rate     float64
+	capacity int64
+	fallback srate.Limiter
+}
+
+func (l *Limiter) Allow() bool {
+	ok, _ := l.Take()
+	return ok
+}
+
+func (l *Limiter) Take() (bool, srate.Status) {
+	return l.TakeN(1)
+}
+
+func (l *Limiter) TakeN(n int64) (bool, srate.Status) {
+	if !l.backend.available() {
+		return l.fallback.TakeN(n)
+	}
+
+	allowed, tokens, err := l.take(n)
+	if err != nil {
+		l.backend.markDown()
+		return l.fallback.TakeN(n)
+	}
+	return allowed, srate.NewBucketStatusN(tokens, n, l.capacity, l.rate)
+}
+
+func (l *Limiter) Rate() float64 {
+	return l.rate
+}
+
+func (l *Limiter) Capacity() int64 {
+	return l.capacity
+}
+
+func (l *Limiter) take(n int64) (bool, float64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), l.backend.timeout)
+	defer cancel()
+
+	res, err := tokenBucket.Run(ctx, l.backend.client, []string{l.key}, l.rate, l.capacity, n).Result()
+	if err != nil {
+		return false, 0, err
+	}
+	values, ok := res.([]interface{})
+	if !ok || len(values) != 2 {
+		return false, 0, fmt.Errorf("unexpected response from the store: %v", res)
+	}
+	allowed, _ := values[0].(int64)
+	tokens, _ := strconv.ParseFloat(fmt.Sprintf("%v", values[1]), 64)
+	return allowed == 1, tokens, nil
+}
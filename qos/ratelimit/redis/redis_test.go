@@ -0,0 +1,241 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redis
+
+import (
+	"context"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/starvn/sonic/qos/ratelimit/juju"
+	"github.com/starvn/sonic/qos/ratelimit/rate"
+	"testing"
+	"time"
+)
+
+// testTimeout replaces the default timeout of the store, too tight for miniredis running the
+// scripts on a loaded machine. The limiters would fall back to their local buckets, making the
+// assertions on the shared ones flaky
+const testTimeout = "1s"
+
+func TestParseConfig(t *testing.T) {
+	cfg, ok := ParseConfig(map[string]interface{}{
+		"address":       "localhost:6379",
+		"db":            2.0,
+		"keyPrefix":     "test",
+		"timeout":       "10ms",
+		"retryInterval": "1s",
+	})
+	if !ok {
+		t.Error("the config should be accepted")
+		return
+	}
+	if cfg.Address != "localhost:6379" || cfg.DB != 2 || cfg.KeyPrefix != "test" ||
+		cfg.Timeout != 10*time.Millisecond || cfg.RetryInterval != time.Second {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+
+	for _, v := range []interface{}{nil, 42, map[string]interface{}{}, map[string]interface{}{"db": 1}} {
+		if _, ok := ParseConfig(v); ok {
+			t.Errorf("the config %v should be rejected", v)
+		}
+	}
+}
+
+func TestNewClientWithContext(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg, _ := ParseConfig(map[string]interface{}{"address": s.Addr()})
+
+	c := NewClientWithContext(ctx, cfg)
+	if NewClientWithContext(ctx, cfg) != c {
+		t.Error("the client should be shared within the context")
+	}
+	if NewClient(cfg) == c {
+		t.Error("the client should not be shared with other contexts")
+	}
+	if err := c.Ping(context.Background()).Err(); err != nil {
+		t.Error(err)
+	}
+
+	cancel()
+	<-time.After(10 * time.Millisecond)
+
+	clientsMu.Lock()
+	_, ok := clients[clientKey{ctx: ctx, addr: fmt.Sprintf("%s|%d|%s", cfg.Address, cfg.DB, cfg.Password)}]
+	clientsMu.Unlock()
+	if ok {
+		t.Error("the client should be released with its context")
+	}
+	if err := c.Ping(context.Background()).Err(); err == nil {
+		t.Error("the client should be closed with its context")
+	}
+}
+
+func TestBackend_sharedBetweenReplicas(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg, _ := ParseConfig(map[string]interface{}{"address": s.Addr(), "timeout": testTimeout})
+
+	stores := []func(string) bool{
+		func(k string) bool {
+			return juju.NewLimiterStore(1, 5, NewBackend(ctx, NewClient(cfg), cfg, "test"))(k).Allow()
+		},
+		func(k string) bool {
+			return rate.NewLimiterStore(1, 5, NewBackend(ctx, NewClient(cfg), cfg, "test"))(k).Allow()
+		},
+	}
+
+	for i := 0; i < 5; i++ {
+		if !stores[i%2]("a") {
+			t.Errorf("call #%d should be allowed", i)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if stores[i%2]("a") {
+			t.Errorf("call #%d should be limited by the shared bucket", i)
+		}
+	}
+	if !stores[1]("b") {
+		t.Error("a different key should have its own bucket")
+	}
+	if !s.Exists("sonic:ratelimit:test:a") {
+		t.Error("the bucket should be stored in the shared store")
+	}
+}
+
+func TestBackend_refill(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the buckets are refilled with the clock of the store
+	current := time.Now()
+	s.SetTime(current)
+
+	cfg, _ := ParseConfig(map[string]interface{}{"address": s.Addr(), "timeout": testTimeout})
+	store := juju.NewLimiterStore(10, 1, NewBackend(ctx, NewClient(cfg), cfg, "refill"))
+
+	if !store("a").Allow() {
+		t.Error("the first call should be allowed")
+	}
+	if store("a").Allow() {
+		t.Error("the second call should be limited")
+	}
+	current = current.Add(50 * time.Millisecond)
+	s.SetTime(current)
+	ok, status := store("a").Take()
+	if ok {
+		t.Error("the third call should be limited")
+	}
+	if status.Limit != 1 || status.Remaining != 0 || status.RetryAfter != 50*time.Millisecond {
+		t.Errorf("unexpected status: %+v", status)
+	}
+	current = current.Add(50 * time.Millisecond)
+	s.SetTime(current)
+	if !store("a").Allow() {
+		t.Error("the bucket should have been refilled")
+	}
+}
+
+func TestBackend_sharedLocal(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cfg, _ := ParseConfig(map[string]interface{}{"address": s.Addr(), "timeout": testTimeout})
+	b1 := NewBackend(ctx, NewClient(cfg), cfg, "first")
+	b2 := NewBackend(ctx, NewClient(cfg), cfg, "second")
+	if b1.local != b2.local {
+		t.Error("the backends bound to the same context should share the local backend")
+	}
+
+	if !juju.NewLimiterStore(1, 1, b1)("a").Allow() {
+		t.Error("the first backend should allow the call")
+	}
+	if !juju.NewLimiterStore(1, 1, b2)("a").Allow() {
+		t.Error("the same key in another backend should have its own bucket")
+	}
+
+	cancel()
+	<-time.After(10 * time.Millisecond)
+
+	localsMu.Lock()
+	_, ok := locals[ctx]
+	localsMu.Unlock()
+	if ok {
+		t.Error("the local backend should be released with its context")
+	}
+}
+
+func TestBackend_fallback(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg, _ := ParseConfig(map[string]interface{}{"address": s.Addr(), "retryInterval": "1h"})
+	b := NewBackend(ctx, NewClient(cfg), cfg, "fallback")
+	store := juju.NewLimiterStore(1, 2, b)
+
+	if !store("a").Allow() {
+		t.Error("the first call should be allowed")
+	}
+
+	s.Close()
+
+	if !store("a").Allow() {
+		t.Error("the local bucket should allow the call while the store is down")
+	}
+	if b.available() {
+		t.Error("the store should be flagged as unavailable")
+	}
+	if !store("a").Allow() {
+		t.Error("the local bucket should allow its second token")
+	}
+	if store("a").Allow() {
+		t.Error("the local bucket should be empty")
+	}
+}
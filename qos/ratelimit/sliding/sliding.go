@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package sliding provides a sliding-window counter limiter. The calls of the previous window are
+// weighted by the part of it still overlapping the sliding window, so clients can't get twice the
+// limit through by bursting around the boundaries of the windows
+package sliding
+
+import (
+	"context"
+	srate "github.com/starvn/sonic/qos/ratelimit"
+	"math"
+	"sync"
+	"time"
+)
+
+var now = time.Now
+
+// NewLimiter returns a limiter admitting up to limit calls in any window of the given duration. It
+// panics if the limit or the window are not positive
+func NewLimiter(limit int64, window time.Duration) *Limiter {
+	if limit <= 0 {
+		panic("sliding window limit is not > 0")
+	}
+	if window <= 0 {
+		panic("sliding window duration is not > 0")
+	}
+	return &Limiter{
+		mu:     new(sync.Mutex),
+		limit:  limit,
+		window: window,
+	}
+}
+
+type Limiter struct {
+	mu       *sync.Mutex
+	limit    int64
+	window   time.Duration
+	start    time.Time
+	current  int64
+	previous int64
+}
+
+func (l *Limiter) Allow() bool {
+	ok, _ := l.TakeN(1)
+	return ok
+}
+
+func (l *Limiter) Take() (bool, srate.Status) {
+	return l.TakeN(1)
+}
+
+func (l *Limiter) TakeN(n int64) (bool, srate.Status) {
+	t := now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.advance(t)
+	elapsed := t.Sub(l.start)
+
+	used := l.current + WeightedPrevious(l.previous, elapsed, l.window)
+	allowed := used+n <= l.limit
+	if allowed {
+		l.current += n
+		used += n
+	}
+
+	status := srate.Status{
+		Limit:     l.limit,
+		Remaining: l.limit - used,
+		Reset:     l.reset(elapsed),
+	}
+	if status.Remaining < 0 {
+		status.Remaining = 0
+	}
+	if !allowed {
+		status.RetryAfter = RetryAfter(l.limit, l.current, l.previous, n, elapsed, l.window)
+	}
+	return allowed, status
+}
+
+func (l *Limiter) advance(t time.Time) {
+	start := t.Truncate(l.window)
+	if start.Equal(l.start) {
+		return
+	}
+	if start.Sub(l.start) == l.window {
+		l.previous = l.current
+	} else {
+		l.previous = 0
+	}
+	l.current = 0
+	l.start = start
+}
+
+// WeightedPrevious returns the calls of the previous window still counted by the sliding window,
+// weighted by the part of the previous window overlapping it
+func WeightedPrevious(previous int64, elapsed, window time.Duration) int64 {
+	if previous == 0 {
+		return 0
+	}
+	overlap := 1 - float64(elapsed)/float64(window)
+	return int64(math.Ceil(float64(previous) * overlap))
+}
+
+// reset returns the time required for the calls already admitted to leave the sliding window
+func (l *Limiter) reset(elapsed time.Duration) time.Duration {
+	switch {
+	case l.current > 0:
+		return 2*l.window - elapsed
+	case l.previous > 0:
+		return l.window - elapsed
+	}
+	return 0
+}
+
+// RetryAfter estimates the time required for the sliding window to admit n more calls, given the
+// calls of the current and the previous windows and the time elapsed since the current one started
+func RetryAfter(limit, current, previous, n int64, elapsed, window time.Duration) time.Duration {
+	w := float64(window)
+
+	if free := limit - current - n; free >= 0 && previous > 0 {
+		d := math.Ceil(w*float64(previous-free)/float64(previous) - float64(elapsed))
+		if d > 0 {
+			return time.Duration(d)
+		}
+		return 0
+	}
+
+	d := window - elapsed
+	if free := limit - n; free >= 0 && current > 0 {
+		d += time.Duration(math.Ceil(w * float64(current-free) / float64(current)))
+	}
+	return d
+}
+
+func NewLimiterStore(limit int64, window time.Duration, backend srate.Backend) srate.LimiterStore {
+	f := func() interface{} { return NewLimiter(limit, window) }
+	return func(t string) srate.Limiter {
+		return backend.Load(t, f).(srate.Limiter)
+	}
+}
+
+func NewMemoryStore(limit int64, window time.Duration) srate.LimiterStore {
+	return NewLimiterStore(limit, window, srate.DefaultShardedMemoryBackend(context.Background()))
+}
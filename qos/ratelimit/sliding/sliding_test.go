@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sliding
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter_boundaries(t *testing.T) {
+	defer func() { now = time.Now }()
+	current := time.Date(2021, time.February, 14, 10, 0, 59, 0, time.UTC)
+	now = func() time.Time { return current }
+
+	l := NewLimiter(10, time.Minute)
+	for i := 0; i < 10; i++ {
+		if !l.Allow() {
+			t.Errorf("call #%d should be allowed", i)
+		}
+	}
+
+	current = current.Add(time.Second)
+	ok, status := l.Take()
+	if ok {
+		t.Error("the calls of the previous window should still count")
+	}
+	if status.Limit != 10 || status.Remaining != 0 || status.RetryAfter != 6*time.Second {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	current = current.Add(6 * time.Second)
+	ok, status = l.Take()
+	if !ok {
+		t.Error("the sliding window should admit a new call")
+	}
+	if status.Remaining != 0 || status.Reset != 114*time.Second {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	current = current.Add(2 * time.Minute)
+	if ok, status := l.TakeN(10); !ok || status.Remaining != 0 {
+		t.Errorf("the limiter should be replenished: %+v", status)
+	}
+}
+
+func TestNewMemoryStore(t *testing.T) {
+	store := NewMemoryStore(1, time.Minute)
+	if !store("1").Allow() {
+		t.Error("The limiter should allow the first call")
+	}
+	if store("1").Allow() {
+		t.Error("The limiter should block the second call")
+	}
+	if !store("2").Allow() {
+		t.Error("The limiter should allow the third call because it requests a new limiter")
+	}
+}
+
+func TestNewLimiter_invalid(t *testing.T) {
+	for _, tc := range []struct {
+		limit  int64
+		window time.Duration
+	}{
+		{limit: 0, window: time.Second},
+		{limit: -1, window: time.Second},
+		{limit: 1, window: 0},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("the limiter %d/%v should be rejected", tc.limit, tc.window)
+				}
+			}()
+			NewLimiter(tc.limit, tc.window)
+		}()
+	}
+}
@@ -35,6 +35,56 @@ var (
 
 type Limiter interface {
 	Allow() bool
+	// Take tries to consume a token, reporting the state of the limiter after the attempt
+	Take() (bool, Status)
+	// TakeN tries to consume n tokens at once, reporting the state of the limiter after the attempt
+	TakeN(int64) (bool, Status)
+}
+
+// Status describes the state of a limiter after an admission attempt
+type Status struct {
+	// Limit is the maximum number of tokens the limiter can hold
+	Limit int64
+	// Remaining is the number of tokens left
+	Remaining int64
+	// Reset is the time required to replenish the limiter completely
+	Reset time.Duration
+	// RetryAfter is the time required to get the next token
+	RetryAfter time.Duration
+}
+
+// NewBucketStatus returns the status of a token bucket holding the given amount of tokens
+func NewBucketStatus(tokens float64, capacity int64, rate float64) Status {
+	return NewBucketStatusN(tokens, 1, capacity, rate)
+}
+
+// NewBucketStatusN returns the status of a token bucket holding the given amount of tokens, when
+// the next admission requires n tokens
+func NewBucketStatusN(tokens float64, n int64, capacity int64, rate float64) Status {
+	if tokens < 0 {
+		tokens = 0
+	}
+	s := Status{
+		Limit:     capacity,
+		Remaining: int64(tokens),
+	}
+	if rate <= 0 {
+		return s
+	}
+	if missing := float64(capacity) - tokens; missing > 0 {
+		s.Reset = time.Duration(missing / rate * float64(time.Second))
+	}
+	if missing := float64(n) - tokens; missing > 0 {
+		s.RetryAfter = time.Duration(missing / rate * float64(time.Second))
+	}
+	return s
+}
+
+// TokenBucket is implemented by the limiters able to expose the parameters of their bucket, so
+// distributed backends can replicate them on a shared store
+type TokenBucket interface {
+	Rate() float64
+	Capacity() int64
 }
 
 type LimiterStore func(string) Limiter
@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package proxy provides a backend proxy middleware retrying the failed calls with an exponential
+// backoff, within the budget of retries of the backend
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/starvn/sonic/qos/httpcache"
+	"github.com/starvn/sonic/qos/retry"
+	"github.com/starvn/sonic/telemetry/metrics"
+	"github.com/starvn/turbo/config"
+	"github.com/starvn/turbo/log"
+	"github.com/starvn/turbo/proxy"
+	"go.opencensus.io/trace"
+	"net"
+	"time"
+)
+
+func BackendFactory(next proxy.BackendFactory, logger log.Logger, m *metrics.Metrics) proxy.BackendFactory {
+	return func(cfg *config.Backend) proxy.Proxy {
+		return NewMiddleware(cfg, logger, m)(next(cfg))
+	}
+}
+
+func NewMiddleware(remote *config.Backend, logger log.Logger, m *metrics.Metrics) proxy.Middleware {
+	logPrefix := "[BACKEND: " + remote.URLPattern + "][Retry]"
+	cfg := retry.ConfigGetter(remote.ExtraConfig).(retry.Config)
+	if cfg.MaxAttempts < 2 {
+		return proxy.EmptyMiddleware
+	}
+
+	statusCodes := make(map[int]struct{}, len(cfg.StatusCodes))
+	for _, c := range cfg.StatusCodes {
+		statusCodes[c] = struct{}{}
+	}
+	budget := retry.NewBudget(cfg.BudgetRatio, cfg.BudgetMinPerSecond, cfg.BudgetWindow)
+
+	report := func(attempts int, exhausted bool) {}
+	if m != nil && m.Config != nil && !m.Config.BackendDisabled {
+		labels := "layer.backend.name." + remote.URLPattern
+		histogram := m.Proxy.Histogram("retry.attempts", labels)
+		retries := m.Proxy.Counter("retry.retries", labels)
+		exhaustedCounter := m.Proxy.Counter("retry.budget_exhausted", labels)
+		report = func(attempts int, exhausted bool) {
+			histogram.Update(int64(attempts))
+			retries.Inc(int64(attempts - 1))
+			if exhausted {
+				exhaustedCounter.Inc(1)
+			}
+		}
+	}
+
+	logger.Debug(logPrefix, "Retrying up to", cfg.MaxAttempts, "attempts")
+
+	return func(next ...proxy.Proxy) proxy.Proxy {
+		if len(next) > 1 {
+			panic(proxy.ErrTooManyProxies)
+		}
+		return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+			if httpcache.IsStaleOnly(ctx) {
+				return next[0](ctx, request)
+			}
+			budget.Request()
+			if !cfg.NonIdempotent && !retry.IsIdempotent(request.Method) {
+				return next[0](ctx, request)
+			}
+
+			var resp *proxy.Response
+			var err error
+			attempts := 0
+			exhausted := false
+			for {
+				attempts++
+				// every attempt gets its own copy of the request, with the body buffered for the replays
+				resp, err = next[0](ctx, proxy.CloneRequest(request))
+				if attempts >= cfg.MaxAttempts || !shouldRetry(cfg, statusCodes, resp, err) {
+					break
+				}
+				if !budget.Retry() {
+					exhausted = true
+					break
+				}
+				if !wait(ctx, cfg.Backoff(attempts)) {
+					break
+				}
+			}
+
+			report(attempts, exhausted)
+			if span := trace.FromContext(ctx); span != nil {
+				span.AddAttributes(trace.Int64Attribute("retry.attempts", int64(attempts)))
+			}
+			return resp, err
+		}
+	}
+}
+
+type statusCoder interface {
+	StatusCode() int
+}
+
+func shouldRetry(cfg retry.Config, statusCodes map[int]struct{}, resp *proxy.Response, err error) bool {
+	if err == nil {
+		if resp == nil {
+			return false
+		}
+		_, ok := statusCodes[resp.Metadata.StatusCode]
+		return ok
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, httpcache.ErrNotCached) {
+		return false
+	}
+	var sc statusCoder
+	if errors.As(err, &sc) {
+		_, ok := statusCodes[sc.StatusCode()]
+		return ok
+	}
+	// only the transport errors are retried, not the rejections of the other middlewares
+	var ne net.Error
+	return cfg.RetryOnErrors && errors.As(err, &ne)
+}
+
+// wait sleeps for the backoff, unless the request can't be retried before its deadline
+func wait(ctx context.Context, d time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(d).After(deadline) {
+		return false
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
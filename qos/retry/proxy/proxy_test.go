@@ -0,0 +1,207 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	gologging "github.com/op/go-logging"
+	"github.com/starvn/sonic/qos/httpcache"
+	"github.com/starvn/sonic/qos/retry"
+	"github.com/starvn/sonic/telemetry/metrics"
+	"github.com/starvn/turbo/config"
+	"github.com/starvn/turbo/proxy"
+	"github.com/starvn/turbo/transport/http/client"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newBackend(cfg map[string]interface{}) *config.Backend {
+	return &config.Backend{
+		URLPattern:  "/retry",
+		ExtraConfig: map[string]interface{}{retry.Namespace: cfg},
+	}
+}
+
+func TestNewMiddleware_zeroConfig(t *testing.T) {
+	for _, remote := range []*config.Backend{
+		{},
+		newBackend(map[string]interface{}{"max_attempts": 1}),
+	} {
+		calls := 0
+		p := NewMiddleware(remote, gologging.MustGetLogger("proxy_test"), nil)(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			calls++
+			return nil, &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+		})
+		p(context.Background(), &proxy.Request{Method: "GET"})
+		if calls != 1 {
+			t.Errorf("unexpected calls: %d", calls)
+		}
+	}
+}
+
+func TestNewMiddleware(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := metrics.New(ctx, config.ExtraConfig{metrics.Namespace: map[string]interface{}{}}, gologging.MustGetLogger("proxy_test"))
+
+	remote := newBackend(map[string]interface{}{
+		"max_attempts":    3,
+		"initial_backoff": "1ms",
+	})
+
+	var bodies []string
+	p := NewMiddleware(remote, gologging.MustGetLogger("proxy_test"), m)(func(_ context.Context, r *proxy.Request) (*proxy.Response, error) {
+		b, _ := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		bodies = append(bodies, string(b))
+		if len(bodies) < 3 {
+			return nil, client.HTTPResponseError{Code: 503, Msg: "unavailable"}
+		}
+		return &proxy.Response{IsComplete: true}, nil
+	})
+
+	resp, err := p(context.Background(), &proxy.Request{Method: "PUT", Body: ioutil.NopCloser(bytes.NewBufferString("payload"))})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !resp.IsComplete {
+		t.Error("unexpected response")
+	}
+	if len(bodies) != 3 {
+		t.Errorf("unexpected attempts: %d", len(bodies))
+	}
+	for _, b := range bodies {
+		if b != "payload" {
+			t.Errorf("the body should be replayed: %v", bodies)
+		}
+	}
+
+	stats := m.TakeSnapshot()
+	if v := stats.Counters["sonic.proxy.retry.retries.layer.backend.name./retry"]; v != 2 {
+		t.Errorf("unexpected retries counter: %d", v)
+	}
+	if v := stats.Histograms["sonic.proxy.retry.attempts.layer.backend.name./retry"]; v.Max != 3 {
+		t.Errorf("unexpected attempts histogram: %+v", v)
+	}
+}
+
+func TestNewMiddleware_notRetryable(t *testing.T) {
+	remote := newBackend(map[string]interface{}{
+		"max_attempts":    3,
+		"initial_backoff": "1ms",
+	})
+	for _, tc := range []struct {
+		name   string
+		method string
+		resp   *proxy.Response
+		err    error
+	}{
+		{"non idempotent", "POST", nil, client.HTTPResponseError{Code: 503}},
+		{"status code", "GET", nil, client.HTTPResponseError{Code: 404}},
+		{"response", "GET", &proxy.Response{Metadata: proxy.Metadata{StatusCode: 500}}, nil},
+		{"generic error", "GET", nil, errors.New("rejected")},
+		{"cancelled", "GET", nil, context.Canceled},
+	} {
+		calls := 0
+		p := NewMiddleware(remote, gologging.MustGetLogger("proxy_test"), nil)(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			calls++
+			return tc.resp, tc.err
+		})
+		p(context.Background(), &proxy.Request{Method: tc.method})
+		if calls != 1 {
+			t.Errorf("%s: unexpected calls: %d", tc.name, calls)
+		}
+	}
+}
+
+func TestNewMiddleware_staleOnly(t *testing.T) {
+	remote := newBackend(map[string]interface{}{
+		"max_attempts":    3,
+		"initial_backoff": "1ms",
+		"retry_on_errors": true,
+	})
+	for _, tc := range []struct {
+		name string
+		ctx  context.Context
+		err  error
+	}{
+		{"not cached", context.Background(), &url.Error{Op: "Get", URL: "http://example.com", Err: httpcache.ErrNotCached}},
+		{"stale only", httpcache.StaleOnly(context.Background()), client.HTTPResponseError{Code: 503}},
+	} {
+		calls := 0
+		p := NewMiddleware(remote, gologging.MustGetLogger("proxy_test"), nil)(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			calls++
+			return nil, tc.err
+		})
+		p(tc.ctx, &proxy.Request{Method: "GET"})
+		if calls != 1 {
+			t.Errorf("%s: unexpected calls: %d", tc.name, calls)
+		}
+	}
+}
+
+func TestNewMiddleware_budget(t *testing.T) {
+	remote := newBackend(map[string]interface{}{
+		"max_attempts":          5,
+		"initial_backoff":       "1ms",
+		"budget_ratio":          0.5,
+		"budget_min_per_second": 0,
+	})
+	calls := 0
+	p := NewMiddleware(remote, gologging.MustGetLogger("proxy_test"), nil)(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		calls++
+		return &proxy.Response{Metadata: proxy.Metadata{StatusCode: 502}}, nil
+	})
+	for i := 0; i < 4; i++ {
+		p(context.Background(), &proxy.Request{Method: "GET"})
+	}
+	if calls != 6 {
+		t.Errorf("the retries should be limited by the budget. calls: %d", calls)
+	}
+}
+
+func TestNewMiddleware_deadline(t *testing.T) {
+	remote := newBackend(map[string]interface{}{
+		"max_attempts":    5,
+		"initial_backoff": "100ms",
+		"jitter":          0,
+	})
+	calls := 0
+	p := NewMiddleware(remote, gologging.MustGetLogger("proxy_test"), nil)(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		calls++
+		return nil, &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	if _, err := p(ctx, &proxy.Request{Method: "GET"}); err == nil {
+		t.Error("error expected")
+	}
+	if calls != 2 {
+		t.Errorf("unexpected calls: %d", calls)
+	}
+	if d := time.Since(begin); d > 150*time.Millisecond {
+		t.Errorf("the middleware should not wait beyond the deadline: %v", d)
+	}
+}
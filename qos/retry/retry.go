@@ -0,0 +1,225 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package retry provides the settings, the backoff and the budget of the retries of the failed
+// calls to the backends
+package retry
+
+import (
+	"fmt"
+	"github.com/starvn/turbo/config"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const Namespace = "github.com/starvn/sonic/qos/retry"
+
+type Config struct {
+	MaxAttempts       int
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+	// Jitter is the ratio of the backoff randomized, between 0 and 1
+	Jitter float64
+	// StatusCodes are the status codes of the responses worth a retry
+	StatusCodes []int
+	// RetryOnErrors enables the retries of the network errors (connection refused, reset...)
+	RetryOnErrors bool
+	// NonIdempotent enables the retries of the requests with non idempotent methods (POST, PATCH)
+	NonIdempotent bool
+	// BudgetRatio is the ratio of retries allowed over the requests in the BudgetWindow, on top of
+	// the BudgetMinPerSecond retries always allowed
+	BudgetRatio        float64
+	BudgetMinPerSecond float64
+	BudgetWindow       time.Duration
+}
+
+var ZeroCfg = Config{}
+
+func ConfigGetter(e config.ExtraConfig) interface{} {
+	v, ok := e[Namespace]
+	if !ok {
+		return ZeroCfg
+	}
+	tmp, ok := v.(map[string]interface{})
+	if !ok {
+		return ZeroCfg
+	}
+	cfg := Config{
+		MaxAttempts:        3,
+		InitialBackoff:     50 * time.Millisecond,
+		MaxBackoff:         time.Second,
+		BackoffMultiplier:  2,
+		Jitter:             0.5,
+		StatusCodes:        []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+		RetryOnErrors:      true,
+		BudgetRatio:        0.2,
+		BudgetMinPerSecond: 1,
+		BudgetWindow:       10 * time.Second,
+	}
+	if v, ok := tmp["max_attempts"]; ok {
+		cfg.MaxAttempts = int(toFloat64(v))
+	}
+	if v, ok := tmp["initial_backoff"]; ok {
+		if d, err := time.ParseDuration(fmt.Sprintf("%v", v)); err == nil {
+			cfg.InitialBackoff = d
+		}
+	}
+	if v, ok := tmp["max_backoff"]; ok {
+		if d, err := time.ParseDuration(fmt.Sprintf("%v", v)); err == nil {
+			cfg.MaxBackoff = d
+		}
+	}
+	if v, ok := tmp["backoff_multiplier"]; ok {
+		if m := toFloat64(v); m >= 1 {
+			cfg.BackoffMultiplier = m
+		}
+	}
+	if v, ok := tmp["jitter"]; ok {
+		if j := toFloat64(v); j >= 0 && j <= 1 {
+			cfg.Jitter = j
+		}
+	}
+	if v, ok := tmp["status_codes"].([]interface{}); ok {
+		cfg.StatusCodes = []int{}
+		for _, code := range v {
+			if c, err := strconv.Atoi(fmt.Sprintf("%v", code)); err == nil {
+				cfg.StatusCodes = append(cfg.StatusCodes, c)
+			}
+		}
+	}
+	if v, ok := tmp["retry_on_errors"].(bool); ok {
+		cfg.RetryOnErrors = v
+	}
+	if v, ok := tmp["non_idempotent"].(bool); ok {
+		cfg.NonIdempotent = v
+	}
+	if v, ok := tmp["budget_ratio"]; ok {
+		cfg.BudgetRatio = toFloat64(v)
+	}
+	if v, ok := tmp["budget_min_per_second"]; ok {
+		cfg.BudgetMinPerSecond = toFloat64(v)
+	}
+	if v, ok := tmp["budget_window"]; ok {
+		if d, err := time.ParseDuration(fmt.Sprintf("%v", v)); err == nil && d > 0 {
+			cfg.BudgetWindow = d
+		}
+	}
+	if cfg.MaxBackoff < cfg.InitialBackoff {
+		cfg.MaxBackoff = cfg.InitialBackoff
+	}
+	return cfg
+}
+
+func toFloat64(v interface{}) float64 {
+	switch val := v.(type) {
+	case int64:
+		return float64(val)
+	case int:
+		return float64(val)
+	case float64:
+		return val
+	}
+	return 0
+}
+
+// IsIdempotent reports if the requests with the given method can be safely retried
+func IsIdempotent(method string) bool {
+	switch strings.ToUpper(method) {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// Backoff returns the time to wait before the given retry (starting at 1): the initial backoff is
+// multiplied on every retry, capped to the max backoff and randomized by the jitter ratio
+func (c Config) Backoff(retry int) time.Duration {
+	d := float64(c.InitialBackoff) * math.Pow(c.BackoffMultiplier, float64(retry-1))
+	if d > float64(c.MaxBackoff) {
+		d = float64(c.MaxBackoff)
+	}
+	return time.Duration(d * (1 - c.Jitter*rand.Float64()))
+}
+
+var now = time.Now
+
+// Budget limits the retries to a ratio of the requests, so the retries of a failing backend do not
+// multiply its load. The requests and the retries are counted over a sliding window
+type Budget struct {
+	ratio        float64
+	minPerWindow float64
+	window       time.Duration
+	mu           *sync.Mutex
+	start        time.Time
+	requests     float64
+	retries      float64
+	prevRequests float64
+	prevRetries  float64
+}
+
+func NewBudget(ratio, minPerSecond float64, window time.Duration) *Budget {
+	return &Budget{
+		ratio:        ratio,
+		minPerWindow: minPerSecond * window.Seconds(),
+		window:       window,
+		mu:           new(sync.Mutex),
+		start:        now().Truncate(window),
+	}
+}
+
+// Request records a new request
+func (b *Budget) Request() {
+	b.mu.Lock()
+	b.advance(now())
+	b.requests++
+	b.mu.Unlock()
+}
+
+// Retry reports if the budget allows a new retry, recording it
+func (b *Budget) Retry() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := now()
+	b.advance(t)
+	weight := 1 - float64(t.Sub(b.start))/float64(b.window)
+	requests := b.requests + b.prevRequests*weight
+	retries := b.retries + b.prevRetries*weight
+	if retries+1 > b.ratio*requests+b.minPerWindow {
+		return false
+	}
+	b.retries++
+	return true
+}
+
+func (b *Budget) advance(t time.Time) {
+	start := t.Truncate(b.window)
+	if start.Equal(b.start) {
+		return
+	}
+	if start.Sub(b.start) == b.window {
+		b.prevRequests, b.prevRetries = b.requests, b.retries
+	} else {
+		b.prevRequests, b.prevRetries = 0, 0
+	}
+	b.requests, b.retries = 0, 0
+	b.start = start
+}
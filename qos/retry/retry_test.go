@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package retry
+
+import (
+	"encoding/json"
+	"github.com/starvn/turbo/config"
+	"testing"
+	"time"
+)
+
+func TestConfigGetter(t *testing.T) {
+	serializedCfg := []byte(`{
+		"github.com/starvn/sonic/qos/retry": {
+			"max_attempts": 4,
+			"initial_backoff": "10ms",
+			"max_backoff": "100ms",
+			"backoff_multiplier": 3,
+			"jitter": 0,
+			"status_codes": [503, "429"],
+			"retry_on_errors": false,
+			"non_idempotent": true,
+			"budget_ratio": 0.1,
+			"budget_window": "1m"
+		}
+	}`)
+	var dat config.ExtraConfig
+	if err := json.Unmarshal(serializedCfg, &dat); err != nil {
+		t.Error(err.Error())
+	}
+	cfg := ConfigGetter(dat).(Config)
+	if cfg.MaxAttempts != 4 || cfg.InitialBackoff != 10*time.Millisecond || cfg.MaxBackoff != 100*time.Millisecond ||
+		cfg.BackoffMultiplier != 3 || cfg.Jitter != 0 || cfg.RetryOnErrors || !cfg.NonIdempotent ||
+		cfg.BudgetRatio != 0.1 || cfg.BudgetMinPerSecond != 1 || cfg.BudgetWindow != time.Minute {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+	if len(cfg.StatusCodes) != 2 || cfg.StatusCodes[0] != 503 || cfg.StatusCodes[1] != 429 {
+		t.Errorf("unexpected status codes: %v", cfg.StatusCodes)
+	}
+
+	for i, expected := range []time.Duration{10 * time.Millisecond, 30 * time.Millisecond, 90 * time.Millisecond, 100 * time.Millisecond} {
+		if d := cfg.Backoff(i + 1); d != expected {
+			t.Errorf("unexpected backoff for the retry #%d: %v", i+1, d)
+		}
+	}
+}
+
+func TestConfig_Backoff_jitter(t *testing.T) {
+	cfg := Config{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, BackoffMultiplier: 2, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if d := cfg.Backoff(2); d < 100*time.Millisecond || d > 200*time.Millisecond {
+			t.Errorf("unexpected backoff: %v", d)
+		}
+	}
+}
+
+func TestIsIdempotent(t *testing.T) {
+	for _, m := range []string{"GET", "head", "PUT", "DELETE", "OPTIONS"} {
+		if !IsIdempotent(m) {
+			t.Errorf("%s should be idempotent", m)
+		}
+	}
+	for _, m := range []string{"POST", "PATCH"} {
+		if IsIdempotent(m) {
+			t.Errorf("%s should not be idempotent", m)
+		}
+	}
+}
+
+func TestBudget(t *testing.T) {
+	defer func() { now = time.Now }()
+	current := time.Date(2021, time.February, 14, 10, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+
+	b := NewBudget(0.2, 0, 10*time.Second)
+	for i := 0; i < 10; i++ {
+		b.Request()
+	}
+	for i := 0; i < 2; i++ {
+		if !b.Retry() {
+			t.Errorf("the retry #%d should be allowed", i)
+		}
+	}
+	if b.Retry() {
+		t.Error("the budget should be exhausted")
+	}
+
+	// half of the previous window is still counted
+	current = current.Add(15 * time.Second)
+	for i := 0; i < 5; i++ {
+		b.Request()
+	}
+	if !b.Retry() {
+		t.Error("the retry should be allowed")
+	}
+	if b.Retry() {
+		t.Error("the budget should be exhausted")
+	}
+
+	current = current.Add(time.Minute)
+	if b.Retry() {
+		t.Error("the budget should be empty without requests")
+	}
+	b = NewBudget(0.2, 1, 10*time.Second)
+	for i := 0; i < 10; i++ {
+		if !b.Retry() {
+			t.Errorf("the min retries should be allowed: #%d", i)
+		}
+	}
+	if b.Retry() {
+		t.Error("the budget should be exhausted")
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package admin serves the token protected admin APIs of the service components
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/starvn/turbo/config"
+	"github.com/starvn/turbo/log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrNoToken is returned when an admin API is defined without a token
+var ErrNoToken = errors.New("the admin API requires a token")
+
+// Config defines an admin API. The requests must send the token as a bearer token
+type Config struct {
+	ListenAddress string
+	Token         string
+}
+
+// ConfigGetter returns the admin API defined under the namespace at the service level, with the
+// format {"admin": {"listen_address": ":8091", "token": "secret"}}
+func ConfigGetter(e config.ExtraConfig, namespace string) (Config, bool) {
+	v, ok := e[namespace].(map[string]interface{})
+	if !ok {
+		return Config{}, false
+	}
+	admin, ok := v["admin"].(map[string]interface{})
+	if !ok {
+		return Config{}, false
+	}
+	cfg := Config{}
+	cfg.ListenAddress, _ = admin["listen_address"].(string)
+	cfg.Token, _ = admin["token"].(string)
+	return cfg, cfg.ListenAddress != ""
+}
+
+// Run serves the handler under the path and its subpaths on the listen address of the config. The
+// server is shut down when the context is cancelled
+func Run(ctx context.Context, cfg Config, path string, h http.Handler, l log.Logger, logPrefix string) error {
+	if cfg.Token == "" {
+		return ErrNoToken
+	}
+	ln, err := net.Listen("tcp", cfg.ListenAddress)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, h)
+	mux.Handle(path+"/", h)
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			l.Error(logPrefix, err.Error())
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_ = server.Shutdown(ctx)
+		cancel()
+	}()
+
+	l.Debug(logPrefix, "The endpoint", path, "is now available on", cfg.ListenAddress)
+	return nil
+}
+
+// Authorize rejects the requests not sending the token in the Authorization header as a bearer
+// token before they reach the handler
+func Authorize(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !authorized(req, token) {
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// WriteJSON writes the value as the JSON body of the response
+func WriteJSON(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(v)
+}
+
+func authorized(req *http.Request, token string) bool {
+	auth := req.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
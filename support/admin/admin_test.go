@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package admin
+
+import (
+	"context"
+	"fmt"
+	gologging "github.com/op/go-logging"
+	"github.com/starvn/turbo/config"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConfigGetter(t *testing.T) {
+	for i, tc := range []struct {
+		e   config.ExtraConfig
+		cfg Config
+		ok  bool
+	}{
+		{config.ExtraConfig{}, Config{}, false},
+		{config.ExtraConfig{"ns": map[string]interface{}{}}, Config{}, false},
+		{config.ExtraConfig{"ns": map[string]interface{}{"admin": map[string]interface{}{"token": "secret"}}}, Config{Token: "secret"}, false},
+		{config.ExtraConfig{"ns": map[string]interface{}{"admin": map[string]interface{}{"listen_address": ":8091"}}}, Config{ListenAddress: ":8091"}, true},
+		{config.ExtraConfig{"ns": map[string]interface{}{"admin": map[string]interface{}{"listen_address": ":8091", "token": "secret"}}}, Config{ListenAddress: ":8091", Token: "secret"}, true},
+	} {
+		cfg, ok := ConfigGetter(tc.e, "ns")
+		if cfg != tc.cfg || ok != tc.ok {
+			t.Errorf("#%d: unexpected config %+v %v", i, cfg, ok)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	h := Authorize("secret", http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		WriteJSON(rw, map[string]bool{"ok": true})
+	}))
+	for _, tc := range []struct {
+		auth   string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Basic secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%q: unexpected status code %d", tc.auth, w.Code)
+		}
+		if tc.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%q: unexpected headers %v", tc.auth, w.Header())
+		}
+		if tc.status == http.StatusOK && w.Body.String() != "{\"ok\":true}\n" {
+			t.Errorf("%q: unexpected body %s", tc.auth, w.Body.String())
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	logger := gologging.MustGetLogger("admin_test")
+	h := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(rw, req.URL.Path)
+	})
+
+	if err := Run(context.Background(), Config{ListenAddress: ":0"}, "/__admin", h, logger, "[TEST]"); err != ErrNoToken {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := Run(ctx, Config{ListenAddress: addr, Token: "secret"}, "/__admin", h, logger, "[TEST]"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, path := range []string{"/__admin", "/__admin/purge"} {
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != path {
+			t.Errorf("unexpected body for %s: %s", path, string(b))
+		}
+	}
+	if resp, err := http.Get("http://" + addr + "/other"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected response: %v %v", resp, err)
+	}
+}
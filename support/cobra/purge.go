@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cobra
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/starvn/sonic/qos/httpcache"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+func purgeFunc(cmd *cobra.Command, args []string) {
+	q := url.Values{}
+	for k, v := range map[string]string{"key": purgeKey, "prefix": purgePrefix, "tag": purgeTag, "store": purgeStore} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if q.Get("key") == "" && q.Get("prefix") == "" && q.Get("tag") == "" {
+		cmd.Println(errorMsg("Please, provide the key, the prefix or the tag of the responses to purge"))
+		os.Exit(1)
+		return
+	}
+
+	token := purgeToken
+	if token == "" {
+		token = os.Getenv("SONIC_HTTPCACHE_TOKEN")
+	}
+	purged, err := purge(purgeAddress, token, q)
+	if err != nil {
+		cmd.Println(errorMsg("ERROR purging the cache:") + fmt.Sprintf("\t%s\n", err.Error()))
+		os.Exit(1)
+		return
+	}
+	for store, n := range purged {
+		cmd.Printf("%s: %d response(s) purged\n", store, n)
+	}
+}
+
+// purge calls the admin API of the cache listening at the given address
+func purge(address, token string, q url.Values) (map[string]int, error) {
+	u := strings.TrimRight(address, "/") + httpcache.AdminPath + "/purge?" + q.Encode()
+	req, err := http.NewRequest(http.MethodPost, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	res := struct {
+		Purged map[string]int `json:"purged"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return res.Purged, nil
+}
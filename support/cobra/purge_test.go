@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2021 Huy Duc Dao
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cobra
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/starvn/sonic/qos/httpcache"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPurgeCommand(t *testing.T) {
+	r := httpcache.NewRegistry()
+	s := httpcache.NewTaggedStore(httpcache.NewMemoryStore(httpcache.DefaultMaxSize, nil), httpcache.DefaultSurrogateKeyHeader)
+	for key, tags := range map[string]string{"/users/1": "users", "/users/2": "users", "/orders/1": "orders"} {
+		s.Set(key, []byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nSurrogate-Key: %s\r\nContent-Length: 2\r\n\r\n{}", tags)))
+	}
+	name := r.Add("backend", s)
+
+	server := httptest.NewServer(httpcache.NewAdminHandler(r, "secret"))
+	defer server.Close()
+
+	t.Setenv("SONIC_HTTPCACHE_TOKEN", "secret")
+	defer func() {
+		purgeAddress, purgeToken, purgeKey, purgePrefix, purgeTag, purgeStore = "", "", "", "", "", ""
+	}()
+
+	PurgeCommand.BuildFlags()
+	buf := new(bytes.Buffer)
+	PurgeCommand.Cmd.SetOut(buf)
+	PurgeCommand.Cmd.SetArgs([]string{"-a", server.URL, "--tag", "users", "--store", name})
+	if err := PurgeCommand.Cmd.Execute(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if purgeAddress != server.URL || purgeTag != "users" || purgeStore != name || purgeKey != "" || purgePrefix != "" {
+		t.Errorf("unexpected flags: %s %s %s %s %s", purgeAddress, purgeTag, purgeStore, purgeKey, purgePrefix)
+	}
+	if out := buf.String(); out != name+": 2 response(s) purged\n" {
+		t.Errorf("unexpected output: %q", out)
+	}
+	if keys := s.Keys(); len(keys) != 1 || keys[0] != "/orders/1" {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	var req *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		req = r
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		_, _ = rw.Write([]byte(`{"purged":{"a":1,"b":2}}`))
+	}))
+	defer server.Close()
+
+	q := url.Values{"prefix": []string{"/users"}, "store": []string{"a"}}
+	purged, err := purge(server.URL+"/", "secret", q)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(purged) != 2 || purged["a"] != 1 || purged["b"] != 2 {
+		t.Errorf("unexpected purged responses: %v", purged)
+	}
+	if req.Method != http.MethodPost || req.URL.Path != httpcache.AdminPath+"/purge" || req.URL.RawQuery != q.Encode() {
+		t.Errorf("unexpected request: %s %s", req.Method, req.URL)
+	}
+
+	if _, err := purge(server.URL, "wrong", q); err == nil || !strings.Contains(err.Error(), "401 Unauthorized: unauthorized") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
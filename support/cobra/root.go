@@ -28,6 +28,12 @@ var (
 	cfgFile         string
 	debug           int
 	port            int
+	purgeAddress    string
+	purgeToken      string
+	purgeKey        string
+	purgePrefix     string
+	purgeTag        string
+	purgeStore      string
 	checkGinRoutes  bool
 	parser          config.Parser
 	run             func(config.ServiceConfig)
@@ -36,6 +42,7 @@ var (
 	RootCommand     Command
 	RunCommand      Command
 	CheckCommand    Command
+	PurgeCommand    Command
 
 	rootCmd = &cobra.Command{
 		Use:   "sonic",
@@ -58,6 +65,14 @@ var (
 		Run:     runFunc,
 		Example: "sonic run -d -c sonic.json",
 	}
+
+	purgeCmd = &cobra.Command{
+		Use:     "purge",
+		Short:   "Purges the responses cached by a running Sonic server.",
+		Long:    "Purges the responses cached by a running Sonic server, by key, by prefix or by surrogate key,\nusing the admin API of the http cache. The token can be set with the SONIC_HTTPCACHE_TOKEN env var",
+		Run:     purgeFunc,
+		Example: "sonic purge -a http://localhost:8092 --tag users",
+	}
 )
 
 func init() {
@@ -77,7 +92,15 @@ func init() {
 	portFlag := IntFlagBuilder(&port, "port", "p", 0, "Listening port for the http service")
 	RunCommand = NewCommand(runCmd, portFlag)
 
-	DefaultRoot = NewRoot(RootCommand, CheckCommand, RunCommand)
+	addressFlag := StringFlagBuilder(&purgeAddress, "address", "a", "http://localhost:8092", "Address of the admin API of the http cache")
+	tokenFlag := StringFlagBuilder(&purgeToken, "token", "", "", "Token of the admin API of the http cache")
+	keyFlag := StringFlagBuilder(&purgeKey, "key", "k", "", "Cache key of the response to purge")
+	purgePrefixFlag := StringFlagBuilder(&purgePrefix, "prefix", "", "", "Prefix of the cache keys of the responses to purge")
+	tagFlag := StringFlagBuilder(&purgeTag, "tag", "", "", "Surrogate key of the responses to purge")
+	storeFlag := StringFlagBuilder(&purgeStore, "store", "", "", "Name of the store to purge. All the stores are purged by default")
+	PurgeCommand = NewCommand(purgeCmd, addressFlag, tokenFlag, keyFlag, purgePrefixFlag, tagFlag, storeFlag)
+
+	DefaultRoot = NewRoot(RootCommand, CheckCommand, RunCommand, PurgeCommand)
 }
 
 const encodedLogo = "CiAgIF9fX19fX19fICBfICBfX19fX19fX19fXyAgX19fICAgX19fICBfX19fICBfX19fX19fXyBfX19fX19fX19fXyAgICAgIF9fX19fX18gIF9fCiAgLyBfXy8gX18gXC8gfC8gLyAgXy8gX19fLyAvIF8gfCAvIF8gXC8gIF8vIC8gX19fLyBfIC9fICBfXy8gX18vIHwgL3wgLyAvIF8gXCBcLyAvCiBfXCBcLyAvXy8gLyAgICAvLyAvLyAvX18gIC8gX18gfC8gX19fLy8gLyAgLyAoXyAvIF9fIHwvIC8gLyBfLyB8IHwvIHwvIC8gX18gfFwgIC8gCi9fX18vXF9fX18vXy98Xy9fX18vXF9fXy8gL18vIHxfL18vICAvX19fLyAgXF9fXy9fLyB8Xy9fLyAvX19fLyB8X18vfF9fL18vIHxffC9fLyAgCiAgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgCg=="
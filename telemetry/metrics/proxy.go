@@ -107,3 +107,12 @@ func (rm *ProxyMetrics) Histogram(labels ...string) metrics.Histogram {
 func (rm *ProxyMetrics) Counter(labels ...string) metrics.Counter {
 	return metrics.GetOrRegisterCounter(strings.Join(labels, "."), rm.register)
 }
+
+func (rm *ProxyMetrics) Gauge(labels ...string) metrics.Gauge {
+	return metrics.GetOrRegisterGauge(strings.Join(labels, "."), rm.register)
+}
+
+// FunctionalGauge registers a gauge reporting the value returned by f every time it is read
+func (rm *ProxyMetrics) FunctionalGauge(f func() int64, labels ...string) metrics.Gauge {
+	return rm.register.GetOrRegister(strings.Join(labels, "."), metrics.NewFunctionalGauge(f)).(metrics.Gauge)
+}